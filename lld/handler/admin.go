@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// AdminTokenHeader carries the shared secret for /admin routes.
+const AdminTokenHeader = "X-Admin-Token"
+
+// adminOnly lets a request through to next only if it carries the configured
+// admin token, or an API key with the admin role. With neither configured
+// every admin request is refused.
+func adminOnly(token string, keys map[string]APIKeyIdentity, next http.HandlerFunc) http.HandlerFunc {
+	withKey := requireAPIKey(keys, RoleAdmin, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(APIKeyHeader) != "" {
+			withKey(w, r)
+			return
+		}
+		got := r.Header.Get(AdminTokenHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeErr(w, http.StatusForbidden, "admin access required")
+			return
+		}
+		next(w, r)
+	}
+}
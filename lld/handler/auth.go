@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTokenTTL is how long a token issued by POST /auth/login is valid
+// when Handler.TokenTTL is unset.
+const DefaultTokenTTL = time.Hour
+
+var (
+	errMalformedToken = errors.New("malformed token")
+	errBadSignature   = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired")
+)
+
+// jwtHeader is the only header tokens are signed and accepted with.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Iat int64  `json:"iat,omitempty"`
+	Exp int64  `json:"exp"`
+}
+
+type userCtxKey struct{}
+
+// UserFromContext returns the user_id of the bearer token that authenticated
+// the request, if any.
+func UserFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(userCtxKey{}).(string)
+	return id, ok
+}
+
+// SignToken issues an HS256 JWT for userID, valid for ttl from now.
+func SignToken(secret []byte, userID string, ttl time.Duration, now time.Time) (string, error) {
+	claims, err := json.Marshal(jwtClaims{Sub: userID, Iat: now.Unix(), Exp: now.Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(jwtSign(secret, signed)), nil
+}
+
+// parseToken checks token's header, signature and expiry and returns its
+// subject. Only the exact header SignToken writes is accepted, so "none"
+// and other algorithms never reach the signature check.
+func parseToken(secret []byte, token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return "", errMalformedToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errMalformedToken
+	}
+	if !hmac.Equal(sig, jwtSign(secret, parts[0]+"."+parts[1])) {
+		return "", errBadSignature
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errMalformedToken
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(raw, &claims); err != nil || claims.Sub == "" || claims.Exp == 0 {
+		return "", errMalformedToken
+	}
+	if now.Unix() >= claims.Exp {
+		return "", errTokenExpired
+	}
+	return claims.Sub, nil
+}
+
+func jwtSign(secret []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// requireUser lets a request through to next only if it carries a valid
+// "Authorization: Bearer" token signed with secret, storing the token's
+// subject in the request context as its user_id. Anything else gets 401.
+func requireUser(secret []byte, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeErr(w, http.StatusUnauthorized, "bearer token required")
+			return
+		}
+		userID, err := parseToken(secret, strings.TrimSpace(token), time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			writeErr(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userCtxKey{}, userID)))
+	}
+}
+
+// userRoute wraps a route that acts on behalf of a user: with JWTSecret set
+// it needs a bearer token, otherwise it's next unchanged.
+func (h *Handler) userRoute(next http.HandlerFunc) http.HandlerFunc {
+	if len(h.JWTSecret) == 0 {
+		return next
+	}
+	return requireUser(h.JWTSecret, next)
+}
+
+// actingUser returns the user a request acts for: the token's subject when
+// the request was authenticated, otherwise the claimed user_id from the body
+// or query. A claimed user_id that isn't the token's is 403, a missing one
+// without a token 400; either way the error is written and ok is false.
+func (h *Handler) actingUser(w http.ResponseWriter, r *http.Request, claimed string) (userID string, ok bool) {
+	if userID, ok := UserFromContext(r.Context()); ok {
+		if claimed != "" && claimed != userID {
+			writeErr(w, http.StatusForbidden, "user_id does not match the token")
+			return "", false
+		}
+		return userID, true
+	}
+	if claimed == "" {
+		writeErr(w, http.StatusBadRequest, "user_id required")
+		return "", false
+	}
+	return claimed, true
+}
+
+// Login handles POST /auth/login, a stub that issues a token for any user_id
+// without checking credentials; it's only registered with EnableLoginStub.
+// body: { "user_id": "..." }
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if req.UserID == "" {
+		writeErr(w, http.StatusBadRequest, "user_id required")
+		return
+	}
+	ttl := h.TokenTTL
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	token, err := SignToken(h.JWTSecret, req.UserID, ttl, time.Now())
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, fmt.Sprintf("signing token: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int64(ttl.Seconds()),
+	})
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+//go:embed dashboard/index.html
+var dashboardHTML string
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// dashboardAuth is the credential the dashboard's script sends with its API
+// calls: the one the page itself was loaded with.
+type dashboardAuth struct {
+	Header string
+	Secret string
+}
+
+// AdminDashboard handles GET /admin, a single page that lists and creates
+// products, sets stock and pages through orders using the JSON endpoints.
+func (h *Handler) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	auth := dashboardAuth{Header: AdminTokenHeader, Secret: r.Header.Get(AdminTokenHeader)}
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		auth = dashboardAuth{Header: APIKeyHeader, Secret: key}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboardPage.Execute(w, auth); err != nil {
+		log.Printf("admin dashboard: %v", err)
+	}
+}
+
+// basicAdminAuth lets a browser sign in to a page behind adminOnly: the
+// password of HTTP Basic credentials is taken as the admin token (the user
+// name is ignored). A request with no credentials at all is challenged for
+// them; one carrying the usual headers passes through untouched.
+func basicAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(AdminTokenHeader) == "" && r.Header.Get(APIKeyHeader) == "" {
+			_, pass, ok := r.BasicAuth()
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+				writeErr(w, http.StatusUnauthorized, "admin credentials required")
+				return
+			}
+			r = r.Clone(r.Context())
+			r.Header.Set(AdminTokenHeader, pass)
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ResponseMode selects how writeJSON / writeErr shape response bodies
+type ResponseMode string
+
+const (
+	// ResponseRaw writes payloads as-is and errors as {"error": "msg", "code": "..."}
+	ResponseRaw ResponseMode = "raw"
+	// ResponseEnveloped wraps payloads as {"data": ..., "meta": ...} and errors
+	// as {"error": {"status": 400, "code": "BAD_REQUEST", "message": "msg"}}
+	ResponseEnveloped ResponseMode = "envelope"
+)
+
+type envelope struct {
+	Data interface{} `json:"data"`
+	Meta *listMeta   `json:"meta,omitempty"`
+}
+
+type errorBody struct {
+	Status     int       `json:"status"`
+	Code       ErrorCode `json:"code"`
+	Message    string    `json:"message"`
+	Violations []string  `json:"violations,omitempty"`
+}
+
+// listMeta is the pagination info list endpoints report
+type listMeta struct {
+	Total  int64 `json:"total"`
+	Limit  int   `json:"limit,omitempty"`
+	Offset int   `json:"offset,omitempty"`
+}
+
+// envelopeWriter marks a response as enveloped and carries the meta a list
+// handler set before writing its body.
+type envelopeWriter struct {
+	http.ResponseWriter
+	meta *listMeta
+}
+
+// withEnvelope makes writeJSON / writeErr use the enveloped shape for every
+// request passing through it.
+func withEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&envelopeWriter{ResponseWriter: w}, r)
+	})
+}
+
+// setListMeta reports pagination info: always as X-Total-Count, and as the
+// envelope's meta when enveloped.
+func setListMeta(w http.ResponseWriter, m listMeta) {
+	w.Header().Set("X-Total-Count", strconv.FormatInt(m.Total, 10))
+	if ew, ok := w.(*envelopeWriter); ok {
+		ew.meta = &m
+	}
+}
+
+// writeViolations is writeErr for a 400 that lists individual violations
+func writeViolations(w http.ResponseWriter, msg string, violations []string) {
+	if ew, ok := w.(*envelopeWriter); ok {
+		writeJSON(ew.ResponseWriter, http.StatusBadRequest, map[string]errorBody{
+			"error": {Status: http.StatusBadRequest, Code: CodeValidation, Message: msg, Violations: violations},
+		})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": msg, "code": CodeValidation, "violations": violations})
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"inventory-management/service"
+	"inventory-management/store"
+	"net/http"
+)
+
+// ErrorCode is the stable, machine-readable code sent with every error
+// response so clients can branch without parsing the message.
+type ErrorCode string
+
+// Generic codes, derived from the HTTP status when no sentinel matches
+const (
+	CodeBadRequest   ErrorCode = "BAD_REQUEST"
+	CodeValidation   ErrorCode = "VALIDATION_FAILED"
+	CodeUnauthorized ErrorCode = "UNAUTHORIZED"
+	CodeForbidden    ErrorCode = "FORBIDDEN"
+	CodeNotFound     ErrorCode = "NOT_FOUND"
+	CodeConflict     ErrorCode = "CONFLICT"
+	CodeRateLimited  ErrorCode = "RATE_LIMITED"
+	CodeUnprocessed  ErrorCode = "UNPROCESSABLE"
+	CodeUnavailable  ErrorCode = "SERVICE_UNAVAILABLE"
+	CodeInternal     ErrorCode = "INTERNAL"
+)
+
+// Codes for the typed service/store errors
+const (
+	CodeInsufficientStock    ErrorCode = "INSUFFICIENT_STOCK"
+	CodeQuantityOutOfRange   ErrorCode = "QUANTITY_OUT_OF_RANGE"
+	CodeNoPrice              ErrorCode = "NO_PRICE"
+	CodeNotPublished         ErrorCode = "NOT_PUBLISHED"
+	CodeNotAvailableYet      ErrorCode = "NOT_AVAILABLE_YET"
+	CodeNoLongerAvailable    ErrorCode = "NO_LONGER_AVAILABLE"
+	CodeItemUnavailable      ErrorCode = "ITEM_UNAVAILABLE"
+	CodeUntrackedInventory   ErrorCode = "UNTRACKED_INVENTORY"
+	CodeProductInCarts       ErrorCode = "PRODUCT_IN_CARTS"
+	CodeReturnExceedsOrdered ErrorCode = "RETURN_EXCEEDS_ORDERED"
+	CodeInvalidTransition    ErrorCode = "INVALID_STATUS_TRANSITION"
+	CodeTooManyIDs           ErrorCode = "TOO_MANY_IDS"
+	CodeTooManyItems         ErrorCode = "TOO_MANY_ITEMS"
+	CodeUnknownShippingZone  ErrorCode = "UNKNOWN_SHIPPING_ZONE"
+	CodeUnknownCurrency      ErrorCode = "UNKNOWN_CURRENCY"
+	CodeMetadataTooLarge     ErrorCode = "METADATA_TOO_LARGE"
+	CodeTextTooLong          ErrorCode = "TEXT_TOO_LONG"
+	CodeOutboxAlreadyPending ErrorCode = "OUTBOX_ALREADY_PENDING"
+	CodeOrderNotCancelled    ErrorCode = "ORDER_NOT_CANCELLED"
+	CodeBundleInUse          ErrorCode = "BUNDLE_IN_USE"
+	CodeInvalidBundle        ErrorCode = "INVALID_BUNDLE"
+	CodeNoCartSnapshot       ErrorCode = "NO_CART_SNAPSHOT"
+	CodeCartEmpty            ErrorCode = "CART_EMPTY"
+	CodePaymentDeclined      ErrorCode = "PAYMENT_DECLINED"
+	CodePaymentTimeout       ErrorCode = "PAYMENT_TIMEOUT"
+	CodePaymentFailed        ErrorCode = "PAYMENT_FAILED"
+	CodePaymentsDisabled     ErrorCode = "PAYMENTS_DISABLED"
+	CodeUnknownCoupon        ErrorCode = "UNKNOWN_COUPON"
+	CodeCouponExpired        ErrorCode = "COUPON_EXPIRED"
+	CodeCouponUsedUp         ErrorCode = "COUPON_USED_UP"
+	CodeIdempotencyKeyInUse  ErrorCode = "IDEMPOTENCY_KEY_IN_USE"
+	CodeCancelWindowClosed   ErrorCode = "CANCEL_WINDOW_CLOSED"
+	CodeProductNotFound      ErrorCode = "PRODUCT_NOT_FOUND"
+	CodeMixedCurrencies      ErrorCode = "MIXED_CURRENCIES"
+	CodeVersionConflict      ErrorCode = "VERSION_CONFLICT"
+)
+
+// errorMappings maps typed errors to their HTTP status and code; the first
+// match (errors.Is) wins. 400 is kept for requests that are wrong in
+// themselves; an error that depends on the current state (stock, status)
+// is a 409 or 422.
+var errorMappings = []struct {
+	err    error
+	status int
+	code   ErrorCode
+}{
+	{sql.ErrNoRows, http.StatusNotFound, CodeNotFound},
+	{store.ErrInsufficientStock, http.StatusConflict, CodeInsufficientStock},
+	{store.ErrQuantityOutOfRange, http.StatusUnprocessableEntity, CodeQuantityOutOfRange},
+	{store.ErrNoPrice, http.StatusUnprocessableEntity, CodeNoPrice},
+	{store.ErrNotPublished, http.StatusUnprocessableEntity, CodeNotPublished},
+	{store.ErrNotAvailableYet, http.StatusUnprocessableEntity, CodeNotAvailableYet},
+	{store.ErrNoLongerAvailable, http.StatusUnprocessableEntity, CodeNoLongerAvailable},
+	{store.ErrItemUnavailable, http.StatusUnprocessableEntity, CodeItemUnavailable},
+	{store.ErrMixedCurrencies, http.StatusUnprocessableEntity, CodeMixedCurrencies},
+	{store.ErrUntrackedInventory, http.StatusConflict, CodeUntrackedInventory},
+	{store.ErrProductInCarts, http.StatusConflict, CodeProductInCarts},
+	{store.ErrReturnExceedsOrdered, http.StatusUnprocessableEntity, CodeReturnExceedsOrdered},
+	{store.ErrInvalidTransition, http.StatusConflict, CodeInvalidTransition},
+	{store.ErrBundleInUse, http.StatusConflict, CodeBundleInUse},
+	{store.ErrInvalidBundle, http.StatusBadRequest, CodeInvalidBundle},
+	{store.ErrNoCartSnapshot, http.StatusNotFound, CodeNoCartSnapshot},
+	{store.ErrCartEmpty, http.StatusUnprocessableEntity, CodeCartEmpty},
+	{store.ErrUnknownCoupon, http.StatusUnprocessableEntity, CodeUnknownCoupon},
+	{store.ErrCouponExpired, http.StatusUnprocessableEntity, CodeCouponExpired},
+	{store.ErrCouponUsedUp, http.StatusUnprocessableEntity, CodeCouponUsedUp},
+	{store.ErrIdempotencyKeyInUse, http.StatusConflict, CodeIdempotencyKeyInUse},
+	{store.ErrCancelWindowClosed, http.StatusConflict, CodeCancelWindowClosed},
+	{store.ErrVersionConflict, http.StatusConflict, CodeVersionConflict},
+	{service.ErrTooManyIDs, http.StatusBadRequest, CodeTooManyIDs},
+	{service.ErrUnknownShippingZone, http.StatusBadRequest, CodeUnknownShippingZone},
+	{service.ErrUnknownCurrency, http.StatusBadRequest, CodeUnknownCurrency},
+	{service.ErrMetadataTooLarge, http.StatusBadRequest, CodeMetadataTooLarge},
+	{service.ErrTextTooLong, http.StatusBadRequest, CodeTextTooLong},
+	{service.ErrOutboxAlreadyPending, http.StatusConflict, CodeOutboxAlreadyPending},
+	{service.ErrOrderNotCancelled, http.StatusConflict, CodeOrderNotCancelled},
+	{service.ErrForbidden, http.StatusForbidden, CodeForbidden},
+	{service.ErrProductNotFound, http.StatusNotFound, CodeProductNotFound},
+	{service.ErrPaymentDeclined, http.StatusPaymentRequired, CodePaymentDeclined},
+	{service.ErrPaymentTimeout, http.StatusGatewayTimeout, CodePaymentTimeout},
+	{service.ErrPaymentFailed, http.StatusBadGateway, CodePaymentFailed},
+	{service.ErrNoPaymentGateway, http.StatusNotImplemented, CodePaymentsDisabled},
+}
+
+func codeForStatus(status int) ErrorCode {
+	switch {
+	case status == http.StatusUnauthorized:
+		return CodeUnauthorized
+	case status == http.StatusForbidden:
+		return CodeForbidden
+	case status == http.StatusNotFound:
+		return CodeNotFound
+	case status == http.StatusConflict:
+		return CodeConflict
+	case status == http.StatusUnprocessableEntity:
+		return CodeUnprocessed
+	case status == http.StatusTooManyRequests:
+		return CodeRateLimited
+	case status == http.StatusServiceUnavailable:
+		return CodeUnavailable
+	case status >= 500:
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// writeServiceErr writes err with the status and code of the first matching
+// typed error, or with fallback (and its generic code) if none match.
+func writeServiceErr(w http.ResponseWriter, err error, fallback int) {
+	status, code := classifyErr(err, fallback)
+	writeCodedErr(w, status, code, err.Error())
+}
+
+// classifyErr returns the status and code writeServiceErr would send for err.
+func classifyErr(err error, fallback int) (int, ErrorCode) {
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return m.status, m.code
+		}
+	}
+	return fallback, codeForStatus(fallback)
+}
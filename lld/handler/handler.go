@@ -1,10 +1,21 @@
 package handler
 
 import (
+	"bufio"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"inventory-management/money"
 	"inventory-management/service"
+	"inventory-management/store"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -12,33 +23,195 @@ import (
 // Handler is the HTTP layer that talks to service.Service
 type Handler struct {
 	svc service.ServiceInterface
+
+	// MaxConcurrentCheckouts bounds simultaneous POST /checkout/order requests
+	// (0 = unlimited). Excess requests wait up to CheckoutQueueTimeout for a
+	// slot and then get 503.
+	MaxConcurrentCheckouts int
+	CheckoutQueueTimeout   time.Duration
+
+	// ResponseMode selects raw (default) or enveloped response bodies.
+	ResponseMode ResponseMode
+
+	// AdminToken must be sent in the X-Admin-Token header to reach /admin
+	// routes; if empty they are all refused.
+	AdminToken string
+
+	// APIKeys maps X-API-Key values to the calling service. Keys with the
+	// admin role may use /admin routes instead of AdminToken.
+	APIKeys map[string]APIKeyIdentity
+
+	// LatencyBudgets maps route templates (e.g. "/checkout/order") to the
+	// duration a request may take before it is counted and logged as slow.
+	LatencyBudgets map[string]time.Duration
+
+	// BatchLimits overrides DefaultBatchLimit, the longest array a batch
+	// endpoint accepts, per route template.
+	BatchLimits map[string]int
+
+	// Metrics, when set, is updated by the handlers and served at GET /metrics
+	Metrics *Metrics
+
+	// JWTSecret, when set, is the HMAC key of the bearer tokens cart,
+	// checkout and order routes then require; the user they act for is the
+	// token's subject. Without it those routes trust the user_id they're sent.
+	JWTSecret []byte
+
+	// EnableLoginStub registers POST /auth/login, which issues a token valid
+	// for TokenTTL (DefaultTokenTTL if zero) for any user_id. Testing only.
+	EnableLoginStub bool
+	TokenTTL        time.Duration
+
+	// RateLimit, when RPS is set, throttles cart and checkout requests per
+	// user (or per IP without a token); excess requests get 429.
+	RateLimit RateLimit
+
+	// MaxBodyBytes caps request bodies (DefaultMaxBodyBytes if zero); larger
+	// ones get 413. It applies to catalog imports too.
+	MaxBodyBytes int64
 }
 
 // NewHandler returns a Handler instance
 func NewHandler(s service.ServiceInterface) *Handler {
-	return &Handler{svc: s}
+	return &Handler{svc: s, CheckoutQueueTimeout: 2 * time.Second, ResponseMode: ResponseRaw}
 }
 
 // RegisterRoutes registers all routes on the provided router
 func (h *Handler) RegisterRoutes(r *mux.Router) {
+	// outermost, so the envelope still sees its own writer
+	if h.Metrics != nil {
+		r.Use(h.Metrics.middleware())
+	}
+	if h.ResponseMode == ResponseEnveloped {
+		r.Use(withEnvelope)
+	}
+	if len(h.LatencyBudgets) > 0 {
+		r.Use(latencyBudget(h.LatencyBudgets, log.Default()))
+	}
+	maxBody := h.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBodyBytes
+	}
+	r.Use(limitBody(maxBody))
+	batch := func(route, field string, next http.HandlerFunc) http.HandlerFunc {
+		return limitArray(field, h.batchLimit(route), next)
+	}
+
+	user := h.userRoute
+	// limited is user with the per-client rate limit inside the bearer
+	// check, so buckets are keyed by the token's user
+	limited := user
+	if h.RateLimit.RPS > 0 {
+		rl := newRateLimiter(h.RateLimit)
+		limited = func(next http.HandlerFunc) http.HandlerFunc { return user(rl.wrap(next)) }
+	}
+
+	// Health
+	r.HandleFunc("/healthz", h.Healthz).Methods("GET")
+	r.HandleFunc("/livez", h.Livez).Methods("GET")
+
+	// Auth
+	if h.EnableLoginStub && len(h.JWTSecret) > 0 {
+		r.HandleFunc("/auth/login", h.Login).Methods("POST")
+	}
+
 	// Products
-	r.HandleFunc("/products", h.CreateProduct).Methods("POST")
+	r.HandleFunc("/products", validateBody("create_product", h.CreateProduct)).Methods("POST")
+	r.HandleFunc("/products/bulk", h.CreateProducts).Methods("POST")
 	r.HandleFunc("/products/list", h.ListProducts).Methods("GET")
+	r.HandleFunc("/products/search", h.SearchProducts).Methods("GET")
+	r.HandleFunc("/products/prices", batch("/products/prices", "ids", h.GetPrices)).Methods("POST")
+	r.HandleFunc("/products/stock", h.UpdateStock).Methods("POST")
+	r.HandleFunc("/products/stock/adjust", h.AdjustStock).Methods("POST")
+	r.HandleFunc("/products/stock/bulk", h.UpdateStockBatch).Methods("POST")
+	r.HandleFunc("/products/low-stock", h.ListLowStockProducts).Methods("GET")
+	r.HandleFunc("/products/{id}", h.GetProduct).Methods("GET")
+	r.HandleFunc("/products/{id}", validateBody("update_product", h.UpdateProduct)).Methods("PUT")
+	r.HandleFunc("/products/{id}", h.DeleteProduct).Methods("DELETE")
+	r.HandleFunc("/products/{id}/clone", h.CloneProduct).Methods("POST")
+	r.HandleFunc("/products/{id}/publish", h.setPublished(true)).Methods("POST")
+	r.HandleFunc("/products/{id}/unpublish", h.setPublished(false)).Methods("POST")
+	r.HandleFunc("/products/{id}/stock", h.GetStock).Methods("GET")
+	r.HandleFunc("/products/{id}/velocity", h.SalesVelocity).Methods("GET")
+	r.HandleFunc("/products/{id}/reorder-suggestion", h.ReorderSuggestion).Methods("GET")
+	r.HandleFunc("/products/{id}/reviews", h.ListReviews).Methods("GET")
+	r.HandleFunc("/products/{id}/reviews/summary", h.ReviewSummary).Methods("GET")
+	r.HandleFunc("/products/{id}/track-inventory", h.SetTrackInventory).Methods("PUT")
+	r.HandleFunc("/products/{id}/reservation-limit", h.SetReservationLimit).Methods("PUT")
+	r.HandleFunc("/products/{id}/availability", h.SetAvailability).Methods("PUT")
+	r.HandleFunc("/products/{id}/tags", h.ListTags).Methods("GET")
+	r.HandleFunc("/products/{id}/tags", h.AddTag).Methods("POST")
+	r.HandleFunc("/products/{id}/tags/{tag}", h.RemoveTag).Methods("DELETE")
 
 	// Cart
-	r.HandleFunc("/cart/add", h.AddToCart).Methods("POST")
-	r.HandleFunc("/cart/remove", h.RemoveFromCart).Methods("POST")
-	r.HandleFunc("/cart/list", h.ListCart).Methods("GET")
+	r.HandleFunc("/cart/add", limited(validateBody("cart_add", h.AddToCart))).Methods("POST")
+	r.HandleFunc("/cart/remove", limited(validateBody("cart_remove", h.RemoveFromCart))).Methods("POST")
+	r.HandleFunc("/cart/update", limited(validateBody("cart_update", h.UpdateCartQuantity))).Methods("POST")
+	r.HandleFunc("/cart/clear", limited(validateBody("cart_clear", h.ClearCart))).Methods("POST")
+	r.HandleFunc("/cart/add-batch", limited(batch("/cart/add-batch", "items", h.AddToCartBatch))).Methods("POST")
+	r.HandleFunc("/cart/remove-batch", limited(batch("/cart/remove-batch", "product_ids", h.RemoveFromCartBatch))).Methods("POST")
+	r.HandleFunc("/cart", limited(h.GetCartInCurrency)).Methods("GET")
+	r.HandleFunc("/cart/list", limited(h.ListCart)).Methods("GET")
+	r.HandleFunc("/cart/detailed", limited(h.ListCartDetailed)).Methods("GET")
+	r.HandleFunc("/cart/fulfillable", limited(h.CheckFulfillable)).Methods("GET")
 
 	// Checkout
-	r.HandleFunc("/checkout/order", h.Checkout).Methods("POST")
+	checkout := validateBody("checkout", h.Checkout)
+	pay := validateBody("checkout_pay", h.CheckoutAndPay)
+	if h.MaxConcurrentCheckouts > 0 {
+		checkout = concurrencyLimit(h.MaxConcurrentCheckouts, h.CheckoutQueueTimeout, checkout)
+		pay = concurrencyLimit(h.MaxConcurrentCheckouts, h.CheckoutQueueTimeout, pay)
+	}
+	r.HandleFunc("/checkout/order", limited(checkout)).Methods("POST")
+	r.HandleFunc("/checkout/pay", limited(pay)).Methods("POST")
+	r.HandleFunc("/checkout/quote", limited(h.QuoteCheckout)).Methods("POST")
+	r.HandleFunc("/checkout/shipping-estimate", limited(h.EstimateShipping)).Methods("POST")
+
+	// Orders
+	r.HandleFunc("/orders/list", user(h.ListOrders)).Methods("GET")
+	r.HandleFunc("/orders/{id}", user(h.GetOrder)).Methods("GET")
+	r.HandleFunc("/orders/{id}/return", user(h.ReturnOrderItem)).Methods("POST")
+	r.HandleFunc("/orders/{id}/status", adminOnly(h.AdminToken, h.APIKeys, h.UpdateOrderStatus)).Methods("PATCH")
+	r.HandleFunc("/orders/{id}/cancel", user(h.CancelOrder)).Methods("POST")
+	r.HandleFunc("/orders/{id}/restore-to-cart", user(h.RestoreOrderToCart)).Methods("POST")
+	r.HandleFunc("/orders/{id}/cart-snapshot", adminOnly(h.AdminToken, h.APIKeys, h.GetCartSnapshot)).Methods("GET")
+
+	// Admin
+	r.HandleFunc("/admin", basicAdminAuth(adminOnly(h.AdminToken, h.APIKeys, h.AdminDashboard))).Methods("GET")
+	r.HandleFunc("/admin/products", adminOnly(h.AdminToken, h.APIKeys, h.ListAllProducts)).Methods("GET")
+	r.HandleFunc("/admin/products/export", adminOnly(h.AdminToken, h.APIKeys, h.ExportProducts)).Methods("GET")
+	r.HandleFunc("/admin/products/import-catalog", adminOnly(h.AdminToken, h.APIKeys, h.ImportProducts)).Methods("POST")
+	r.HandleFunc("/admin/products/publish-batch", adminOnly(h.AdminToken, h.APIKeys,
+		batch("/admin/products/publish-batch", "ids", h.PublishProducts))).Methods("POST")
+	r.HandleFunc("/admin/products/{id}/orders", adminOnly(h.AdminToken, h.APIKeys, h.OrdersContainingProduct)).Methods("GET")
+	r.HandleFunc("/admin/products/{id}/restore", adminOnly(h.AdminToken, h.APIKeys, h.RestoreProduct)).Methods("POST")
+	r.HandleFunc("/admin/orders", adminOnly(h.AdminToken, h.APIKeys, h.ListAllOrders)).Methods("GET")
+	r.HandleFunc("/admin/orders/status-batch", adminOnly(h.AdminToken, h.APIKeys,
+		batch("/admin/orders/status-batch", "order_ids", h.UpdateOrderStatusBatch))).Methods("POST")
+	r.HandleFunc("/admin/stock/movements", adminOnly(h.AdminToken, h.APIKeys, h.ListAllStockMovements)).Methods("GET")
+	r.HandleFunc("/admin/purchase-orders", adminOnly(h.AdminToken, h.APIKeys, h.CreatePurchaseOrder)).Methods("POST")
+	r.HandleFunc("/admin/bundles/{id}/components", adminOnly(h.AdminToken, h.APIKeys,
+		batch("/admin/bundles/{id}/components", "components", h.SetBundleComponents))).Methods("PUT")
+	r.HandleFunc("/admin/outbox", adminOnly(h.AdminToken, h.APIKeys, h.ListOutbox)).Methods("GET")
+	r.HandleFunc("/admin/outbox/{id}/replay", adminOnly(h.AdminToken, h.APIKeys, h.ReplayOutbox)).Methods("POST")
+	r.HandleFunc("/admin/metrics", adminOnly(h.AdminToken, h.APIKeys, expvar.Handler().ServeHTTP)).Methods("GET")
+	if h.Metrics != nil {
+		r.Handle("/metrics", h.Metrics.handler()).Methods("GET")
+	}
 }
 
 // --- request / response shapes ---
 type createProductReq struct {
-	Name        string  `json:"name"`
-	Description string  `json:"description,omitempty"`
-	Price       float64 `json:"price"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Price       money.Cents `json:"price"`
+	Category    string      `json:"category,omitempty"`
+	Currency    string      `json:"currency,omitempty"` // ISO 4217; the base currency if empty
+}
+
+type updateProductReq struct {
+	createProductReq
+	Version int `json:"version"` // as last read; see UpdateProduct
 }
 
 type updateStockReq struct {
@@ -46,6 +219,89 @@ type updateStockReq struct {
 	NewStock  int   `json:"new_stock"`
 }
 
+type adjustStockReq struct {
+	ProductID int64 `json:"product_id"`
+	Delta     int   `json:"delta"`
+}
+
+type shippingEstimateReq struct {
+	UserID      string `json:"user_id"`
+	Destination string `json:"destination"`
+}
+
+type returnItemReq struct {
+	UserID    string `json:"user_id"`
+	ProductID int64  `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Restock   bool   `json:"restock"`
+}
+
+type pricesReq struct {
+	IDs []int64 `json:"ids"`
+}
+
+type tagReq struct {
+	Tag string `json:"tag"`
+}
+
+type availabilityReq struct {
+	AvailableFrom  *time.Time `json:"available_from"`
+	AvailableUntil *time.Time `json:"available_until"`
+}
+
+type purchaseOrderReq struct {
+	ProductID  int64     `json:"product_id"`
+	Quantity   int       `json:"quantity"`
+	ExpectedAt time.Time `json:"expected_at"`
+}
+
+type cartBatchAddReq struct {
+	UserID string `json:"user_id"`
+	Items  []struct {
+		ProductID int64 `json:"product_id"`
+		Quantity  int   `json:"quantity"`
+	} `json:"items"`
+}
+
+type cartBatchRemoveReq struct {
+	UserID     string  `json:"user_id"`
+	ProductIDs []int64 `json:"product_ids"`
+}
+
+// cartBatchItemResp is one item's outcome in a best-effort batch response
+type cartBatchItemResp struct {
+	ProductID int64     `json:"product_id"`
+	OK        bool      `json:"ok"`
+	Status    int       `json:"status"`
+	Code      ErrorCode `json:"code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type publishBatchReq struct {
+	IDs []int64 `json:"ids"`
+}
+
+type orderStatusBatchReq struct {
+	OrderIDs []int64 `json:"order_ids"`
+	Status   string  `json:"status"`
+	Strict   bool    `json:"strict"`
+}
+
+type trackInventoryReq struct {
+	TrackInventory bool `json:"track_inventory"`
+}
+
+type reservationLimitReq struct {
+	MaxPerUser *int `json:"max_per_user"` // null = store-wide limit
+}
+
+type bundleComponentsReq struct {
+	Components []struct {
+		ProductID int64 `json:"product_id"`
+		Quantity  int   `json:"quantity"`
+	} `json:"components"`
+}
+
 type addRemoveCartReq struct {
 	UserID    string `json:"user_id"`
 	ProductID int64  `json:"product_id"`
@@ -54,154 +310,1496 @@ type addRemoveCartReq struct {
 
 // --- helpers ---
 func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if ew, ok := w.(*envelopeWriter); ok {
+		v = envelope{Data: v, Meta: ew.meta}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-func writeErr(w http.ResponseWriter, code int, msg string) {
-	writeJSON(w, code, map[string]string{"error": msg})
+// writeErr writes an error with the generic code for its status
+func writeErr(w http.ResponseWriter, status int, msg string) {
+	writeCodedErr(w, status, codeForStatus(status), msg)
+}
+
+func writeCodedErr(w http.ResponseWriter, status int, code ErrorCode, msg string) {
+	if ew, ok := w.(*envelopeWriter); ok {
+		writeJSON(ew.ResponseWriter, status, map[string]errorBody{"error": {Status: status, Code: code, Message: msg}})
+		return
+	}
+	writeJSON(w, status, map[string]string{"error": msg, "code": string(code)})
 }
 
 // --- Handler ---
 
-// CreateProduct handles POST /products
+// healthCheckTimeout bounds the database ping behind /healthz
+const healthCheckTimeout = 2 * time.Second
+
+// Healthz handles GET /healthz: 200 if the database answers a ping, 503 if not
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := h.svc.Ping(ctx); err != nil {
+		log.Printf("healthz: %v", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Livez handles GET /livez: 200 as long as the process is serving
+func (h *Handler) Livez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// CreateProduct handles POST /products (body validated by schemas/create_product.json)
 func (h *Handler) CreateProduct(w http.ResponseWriter, r *http.Request) {
 	var req createProductReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeErr(w, http.StatusBadRequest, "invalid json")
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	id, err := h.svc.CreateProduct(r.Context(), req.Name, req.Description, req.Price, req.Category, req.Currency)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
-	if req.Name == "" {
-		writeErr(w, http.StatusBadRequest, "name is required")
+	writeJSON(w, http.StatusCreated, map[string]int64{"id": id})
+}
+
+// CreateProducts handles POST /products/bulk
+// body: [ { "name": "...", "price": 9.99, ... }, ... ]; all are created or,
+// if one is invalid, none
+func (h *Handler) CreateProducts(w http.ResponseWriter, r *http.Request) {
+	var req []service.NewProduct
+	if !decodeJSON(w, r, &req, "invalid json: expected an array of products") {
 		return
 	}
-	if req.Price < 0 {
-		writeErr(w, http.StatusBadRequest, "price must be >= 0")
+	ids, err := h.svc.CreateProducts(r.Context(), req)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
 		return
 	}
+	writeJSON(w, http.StatusCreated, map[string][]int64{"ids": ids})
+}
 
-	id, err := h.svc.CreateProduct(req.Name, req.Description, req.Price)
+// GetProduct handles GET /products/{id}
+func (h *Handler) GetProduct(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	p, err := h.svc.GetProduct(r.Context(), productID)
 	if err != nil {
-		writeErr(w, http.StatusInternalServerError, err.Error())
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, http.StatusCreated, map[string]int64{"id": id})
+	writeJSON(w, http.StatusOK, p)
+}
+
+// UpdateProduct handles PUT /products/{id} (body validated by schemas/update_product.json)
+// body: { "name": "...", "description": "...", "price": 9.99, "category": "electronics", "currency": "EUR", "version": 3 }
+// version is the one GET /products/{id} returned; if the product has changed
+// since, the update is refused with 409 VERSION_CONFLICT. The response
+// carries the new version.
+func (h *Handler) UpdateProduct(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	var req updateProductReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if err := h.svc.UpdateProduct(r.Context(), productID, req.Name, req.Description, req.Price, req.Category, req.Currency, req.Version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "updated", "version": req.Version + 1})
 }
 
-// ListProducts handles GET /products/list
+// ListProducts handles GET /products/list[?limit=&offset=&sort=&exact_count=true]
+// Without limit the whole catalog is returned. With limit the response is
+// paged and X-Total-Count carries the total (approximate unless exact_count);
+// sort: id, price_asc, price_desc, name or newest (default configurable when
+// paged, then id).
+// ?category= restricts it to one category; one or more ?tag= params to
+// products carrying all those tags; ?available_now=true to products inside
+// their availability window.
 func (h *Handler) ListProducts(w http.ResponseWriter, r *http.Request) {
-	ps, err := h.svc.ListProducts()
+	q := r.URL.Query()
+	if category := q.Get("category"); category != "" {
+		ps, err := h.svc.ListProductsByCategory(r.Context(), category)
+		if err != nil {
+			writeServiceErr(w, err, http.StatusBadRequest)
+			return
+		}
+		setListMeta(w, listMeta{Total: int64(len(ps))})
+		writeJSON(w, http.StatusOK, ps)
+		return
+	}
+	if tags := q["tag"]; len(tags) > 0 {
+		ps, err := h.svc.ListProductsByTags(r.Context(), tags)
+		if err != nil {
+			writeServiceErr(w, err, http.StatusBadRequest)
+			return
+		}
+		setListMeta(w, listMeta{Total: int64(len(ps))})
+		writeJSON(w, http.StatusOK, ps)
+		return
+	}
+	if q.Get("available_now") == "true" {
+		ps, err := h.svc.ListAvailableProducts(r.Context())
+		if err != nil {
+			writeServiceErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		setListMeta(w, listMeta{Total: int64(len(ps))})
+		writeJSON(w, http.StatusOK, ps)
+		return
+	}
+	sort := q.Get("sort")
+	if sort != "" && !store.IsProductSort(sort) {
+		writeErr(w, http.StatusBadRequest, "sort must be id, price_asc, price_desc, name or newest")
+		return
+	}
+	if q.Get("limit") == "" {
+		ps, err := h.svc.ListProducts(r.Context(), sort)
+		if err != nil {
+			writeServiceErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		setListMeta(w, listMeta{Total: int64(len(ps))})
+		writeJSON(w, http.StatusOK, ps)
+		return
+	}
+
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		writeErr(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeErr(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+
+	ps, err := h.svc.ListProductsPage(r.Context(), limit, offset, sort)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	total, err := h.svc.CountProducts(r.Context(), q.Get("exact_count") == "true")
 	if err != nil {
-		writeErr(w, http.StatusInternalServerError, err.Error())
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
+	setListMeta(w, listMeta{Total: total, Limit: limit, Offset: offset})
 	writeJSON(w, http.StatusOK, ps)
 }
 
-// AddToCart handles POST /cart/add
-// body: { "user_id": "...", "product_id": 1, "quantity": 2 }
-func (h *Handler) AddToCart(w http.ResponseWriter, r *http.Request) {
-	var req addRemoveCartReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeErr(w, http.StatusBadRequest, "invalid json")
+// CloneProduct handles POST /products/{id}/clone
+func (h *Handler) CloneProduct(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
 		return
 	}
-	if req.UserID == "" {
-		writeErr(w, http.StatusBadRequest, "user_id is required")
+	id, err := h.svc.CloneProduct(r.Context(), productID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
-	if req.Quantity <= 0 {
-		writeErr(w, http.StatusBadRequest, "quantity must be > 0")
+	writeJSON(w, http.StatusCreated, map[string]int64{"id": id})
+}
+
+// setPublished handles POST /products/{id}/publish and /products/{id}/unpublish
+func (h *Handler) setPublished(published bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil || productID <= 0 {
+			writeErr(w, http.StatusBadRequest, "invalid product id")
+			return
+		}
+		if err := h.svc.SetPublished(r.Context(), productID, published); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErr(w, http.StatusNotFound, "product not found")
+				return
+			}
+			writeServiceErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"published": published})
+	}
+}
+
+// DeleteProduct handles DELETE /products/{id}[?strict=true]; repeating it is
+// harmless. With strict an unknown product is 404 and one still in a cart 409.
+func (h *Handler) DeleteProduct(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
 		return
 	}
-	if err := h.svc.AddToCart(req.UserID, req.ProductID, req.Quantity); err != nil {
-		// service returns descriptive errors; map them to HTTP codes if needed
-		writeErr(w, http.StatusBadRequest, err.Error())
+	carts, err := h.svc.DeleteProduct(r.Context(), productID, r.URL.Query().Get("strict") == "true")
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"status": "added"})
+	writeJSON(w, http.StatusOK, map[string]int{"carts_affected": carts})
 }
 
-// RemoveFromCart handles POST /cart/remove
-// body: { "user_id": "...", "product_id": 1 }
-func (h *Handler) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
-	var req addRemoveCartReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeErr(w, http.StatusBadRequest, "invalid json")
+// PublishProducts handles POST /admin/products/publish-batch
+// body: { "ids": [4, 5, 6] }; all go live together or, if one is unknown, none
+func (h *Handler) PublishProducts(w http.ResponseWriter, r *http.Request) {
+	var req publishBatchReq
+	if !decodeJSON(w, r, &req, "invalid json") {
 		return
 	}
-	if req.UserID == "" {
-		writeErr(w, http.StatusBadRequest, "user_id is required")
+	published, err := h.svc.PublishProducts(r.Context(), req.IDs)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
 		return
 	}
-	if err := h.svc.RemoveFromCart(req.UserID, req.ProductID); err != nil {
-		// If store returns sql.ErrNoRows, you might map to 404 — here we return 400 for simplicity
-		writeErr(w, http.StatusBadRequest, err.Error())
+	writeJSON(w, http.StatusOK, map[string][]int64{"published": published})
+}
+
+// ListAllProducts handles GET /admin/products[?include_deleted=true]
+func (h *Handler) ListAllProducts(w http.ResponseWriter, r *http.Request) {
+	ps, err := h.svc.ListAllProducts(r.Context(), r.URL.Query().Get("include_deleted") == "true")
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+	setListMeta(w, listMeta{Total: int64(len(ps))})
+	writeJSON(w, http.StatusOK, ps)
 }
 
-// ListCart handles GET /cart/list?user_id=...
-func (h *Handler) ListCart(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
-		writeErr(w, http.StatusBadRequest, "user_id required")
+// RestoreProduct handles POST /admin/products/{id}/restore
+func (h *Handler) RestoreProduct(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	if err := h.svc.RestoreProduct(r.Context(), productID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": productID, "restored": true})
+}
+
+// ExportProducts handles GET /admin/products/export?format=json|jsonl
+// Streams every product (drafts included) as one JSON array, or one object
+// per line with format=jsonl. The body is never enveloped. An error before
+// the first product is an ordinary error response; after that the status is
+// already sent, so the stream is cut short (leaving invalid JSON) and the
+// error logged.
+func (h *Handler) ExportProducts(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		format = "json"
+	case "jsonl":
+	default:
+		writeErr(w, http.StatusBadRequest, "format must be json or jsonl")
+		return
+	}
+	// errors keep the configured shape, the export itself is never enveloped
+	out := w
+	if ew, ok := w.(*envelopeWriter); ok {
+		out = ew.ResponseWriter
+	}
+	enc := json.NewEncoder(out)
+	n := 0
+	err := h.svc.ExportProducts(r.Context(), func(p service.ProductExportDTO) error {
+		if n == 0 {
+			if format == "jsonl" {
+				out.Header().Set("Content-Type", "application/x-ndjson")
+			} else {
+				out.Header().Set("Content-Type", "application/json")
+			}
+			out.WriteHeader(http.StatusOK)
+			if format == "json" {
+				if _, err := io.WriteString(out, "[\n"); err != nil {
+					return err
+				}
+			}
+		} else if format == "json" {
+			if _, err := io.WriteString(out, ","); err != nil {
+				return err
+			}
+		}
+		n++
+		return enc.Encode(p)
+	})
+	switch {
+	case err != nil && n == 0:
+		writeServiceErr(w, err, http.StatusInternalServerError)
+	case err != nil:
+		log.Printf("product export cut short after %d products: %v", n, err)
+	case n == 0 && format == "json":
+		writeJSON(out, http.StatusOK, []service.ProductExportDTO{})
+	case n == 0:
+		out.Header().Set("Content-Type", "application/x-ndjson")
+		out.WriteHeader(http.StatusOK)
+	case format == "json":
+		_, _ = io.WriteString(out, "]\n")
+	}
+}
+
+// ImportProducts handles POST /admin/products/import-catalog
+// body: what GET /admin/products/export wrote, as a JSON array or JSON lines
+// -> { "created": 2, "updated": 1, "skipped": 1, "errors": [{"index": 3, "id": 9, "error": "name required"}] }
+func (h *Handler) ImportProducts(w http.ResponseWriter, r *http.Request) {
+	body := bufio.NewReader(r.Body)
+	dec := json.NewDecoder(body)
+	var records []service.ProductExportDTO
+	first, err := body.Peek(1)
+	for err == nil && (first[0] == ' ' || first[0] == '\t' || first[0] == '\r' || first[0] == '\n') {
+		_, _ = body.ReadByte()
+		first, err = body.Peek(1)
+	}
+	switch {
+	case err == io.EOF:
+		writeErr(w, http.StatusBadRequest, "empty catalog")
 		return
+	case err != nil:
+		writeBodyErr(w, err, "invalid json")
+		return
+	case first[0] == '[':
+		if err := dec.Decode(&records); err != nil {
+			writeBodyErr(w, err, "invalid json")
+			return
+		}
+	default:
+		for line := 1; dec.More(); line++ {
+			var p service.ProductExportDTO
+			if err := dec.Decode(&p); err != nil {
+				writeBodyErr(w, err, fmt.Sprintf("invalid json on record %d", line))
+				return
+			}
+			records = append(records, p)
+		}
 	}
-	items, total, err := h.svc.GetCart(userID)
+	rep, err := h.svc.ImportProducts(r.Context(), records)
 	if err != nil {
-		writeErr(w, http.StatusInternalServerError, err.Error())
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "items": items, "total": total})
+	writeJSON(w, http.StatusOK, rep)
 }
 
-// Checkout handles POST /checkout/order
-// body: { "user_id": "..." }
-func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		UserID string `json:"user_id"`
+// SearchProducts handles GET /products/search?q=cable. Stock is always
+// reported; include_stock is still accepted (and validated) for older clients.
+func (h *Handler) SearchProducts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if v := q.Get("include_stock"); v != "" {
+		if _, err := strconv.ParseBool(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "include_stock must be true or false")
+			return
+		}
+	}
+	ps, err := h.svc.SearchProducts(r.Context(), q.Get("q"))
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeErr(w, http.StatusBadRequest, "invalid json")
+	setListMeta(w, listMeta{Total: int64(len(ps))})
+	writeJSON(w, http.StatusOK, ps)
+}
+
+// SalesVelocity handles GET /products/{id}/velocity?days=30
+func (h *Handler) SalesVelocity(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
 		return
 	}
-	if req.UserID == "" {
-		writeErr(w, http.StatusBadRequest, "user_id required")
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		if days, err = strconv.Atoi(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "days must be an integer")
+			return
+		}
+	}
+	perDay, err := h.svc.SalesVelocity(r.Context(), productID, days)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
 		return
 	}
-	ord, err := h.svc.Checkout(req.UserID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"product_id":    productID,
+		"days":          days,
+		"units_per_day": perDay,
+	})
+}
+
+// ListLowStockProducts handles GET /products/low-stock[?threshold=5]
+// Without a threshold the configured default is used.
+func (h *Handler) ListLowStockProducts(w http.ResponseWriter, r *http.Request) {
+	threshold := -1
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeErr(w, http.StatusBadRequest, "threshold must be a non-negative integer")
+			return
+		}
+		threshold = n
+	}
+	ps, err := h.svc.ListLowStockProducts(r.Context(), threshold)
 	if err != nil {
-		// possible errors: cart empty, product missing, DB problems
-		// map known errors to appropriate codes as needed
-		writeErr(w, http.StatusBadRequest, err.Error())
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, http.StatusCreated, ord)
+	setListMeta(w, listMeta{Total: int64(len(ps))})
+	writeJSON(w, http.StatusOK, ps)
 }
 
-func (h *Handler) UpdateStock(w http.ResponseWriter, r *http.Request) {
-	var req updateStockReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeErr(w, http.StatusBadRequest, "invalid json")
+// ListReviews handles GET /products/{id}/reviews?limit=&offset=&sort=&min_rating=
+// sort: newest (default), highest, lowest
+func (h *Handler) ListReviews(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
 		return
 	}
-	if req.ProductID == 0 {
-		writeErr(w, http.StatusBadRequest, "product_id required")
+	v := r.URL.Query()
+	q := store.ReviewQuery{Sort: v.Get("sort"), Limit: 20}
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"limit", &q.Limit}, {"offset", &q.Offset}, {"min_rating", &q.MinRating}} {
+		if s := v.Get(p.name); s != "" {
+			if *p.dst, err = strconv.Atoi(s); err != nil {
+				writeErr(w, http.StatusBadRequest, p.name+" must be an integer")
+				return
+			}
+		}
+	}
+
+	reviews, total, err := h.svc.ListReviews(r.Context(), productID, q)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
 		return
 	}
-	if req.NewStock < 0 {
-		writeErr(w, http.StatusBadRequest, "new_stock must be >= 0")
+	setListMeta(w, listMeta{Total: total, Limit: q.Limit, Offset: q.Offset})
+	writeJSON(w, http.StatusOK, reviews)
+}
+
+// ReviewSummary handles GET /products/{id}/reviews/summary
+func (h *Handler) ReviewSummary(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	sum, err := h.svc.ReviewSummary(r.Context(), productID)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sum)
+}
+
+// ReorderSuggestion handles GET /products/{id}/reorder-suggestion
+func (h *Handler) ReorderSuggestion(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	qty, err := h.svc.ReorderSuggestion(r.Context(), productID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"product_id": productID, "suggested_quantity": qty})
+}
+
+// GetStock handles GET /products/{id}/stock; untracked products report -1.
+func (h *Handler) GetStock(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	stock, err := h.svc.GetStock(r.Context(), productID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"product_id": productID, "stock": stock})
+}
+
+// SetTrackInventory handles PUT /products/{id}/track-inventory
+// body: { "track_inventory": false }
+func (h *Handler) SetTrackInventory(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	var req trackInventoryReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if err := h.svc.SetTrackInventory(r.Context(), productID, req.TrackInventory); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"product_id": productID, "track_inventory": req.TrackInventory})
+}
+
+// SetReservationLimit handles PUT /products/{id}/reservation-limit
+// body: { "max_per_user": 2 } (null clears it)
+func (h *Handler) SetReservationLimit(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	var req reservationLimitReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if err := h.svc.SetReservationLimit(r.Context(), productID, req.MaxPerUser); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"product_id": productID, "max_per_user": req.MaxPerUser})
+}
+
+// GetPrices handles POST /products/prices
+// body: { "ids": [1, 2, 3] } -> { "1": 9.99, "3": 4.5 } (unknown, draft and deleted ids omitted)
+func (h *Handler) GetPrices(w http.ResponseWriter, r *http.Request) {
+	var req pricesReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if len(req.IDs) == 0 {
+		writeErr(w, http.StatusBadRequest, "ids required")
+		return
+	}
+	prices, err := h.svc.GetPrices(r.Context(), req.IDs)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, prices)
+}
+
+// SetAvailability handles PUT /products/{id}/availability
+// body: { "available_from": "2025-01-01T00:00:00Z", "available_until": null }
+func (h *Handler) SetAvailability(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	var req availabilityReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if err := h.svc.SetAvailability(r.Context(), productID, req.AvailableFrom, req.AvailableUntil); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ListTags handles GET /products/{id}/tags
+func (h *Handler) ListTags(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	tags, err := h.svc.ListTags(r.Context(), productID)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"product_id": productID, "tags": tags})
+}
+
+// AddTag handles POST /products/{id}/tags
+// body: { "tag": "on-sale" }
+func (h *Handler) AddTag(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	var req tagReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if err := h.svc.AddTag(r.Context(), productID, req.Tag); err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "tagged"})
+}
+
+// RemoveTag handles DELETE /products/{id}/tags/{tag}
+func (h *Handler) RemoveTag(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	if err := h.svc.RemoveTag(r.Context(), productID, mux.Vars(r)["tag"]); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "tag not found on product")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "untagged"})
+}
+
+// AddToCart handles POST /cart/add (body validated by schemas/cart_add.json)
+// body: { "user_id": "...", "product_id": 1, "quantity": 2 }
+func (h *Handler) AddToCart(w http.ResponseWriter, r *http.Request) {
+	var req addRemoveCartReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	err := h.svc.AddToCart(r.Context(), userID, req.ProductID, req.Quantity)
+	h.Metrics.cartAdd(err)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "added"})
+}
+
+// RemoveFromCart handles POST /cart/remove (body validated by schemas/cart_remove.json)
+// body: { "user_id": "...", "product_id": 1 }
+func (h *Handler) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	var req addRemoveCartReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	if err := h.svc.RemoveFromCart(r.Context(), userID, req.ProductID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "item not in cart")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+// UpdateCartQuantity handles POST /cart/update (body validated by schemas/cart_update.json)
+// body: { "user_id": "...", "product_id": 1, "quantity": 3 } (0 removes the line)
+func (h *Handler) UpdateCartQuantity(w http.ResponseWriter, r *http.Request) {
+	var req addRemoveCartReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	if err := h.svc.UpdateCartQuantity(r.Context(), userID, req.ProductID, req.Quantity); err != nil {
+		h.Metrics.stockErr(err)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not in cart")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "updated"})
+}
+
+// ClearCart handles POST /cart/clear (body validated by schemas/cart_clear.json)
+// body: { "user_id": "..." }
+func (h *Handler) ClearCart(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	if err := h.svc.ClearCart(r.Context(), userID); err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "cleared"})
+}
+
+// AddToCartBatch handles POST /cart/add-batch?mode=best_effort
+// body: { "user_id": "...", "items": [{"product_id": 1, "quantity": 2}, ...] }
+// All items are added or none (the error names the failing one) unless
+// mode=best_effort, which answers 207 with a result per item if any failed.
+func (h *Handler) AddToCartBatch(w http.ResponseWriter, r *http.Request) {
+	var req cartBatchAddReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	items := make([]service.CartBatchItem, 0, len(req.Items))
+	for _, it := range req.Items {
+		items = append(items, service.CartBatchItem{ProductID: it.ProductID, Quantity: it.Quantity})
+	}
+	results, err := h.svc.AddToCartBatch(r.Context(), userID, items, r.URL.Query().Get("mode"))
+	if err != nil {
+		h.Metrics.stockErr(err)
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeCartBatchResults(w, "added", results)
+}
+
+// RemoveFromCartBatch handles POST /cart/remove-batch?mode=best_effort
+// body: { "user_id": "...", "product_ids": [1, 2] }
+// Same modes and responses as AddToCartBatch.
+func (h *Handler) RemoveFromCartBatch(w http.ResponseWriter, r *http.Request) {
+	var req cartBatchRemoveReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	results, err := h.svc.RemoveFromCartBatch(r.Context(), userID, req.ProductIDs, r.URL.Query().Get("mode"))
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeCartBatchResults(w, "removed", results)
+}
+
+// writeCartBatchResults answers 200 with status when every item was applied,
+// 207 Multi-Status with each item's outcome otherwise.
+func writeCartBatchResults(w http.ResponseWriter, status string, results []service.CartBatchResult) {
+	out := make([]cartBatchItemResp, 0, len(results))
+	failed := 0
+	for _, res := range results {
+		item := cartBatchItemResp{ProductID: res.ProductID, OK: res.Err == nil, Status: http.StatusOK}
+		if res.Err != nil {
+			failed++
+			item.Status, item.Code = classifyErr(res.Err, http.StatusBadRequest)
+			item.Error = res.Err.Error()
+		}
+		out = append(out, item)
+	}
+	if failed == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": status, "results": out})
+		return
+	}
+	writeJSON(w, http.StatusMultiStatus, map[string]interface{}{
+		"succeeded": len(out) - failed,
+		"failed":    failed,
+		"results":   out,
+	})
+}
+
+// ListCart handles GET /cart/list?user_id=...
+func (h *Handler) ListCart(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.actingUser(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+	items, total, unresolved, err := h.svc.GetCart(r.Context(), userID)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "items": items, "total": total, "unresolved": unresolved})
+}
+
+// GetCartInCurrency handles GET /cart?user_id=...&currency=EUR (default: the
+// base currency)
+func (h *Handler) GetCartInCurrency(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	userID, ok := h.actingUser(w, r, q.Get("user_id"))
+	if !ok {
+		return
+	}
+	cart, err := h.svc.GetCartInCurrency(r.Context(), userID, q.Get("currency"))
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, cart)
+}
+
+// ListCartDetailed handles GET /cart/detailed?user_id=...
+func (h *Handler) ListCartDetailed(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.actingUser(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+	items, total, err := h.svc.GetCartDetailed(r.Context(), userID)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "items": items, "total": total})
+}
+
+// CheckFulfillable handles GET /cart/fulfillable?user_id=...
+func (h *Handler) CheckFulfillable(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.actingUser(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+	fulfillable, short, err := h.svc.CheckFulfillable(r.Context(), userID)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "fulfillable": fulfillable, "short_product_ids": short})
+}
+
+// ListOrders handles GET /orders/list?user_id=...
+func (h *Handler) ListOrders(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.actingUser(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+	orders, err := h.svc.GetOrderHistory(r.Context(), userID)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// GetOrder handles GET /orders/{id}?user_id=...; another user's order is 403
+func (h *Handler) GetOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || orderID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	userID, ok := h.actingUser(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+	ord, err := h.svc.GetOrder(r.Context(), userID, orderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "order not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, ord)
+}
+
+// ListAllOrders handles GET /admin/orders
+// [?status=&user_id=&from=RFC3339&to=RFC3339&limit=50&offset=0]
+func (h *Handler) ListAllOrders(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.OrderFilter{Status: q.Get("status"), UserID: q.Get("user_id")}
+	var err error
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErr(w, http.StatusBadRequest, "from must be an RFC3339 timestamp")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErr(w, http.StatusBadRequest, "to must be an RFC3339 timestamp")
+			return
+		}
+	}
+	limit, offset := 50, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "limit must be an integer")
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "offset must be an integer")
+			return
+		}
+	}
+
+	orders, total, err := h.svc.ListAllOrders(r.Context(), filter, limit, offset)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	setListMeta(w, listMeta{Total: total, Limit: limit, Offset: offset})
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// OrdersContainingProduct handles GET /admin/products/{id}/orders
+// [?from=RFC3339&to=RFC3339&limit=50&offset=0]
+func (h *Handler) OrdersContainingProduct(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || productID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	q := r.URL.Query()
+	var from, to time.Time
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErr(w, http.StatusBadRequest, "from must be an RFC3339 timestamp")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErr(w, http.StatusBadRequest, "to must be an RFC3339 timestamp")
+			return
+		}
+	}
+	limit, offset := 50, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "limit must be an integer")
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "offset must be an integer")
+			return
+		}
+	}
+
+	orders, total, err := h.svc.OrdersContainingProduct(r.Context(), productID, from, to, limit, offset)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	setListMeta(w, listMeta{Total: total, Limit: limit, Offset: offset})
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// ListAllStockMovements handles GET /admin/stock/movements
+// [?product_id=&reason=&from=RFC3339&to=RFC3339&limit=100&offset=0]
+func (h *Handler) ListAllStockMovements(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.MovementFilter{Reason: q.Get("reason")}
+	var err error
+	if v := q.Get("product_id"); v != "" {
+		if filter.ProductID, err = strconv.ParseInt(v, 10, 64); err != nil || filter.ProductID <= 0 {
+			writeErr(w, http.StatusBadRequest, "invalid product id")
+			return
+		}
+	}
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErr(w, http.StatusBadRequest, "from must be an RFC3339 timestamp")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			writeErr(w, http.StatusBadRequest, "to must be an RFC3339 timestamp")
+			return
+		}
+	}
+	limit, offset := 100, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "limit must be an integer")
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil {
+			writeErr(w, http.StatusBadRequest, "offset must be an integer")
+			return
+		}
+	}
+
+	movements, total, err := h.svc.ListAllStockMovements(r.Context(), filter, limit, offset)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	setListMeta(w, listMeta{Total: total, Limit: limit, Offset: offset})
+	writeJSON(w, http.StatusOK, movements)
+}
+
+// UpdateOrderStatusBatch handles POST /admin/orders/status-batch
+// body: { "order_ids": [1, 2], "status": "shipped", "strict": false }
+func (h *Handler) UpdateOrderStatusBatch(w http.ResponseWriter, r *http.Request) {
+	var req orderStatusBatchReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	updated, err := h.svc.UpdateOrderStatusBatch(r.Context(), req.OrderIDs, req.Status, req.Strict)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]int64{"updated": updated})
+}
+
+// SetBundleComponents handles PUT /admin/bundles/{id}/components
+// body: { "components": [{"product_id": 2, "quantity": 1}, {"product_id": 3, "quantity": 2}] }
+func (h *Handler) SetBundleComponents(w http.ResponseWriter, r *http.Request) {
+	bundleID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || bundleID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	var req bundleComponentsReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	components := make([]store.BundleComponent, 0, len(req.Components))
+	for _, c := range req.Components {
+		components = append(components, store.BundleComponent{ProductID: c.ProductID, Quantity: c.Quantity})
+	}
+	if err := h.svc.SetBundleComponents(r.Context(), bundleID, components); err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"product_id": bundleID, "components": len(components)})
+}
+
+// CreatePurchaseOrder handles POST /admin/purchase-orders
+// body: { "product_id": 1, "quantity": 50, "expected_at": "2025-03-01T00:00:00Z" }
+func (h *Handler) CreatePurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	var req purchaseOrderReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	id, err := h.svc.CreatePurchaseOrder(r.Context(), req.ProductID, req.Quantity, req.ExpectedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]int64{"id": id})
+}
+
+// QuoteCheckout handles POST /checkout/quote
+// body: { "user_id": "...", "hold": true }
+func (h *Handler) QuoteCheckout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID string `json:"user_id"`
+		Hold   bool   `json:"hold"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	quote, err := h.svc.QuoteCheckout(r.Context(), userID, req.Hold)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, quote)
+}
+
+// IdempotencyKeyHeader makes POST /checkout/order safe to retry: a repeat
+// with the same key and user returns the order the first request placed.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Checkout handles POST /checkout/order (body validated by schemas/checkout.json)
+// body: { "user_id": "...", "metadata": {"campaign": "..."}, "remove_unavailable": false, "coupon_code": "SPRING10" }
+// An Idempotency-Key header makes the checkout idempotent for 24 hours.
+func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID            string            `json:"user_id"`
+		Metadata          map[string]string `json:"metadata,omitempty"`
+		RemoveUnavailable bool              `json:"remove_unavailable"`
+		CouponCode        string            `json:"coupon_code"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	ord, err := h.svc.Checkout(r.Context(), userID, req.Metadata, store.CheckoutOptions{
+		RemoveUnavailable: req.RemoveUnavailable,
+		CouponCode:        req.CouponCode,
+		IdempotencyKey:    r.Header.Get(IdempotencyKeyHeader),
+	})
+	h.Metrics.checkout(err)
+	if err != nil {
+		// possible errors: cart empty, product missing, DB problems; typed
+		// ones get their own status/code, the rest are 400
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, ord)
+}
+
+// CheckoutAndPay handles POST /checkout/pay (body validated by
+// schemas/checkout_pay.json)
+// body: { "user_id": "...", "payment_token": "tok_...", "metadata": {...}, "remove_unavailable": false, "coupon_code": "..." }
+func (h *Handler) CheckoutAndPay(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID            string            `json:"user_id"`
+		PaymentToken      string            `json:"payment_token"`
+		Metadata          map[string]string `json:"metadata,omitempty"`
+		RemoveUnavailable bool              `json:"remove_unavailable"`
+		CouponCode        string            `json:"coupon_code"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	ord, err := h.svc.CheckoutAndPay(r.Context(), userID, req.Metadata,
+		store.CheckoutOptions{RemoveUnavailable: req.RemoveUnavailable, CouponCode: req.CouponCode}, req.PaymentToken)
+	h.Metrics.checkout(err)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, ord)
+}
+
+// EstimateShipping handles POST /checkout/shipping-estimate
+// body: { "user_id": "...", "destination": "domestic" }
+func (h *Handler) EstimateShipping(w http.ResponseWriter, r *http.Request) {
+	var req shippingEstimateReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	if req.Destination == "" {
+		writeErr(w, http.StatusBadRequest, "destination required")
+		return
+	}
+	cost, err := h.svc.EstimateShipping(r.Context(), userID, req.Destination)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "destination": req.Destination, "cost": cost})
+}
+
+// ReturnOrderItem handles POST /orders/{id}/return
+// body: { "user_id": "...", "product_id": 1, "quantity": 1, "restock": true }
+func (h *Handler) ReturnOrderItem(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || orderID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	var req returnItemReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if req.ProductID <= 0 {
+		writeErr(w, http.StatusBadRequest, "product_id required")
+		return
+	}
+	if req.Quantity <= 0 {
+		writeErr(w, http.StatusBadRequest, "quantity must be > 0")
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	if err := h.svc.ReturnOrderItem(r.Context(), orderID, userID, req.ProductID, req.Quantity, req.Restock); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "order item not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "returned"})
+}
+
+// UpdateOrderStatus handles PATCH /orders/{id}/status (admin only)
+// body: { "status": "shipped" }
+func (h *Handler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || orderID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	var req struct {
+		Status string `json:"status"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if err := h.svc.UpdateOrderStatus(r.Context(), orderID, req.Status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "order not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": orderID, "status": req.Status})
+}
+
+// CancelOrder handles POST /orders/{id}/cancel
+// body: { "user_id": "..." }
+func (h *Handler) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || orderID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	if err := h.svc.CancelOrder(r.Context(), orderID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "order not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": store.OrderStatusCancelled})
+}
+
+// RestoreOrderToCart handles POST /orders/{id}/restore-to-cart
+// body: { "user_id": "..." }
+func (h *Handler) RestoreOrderToCart(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || orderID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	userID, ok := h.actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	restored, unavailable, err := h.svc.RestoreCancelledOrderToCart(r.Context(), userID, orderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "order not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	if unavailable == nil {
+		unavailable = []int64{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"restored": restored, "out_of_stock": unavailable})
+}
+
+// GetCartSnapshot handles GET /orders/{id}/cart-snapshot (admin only: it's
+// for support looking into disputes)
+func (h *Handler) GetCartSnapshot(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || orderID <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	snap, err := h.svc.GetCartSnapshot(r.Context(), orderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "order not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// ListOutbox handles GET /admin/outbox?status=failed (default status: failed)
+func (h *Handler) ListOutbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = store.OutboxFailed
+	}
+	events, err := h.svc.ListOutboxEvents(r.Context(), status)
+	if err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// ReplayOutbox handles POST /admin/outbox/{id}/replay
+func (h *Handler) ReplayOutbox(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		writeErr(w, http.StatusBadRequest, "invalid event id")
+		return
+	}
+	ev, err := h.svc.ReplayOutboxEvent(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "outbox event not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "requeued", "event": ev})
+}
+
+// UpdateStock handles POST /products/stock, setting a tracked product's
+// stock (the change is recorded as an adjustment movement). Reservations made
+// since the caller read the stock are overwritten; AdjustStock doesn't.
+// body: { "product_id": 1, "new_stock": 40 }
+func (h *Handler) UpdateStock(w http.ResponseWriter, r *http.Request) {
+	var req updateStockReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if req.ProductID == 0 {
+		writeErr(w, http.StatusBadRequest, "product_id required")
+		return
+	}
+	if req.NewStock < 0 {
+		writeErr(w, http.StatusBadRequest, "new_stock must be >= 0")
+		return
+	}
+	if err := h.svc.UpdateStock(r.Context(), req.ProductID, req.NewStock); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErr(w, http.StatusNotFound, "product not found")
+			return
+		}
+		writeServiceErr(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// UpdateStockBatch handles POST /products/stock/bulk, setting the stock of
+// every listed product together, e.g. when a shipment arrives. If any id is
+// unknown (404) or untracked (409) none are set; the error names them.
+// body: [{ "product_id": 1, "new_stock": 100 }, { "product_id": 2, "new_stock": 40 }]
+func (h *Handler) UpdateStockBatch(w http.ResponseWriter, r *http.Request) {
+	var req []updateStockReq
+	if !decodeJSON(w, r, &req, "invalid json: expected an array of stock updates") {
+		return
+	}
+	updates := make([]store.StockUpdate, 0, len(req))
+	for _, u := range req {
+		updates = append(updates, store.StockUpdate{ProductID: u.ProductID, NewStock: u.NewStock})
+	}
+	if err := h.svc.UpdateStockBatch(r.Context(), updates); err != nil {
+		writeServiceErr(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "updated": len(updates)})
+}
+
+// AdjustStock handles POST /products/stock/adjust, adding delta (negative to
+// take stock away) to a tracked product's stock; 409 if it would go negative
+// body: { "product_id": 1, "delta": 12 }
+func (h *Handler) AdjustStock(w http.ResponseWriter, r *http.Request) {
+	var req adjustStockReq
+	if !decodeJSON(w, r, &req, "invalid json") {
+		return
+	}
+	if req.ProductID == 0 {
+		writeErr(w, http.StatusBadRequest, "product_id required")
+		return
+	}
+	if req.Delta == 0 {
+		writeErr(w, http.StatusBadRequest, "delta must not be zero")
 		return
 	}
-	if err := h.svc.UpdateStock(req.ProductID, req.NewStock); err != nil {
-		if err == sql.ErrNoRows {
+	if err := h.svc.AdjustStock(r.Context(), req.ProductID, req.Delta); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
 			writeErr(w, http.StatusNotFound, "product not found")
 			return
 		}
-		writeErr(w, http.StatusInternalServerError, err.Error())
+		writeServiceErr(w, err, http.StatusInternalServerError)
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
@@ -1 +1,2838 @@
+package handler
 
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"inventory-management/money"
+	"inventory-management/service"
+	"inventory-management/store"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// ---- fakeService implementing service.ServiceInterface for tests ----
+type fakeService struct {
+	CreateProductFn    func(name, desc string, price money.Cents, category, currency string) (int64, error)
+	CreateProductsFn   func(products []service.NewProduct) ([]int64, error)
+	UpdateProductFn    func(id int64, name, desc string, price money.Cents, category, currency string, version int) error
+	GetProductFn       func(id int64) (service.ProductDTO, error)
+	CloneProductFn     func(id int64) (int64, error)
+	SetPublishedFn     func(id int64, published bool) error
+	ListAllProductsFn  func(includeDeleted bool) ([]service.ProductDTO, error)
+	LowStockFn         func(threshold int) ([]service.ProductDTO, error)
+	RestoreProductFn   func(id int64) error
+	SearchFn           func(q string) ([]service.ProductDTO, error)
+	DeleteProductFn    func(id int64, strict bool) (int, error)
+	PublishBatchFn     func(ids []int64) ([]int64, error)
+	ListProductsFn     func(sort string) ([]service.ProductDTO, error)
+	ListPageFn         func(limit, offset int, sort string) ([]service.ProductDTO, error)
+	ListAvailableFn    func() ([]service.ProductDTO, error)
+	CountProductsFn    func(exact bool) (int64, error)
+	GetPricesFn        func(ids []int64) (map[int64]money.Cents, error)
+	ListByTagsFn       func(tags []string) ([]service.ProductDTO, error)
+	ListByCategoryFn   func(category string) ([]service.ProductDTO, error)
+	AddTagFn           func(productID int64, tag string) error
+	RemoveTagFn        func(productID int64, tag string) error
+	ListTagsFn         func(productID int64) ([]string, error)
+	AddToCartFn        func(userID string, productID int64, qty int) error
+	RemoveFromCartFn   func(userID string, productID int64) error
+	AddBatchFn         func(userID string, items []service.CartBatchItem, mode string) ([]service.CartBatchResult, error)
+	RemoveBatchFn      func(userID string, productIDs []int64, mode string) ([]service.CartBatchResult, error)
+	ClearCartFn        func(userID string) error
+	UpdateQtyFn        func(userID string, productID int64, newQty int) error
+	GetCartFn          func(userID string) ([]service.CartDTO, money.Cents, []int64, error)
+	CartCurrencyFn     func(userID, currency string) (service.ConvertedCartDTO, error)
+	QuoteFn            func(userID string, hold bool) (service.QuoteDTO, error)
+	GetCartDetailedFn  func(userID string) ([]service.CartDetailDTO, money.Cents, error)
+	CheckFulfillableFn func(userID string) (bool, []int64, error)
+	EstimateShippingFn func(userID, destination string) (float64, error)
+	CheckoutFn         func(userID string, meta map[string]string, opts store.CheckoutOptions) (service.OrderDTO, error)
+	ListAllOrdersFn    func(filter store.OrderFilter, limit, offset int) ([]service.OrderDTO, int64, error)
+	OrderHistoryFn     func(userID string) ([]service.OrderDTO, error)
+	GetOrderFn         func(userID string, orderID int64) (service.OrderDTO, error)
+	CancelOrderFn      func(orderID int64, userID string) error
+	PingFn             func(ctx context.Context) error
+	PayFn              func(userID string, meta map[string]string, opts store.CheckoutOptions, token string) (service.OrderDTO, error)
+	ProductOrdersFn    func(productID int64, from, to time.Time, limit, offset int) ([]service.ProductOrderDTO, int64, error)
+	VelocityFn         func(productID int64, days int) (float64, error)
+	StockFn            func(productID int64) (int, error)
+	ReorderFn          func(productID int64) (int, error)
+	RestoreOrderFn     func(userID string, orderID int64) ([]service.CartDTO, []int64, error)
+	CartSnapshotFn     func(orderID int64) (service.CartSnapshotDTO, error)
+	StatusBatchFn      func(orderIDs []int64, status string, strict bool) ([]int64, error)
+	OrderStatusFn      func(orderID int64, status string) error
+	ListReviewsFn      func(productID int64, q store.ReviewQuery) ([]service.ReviewDTO, int64, error)
+	ReviewSummaryFn    func(productID int64) (service.ReviewSummaryDTO, error)
+	UpdateOrderMetaFn  func(orderID int64, meta map[string]string) error
+	ReturnItemFn       func(orderID int64, userID string, productID int64, qty int, restock bool) error
+	UpdateStockFn      func(productID int64, newStock int) error
+	StockBatchFn       func(updates []store.StockUpdate) error
+	AdjustStockFn      func(productID int64, delta int) error
+	ListMovementsFn    func(filter store.MovementFilter, limit, offset int) ([]service.StockMovementDTO, int64, error)
+	SetTrackFn         func(productID int64, track bool) error
+	SetLimitFn         func(productID int64, limit *int) error
+	ExportFn           func(fn func(service.ProductExportDTO) error) error
+	ImportFn           func(records []service.ProductExportDTO) (service.ImportReport, error)
+	SetBundleFn        func(bundleID int64, components []store.BundleComponent) error
+	SetAvailabilityFn  func(productID int64, from, until *time.Time) error
+	CreatePOFn         func(productID int64, qty int, expectedAt time.Time) (int64, error)
+	ListOutboxFn       func(status string) ([]service.OutboxEventDTO, error)
+	ReplayOutboxFn     func(id int64) (service.OutboxEventDTO, error)
+}
+
+func (f *fakeService) CreateProduct(ctx context.Context, name, desc string, price money.Cents, category, currency string) (int64, error) {
+	return f.CreateProductFn(name, desc, price, category, currency)
+}
+func (f *fakeService) CreateProducts(ctx context.Context, products []service.NewProduct) ([]int64, error) {
+	return f.CreateProductsFn(products)
+}
+func (f *fakeService) GetProduct(ctx context.Context, id int64) (service.ProductDTO, error) {
+	return f.GetProductFn(id)
+}
+func (f *fakeService) UpdateProduct(ctx context.Context, id int64, name, desc string, price money.Cents, category, currency string, version int) error {
+	return f.UpdateProductFn(id, name, desc, price, category, currency, version)
+}
+func (f *fakeService) ListProducts(ctx context.Context, sort string) ([]service.ProductDTO, error) {
+	return f.ListProductsFn(sort)
+}
+func (f *fakeService) ListProductsByCategory(ctx context.Context, category string) ([]service.ProductDTO, error) {
+	return f.ListByCategoryFn(category)
+}
+func (f *fakeService) CloneProduct(ctx context.Context, id int64) (int64, error) {
+	return f.CloneProductFn(id)
+}
+func (f *fakeService) SetPublished(ctx context.Context, id int64, published bool) error {
+	return f.SetPublishedFn(id, published)
+}
+func (f *fakeService) ListAllProducts(ctx context.Context, includeDeleted bool) ([]service.ProductDTO, error) {
+	return f.ListAllProductsFn(includeDeleted)
+}
+func (f *fakeService) ListLowStockProducts(ctx context.Context, threshold int) ([]service.ProductDTO, error) {
+	return f.LowStockFn(threshold)
+}
+func (f *fakeService) RestoreProduct(ctx context.Context, id int64) error {
+	return f.RestoreProductFn(id)
+}
+func (f *fakeService) PublishProducts(ctx context.Context, ids []int64) ([]int64, error) {
+	return f.PublishBatchFn(ids)
+}
+func (f *fakeService) DeleteProduct(ctx context.Context, id int64, strict bool) (int, error) {
+	return f.DeleteProductFn(id, strict)
+}
+func (f *fakeService) SearchProducts(ctx context.Context, q string) ([]service.ProductDTO, error) {
+	return f.SearchFn(q)
+}
+func (f *fakeService) ListProductsPage(ctx context.Context, limit, offset int, sort string) ([]service.ProductDTO, error) {
+	return f.ListPageFn(limit, offset, sort)
+}
+func (f *fakeService) CountProducts(ctx context.Context, exact bool) (int64, error) {
+	return f.CountProductsFn(exact)
+}
+func (f *fakeService) ListProductsByTags(ctx context.Context, tags []string) ([]service.ProductDTO, error) {
+	return f.ListByTagsFn(tags)
+}
+func (f *fakeService) AddTag(ctx context.Context, productID int64, tag string) error {
+	return f.AddTagFn(productID, tag)
+}
+func (f *fakeService) RemoveTag(ctx context.Context, productID int64, tag string) error {
+	return f.RemoveTagFn(productID, tag)
+}
+func (f *fakeService) ListTags(ctx context.Context, productID int64) ([]string, error) {
+	return f.ListTagsFn(productID)
+}
+func (f *fakeService) GetPrices(ctx context.Context, ids []int64) (map[int64]money.Cents, error) {
+	return f.GetPricesFn(ids)
+}
+func (f *fakeService) AddToCart(ctx context.Context, userID string, productID int64, qty int) error {
+	return f.AddToCartFn(userID, productID, qty)
+}
+func (f *fakeService) RemoveFromCart(ctx context.Context, userID string, productID int64) error {
+	return f.RemoveFromCartFn(userID, productID)
+}
+func (f *fakeService) AddToCartBatch(ctx context.Context, userID string, items []service.CartBatchItem, mode string) ([]service.CartBatchResult, error) {
+	return f.AddBatchFn(userID, items, mode)
+}
+func (f *fakeService) RemoveFromCartBatch(ctx context.Context, userID string, productIDs []int64, mode string) ([]service.CartBatchResult, error) {
+	return f.RemoveBatchFn(userID, productIDs, mode)
+}
+func (f *fakeService) ClearCart(ctx context.Context, userID string) error {
+	return f.ClearCartFn(userID)
+}
+func (f *fakeService) UpdateCartQuantity(ctx context.Context, userID string, productID int64, newQty int) error {
+	return f.UpdateQtyFn(userID, productID, newQty)
+}
+func (f *fakeService) GetCart(ctx context.Context, userID string) ([]service.CartDTO, money.Cents, []int64, error) {
+	return f.GetCartFn(userID)
+}
+func (f *fakeService) GetCartInCurrency(ctx context.Context, userID, currency string) (service.ConvertedCartDTO, error) {
+	return f.CartCurrencyFn(userID, currency)
+}
+func (f *fakeService) QuoteCheckout(ctx context.Context, userID string, hold bool) (service.QuoteDTO, error) {
+	return f.QuoteFn(userID, hold)
+}
+func (f *fakeService) GetCartDetailed(ctx context.Context, userID string) ([]service.CartDetailDTO, money.Cents, error) {
+	return f.GetCartDetailedFn(userID)
+}
+func (f *fakeService) CheckFulfillable(ctx context.Context, userID string) (bool, []int64, error) {
+	return f.CheckFulfillableFn(userID)
+}
+func (f *fakeService) EstimateShipping(ctx context.Context, userID, destination string) (float64, error) {
+	return f.EstimateShippingFn(userID, destination)
+}
+func (f *fakeService) Checkout(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions) (service.OrderDTO, error) {
+	return f.CheckoutFn(userID, meta, opts)
+}
+func (f *fakeService) OrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time, limit, offset int) ([]service.ProductOrderDTO, int64, error) {
+	return f.ProductOrdersFn(productID, from, to, limit, offset)
+}
+func (f *fakeService) Ping(ctx context.Context) error { return f.PingFn(ctx) }
+func (f *fakeService) CheckoutAndPay(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions, token string) (service.OrderDTO, error) {
+	return f.PayFn(userID, meta, opts, token)
+}
+func (f *fakeService) GetOrder(ctx context.Context, userID string, orderID int64) (service.OrderDTO, error) {
+	return f.GetOrderFn(userID, orderID)
+}
+func (f *fakeService) CancelOrder(ctx context.Context, orderID int64, userID string) error {
+	return f.CancelOrderFn(orderID, userID)
+}
+func (f *fakeService) GetOrderHistory(ctx context.Context, userID string) ([]service.OrderDTO, error) {
+	return f.OrderHistoryFn(userID)
+}
+func (f *fakeService) ListAllOrders(ctx context.Context, filter store.OrderFilter, limit, offset int) ([]service.OrderDTO, int64, error) {
+	return f.ListAllOrdersFn(filter, limit, offset)
+}
+func (f *fakeService) ReorderSuggestion(ctx context.Context, productID int64) (int, error) {
+	return f.ReorderFn(productID)
+}
+func (f *fakeService) GetStock(ctx context.Context, productID int64) (int, error) {
+	return f.StockFn(productID)
+}
+func (f *fakeService) SalesVelocity(ctx context.Context, productID int64, days int) (float64, error) {
+	return f.VelocityFn(productID, days)
+}
+func (f *fakeService) UpdateOrderStatusBatch(ctx context.Context, orderIDs []int64, status string, strict bool) ([]int64, error) {
+	return f.StatusBatchFn(orderIDs, status, strict)
+}
+func (f *fakeService) UpdateOrderStatus(ctx context.Context, orderID int64, status string) error {
+	return f.OrderStatusFn(orderID, status)
+}
+func (f *fakeService) RestoreCancelledOrderToCart(ctx context.Context, userID string, orderID int64) ([]service.CartDTO, []int64, error) {
+	return f.RestoreOrderFn(userID, orderID)
+}
+func (f *fakeService) GetCartSnapshot(ctx context.Context, orderID int64) (service.CartSnapshotDTO, error) {
+	return f.CartSnapshotFn(orderID)
+}
+func (f *fakeService) ListReviews(ctx context.Context, productID int64, q store.ReviewQuery) ([]service.ReviewDTO, int64, error) {
+	return f.ListReviewsFn(productID, q)
+}
+func (f *fakeService) ReviewSummary(ctx context.Context, productID int64) (service.ReviewSummaryDTO, error) {
+	return f.ReviewSummaryFn(productID)
+}
+func (f *fakeService) UpdateOrderMetadata(ctx context.Context, orderID int64, meta map[string]string) error {
+	return f.UpdateOrderMetaFn(orderID, meta)
+}
+func (f *fakeService) ReturnOrderItem(ctx context.Context, orderID int64, userID string, productID int64, qty int, restock bool) error {
+	return f.ReturnItemFn(orderID, userID, productID, qty, restock)
+}
+func (f *fakeService) SetAvailability(ctx context.Context, productID int64, from, until *time.Time) error {
+	return f.SetAvailabilityFn(productID, from, until)
+}
+func (f *fakeService) ListAvailableProducts(ctx context.Context) ([]service.ProductDTO, error) {
+	return f.ListAvailableFn()
+}
+func (f *fakeService) CreatePurchaseOrder(ctx context.Context, productID int64, qty int, expectedAt time.Time) (int64, error) {
+	return f.CreatePOFn(productID, qty, expectedAt)
+}
+func (f *fakeService) ImportProducts(ctx context.Context, records []service.ProductExportDTO) (service.ImportReport, error) {
+	return f.ImportFn(records)
+}
+func (f *fakeService) ExportProducts(ctx context.Context, fn func(service.ProductExportDTO) error) error {
+	return f.ExportFn(fn)
+}
+func (f *fakeService) SetReservationLimit(ctx context.Context, productID int64, limit *int) error {
+	return f.SetLimitFn(productID, limit)
+}
+func (f *fakeService) SetTrackInventory(ctx context.Context, productID int64, track bool) error {
+	return f.SetTrackFn(productID, track)
+}
+func (f *fakeService) SetBundleComponents(ctx context.Context, bundleID int64, components []store.BundleComponent) error {
+	return f.SetBundleFn(bundleID, components)
+}
+func (f *fakeService) ListOutboxEvents(ctx context.Context, status string) ([]service.OutboxEventDTO, error) {
+	return f.ListOutboxFn(status)
+}
+func (f *fakeService) ReplayOutboxEvent(ctx context.Context, id int64) (service.OutboxEventDTO, error) {
+	return f.ReplayOutboxFn(id)
+}
+func (f *fakeService) UpdateStock(ctx context.Context, productID int64, newStock int) error {
+	return f.UpdateStockFn(productID, newStock)
+}
+func (f *fakeService) AdjustStock(ctx context.Context, productID int64, delta int) error {
+	return f.AdjustStockFn(productID, delta)
+}
+func (f *fakeService) UpdateStockBatch(ctx context.Context, updates []store.StockUpdate) error {
+	return f.StockBatchFn(updates)
+}
+func (f *fakeService) ListAllStockMovements(ctx context.Context, filter store.MovementFilter, limit, offset int) ([]service.StockMovementDTO, int64, error) {
+	return f.ListMovementsFn(filter, limit, offset)
+}
+
+// ---- helpers ----
+
+// serve routes req through a router with all handler routes registered
+func serve(svc service.ServiceInterface, req *http.Request) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	NewHandler(svc).RegisterRoutes(r)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+const testAdminToken = "test-admin-token"
+
+// serveAdmin is serve with an admin token configured and sent on req
+func serveAdmin(svc service.ServiceInterface, req *http.Request) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	h := NewHandler(svc)
+	h.AdminToken = testAdminToken
+	h.RegisterRoutes(r)
+	req.Header.Set(AdminTokenHeader, testAdminToken)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var out map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("invalid json response %q: %v", rec.Body.String(), err)
+	}
+	return out
+}
+
+// ---- Tests ----
+
+func TestCheckFulfillableHandler(t *testing.T) {
+	svc := &fakeService{
+		CheckFulfillableFn: func(userID string) (bool, []int64, error) {
+			if userID != "u1" {
+				return false, nil, errors.New("unexpected user")
+			}
+			return false, []int64{4, 9}, nil
+		},
+	}
+
+	// missing user_id
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/cart/fulfillable", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/cart/fulfillable?user_id=u1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := decodeBody(t, rec)
+	if body["fulfillable"] != false {
+		t.Fatalf("expected fulfillable=false, got %v", body["fulfillable"])
+	}
+	short, _ := body["short_product_ids"].([]interface{})
+	if len(short) != 2 || short[0] != float64(4) || short[1] != float64(9) {
+		t.Fatalf("unexpected short ids: %v", body["short_product_ids"])
+	}
+}
+
+func TestListProductsSort(t *testing.T) {
+	var gotSort string
+	created := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	svc := &fakeService{ListProductsFn: func(sort string) ([]service.ProductDTO, error) {
+		gotSort = sort
+		return []service.ProductDTO{{ID: 7, CreatedAt: &created, UpdatedAt: &created}}, nil
+	}}
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?sort=newest", nil))
+	if rec.Code != http.StatusOK || gotSort != "newest" {
+		t.Fatalf("want 200 sorted newest, got %d %q: %s", rec.Code, gotSort, rec.Body.String())
+	}
+	var ps []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ps); err != nil {
+		t.Fatalf("invalid json response %q: %v", rec.Body.String(), err)
+	}
+	if len(ps) != 1 || ps[0]["created_at"] != "2030-01-02T00:00:00Z" || ps[0]["updated_at"] == nil {
+		t.Fatalf("expected timestamps in the listing, got %v", ps)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?sort=oldest", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for an unknown sort, got %d", rec.Code)
+	}
+}
+
+func TestListProductsPagedTotalCount(t *testing.T) {
+	var gotExact []bool
+	svc := &fakeService{
+		ListPageFn: func(limit, offset int, sort string) ([]service.ProductDTO, error) {
+			if limit != 2 || offset != 2 {
+				return nil, errors.New("unexpected page")
+			}
+			return []service.ProductDTO{{ID: 3}, {ID: 4}}, nil
+		},
+		CountProductsFn: func(exact bool) (int64, error) {
+			gotExact = append(gotExact, exact)
+			if exact {
+				return 10, nil
+			}
+			return 9, nil
+		},
+		ListProductsFn: func(sort string) ([]service.ProductDTO, error) {
+			return []service.ProductDTO{{ID: 1}, {ID: 2}, {ID: 3}}, nil
+		},
+	}
+
+	// approximate (configured) count
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?limit=2&offset=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "9" {
+		t.Fatalf("expected X-Total-Count 9, got %q", got)
+	}
+
+	// exact count on request
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?limit=2&offset=2&exact_count=true", nil))
+	if got := rec.Header().Get("X-Total-Count"); got != "10" {
+		t.Fatalf("expected X-Total-Count 10, got %q", got)
+	}
+	if len(gotExact) != 2 || gotExact[0] || !gotExact[1] {
+		t.Fatalf("unexpected exact flags: %v", gotExact)
+	}
+
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?limit=2&offset=2&sort=cheapest", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown sort, got %d", rec.Code)
+	}
+
+	// unpaged listing counts what it returns without a count query
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/products/list", nil))
+	if got := rec.Header().Get("X-Total-Count"); got != "3" {
+		t.Fatalf("expected X-Total-Count 3, got %q", got)
+	}
+	if len(gotExact) != 2 {
+		t.Fatalf("unpaged list should not count, got %v", gotExact)
+	}
+
+	// bad limit
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?limit=abc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad limit, got %d", rec.Code)
+	}
+}
+
+func TestReturnOrderItemHandler(t *testing.T) {
+	svc := &fakeService{
+		ReturnItemFn: func(orderID int64, userID string, productID int64, qty int, restock bool) error {
+			switch {
+			case orderID == 404:
+				return sql.ErrNoRows
+			case userID != "u1":
+				return fmt.Errorf("%w: order %d belongs to another user", service.ErrForbidden, orderID)
+			case qty > 2:
+				return store.ErrReturnExceedsOrdered
+			case orderID != 7 || productID != 3 || !restock:
+				return errors.New("unexpected args")
+			}
+			return nil
+		},
+	}
+	post := func(path, body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	}
+
+	if rec := post("/orders/7/return", `{"user_id":"u1","product_id":3,"quantity":1,"restock":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post("/orders/7/return", `{"user_id":"u1","product_id":3,"quantity":5,"restock":true}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for over-quantity, got %d", rec.Code)
+	}
+	if rec := post("/orders/7/return", `{"user_id":"u2","product_id":3,"quantity":1,"restock":true}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user's order, got %d", rec.Code)
+	}
+	if rec := post("/orders/7/return", `{"product_id":3,"quantity":1}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without user_id, got %d", rec.Code)
+	}
+	if rec := post("/orders/404/return", `{"user_id":"u1","product_id":3,"quantity":1}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+	if rec := post("/orders/abc/return", `{"user_id":"u1","product_id":3,"quantity":1}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad id, got %d", rec.Code)
+	}
+}
+
+func TestReturnOrderItem_BearerToken(t *testing.T) {
+	returned := false
+	svc := &fakeService{ReturnItemFn: func(orderID int64, userID string, productID int64, qty int, restock bool) error {
+		if userID != "u1" {
+			return fmt.Errorf("%w: order %d belongs to another user", service.ErrForbidden, orderID)
+		}
+		returned = true
+		return nil
+	}}
+	secret := []byte("s3cret")
+	h := NewHandler(svc)
+	h.JWTSecret = secret
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	call := func(body, userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/orders/7/return", strings.NewReader(body))
+		if userID != "" {
+			tok, _ := SignToken(secret, userID, time.Hour, time.Now())
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// no token: refused before the order is touched, even naming its owner
+	if rec := call(`{"user_id":"u1","product_id":3,"quantity":1,"restock":true}`, ""); rec.Code != http.StatusUnauthorized || returned {
+		t.Fatalf("want 401 without returning, got %d", rec.Code)
+	}
+	// another user's token: the order isn't theirs
+	if rec := call(`{"product_id":3,"quantity":1,"restock":true}`, "u2"); rec.Code != http.StatusForbidden || returned {
+		t.Fatalf("want 403 for another user's order, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := call(`{"product_id":3,"quantity":1,"restock":true}`, "u1"); rec.Code != http.StatusOK || !returned {
+		t.Fatalf("want 200 for the owner, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestOutboxAdminHandlers(t *testing.T) {
+	var gotStatus string
+	svc := &fakeService{
+		ListOutboxFn: func(status string) ([]service.OutboxEventDTO, error) {
+			gotStatus = status
+			return []service.OutboxEventDTO{{ID: 4, Status: status}}, nil
+		},
+		ReplayOutboxFn: func(id int64) (service.OutboxEventDTO, error) {
+			switch id {
+			case 4:
+				return service.OutboxEventDTO{ID: 4, Status: "failed"}, nil
+			case 5:
+				return service.OutboxEventDTO{}, service.ErrOutboxAlreadyPending
+			}
+			return service.OutboxEventDTO{}, sql.ErrNoRows
+		},
+	}
+
+	// default listing is failed events
+	rec := serveAdmin(svc, httptest.NewRequest(http.MethodGet, "/admin/outbox", nil))
+	if rec.Code != http.StatusOK || gotStatus != "failed" {
+		t.Fatalf("expected 200 listing failed events, got %d status=%q", rec.Code, gotStatus)
+	}
+
+	rec = serveAdmin(svc, httptest.NewRequest(http.MethodPost, "/admin/outbox/4/replay", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := decodeBody(t, rec); body["status"] != "requeued" {
+		t.Fatalf("unexpected body: %v", body)
+	}
+	if rec := serveAdmin(svc, httptest.NewRequest(http.MethodPost, "/admin/outbox/5/replay", nil)); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for pending event, got %d", rec.Code)
+	}
+	if rec := serveAdmin(svc, httptest.NewRequest(http.MethodPost, "/admin/outbox/6/replay", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestListProductsTagFilter(t *testing.T) {
+	var got []string
+	svc := &fakeService{
+		ListByTagsFn: func(tags []string) ([]service.ProductDTO, error) {
+			got = tags
+			return []service.ProductDTO{{ID: 1, Tags: []string{"new", "on-sale"}}}, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?tag=on-sale&tag=new", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(got) != 2 || got[0] != "on-sale" || got[1] != "new" {
+		t.Fatalf("expected both tags passed through, got %v", got)
+	}
+	if rec.Header().Get("X-Total-Count") != "1" {
+		t.Fatalf("unexpected X-Total-Count %q", rec.Header().Get("X-Total-Count"))
+	}
+}
+
+func TestListProductsCategoryFilter(t *testing.T) {
+	var got string
+	svc := &fakeService{
+		ListByCategoryFn: func(category string) ([]service.ProductDTO, error) {
+			got = category
+			if category != "electronics" {
+				return []service.ProductDTO{}, nil
+			}
+			return []service.ProductDTO{{ID: 1, Category: "electronics"}}, nil
+		},
+		ListProductsFn: func(sort string) ([]service.ProductDTO, error) {
+			return []service.ProductDTO{{ID: 1, Category: "electronics"}, {ID: 2}}, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?category=electronics", nil))
+	if rec.Code != http.StatusOK || got != "electronics" {
+		t.Fatalf("expected 200 with the category passed through, got %d %q: %s", rec.Code, got, rec.Body.String())
+	}
+	var ps []service.ProductDTO
+	if err := json.Unmarshal(rec.Body.Bytes(), &ps); err != nil || len(ps) != 1 || ps[0].Category != "electronics" {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/products/list?category=garden", nil))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" || rec.Header().Get("X-Total-Count") != "0" {
+		t.Fatalf("expected an empty list for an unknown category, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// without a category the whole catalogue is listed as before
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/products/list", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &ps); err != nil || len(ps) != 2 {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+}
+
+func TestCheckoutConcurrencyLimit(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	svc := &fakeService{
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (service.OrderDTO, error) {
+			entered <- struct{}{}
+			<-release
+			return service.OrderDTO{ID: 1, UserID: userID}, nil
+		},
+	}
+	h := NewHandler(svc)
+	h.MaxConcurrentCheckouts = 1
+	h.CheckoutQueueTimeout = 50 * time.Millisecond
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	checkout := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checkout/order", strings.NewReader(`{"user_id":"u1"}`)))
+		return rec
+	}
+
+	// first checkout takes the only slot and blocks
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- checkout() }()
+	<-entered
+
+	// excess request times out in the queue -> 503 + Retry-After
+	rec := checkout()
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while saturated, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+
+	// a queued request succeeds once the slot frees up within the timeout
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() { queued <- checkout() }()
+	time.Sleep(10 * time.Millisecond)
+	release <- struct{}{}
+	if rec := <-first; rec.Code != http.StatusCreated {
+		t.Fatalf("expected first checkout 201, got %d", rec.Code)
+	}
+	<-entered
+	release <- struct{}{}
+	if rec := <-queued; rec.Code != http.StatusCreated {
+		t.Fatalf("expected queued checkout 201, got %d", rec.Code)
+	}
+}
+
+func TestGetPricesHandler(t *testing.T) {
+	// real service over a fake store so the cap is exercised end to end
+	fs := &pricesStore{prices: map[int64]money.Cents{1: 999, 3: 450}}
+	svc := service.NewService(fs)
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest(http.MethodPost, "/products/prices", strings.NewReader(body)))
+	}
+
+	// unknown id 2 is omitted
+	rec := post(`{"ids":[1,2,3]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var got map[string]float64
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(got) != 2 || got["1"] != 9.99 || got["3"] != 4.5 {
+		t.Fatalf("unexpected prices: %v", got)
+	}
+
+	// over the cap
+	ids := make([]string, service.MaxPriceLookupIDs+1)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+	}
+	if rec := post(`{"ids":[` + strings.Join(ids, ",") + `]}`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 over the cap, got %d", rec.Code)
+	}
+	if fs.calls != 1 {
+		t.Fatalf("expected store hit once, got %d", fs.calls)
+	}
+
+	if rec := post(`{"ids":[]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for empty ids, got %d", rec.Code)
+	}
+}
+
+// pricesStore is a store.Store that only answers GetPrices
+type pricesStore struct {
+	store.Store
+	prices map[int64]money.Cents
+	calls  int
+}
+
+func (p *pricesStore) GetPrices(ctx context.Context, ids []int64) (map[int64]money.Cents, error) {
+	p.calls++
+	out := map[int64]money.Cents{}
+	for _, id := range ids {
+		if v, ok := p.prices[id]; ok {
+			out[id] = v
+		}
+	}
+	return out, nil
+}
+
+func TestAddToCart_OutsideAvailabilityWindow(t *testing.T) {
+	for _, want := range []error{store.ErrNotAvailableYet, store.ErrNoLongerAvailable} {
+		svc := &fakeService{AddToCartFn: func(string, int64, int) error { return want }}
+		req := httptest.NewRequest("POST", "/cart/add", strings.NewReader(`{"user_id":"u1","product_id":1,"quantity":1}`))
+		rec := serve(svc, req)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%v: want 422, got %d", want, rec.Code)
+		}
+	}
+}
+
+func TestListProducts_AvailableNow(t *testing.T) {
+	svc := &fakeService{
+		ListAvailableFn: func() ([]service.ProductDTO, error) {
+			return []service.ProductDTO{{ID: 2, Name: "b"}}, nil
+		},
+	}
+	req := httptest.NewRequest("GET", "/products/list?available_now=true", nil)
+	rec := serve(svc, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var got []service.ProductDTO
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || len(got) != 1 || got[0].ID != 2 {
+		t.Fatalf("unexpected body: %s", rec.Body.String())
+	}
+}
+
+func TestSetAvailability_Handler(t *testing.T) {
+	var gotFrom, gotUntil *time.Time
+	svc := &fakeService{
+		SetAvailabilityFn: func(id int64, from, until *time.Time) error {
+			if id == 404 {
+				return sql.ErrNoRows
+			}
+			gotFrom, gotUntil = from, until
+			return nil
+		},
+	}
+	req := httptest.NewRequest("PUT", "/products/1/availability", strings.NewReader(`{"available_from":"2030-01-01T00:00:00Z"}`))
+	rec := serve(svc, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	if gotFrom == nil || gotFrom.Year() != 2030 || gotUntil != nil {
+		t.Fatalf("unexpected window: %v %v", gotFrom, gotUntil)
+	}
+
+	req = httptest.NewRequest("PUT", "/products/404/availability", strings.NewReader(`{}`))
+	if rec := serve(svc, req); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+}
+
+func TestSchemaValidation_RejectsViolations(t *testing.T) {
+	called := false
+	svc := &fakeService{AddToCartFn: func(string, int64, int) error { called = true; return nil }}
+	req := httptest.NewRequest("POST", "/cart/add", strings.NewReader(`{"user_id":"","product_id":1.5,"quantity":0}`))
+	rec := serve(svc, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", rec.Code)
+	}
+	if called {
+		t.Fatal("handler should not run for an invalid body")
+	}
+	var body struct {
+		Violations []string `json:"violations"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := []string{
+		"product_id: must be integer",
+		"quantity: must be >= 1",
+		"user_id: must be at least 1 characters",
+	}
+	if strings.Join(body.Violations, "|") != strings.Join(want, "|") {
+		t.Fatalf("want %v, got %v", want, body.Violations)
+	}
+
+	req = httptest.NewRequest("POST", "/products", strings.NewReader(`{"price":"free"}`))
+	rec = serve(&fakeService{}, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "name: is required") ||
+		!strings.Contains(rec.Body.String(), "price: must be number") {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/checkout/order", strings.NewReader(`{"user_id":"u1","metadata":{"n":1}}`))
+	rec = serve(&fakeService{}, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "metadata.n: must be string") {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSchemaValidation_ValidBodyPassesThrough(t *testing.T) {
+	var gotName string
+	var gotPrice money.Cents
+	svc := &fakeService{
+		CreateProductFn: func(name, desc string, price money.Cents, category, currency string) (int64, error) {
+			gotName, gotPrice = name, price
+			return 9, nil
+		},
+	}
+	req := httptest.NewRequest("POST", "/products", strings.NewReader(`{"name":"mug","price":4.5}`))
+	rec := serve(svc, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if gotName != "mug" || gotPrice != 450 {
+		t.Fatalf("handler saw %q %v", gotName, gotPrice)
+	}
+}
+
+func TestCreateProducts_Handler(t *testing.T) {
+	svc := &fakeService{CreateProductsFn: func(products []service.NewProduct) ([]int64, error) {
+		for i, p := range products {
+			if p.Name == "" {
+				return nil, fmt.Errorf("products[%d]: name required", i)
+			}
+		}
+		return []int64{10, 11}, nil
+	}}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/products/bulk", strings.NewReader(body)))
+	}
+	rec := post(`[{"name":"mug","price":4.5},{"name":"tee","price":12,"category":"apparel"}]`)
+	if body := decodeBody(t, rec); rec.Code != http.StatusCreated || fmt.Sprint(body["ids"]) != "[10 11]" {
+		t.Fatalf("want 201 with ids, got %d %v", rec.Code, body)
+	}
+	rec = post(`[{"name":"mug","price":4.5},{"price":12}]`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "products[1]") {
+		t.Fatalf("want 400 naming products[1], got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"name":"mug"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a non-array body, got %d", rec.Code)
+	}
+}
+
+func TestListAllOrders_AdminGated(t *testing.T) {
+	var got store.OrderFilter
+	var gotLimit, gotOffset int
+	svc := &fakeService{
+		ListAllOrdersFn: func(f store.OrderFilter, limit, offset int) ([]service.OrderDTO, int64, error) {
+			got, gotLimit, gotOffset = f, limit, offset
+			return []service.OrderDTO{{ID: 2}, {ID: 1}}, 7, nil
+		},
+	}
+
+	// no token configured / wrong token
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/admin/orders", nil)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without admin token configured, got %d", rec.Code)
+	}
+	r := mux.NewRouter()
+	h := NewHandler(svc)
+	h.AdminToken = testAdminToken
+	h.RegisterRoutes(r)
+	req := httptest.NewRequest(http.MethodGet, "/admin/orders", nil)
+	req.Header.Set(AdminTokenHeader, "wrong")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong token, got %d", rec.Code)
+	}
+
+	rec = serveAdmin(svc, httptest.NewRequest(http.MethodGet,
+		"/admin/orders?status=placed&user_id=u1&from=2025-01-01T00:00:00Z&limit=2&offset=4", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Total-Count") != "7" {
+		t.Fatalf("expected X-Total-Count 7, got %q", rec.Header().Get("X-Total-Count"))
+	}
+	if got.Status != "placed" || got.UserID != "u1" || got.From.Year() != 2025 || !got.To.IsZero() ||
+		gotLimit != 2 || gotOffset != 4 {
+		t.Fatalf("unexpected filter %+v limit=%d offset=%d", got, gotLimit, gotOffset)
+	}
+
+	if rec := serveAdmin(svc, httptest.NewRequest(http.MethodGet, "/admin/orders?from=yesterday", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad from, got %d", rec.Code)
+	}
+}
+
+func TestUnpricedProduct_Rejected(t *testing.T) {
+	svc := &fakeService{
+		AddToCartFn: func(string, int64, int) error { return store.ErrNoPrice },
+		CheckoutFn: func(string, map[string]string, store.CheckoutOptions) (service.OrderDTO, error) {
+			return service.OrderDTO{}, fmt.Errorf("%w: product 4", store.ErrNoPrice)
+		},
+	}
+	req := httptest.NewRequest("POST", "/cart/add", strings.NewReader(`{"user_id":"u1","product_id":4,"quantity":1}`))
+	if rec := serve(svc, req); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("add: want 422, got %d", rec.Code)
+	}
+	req = httptest.NewRequest("POST", "/checkout/order", strings.NewReader(`{"user_id":"u1"}`))
+	if rec := serve(svc, req); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("checkout: want 422, got %d", rec.Code)
+	}
+}
+
+func TestCheckout_RemoveUnavailable(t *testing.T) {
+	var got store.CheckoutOptions
+	svc := &fakeService{
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (service.OrderDTO, error) {
+			got = opts
+			return service.OrderDTO{ID: 9, UserID: userID, Total: 1000, RemovedProductIDs: []int64{2, 3}}, nil
+		},
+	}
+	req := httptest.NewRequest("POST", "/checkout/order", strings.NewReader(`{"user_id":"u1","remove_unavailable":true}`))
+	rec := serve(svc, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !got.RemoveUnavailable {
+		t.Fatalf("remove_unavailable not passed through")
+	}
+	if ids, _ := decodeBody(t, rec)["removed_product_ids"].([]interface{}); len(ids) != 2 || ids[0] != 2.0 {
+		t.Fatalf("unexpected removed ids: %v", ids)
+	}
+
+	// strict by default: unavailable lines fail the checkout
+	svc.CheckoutFn = func(string, map[string]string, store.CheckoutOptions) (service.OrderDTO, error) {
+		return service.OrderDTO{}, fmt.Errorf("%w: product 2", store.ErrItemUnavailable)
+	}
+	req = httptest.NewRequest("POST", "/checkout/order", strings.NewReader(`{"user_id":"u1"}`))
+	if rec := serve(svc, req); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("want 422, got %d", rec.Code)
+	}
+
+	// a cart mixing currencies can't become one order
+	svc.CheckoutFn = func(string, map[string]string, store.CheckoutOptions) (service.OrderDTO, error) {
+		return service.OrderDTO{}, fmt.Errorf("%w: USD and EUR", store.ErrMixedCurrencies)
+	}
+	req = httptest.NewRequest("POST", "/checkout/order", strings.NewReader(`{"user_id":"u1"}`))
+	rec = serve(svc, req)
+	if rec.Code != http.StatusUnprocessableEntity || decodeBody(t, rec)["code"] != string(CodeMixedCurrencies) {
+		t.Fatalf("want 422 %s, got %d: %s", CodeMixedCurrencies, rec.Code, rec.Body.String())
+	}
+}
+
+func TestListCart_Names(t *testing.T) {
+	svc := &fakeService{
+		GetCartFn: func(string) ([]service.CartDTO, money.Cents, []int64, error) {
+			return []service.CartDTO{
+				{ProductID: 1, Quantity: 2, Price: 450, Name: "mug"},
+				{ProductID: 2, Quantity: 1, Price: 2000, Name: "teapot"},
+			}, 2900, nil, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/cart/list?user_id=u1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := decodeBody(t, rec)
+	items, _ := body["items"].([]interface{})
+	if len(items) != 2 || body["total"] != 29.0 {
+		t.Fatalf("unexpected body %v", body)
+	}
+	for i, want := range []string{"mug", "teapot"} {
+		it := items[i].(map[string]interface{})
+		if it["name"] != want || it["product_id"] == nil || it["quantity"] == nil || it["price"] == nil {
+			t.Fatalf("item %d: unexpected %v", i, it)
+		}
+	}
+}
+
+func TestDeletedProductInCart_NotFound(t *testing.T) {
+	svc := &fakeService{
+		GetCartFn: func(string) ([]service.CartDTO, money.Cents, []int64, error) {
+			return nil, 0, nil, fmt.Errorf("%w: product 7", service.ErrProductNotFound)
+		},
+		CheckoutFn: func(string, map[string]string, store.CheckoutOptions) (service.OrderDTO, error) {
+			return service.OrderDTO{}, fmt.Errorf("%w: product 7", service.ErrProductNotFound)
+		},
+	}
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/cart/list?user_id=u1", nil),
+		httptest.NewRequest(http.MethodPost, "/checkout/order", strings.NewReader(`{"user_id":"u1"}`)),
+	} {
+		rec := serve(svc, req)
+		body := decodeBody(t, rec)
+		if rec.Code != http.StatusNotFound || body["code"] != string(CodeProductNotFound) || body["error"] != "product not found: product 7" {
+			t.Fatalf("%s: want 404 PRODUCT_NOT_FOUND for product 7, got %d %v", req.URL.Path, rec.Code, body)
+		}
+	}
+}
+
+func TestCheckout_Coupon(t *testing.T) {
+	var got store.CheckoutOptions
+	svc := &fakeService{
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (service.OrderDTO, error) {
+			got = opts
+			if opts.CouponCode == "OLD" {
+				return service.OrderDTO{}, fmt.Errorf("%w: OLD", store.ErrCouponExpired)
+			}
+			return service.OrderDTO{ID: 9, UserID: userID, Total: 900, Discount: 100, CouponCode: opts.CouponCode}, nil
+		},
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/checkout/order", strings.NewReader(body)))
+	}
+	rec := post(`{"user_id":"u1","coupon_code":"SPRING10"}`)
+	if rec.Code != http.StatusCreated || got.CouponCode != "SPRING10" {
+		t.Fatalf("want 201 with the coupon passed through, got %d %+v: %s", rec.Code, got, rec.Body.String())
+	}
+	if body := decodeBody(t, rec); body["discount"] != 1.0 || body["coupon_code"] != "SPRING10" {
+		t.Fatalf("unexpected body %v", body)
+	}
+
+	rec = post(`{"user_id":"u1","coupon_code":"OLD"}`)
+	if rec.Code != http.StatusUnprocessableEntity || decodeBody(t, rec)["code"] != string(CodeCouponExpired) {
+		t.Fatalf("want 422 COUPON_EXPIRED, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"user_id":"u1","coupon_code":""}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for an empty coupon_code, got %d", rec.Code)
+	}
+}
+
+func TestCheckout_IdempotencyKeyHeader(t *testing.T) {
+	var got store.CheckoutOptions
+	svc := &fakeService{
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (service.OrderDTO, error) {
+			got = opts
+			if opts.IdempotencyKey == "busy" {
+				return service.OrderDTO{}, fmt.Errorf("%w: busy", store.ErrIdempotencyKeyInUse)
+			}
+			return service.OrderDTO{ID: 9, UserID: userID}, nil
+		},
+	}
+	post := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/checkout/order", strings.NewReader(`{"user_id":"u1"}`))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return serve(svc, req)
+	}
+	if rec := post("k1"); rec.Code != http.StatusCreated || got.IdempotencyKey != "k1" {
+		t.Fatalf("want 201 with the key passed through, got %d %+v", rec.Code, got)
+	}
+	if rec := post(""); rec.Code != http.StatusCreated || got.IdempotencyKey != "" {
+		t.Fatalf("want 201 without a key, got %d %+v", rec.Code, got)
+	}
+	rec := post("busy")
+	if rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeIdempotencyKeyInUse) {
+		t.Fatalf("want 409 IDEMPOTENCY_KEY_IN_USE, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCheckout_EmptyCart(t *testing.T) {
+	svc := &fakeService{
+		CheckoutFn: func(string, map[string]string, store.CheckoutOptions) (service.OrderDTO, error) {
+			return service.OrderDTO{}, store.ErrCartEmpty
+		},
+	}
+	req := httptest.NewRequest("POST", "/checkout/order", strings.NewReader(`{"user_id":"u1"}`))
+	rec := serve(svc, req)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("want 422, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := decodeBody(t, rec); body["code"] != string(CodeCartEmpty) || body["error"] != "cart is empty" {
+		t.Fatalf("unexpected body: %v", body)
+	}
+}
+
+func TestExportProducts_RoundTrip(t *testing.T) {
+	price, grams, limit := 9.5, 250, 2
+	from := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	catalog := []service.ProductExportDTO{
+		{ID: 1, Name: "cable", Description: "usb-c", Price: &price, Stock: 40, TrackInventory: true, Published: true,
+			AvailableFrom: &from, WeightGrams: &grams, MaxReservedPerUser: &limit, Tags: []string{"clearance", "usb"}},
+		{ID: 2, Name: "draft", Stock: 0, Tags: []string{}},
+	}
+	svc := &fakeService{ExportFn: func(fn func(service.ProductExportDTO) error) error {
+		for _, p := range catalog {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+
+	rec := serveAdmin(svc, httptest.NewRequest("GET", "/admin/products/export", nil))
+	var got []service.ProductExportDTO
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("want a 200 JSON array, got %d (%v): %s", rec.Code, err, rec.Body.String())
+	}
+	if !reflect.DeepEqual(got, catalog) {
+		t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got, catalog)
+	}
+
+	rec = serveAdmin(svc, httptest.NewRequest("GET", "/admin/products/export?format=jsonl", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	got = nil
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var p service.ProductExportDTO
+		if err := dec.Decode(&p); err != nil {
+			t.Fatalf("bad line: %v", err)
+		}
+		got = append(got, p)
+	}
+	if !reflect.DeepEqual(got, catalog) {
+		t.Fatalf("jsonl round trip mismatch: %+v", got)
+	}
+
+	if rec := serveAdmin(svc, httptest.NewRequest("GET", "/admin/products/export?format=csv", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for an unknown format, got %d", rec.Code)
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/admin/products/export", nil)); rec.Code == http.StatusOK {
+		t.Fatalf("export served without admin credentials")
+	}
+
+	// an empty catalog is still a valid array; a failure before any product
+	// is an ordinary error
+	catalog = nil
+	if rec := serveAdmin(svc, httptest.NewRequest("GET", "/admin/products/export", nil)); strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("want [], got %q", rec.Body.String())
+	}
+	svc.ExportFn = func(func(service.ProductExportDTO) error) error { return errors.New("db down") }
+	if rec := serveAdmin(svc, httptest.NewRequest("GET", "/admin/products/export", nil)); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("want 500, got %d", rec.Code)
+	}
+}
+
+func TestUpdateCartQuantity(t *testing.T) {
+	var got int
+	svc := &fakeService{UpdateQtyFn: func(userID string, productID int64, newQty int) error {
+		if productID != 1 {
+			return sql.ErrNoRows
+		}
+		if newQty > 5 {
+			return store.ErrInsufficientStock
+		}
+		got = newQty
+		return nil
+	}}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/cart/update", strings.NewReader(body)))
+	}
+	if rec := post(`{"user_id":"u1","product_id":1,"quantity":0}`); rec.Code != http.StatusOK || got != 0 {
+		t.Fatalf("want 200 with quantity 0, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"user_id":"u1","product_id":1,"quantity":8}`); rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeInsufficientStock) {
+		t.Fatalf("want 409 INSUFFICIENT_STOCK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"user_id":"u1","product_id":2,"quantity":1}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := post(`{"user_id":"u1","product_id":1,"quantity":-1}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a negative quantity, got %d", rec.Code)
+	}
+}
+
+func TestImportProducts_ArrayOrLines(t *testing.T) {
+	var got []service.ProductExportDTO
+	svc := &fakeService{ImportFn: func(records []service.ProductExportDTO) (service.ImportReport, error) {
+		got = records
+		return service.ImportReport{Created: 1, Updated: 1, Errors: []service.ImportError{}}, nil
+	}}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serveAdmin(svc, httptest.NewRequest("POST", "/admin/products/import-catalog", strings.NewReader(body)))
+	}
+	for _, body := range []string{
+		`[{"id":1,"name":"cable","tags":["usb"]},{"name":"mat"}]`,
+		"\n{\"id\":1,\"name\":\"cable\",\"tags\":[\"usb\"]}\n{\"name\":\"mat\"}\n",
+	} {
+		rec := post(body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if len(got) != 2 || got[0].ID != 1 || got[0].Tags[0] != "usb" || got[1].Name != "mat" {
+			t.Fatalf("unexpected records from %q: %+v", body, got)
+		}
+		if b := decodeBody(t, rec); b["created"] != 1.0 || b["updated"] != 1.0 || b["skipped"] != 0.0 {
+			t.Fatalf("unexpected report: %v", b)
+		}
+	}
+	for _, body := range []string{"", "[{", "{\"id\":1}\n{"} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("want 400 for %q, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestRemoveFromCart_NotInCart(t *testing.T) {
+	svc := &fakeService{RemoveFromCartFn: func(userID string, productID int64) error {
+		if productID == 5 {
+			return sql.ErrNoRows
+		}
+		return nil
+	}}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/cart/remove", strings.NewReader(body)))
+	}
+	rec := post(`{"user_id":"u1","product_id":5}`)
+	if body := decodeBody(t, rec); rec.Code != http.StatusNotFound || body["error"] != "item not in cart" || body["code"] != string(CodeNotFound) {
+		t.Fatalf("want 404 item not in cart, got %d %v", rec.Code, body)
+	}
+	if rec := post(`{"user_id":"u1","product_id":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	// bad input is still a 400
+	if rec := post(`{"user_id":"u1","product_id":0}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for product_id 0, got %d", rec.Code)
+	}
+}
+
+func TestClearCart(t *testing.T) {
+	var cleared string
+	svc := &fakeService{ClearCartFn: func(userID string) error { cleared = userID; return nil }}
+	rec := serve(svc, httptest.NewRequest("POST", "/cart/clear", strings.NewReader(`{"user_id":"u1"}`)))
+	if rec.Code != http.StatusOK || cleared != "u1" || decodeBody(t, rec)["status"] != "cleared" {
+		t.Fatalf("want 200 clearing u1, got %d (%q): %s", rec.Code, cleared, rec.Body.String())
+	}
+	if rec := serve(svc, httptest.NewRequest("POST", "/cart/clear", strings.NewReader(`{}`))); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 without user_id, got %d", rec.Code)
+	}
+}
+
+func TestSetReservationLimit(t *testing.T) {
+	var got *int
+	svc := &fakeService{SetLimitFn: func(id int64, limit *int) error {
+		if id != 4 {
+			return sql.ErrNoRows
+		}
+		got = limit
+		return nil
+	}}
+	put := func(url, body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("PUT", url, strings.NewReader(body)))
+	}
+	if rec := put("/products/4/reservation-limit", `{"max_per_user":2}`); rec.Code != http.StatusOK || got == nil || *got != 2 {
+		t.Fatalf("want 200 with limit 2, got %d %v: %s", rec.Code, got, rec.Body.String())
+	}
+	if rec := put("/products/4/reservation-limit", `{"max_per_user":null}`); rec.Code != http.StatusOK || got != nil {
+		t.Fatalf("want the limit cleared, got %d %v", rec.Code, got)
+	}
+	if rec := put("/products/5/reservation-limit", `{"max_per_user":2}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+}
+
+func TestUpdateStock(t *testing.T) {
+	var gotID int64
+	var gotStock int
+	svc := &fakeService{UpdateStockFn: func(id int64, stock int) error {
+		if id != 4 {
+			return sql.ErrNoRows
+		}
+		gotID, gotStock = id, stock
+		return nil
+	}}
+	r := mux.NewRouter()
+	NewHandler(svc).RegisterRoutes(r)
+	var match mux.RouteMatch
+	if !r.Match(httptest.NewRequest("POST", "/products/stock", nil), &match) || match.MatchErr != nil {
+		t.Fatalf("expected POST /products/stock to be routed")
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/products/stock", strings.NewReader(body)))
+	}
+	if rec := post(`{"product_id":4,"new_stock":40}`); rec.Code != http.StatusOK || gotID != 4 || gotStock != 40 {
+		t.Fatalf("want 200 with stock 40, got %d %d/%d: %s", rec.Code, gotID, gotStock, rec.Body.String())
+	}
+	if rec := post(`{"product_id":5,"new_stock":40}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := post(`{"product_id":4,"new_stock":-1}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for negative stock, got %d", rec.Code)
+	}
+}
+
+func TestUpdateStockBatch(t *testing.T) {
+	var got []store.StockUpdate
+	svc := &fakeService{StockBatchFn: func(updates []store.StockUpdate) error {
+		for _, u := range updates {
+			if u.ProductID == 99 {
+				return fmt.Errorf("%w: products [99]", sql.ErrNoRows)
+			}
+		}
+		got = updates
+		return nil
+	}}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/products/stock/bulk", strings.NewReader(body)))
+	}
+	rec := post(`[{"product_id":1,"new_stock":100},{"product_id":2,"new_stock":40}]`)
+	if rec.Code != http.StatusOK || len(got) != 2 || got[1] != (store.StockUpdate{ProductID: 2, NewStock: 40}) {
+		t.Fatalf("want 200 with both updates, got %d %+v: %s", rec.Code, got, rec.Body.String())
+	}
+	rec = post(`[{"product_id":1,"new_stock":100},{"product_id":99,"new_stock":1}]`)
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "99") {
+		t.Fatalf("want 404 naming product 99, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"product_id":1,"new_stock":100}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a non-array body, got %d", rec.Code)
+	}
+}
+
+func TestAdjustStock(t *testing.T) {
+	var gotDelta int
+	svc := &fakeService{AdjustStockFn: func(id int64, delta int) error {
+		switch {
+		case id != 4:
+			return sql.ErrNoRows
+		case delta < -10:
+			return store.ErrInsufficientStock
+		}
+		gotDelta = delta
+		return nil
+	}}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/products/stock/adjust", strings.NewReader(body)))
+	}
+	if rec := post(`{"product_id":4,"delta":-3}`); rec.Code != http.StatusOK || gotDelta != -3 {
+		t.Fatalf("want 200 with delta -3, got %d %d: %s", rec.Code, gotDelta, rec.Body.String())
+	}
+	if rec := post(`{"product_id":4,"delta":-11}`); rec.Code != http.StatusConflict {
+		t.Fatalf("want 409 for insufficient stock, got %d", rec.Code)
+	}
+	if rec := post(`{"product_id":5,"delta":2}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := post(`{"product_id":4,"delta":0}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for zero delta, got %d", rec.Code)
+	}
+}
+
+func TestResponseEnvelope_ListProducts(t *testing.T) {
+	svc := &fakeService{
+		ListPageFn: func(limit, offset int, sort string) ([]service.ProductDTO, error) {
+			return []service.ProductDTO{{ID: 3, Name: "c"}}, nil
+		},
+		CountProductsFn: func(bool) (int64, error) { return 12, nil },
+	}
+	get := func(mode ResponseMode, url string) *httptest.ResponseRecorder {
+		r := mux.NewRouter()
+		h := NewHandler(svc)
+		h.ResponseMode = mode
+		h.RegisterRoutes(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	// raw (default): bare array, error as a string
+	rec := get(ResponseRaw, "/products/list?limit=1&offset=2")
+	var raw []service.ProductDTO
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil || len(raw) != 1 || raw[0].ID != 3 {
+		t.Fatalf("raw: unexpected body %s", rec.Body.String())
+	}
+	if rec.Header().Get("X-Total-Count") != "12" {
+		t.Fatalf("raw: expected X-Total-Count 12, got %q", rec.Header().Get("X-Total-Count"))
+	}
+	rec = get(ResponseRaw, "/products/list?limit=x")
+	if body := decodeBody(t, rec); body["error"] != "limit must be a positive integer" {
+		t.Fatalf("raw: unexpected error body %v", body)
+	}
+
+	// enveloped: data + pagination meta, structured error
+	rec = get(ResponseEnveloped, "/products/list?limit=1&offset=2")
+	var env struct {
+		Data []service.ProductDTO `json:"data"`
+		Meta listMeta             `json:"meta"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+		t.Fatalf("envelope: decode: %v", err)
+	}
+	if len(env.Data) != 1 || env.Data[0].ID != 3 || env.Meta != (listMeta{Total: 12, Limit: 1, Offset: 2}) {
+		t.Fatalf("envelope: unexpected body %s", rec.Body.String())
+	}
+	if rec.Header().Get("X-Total-Count") != "12" {
+		t.Fatalf("envelope: expected X-Total-Count 12, got %q", rec.Header().Get("X-Total-Count"))
+	}
+	rec = get(ResponseEnveloped, "/products/list?limit=x")
+	var errEnv struct {
+		Error errorBody `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &errEnv); err != nil ||
+		errEnv.Error.Status != http.StatusBadRequest || errEnv.Error.Message != "limit must be a positive integer" {
+		t.Fatalf("envelope: unexpected error body %s", rec.Body.String())
+	}
+}
+
+func TestCreatePurchaseOrder_Handler(t *testing.T) {
+	var gotID int64
+	var gotQty int
+	svc := &fakeService{
+		CreatePOFn: func(productID int64, qty int, expectedAt time.Time) (int64, error) {
+			if productID == 404 {
+				return 0, sql.ErrNoRows
+			}
+			gotID, gotQty = productID, qty
+			return 77, nil
+		},
+	}
+	body := `{"product_id":3,"quantity":50,"expected_at":"2030-03-01T00:00:00Z"}`
+	if rec := serve(svc, httptest.NewRequest(http.MethodPost, "/admin/purchase-orders", strings.NewReader(body))); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without admin token, got %d", rec.Code)
+	}
+	rec := serveAdmin(svc, httptest.NewRequest(http.MethodPost, "/admin/purchase-orders", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated || gotID != 3 || gotQty != 50 {
+		t.Fatalf("unexpected %d %s (id=%d qty=%d)", rec.Code, rec.Body.String(), gotID, gotQty)
+	}
+	body = `{"product_id":404,"quantity":1,"expected_at":"2030-03-01T00:00:00Z"}`
+	if rec := serveAdmin(svc, httptest.NewRequest(http.MethodPost, "/admin/purchase-orders", strings.NewReader(body))); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestCloneProduct_Handler(t *testing.T) {
+	svc := &fakeService{
+		CloneProductFn: func(id int64) (int64, error) {
+			if id == 404 {
+				return 0, sql.ErrNoRows
+			}
+			return id + 100, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest(http.MethodPost, "/products/7/clone", nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	if body := decodeBody(t, rec); body["id"] != float64(107) {
+		t.Fatalf("unexpected body %v", body)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodPost, "/products/404/clone", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestPublishWorkflow_Handler(t *testing.T) {
+	state := map[int64]bool{}
+	svc := &fakeService{
+		SetPublishedFn: func(id int64, published bool) error {
+			if id == 404 {
+				return sql.ErrNoRows
+			}
+			state[id] = published
+			return nil
+		},
+		ListAllProductsFn: func(includeDeleted bool) ([]service.ProductDTO, error) {
+			if includeDeleted {
+				return []service.ProductDTO{{ID: 1}, {ID: 2}, {ID: 3, Deleted: true}}, nil
+			}
+			return []service.ProductDTO{{ID: 1}, {ID: 2}}, nil
+		},
+		AddToCartFn: func(string, int64, int) error { return store.ErrNotPublished },
+	}
+
+	if rec := serve(svc, httptest.NewRequest(http.MethodPost, "/products/3/publish", nil)); rec.Code != http.StatusOK || !state[3] {
+		t.Fatalf("publish: got %d, state=%v", rec.Code, state)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodPost, "/products/3/unpublish", nil)); rec.Code != http.StatusOK || state[3] {
+		t.Fatalf("unpublish: got %d, state=%v", rec.Code, state)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodPost, "/products/404/publish", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+
+	// unpublished products can't be added to a cart
+	req := httptest.NewRequest(http.MethodPost, "/cart/add", strings.NewReader(`{"user_id":"u1","product_id":3,"quantity":1}`))
+	if rec := serve(svc, req); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 adding unpublished product, got %d", rec.Code)
+	}
+
+	// the admin listing shows everything, but only to admins
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/admin/products", nil)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without admin token, got %d", rec.Code)
+	}
+	rec := serveAdmin(svc, httptest.NewRequest(http.MethodGet, "/admin/products", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Total-Count") != "2" {
+		t.Fatalf("unexpected admin listing %d %s", rec.Code, rec.Body.String())
+	}
+	rec = serveAdmin(svc, httptest.NewRequest(http.MethodGet, "/admin/products?include_deleted=true", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Total-Count") != "3" || !strings.Contains(rec.Body.String(), `"deleted":true`) {
+		t.Fatalf("unexpected admin listing with deleted %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRestoreProduct_Handler(t *testing.T) {
+	svc := &fakeService{RestoreProductFn: func(id int64) error {
+		if id == 404 {
+			return sql.ErrNoRows
+		}
+		return nil
+	}}
+	rec := serveAdmin(svc, httptest.NewRequest(http.MethodPost, "/admin/products/4/restore", nil))
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["restored"] != true {
+		t.Fatalf("want 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serveAdmin(svc, httptest.NewRequest(http.MethodPost, "/admin/products/404/restore", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodPost, "/admin/products/4/restore", nil)); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 without admin token, got %d", rec.Code)
+	}
+}
+
+func TestListLowStockProducts_Handler(t *testing.T) {
+	var got int
+	svc := &fakeService{LowStockFn: func(threshold int) ([]service.ProductDTO, error) {
+		got = threshold
+		return []service.ProductDTO{{ID: 4}}, nil
+	}}
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/low-stock?threshold=3", nil))
+	if rec.Code != http.StatusOK || got != 3 || rec.Header().Get("X-Total-Count") != "1" {
+		t.Fatalf("want 200 for threshold 3, got %d threshold=%d", rec.Code, got)
+	}
+	// no threshold: the service default
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/low-stock", nil)); rec.Code != http.StatusOK || got != -1 {
+		t.Fatalf("want the default threshold, got %d threshold=%d", rec.Code, got)
+	}
+	for _, q := range []string{"-1", "lots"} {
+		if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/low-stock?threshold="+q, nil)); rec.Code != http.StatusBadRequest {
+			t.Fatalf("threshold=%s: want 400, got %d", q, rec.Code)
+		}
+	}
+}
+
+func TestGetStock_Handler(t *testing.T) {
+	svc := &fakeService{
+		StockFn: func(productID int64) (int, error) {
+			if productID == 404 {
+				return 0, sql.ErrNoRows
+			}
+			return 42, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/1/stock", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := decodeBody(t, rec); body["product_id"] != 1.0 || body["stock"] != 42.0 {
+		t.Fatalf("unexpected body %v", body)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/404/stock", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/abc/stock", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", rec.Code)
+	}
+}
+
+func TestSalesVelocity_Handler(t *testing.T) {
+	var gotDays int
+	svc := &fakeService{
+		VelocityFn: func(productID int64, days int) (float64, error) {
+			gotDays = days
+			return 2.5, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/4/velocity", nil))
+	if rec.Code != http.StatusOK || gotDays != 30 {
+		t.Fatalf("expected default 30-day window, got %d days=%d", rec.Code, gotDays)
+	}
+	if body := decodeBody(t, rec); body["units_per_day"] != 2.5 {
+		t.Fatalf("unexpected body %v", body)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/4/velocity?days=7", nil)); rec.Code != http.StatusOK || gotDays != 7 {
+		t.Fatalf("expected days=7, got %d days=%d", rec.Code, gotDays)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/products/4/velocity?days=week", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestErrorCodes_SentinelMapping(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{store.ErrInsufficientStock, http.StatusConflict, CodeInsufficientStock},
+		{store.ErrQuantityOutOfRange, http.StatusUnprocessableEntity, CodeQuantityOutOfRange},
+		{store.ErrNoPrice, http.StatusUnprocessableEntity, CodeNoPrice},
+		{store.ErrNotPublished, http.StatusUnprocessableEntity, CodeNotPublished},
+		{store.ErrNotAvailableYet, http.StatusUnprocessableEntity, CodeNotAvailableYet},
+		{store.ErrNoLongerAvailable, http.StatusUnprocessableEntity, CodeNoLongerAvailable},
+		{store.ErrUntrackedInventory, http.StatusConflict, CodeUntrackedInventory},
+		{store.ErrReturnExceedsOrdered, http.StatusUnprocessableEntity, CodeReturnExceedsOrdered},
+		{store.ErrCartEmpty, http.StatusUnprocessableEntity, CodeCartEmpty},
+		{service.ErrTooManyIDs, http.StatusBadRequest, CodeTooManyIDs},
+		{service.ErrUnknownShippingZone, http.StatusBadRequest, CodeUnknownShippingZone},
+		{service.ErrMetadataTooLarge, http.StatusBadRequest, CodeMetadataTooLarge},
+		{service.ErrOutboxAlreadyPending, http.StatusConflict, CodeOutboxAlreadyPending},
+		{sql.ErrNoRows, http.StatusNotFound, CodeNotFound},
+		// wrapped sentinels still match; unknown errors take the fallback
+		{fmt.Errorf("%w: product 4", store.ErrNoPrice), http.StatusUnprocessableEntity, CodeNoPrice},
+		{errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		writeServiceErr(rec, tc.err, http.StatusInternalServerError)
+		if rec.Code != tc.status {
+			t.Errorf("%v: want status %d, got %d", tc.err, tc.status, rec.Code)
+		}
+		if body := decodeBody(t, rec); body["code"] != string(tc.code) || body["error"] != tc.err.Error() {
+			t.Errorf("%v: want code %s, got %v", tc.err, tc.code, body)
+		}
+	}
+}
+
+func TestAddToCart_OutOfStockIsConflict(t *testing.T) {
+	svc := &fakeService{AddToCartFn: func(string, int64, int) error {
+		return fmt.Errorf("%w: product 1", store.ErrInsufficientStock)
+	}}
+	add := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest(http.MethodPost, "/cart/add", strings.NewReader(body)))
+	}
+
+	rec := add(`{"user_id":"u1","product_id":1,"quantity":3}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("want 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := decodeBody(t, rec)
+	if body["code"] != string(CodeInsufficientStock) || body["error"] != "insufficient stock: product 1" {
+		t.Fatalf("unexpected body %v", body)
+	}
+
+	// a request that fails validation is still a 400
+	if rec := add(`{"user_id":"u1","product_id":1,"quantity":0}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a zero quantity, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestErrorCodes_OnEndpoints(t *testing.T) {
+	svc := &fakeService{AddToCartFn: func(string, int64, int) error { return store.ErrInsufficientStock }}
+	req := httptest.NewRequest(http.MethodPost, "/cart/add", strings.NewReader(`{"user_id":"u1","product_id":1,"quantity":1}`))
+	rec := serve(svc, req)
+	if body := decodeBody(t, rec); body["code"] != string(CodeInsufficientStock) {
+		t.Fatalf("unexpected body %v", body)
+	}
+
+	// handler-level validation and gating errors carry generic codes
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/cart/list", nil))
+	if body := decodeBody(t, rec); rec.Code != http.StatusBadRequest || body["code"] != string(CodeBadRequest) {
+		t.Fatalf("unexpected %d %v", rec.Code, body)
+	}
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/admin/orders", nil))
+	if body := decodeBody(t, rec); body["code"] != string(CodeForbidden) {
+		t.Fatalf("unexpected body %v", body)
+	}
+	rec = serve(svc, httptest.NewRequest(http.MethodPost, "/cart/add", strings.NewReader(`{}`)))
+	if body := decodeBody(t, rec); body["code"] != string(CodeValidation) {
+		t.Fatalf("unexpected body %v", body)
+	}
+}
+
+func TestLatencyBudget_OverBudget(t *testing.T) {
+	var logs bytes.Buffer
+	r := mux.NewRouter()
+	r.Use(latencyBudget(map[string]time.Duration{
+		"/slow/{id}": 5 * time.Millisecond,
+		"/fast":      time.Second,
+	}, log.New(&logs, "", 0)))
+	r.HandleFunc("/slow/{id}", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})
+	r.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {})
+
+	count := func(route string) int64 {
+		if v, ok := overBudget.Get(route).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count("/slow/{id}")
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	if logs.Len() != 0 || count("/fast") != 0 {
+		t.Fatalf("fast request flagged: %q", logs.String())
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow/7", nil))
+	if got := count("/slow/{id}"); got != before+1 {
+		t.Fatalf("expected over-budget count %d, got %d", before+1, got)
+	}
+	line := logs.String()
+	for _, want := range []string{"over latency budget", "route=/slow/{id}", "duration=", "budget=5ms"} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("warning %q missing %q", line, want)
+		}
+	}
+}
+
+func TestParseLatencyBudgets(t *testing.T) {
+	got, err := ParseLatencyBudgets("/checkout/order=500ms, /products/list=200ms")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["/checkout/order"] != 500*time.Millisecond || got["/products/list"] != 200*time.Millisecond {
+		t.Fatalf("unexpected budgets: %v", got)
+	}
+	for _, bad := range []string{"/checkout/order", "/checkout/order=soon", "=1s", "/x=-1s"} {
+		if _, err := ParseLatencyBudgets(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestRestoreOrderToCart_Handler(t *testing.T) {
+	svc := &fakeService{
+		RestoreOrderFn: func(userID string, orderID int64) ([]service.CartDTO, []int64, error) {
+			switch orderID {
+			case 5:
+				return []service.CartDTO{{ProductID: 1, Quantity: 2}}, []int64{2}, nil
+			case 6:
+				return nil, nil, fmt.Errorf("%w: order 6 is placed", service.ErrOrderNotCancelled)
+			}
+			return nil, nil, sql.ErrNoRows
+		},
+	}
+	post := func(id string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/orders/"+id+"/restore-to-cart", strings.NewReader(`{"user_id":"u1"}`)))
+	}
+
+	rec := post("5")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := decodeBody(t, rec)
+	if restored, _ := body["restored"].([]interface{}); len(restored) != 1 {
+		t.Fatalf("unexpected restored: %v", body)
+	}
+	if oos, _ := body["out_of_stock"].([]interface{}); len(oos) != 1 || oos[0] != 2.0 {
+		t.Fatalf("unexpected out_of_stock: %v", body)
+	}
+	if rec := post("6"); rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeOrderNotCancelled) {
+		t.Fatalf("want 409 ORDER_NOT_CANCELLED, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post("7"); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := post("x"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for bad id, got %d", rec.Code)
+	}
+}
+
+func TestListReviews_Handler(t *testing.T) {
+	var got store.ReviewQuery
+	svc := &fakeService{
+		ListReviewsFn: func(productID int64, q store.ReviewQuery) ([]service.ReviewDTO, int64, error) {
+			got = q
+			return []service.ReviewDTO{{ID: 1, ProductID: productID, Rating: 5}}, 7, nil
+		},
+		ReviewSummaryFn: func(productID int64) (service.ReviewSummaryDTO, error) {
+			return service.ReviewSummaryDTO{ProductID: productID, Counts: map[int]int64{1: 0, 2: 0, 3: 0, 4: 2, 5: 5}, Total: 7}, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest("GET", "/products/3/reviews?sort=lowest&min_rating=2&limit=5&offset=5", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Total-Count") != "7" {
+		t.Fatalf("want 200 with total 7, got %d %q", rec.Code, rec.Header().Get("X-Total-Count"))
+	}
+	if got != (store.ReviewQuery{Sort: "lowest", MinRating: 2, Limit: 5, Offset: 5}) {
+		t.Fatalf("unexpected query: %+v", got)
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/products/3/reviews", nil)); rec.Code != http.StatusOK || got.Limit != 20 {
+		t.Fatalf("expected default limit 20, got %d %+v", rec.Code, got)
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/products/3/reviews?min_rating=high", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", rec.Code)
+	}
+
+	rec = serve(svc, httptest.NewRequest("GET", "/products/3/reviews/summary", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	if counts, _ := decodeBody(t, rec)["counts"].(map[string]interface{}); counts["5"] != 5.0 || len(counts) != 5 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+}
+
+func TestSearchProducts_Handler(t *testing.T) {
+	svc := &fakeService{
+		SearchFn: func(q string) ([]service.ProductDTO, error) {
+			return []service.ProductDTO{{ID: 1, Name: "USB " + q, Stock: 12}, {ID: 2, Name: "HDMI " + q}}, nil
+		},
+	}
+	// stock is reported with or without include_stock, out of stock as 0
+	for _, target := range []string{"/products/search?q=cable&include_stock=true", "/products/search?q=cable"} {
+		rec := serve(svc, httptest.NewRequest("GET", target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: want 200, got %d", target, rec.Code)
+		}
+		var ps []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &ps); err != nil || len(ps) != 2 || ps[0]["stock"] != 12.0 || ps[1]["stock"] != 0.0 {
+			t.Fatalf("%s: unexpected body %s (%v)", target, rec.Body.String(), err)
+		}
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/products/search?q=cable&include_stock=maybe", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", rec.Code)
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	keys := map[string]APIKeyIdentity{
+		"k-billing": {Service: "billing", Role: "reader"},
+		"k-ops":     {Service: "ops", Role: RoleAdmin},
+	}
+	var got APIKeyIdentity
+	h := requireAPIKey(keys, "", func(w http.ResponseWriter, r *http.Request) {
+		got, _ = APIKeyFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})
+	call := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	if rec := call("k-billing"); rec.Code != http.StatusNoContent || got.Service != "billing" || got.Role != "reader" {
+		t.Fatalf("valid key: got %d %+v", rec.Code, got)
+	}
+	for _, bad := range []string{"", "k-nope", "k-billin", "k-billing "} {
+		rec := call(bad)
+		if rec.Code != http.StatusUnauthorized || decodeBody(t, rec)["code"] != string(CodeUnauthorized) {
+			t.Fatalf("key %q: want 401 UNAUTHORIZED, got %d %s", bad, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAPIKeyAuth_ComparesEveryKey(t *testing.T) {
+	keys := map[string]APIKeyIdentity{"a": {"s1", "r"}, "bb": {"s2", "r"}, "ccc": {"s3", "r"}}
+	orig := constantTimeEqual
+	defer func() { constantTimeEqual = orig }()
+	var calls int
+	var lens []int
+	constantTimeEqual = func(a, b []byte) bool {
+		calls++
+		lens = append(lens, len(a), len(b))
+		return orig(a, b)
+	}
+
+	for _, key := range []string{"a", "zzzz"} {
+		calls, lens = 0, nil
+		id, ok := matchAPIKey(keys, key)
+		if ok != (key == "a") || (ok && id.Service != "s1") {
+			t.Fatalf("key %q: unexpected match %+v %v", key, id, ok)
+		}
+		// no short-circuit on a match, and lengths never differ
+		if calls != len(keys) {
+			t.Fatalf("key %q: expected %d comparisons, got %d", key, len(keys), calls)
+		}
+		for _, n := range lens {
+			if n != lens[0] {
+				t.Fatalf("key %q: compared values of different lengths %v", key, lens)
+			}
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Now()
+	tok, err := SignToken(secret, "u1", time.Hour, now)
+	if err != nil {
+		t.Fatalf("SignToken: %v", err)
+	}
+	if sub, err := parseToken(secret, tok, now); err != nil || sub != "u1" {
+		t.Fatalf("valid token: got %q %v", sub, err)
+	}
+	if _, err := parseToken(secret, tok, now.Add(time.Hour)); err != errTokenExpired {
+		t.Fatalf("want errTokenExpired, got %v", err)
+	}
+	if _, err := parseToken([]byte("other"), tok, now); err != errBadSignature {
+		t.Fatalf("want errBadSignature, got %v", err)
+	}
+
+	// a re-signed payload for another user, or an unsigned "none" token
+	parts := strings.Split(tok, ".")
+	other, _ := SignToken(secret, "u2", time.Hour, now)
+	forged := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+	if _, err := parseToken(secret, forged, now); err != errBadSignature {
+		t.Fatalf("swapped payload: want errBadSignature, got %v", err)
+	}
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	for _, bad := range []string{"", "a.b", none + "." + parts[1] + ".", tok + ".x"} {
+		if _, err := parseToken(secret, bad, now); err != errMalformedToken {
+			t.Fatalf("token %q: want errMalformedToken, got %v", bad, err)
+		}
+	}
+}
+
+func TestUserRoutes_BearerToken(t *testing.T) {
+	var added, listed string
+	svc := &fakeService{
+		AddToCartFn: func(userID string, productID int64, qty int) error { added = userID; return nil },
+		OrderHistoryFn: func(userID string) ([]service.OrderDTO, error) {
+			listed = userID
+			return []service.OrderDTO{}, nil
+		},
+	}
+	secret := []byte("s3cret")
+	h := NewHandler(svc)
+	h.JWTSecret = secret
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	tok, _ := SignToken(secret, "u1", time.Hour, time.Now())
+	call := func(method, target, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, token := range []string{"", "garbage"} {
+		rec := call("POST", "/cart/add", `{"user_id":"u1","product_id":1,"quantity":1}`, token)
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" || added != "" {
+			t.Fatalf("token %q: want 401 without adding, got %d", token, rec.Code)
+		}
+	}
+	// the token names the user; the body needn't, and mustn't name another
+	if rec := call("POST", "/cart/add", `{"product_id":1,"quantity":1}`, tok); rec.Code != http.StatusOK || added != "u1" {
+		t.Fatalf("want 200 adding for u1, got %d (%q): %s", rec.Code, added, rec.Body.String())
+	}
+	added = ""
+	if rec := call("POST", "/cart/add", `{"user_id":"u2","product_id":1,"quantity":1}`, tok); rec.Code != http.StatusForbidden || added != "" {
+		t.Fatalf("want 403 for another user's cart, got %d", rec.Code)
+	}
+	if rec := call("GET", "/orders/list", "", tok); rec.Code != http.StatusOK || listed != "u1" {
+		t.Fatalf("want 200 listing u1's orders, got %d (%q)", rec.Code, listed)
+	}
+	if rec := call("GET", "/orders/list?user_id=u2", "", tok); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 for another user's orders, got %d", rec.Code)
+	}
+	// public routes stay open
+	if rec := call("GET", "/livez", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("want 200 from /livez, got %d", rec.Code)
+	}
+	// and the login stub is off unless enabled
+	if rec := call("POST", "/auth/login", `{"user_id":"u1"}`, ""); rec.Code != http.StatusNotFound && rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("want /auth/login unregistered, got %d", rec.Code)
+	}
+}
+
+func TestLoginStub(t *testing.T) {
+	var listed string
+	svc := &fakeService{OrderHistoryFn: func(userID string) ([]service.OrderDTO, error) {
+		listed = userID
+		return []service.OrderDTO{}, nil
+	}}
+	h := NewHandler(svc)
+	h.JWTSecret = []byte("s3cret")
+	h.EnableLoginStub = true
+	h.TokenTTL = time.Minute
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"user_id":"u7"}`)))
+	body := decodeBody(t, rec)
+	token, _ := body["access_token"].(string)
+	if rec.Code != http.StatusOK || token == "" || body["token_type"] != "Bearer" || body["expires_in"] != 60.0 {
+		t.Fatalf("want 200 with a token, got %d %v", rec.Code, body)
+	}
+
+	req := httptest.NewRequest("GET", "/orders/list", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || listed != "u7" {
+		t.Fatalf("want the issued token to act for u7, got %d (%q)", rec.Code, listed)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 without user_id, got %d", rec.Code)
+	}
+}
+
+func TestRateLimit_ExhaustsBucket(t *testing.T) {
+	added := 0
+	svc := &fakeService{AddToCartFn: func(string, int64, int) error { added++; return nil }}
+	h := NewHandler(svc)
+	h.RateLimit = RateLimit{RPS: 0.5, Burst: 2}
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	add := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/cart/add", strings.NewReader(`{"user_id":"u1","product_id":1,"quantity":1}`))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := add("10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: want 200, got %d", i, rec.Code)
+		}
+	}
+	rec := add("10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests || decodeBody(t, rec)["code"] != string(CodeRateLimited) {
+		t.Fatalf("want 429 RATE_LIMITED, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ra := rec.Header().Get("Retry-After"); ra != "2" {
+		t.Fatalf("want Retry-After 2, got %q", ra)
+	}
+	if added != 2 {
+		t.Fatalf("the refused request reached the service: %d adds", added)
+	}
+	// another client has its own bucket, and unlimited routes aren't counted
+	if rec := add("10.0.0.2:1234"); rec.Code != http.StatusOK {
+		t.Fatalf("other IP: want 200, got %d", rec.Code)
+	}
+	req := httptest.NewRequest("GET", "/livez", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/livez: want 200, got %d", rec.Code)
+	}
+}
+
+func TestRateLimit_KeyedByTokenUser(t *testing.T) {
+	svc := &fakeService{AddToCartFn: func(string, int64, int) error { return nil }}
+	secret := []byte("s3cret")
+	h := NewHandler(svc)
+	h.JWTSecret = secret
+	h.RateLimit = RateLimit{RPS: 0.1, Burst: 1}
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	add := func(userID, remote string) int {
+		tok, _ := SignToken(secret, userID, time.Hour, time.Now())
+		req := httptest.NewRequest("POST", "/cart/add", strings.NewReader(`{"product_id":1,"quantity":1}`))
+		req.Header.Set("Authorization", "Bearer "+tok)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// same user from two IPs shares a bucket; two users behind one IP don't
+	if code := add("u1", "10.0.0.1:1"); code != http.StatusOK {
+		t.Fatalf("want 200, got %d", code)
+	}
+	if code := add("u1", "10.0.0.9:1"); code != http.StatusTooManyRequests {
+		t.Fatalf("want 429 for u1 from another IP, got %d", code)
+	}
+	if code := add("u2", "10.0.0.1:1"); code != http.StatusOK {
+		t.Fatalf("want 200 for u2, got %d", code)
+	}
+}
+
+func TestRateLimiter_EvictsIdleClients(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(RateLimit{RPS: 1, Burst: 1})
+	l.now = func() time.Time { return now }
+	for _, key := range []string{"a", "b", "c"} {
+		l.reserve(key)
+	}
+	now = now.Add(l.idle / 2)
+	l.reserve("a")
+	now = now.Add(l.idle / 2)
+	l.reserve("d")
+	if _, ok := l.clients["b"]; ok || len(l.clients) != 2 {
+		t.Fatalf("want only a and d kept, got %d clients", len(l.clients))
+	}
+}
+
+func TestAdminRoutes_APIKey(t *testing.T) {
+	svc := &fakeService{
+		ListAllProductsFn: func(bool) ([]service.ProductDTO, error) { return nil, nil },
+	}
+	h := NewHandler(svc)
+	h.APIKeys = map[string]APIKeyIdentity{
+		"k-ops":     {Service: "ops", Role: RoleAdmin},
+		"k-billing": {Service: "billing", Role: "reader"},
+	}
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	call := func(key string) int {
+		req := httptest.NewRequest("GET", "/admin/products", nil)
+		req.Header.Set(APIKeyHeader, key)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := call("k-ops"); code != http.StatusOK {
+		t.Fatalf("admin key: want 200, got %d", code)
+	}
+	if code := call("k-billing"); code != http.StatusForbidden {
+		t.Fatalf("non-admin key: want 403, got %d", code)
+	}
+	if code := call("k-unknown"); code != http.StatusUnauthorized {
+		t.Fatalf("unknown key: want 401, got %d", code)
+	}
+}
+
+func TestCheckoutAndPay_Handler(t *testing.T) {
+	svc := &fakeService{PayFn: func(userID string, meta map[string]string, opts store.CheckoutOptions, token string) (service.OrderDTO, error) {
+		switch token {
+		case "tok_ok":
+			return service.OrderDTO{ID: 7, UserID: userID, Status: store.OrderStatusPaid, ChargeID: "ch_1"}, nil
+		case "tok_slow":
+			return service.OrderDTO{}, fmt.Errorf("%w after 30s", service.ErrPaymentTimeout)
+		}
+		return service.OrderDTO{}, fmt.Errorf("%w: insufficient funds", service.ErrPaymentDeclined)
+	}}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/checkout/pay", strings.NewReader(body)))
+	}
+	rec := post(`{"user_id":"u1","payment_token":"tok_ok"}`)
+	if rec.Code != http.StatusCreated || decodeBody(t, rec)["charge_id"] != "ch_1" {
+		t.Fatalf("want 201 with the charge id, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = post(`{"user_id":"u1","payment_token":"tok_declined"}`)
+	if rec.Code != http.StatusPaymentRequired || decodeBody(t, rec)["code"] != string(CodePaymentDeclined) {
+		t.Fatalf("want 402 PAYMENT_DECLINED, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"user_id":"u1","payment_token":"tok_slow"}`); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("want 504, got %d", rec.Code)
+	}
+	if rec := post(`{"user_id":"u1"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 without a payment token, got %d", rec.Code)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	var pingErr error
+	svc := &fakeService{PingFn: func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected the ping to be bounded")
+		}
+		return pingErr
+	}}
+	rec := serve(svc, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["status"] != "ok" {
+		t.Fatalf("want 200 ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+	pingErr = errors.New("connection refused")
+	rec = serve(svc, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable || decodeBody(t, rec)["status"] != "unavailable" {
+		t.Fatalf("want 503 unavailable, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// liveness doesn't depend on the database
+	if rec := serve(svc, httptest.NewRequest("GET", "/livez", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("want 200 from /livez, got %d", rec.Code)
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	svc := &fakeService{OrderHistoryFn: func(userID string) ([]service.OrderDTO, error) {
+		return []service.OrderDTO{{ID: 9, UserID: userID, Items: []service.CartDTO{{ProductID: 1, Quantity: 2}}}}, nil
+	}}
+	rec := serve(svc, httptest.NewRequest("GET", "/orders/list?user_id=u1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var got []service.OrderDTO
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || len(got) != 1 || got[0].ID != 9 || len(got[0].Items) != 1 {
+		t.Fatalf("unexpected body %+v %v", got, err)
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/orders/list", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 without user_id, got %d", rec.Code)
+	}
+}
+
+func TestCancelOrder_Handler(t *testing.T) {
+	svc := &fakeService{CancelOrderFn: func(orderID int64, userID string) error {
+		switch orderID {
+		case 9:
+			return nil
+		case 10:
+			return fmt.Errorf("%w: order 10 is cancelled, can't become cancelled", store.ErrInvalidTransition)
+		case 11:
+			return fmt.Errorf("%w: order 11 is older than 24h0m0s", store.ErrCancelWindowClosed)
+		case 12:
+			return fmt.Errorf("%w: order 12 belongs to another user", service.ErrForbidden)
+		}
+		return sql.ErrNoRows
+	}}
+	post := func(id string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("POST", "/orders/"+id+"/cancel", strings.NewReader(`{"user_id":"u1"}`)))
+	}
+	if rec := post("9"); rec.Code != http.StatusOK || decodeBody(t, rec)["status"] != store.OrderStatusCancelled {
+		t.Fatalf("want 200 cancelled, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for id, want := range map[string]struct {
+		status int
+		code   ErrorCode
+	}{
+		"10": {http.StatusConflict, CodeInvalidTransition},
+		"11": {http.StatusConflict, CodeCancelWindowClosed},
+		"12": {http.StatusForbidden, CodeForbidden},
+		"13": {http.StatusNotFound, CodeNotFound},
+		"x":  {http.StatusBadRequest, CodeBadRequest},
+	} {
+		rec := post(id)
+		if rec.Code != want.status || decodeBody(t, rec)["code"] != string(want.code) {
+			t.Fatalf("order %s: want %d %s, got %d: %s", id, want.status, want.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestGetOrder_Handler(t *testing.T) {
+	svc := &fakeService{GetOrderFn: func(userID string, orderID int64) (service.OrderDTO, error) {
+		switch {
+		case orderID != 9:
+			return service.OrderDTO{}, sql.ErrNoRows
+		case userID != "u1":
+			return service.OrderDTO{}, fmt.Errorf("%w: order 9 belongs to another user", service.ErrForbidden)
+		}
+		return service.OrderDTO{ID: 9, UserID: userID, Total: 2000, Items: []service.CartDTO{{ProductID: 1, Quantity: 2, Price: 1000}}}, nil
+	}}
+	get := func(url string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("GET", url, nil))
+	}
+	rec := get("/orders/9?user_id=u1")
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["total"] != 20.0 {
+		t.Fatalf("want 200 with the order, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = get("/orders/9?user_id=u2")
+	if rec.Code != http.StatusForbidden || decodeBody(t, rec)["code"] != string(CodeForbidden) {
+		t.Fatalf("want 403 for another user's order, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := get("/orders/10?user_id=u1"); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404 for an unknown order, got %d", rec.Code)
+	}
+	if rec := get("/orders/9"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 without user_id, got %d", rec.Code)
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	h := NewHandler(&fakeService{})
+	h.AdminToken = testAdminToken
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	get := func(set func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		set(req)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(func(req *http.Request) { req.Header.Set(AdminTokenHeader, testAdminToken) })
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("want the page with the admin token, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `content="`+testAdminToken+`"`) {
+		t.Fatalf("expected the page to carry the credential it was loaded with")
+	}
+	// a browser signs in with the token as its Basic password
+	if rec := get(func(req *http.Request) { req.SetBasicAuth("ops", testAdminToken) }); rec.Code != http.StatusOK {
+		t.Fatalf("want 200 with Basic credentials, got %d", rec.Code)
+	}
+	rec = get(func(*http.Request) {})
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Fatalf("want a 401 Basic challenge without credentials, got %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	if rec := get(func(req *http.Request) { req.SetBasicAuth("ops", "wrong") }); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 with a wrong token, got %d", rec.Code)
+	}
+	if rec := get(func(req *http.Request) { req.Header.Set(AdminTokenHeader, "wrong") }); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 with a wrong header token, got %d", rec.Code)
+	}
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	got, err := ParseAPIKeys("k1=billing:reader, k2=ops:admin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["k1"] != (APIKeyIdentity{"billing", "reader"}) || got["k2"] != (APIKeyIdentity{"ops", "admin"}) {
+		t.Fatalf("unexpected keys: %+v", got)
+	}
+	for _, bad := range []string{"k1", "k1=billing", "=billing:reader", "k1=:reader"} {
+		if _, err := ParseAPIKeys(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUpdateOrderStatus_Handler(t *testing.T) {
+	svc := &fakeService{OrderStatusFn: func(orderID int64, status string) error {
+		switch {
+		case orderID == 404:
+			return sql.ErrNoRows
+		case status == store.OrderStatusPending:
+			return fmt.Errorf("%w: order %d is delivered, can't become pending", store.ErrInvalidTransition, orderID)
+		}
+		return nil
+	}}
+	patch := func(id, body string) *httptest.ResponseRecorder {
+		return serveAdmin(svc, httptest.NewRequest("PATCH", "/orders/"+id+"/status", strings.NewReader(body)))
+	}
+	rec := patch("7", `{"status":"shipped"}`)
+	if body := decodeBody(t, rec); rec.Code != http.StatusOK || body["status"] != "shipped" || body["id"] != 7.0 {
+		t.Fatalf("want 200 shipped, got %d %v", rec.Code, body)
+	}
+	rec = patch("7", `{"status":"pending"}`)
+	if rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeInvalidTransition) {
+		t.Fatalf("want 409 INVALID_STATUS_TRANSITION, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := patch("404", `{"status":"shipped"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	// customers can't move their own orders along
+	req := httptest.NewRequest("PATCH", "/orders/7/status", strings.NewReader(`{"status":"delivered"}`))
+	if rec := serve(svc, req); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 without the admin token, got %d", rec.Code)
+	}
+}
+
+func TestUpdateOrderStatusBatch_Handler(t *testing.T) {
+	svc := &fakeService{
+		StatusBatchFn: func(orderIDs []int64, status string, strict bool) ([]int64, error) {
+			if strict {
+				return nil, fmt.Errorf("%w: order 3 is delivered, can't become shipped", store.ErrInvalidTransition)
+			}
+			return []int64{1, 2}, nil
+		},
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serveAdmin(svc, httptest.NewRequest("POST", "/admin/orders/status-batch", strings.NewReader(body)))
+	}
+
+	rec := post(`{"order_ids":[1,2,3],"status":"shipped"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	if updated, _ := decodeBody(t, rec)["updated"].([]interface{}); len(updated) != 2 {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+	rec = post(`{"order_ids":[1,2,3],"status":"shipped","strict":true}`)
+	if rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeInvalidTransition) {
+		t.Fatalf("want 409 INVALID_STATUS_TRANSITION, got %d %s", rec.Code, rec.Body.String())
+	}
+	req := httptest.NewRequest("POST", "/admin/orders/status-batch", strings.NewReader(`{"order_ids":[1],"status":"shipped"}`))
+	if rec := serve(svc, req); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 without admin token, got %d", rec.Code)
+	}
+}
+
+func TestCartBatch_Handler(t *testing.T) {
+	svc := &fakeService{
+		AddBatchFn: func(userID string, items []service.CartBatchItem, mode string) ([]service.CartBatchResult, error) {
+			if mode != service.BatchBestEffort {
+				return nil, fmt.Errorf("product %d: %w", items[1].ProductID, store.ErrInsufficientStock)
+			}
+			return []service.CartBatchResult{
+				{ProductID: items[0].ProductID},
+				{ProductID: items[1].ProductID, Err: store.ErrInsufficientStock},
+			}, nil
+		},
+		RemoveBatchFn: func(userID string, productIDs []int64, mode string) ([]service.CartBatchResult, error) {
+			out := make([]service.CartBatchResult, len(productIDs))
+			for i, id := range productIDs {
+				out[i] = service.CartBatchResult{ProductID: id}
+			}
+			return out, nil
+		},
+	}
+	body := `{"user_id":"u1","items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":9}]}`
+
+	rec := serve(svc, httptest.NewRequest("POST", "/cart/add-batch?mode=best_effort", strings.NewReader(body)))
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("want 207, got %d %s", rec.Code, rec.Body.String())
+	}
+	got := decodeBody(t, rec)
+	results, _ := got["results"].([]interface{})
+	if len(results) != 2 || got["succeeded"] != 1.0 || got["failed"] != 1.0 {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+	if ok := results[0].(map[string]interface{}); ok["ok"] != true || ok["product_id"] != 1.0 {
+		t.Fatalf("expected item 1 to succeed, got %v", ok)
+	}
+	failed := results[1].(map[string]interface{})
+	if failed["ok"] != false || failed["code"] != string(CodeInsufficientStock) || failed["status"] != 409.0 || failed["error"] == "" {
+		t.Fatalf("expected item 2 to fail with INSUFFICIENT_STOCK, got %v", failed)
+	}
+
+	rec = serve(svc, httptest.NewRequest("POST", "/cart/add-batch", strings.NewReader(body)))
+	if rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeInsufficientStock) {
+		t.Fatalf("want atomic batch to fail as a whole, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(svc, httptest.NewRequest("POST", "/cart/remove-batch?mode=best_effort", strings.NewReader(`{"user_id":"u1","product_ids":[1,2]}`)))
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["status"] != "removed" {
+		t.Fatalf("want 200 when every item succeeds, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(svc, httptest.NewRequest("POST", "/cart/remove-batch", strings.NewReader(`{"user_id":"u1","product_ids":`+jsonArray(DefaultBatchLimit+1, func(i int) string { return strconv.Itoa(i + 1) })+`}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("want 413 over the batch limit, got %d", rec.Code)
+	}
+}
+
+func TestGetProduct_Handler(t *testing.T) {
+	svc := &fakeService{
+		GetProductFn: func(id int64) (service.ProductDTO, error) {
+			if id == 9 {
+				return service.ProductDTO{}, sql.ErrNoRows
+			}
+			return service.ProductDTO{ID: id, Name: "b", Stock: 4}, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest("GET", "/products/2", nil))
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["stock"] != 4.0 {
+		t.Fatalf("want 200 with stock, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/products/9", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/products/x", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", rec.Code)
+	}
+}
+
+func TestUpdateProduct_Handler(t *testing.T) {
+	svc := &fakeService{
+		UpdateProductFn: func(id int64, name, desc string, price money.Cents, category, currency string, version int) error {
+			if id == 9 {
+				return sql.ErrNoRows
+			}
+			if version != 2 {
+				return fmt.Errorf("%w: product %d is at version 2, not %d", store.ErrVersionConflict, id, version)
+			}
+			return nil
+		},
+	}
+	put := func(path, body string) *httptest.ResponseRecorder {
+		return serve(svc, httptest.NewRequest("PUT", path, strings.NewReader(body)))
+	}
+	rec := put("/products/3", `{"name":"Widget","price":4.5,"version":2}`)
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["version"] != 3.0 {
+		t.Fatalf("want 200 with the new version, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := put("/products/9", `{"name":"Widget","price":4.5,"version":2}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404 for a missing product, got %d", rec.Code)
+	}
+	if rec := put("/products/3", `{"name":"Widget","price":-1,"version":2}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a negative price, got %d", rec.Code)
+	}
+	// the version is required, and a stale one conflicts
+	if rec := put("/products/3", `{"name":"Widget","price":4.5}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 without a version, got %d", rec.Code)
+	}
+	rec = put("/products/3", `{"name":"Widget","price":4.5,"version":1}`)
+	if rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeVersionConflict) {
+		t.Fatalf("want 409 %s for a stale version, got %d %s", CodeVersionConflict, rec.Code, rec.Body.String())
+	}
+}
+
+func TestOrdersContainingProduct_Handler(t *testing.T) {
+	var gotFrom time.Time
+	svc := &fakeService{
+		ProductOrdersFn: func(productID int64, from, to time.Time, limit, offset int) ([]service.ProductOrderDTO, int64, error) {
+			gotFrom = from
+			return []service.ProductOrderDTO{{OrderDTO: service.OrderDTO{ID: 3}, Quantity: 2}}, 1, nil
+		},
+	}
+	rec := serveAdmin(svc, httptest.NewRequest("GET", "/admin/products/7/orders?from=2025-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Total-Count") != "1" {
+		t.Fatalf("want 200 with a total, got %d %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"quantity":2`) || gotFrom.Year() != 2025 {
+		t.Fatalf("unexpected body %s (from %v)", rec.Body.String(), gotFrom)
+	}
+	if rec := serveAdmin(svc, httptest.NewRequest("GET", "/admin/products/7/orders?to=yesterday", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a bad timestamp, got %d", rec.Code)
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/admin/products/7/orders", nil)); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 without admin token, got %d", rec.Code)
+	}
+}
+
+func TestPublishProducts_Handler(t *testing.T) {
+	svc := &fakeService{
+		PublishBatchFn: func(ids []int64) ([]int64, error) {
+			for _, id := range ids {
+				if id == 99 {
+					return nil, fmt.Errorf("%w: product 99", sql.ErrNoRows)
+				}
+			}
+			return []int64{4, 6}, nil
+		},
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		return serveAdmin(svc, httptest.NewRequest("POST", "/admin/products/publish-batch", strings.NewReader(body)))
+	}
+	rec := post(`{"ids":[4,5,6]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := decodeBody(t, rec)["published"].([]interface{}); len(got) != 2 {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+	if rec := post(`{"ids":[4,99]}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404 for an unknown id, got %d", rec.Code)
+	}
+	req := httptest.NewRequest("POST", "/admin/products/publish-batch", strings.NewReader(`{"ids":[4]}`))
+	if rec := serve(svc, req); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 without admin token, got %d", rec.Code)
+	}
+}
+
+func TestDeleteProduct_Handler(t *testing.T) {
+	svc := &fakeService{
+		DeleteProductFn: func(id int64, strict bool) (int, error) {
+			switch {
+			case strict && id == 4:
+				return 0, fmt.Errorf("%w: product 4", store.ErrProductInCarts)
+			case strict && id == 9:
+				return 0, sql.ErrNoRows
+			}
+			return 2, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest("DELETE", "/products/4", nil))
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["carts_affected"] != 2.0 {
+		t.Fatalf("want 200 with 2 carts, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(svc, httptest.NewRequest("DELETE", "/products/abc", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", rec.Code)
+	}
+	rec = serve(svc, httptest.NewRequest("DELETE", "/products/4?strict=true", nil))
+	if rec.Code != http.StatusConflict || decodeBody(t, rec)["code"] != string(CodeProductInCarts) {
+		t.Fatalf("want 409 PRODUCT_IN_CARTS, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(svc, httptest.NewRequest("DELETE", "/products/9?strict=true", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404 for a missing product, got %d", rec.Code)
+	}
+}
+
+func TestReorderSuggestion_Handler(t *testing.T) {
+	svc := &fakeService{
+		ReorderFn: func(productID int64) (int, error) {
+			if productID == 9 {
+				return 0, sql.ErrNoRows
+			}
+			return 8, nil
+		},
+	}
+	rec := serve(svc, httptest.NewRequest("GET", "/products/1/reorder-suggestion", nil))
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["suggested_quantity"] != 8.0 {
+		t.Fatalf("want 200 with 8, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/products/9/reorder-suggestion", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+}
+
+func TestGetCartSnapshot_Handler(t *testing.T) {
+	price := money.Cents(500)
+	svc := &fakeService{
+		CartSnapshotFn: func(orderID int64) (service.CartSnapshotDTO, error) {
+			switch orderID {
+			case 5:
+				return service.CartSnapshotDTO{OrderID: 5, UserID: "u1", Items: []service.CartSnapshotLineDTO{
+					{ProductID: 1, Quantity: 2, Price: &price},
+					{ProductID: 2, Quantity: 1, Removed: true},
+				}}, nil
+			case 6:
+				return service.CartSnapshotDTO{}, fmt.Errorf("%w: order 6", store.ErrNoCartSnapshot)
+			}
+			return service.CartSnapshotDTO{}, sql.ErrNoRows
+		},
+	}
+	get := func(id string) *httptest.ResponseRecorder {
+		return serveAdmin(svc, httptest.NewRequest("GET", "/orders/"+id+"/cart-snapshot", nil))
+	}
+
+	rec := get("5")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	items, _ := decodeBody(t, rec)["items"].([]interface{})
+	if len(items) != 2 {
+		t.Fatalf("unexpected items: %s", rec.Body.String())
+	}
+	if second := items[1].(map[string]interface{}); second["price"] != nil || second["removed"] != true {
+		t.Fatalf("expected the removed, unpriced line as-is, got %v", second)
+	}
+	if rec := get("6"); rec.Code != http.StatusNotFound || decodeBody(t, rec)["code"] != string(CodeNoCartSnapshot) {
+		t.Fatalf("want 404 NO_CART_SNAPSHOT, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get("7"); rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", rec.Code)
+	}
+	if rec := serve(svc, httptest.NewRequest("GET", "/orders/5/cart-snapshot", nil)); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 without admin token, got %d", rec.Code)
+	}
+}
+
+func TestListAllStockMovements_Handler(t *testing.T) {
+	var got store.MovementFilter
+	var gotLimit, gotOffset int
+	svc := &fakeService{
+		ListMovementsFn: func(f store.MovementFilter, limit, offset int) ([]service.StockMovementDTO, int64, error) {
+			got, gotLimit, gotOffset = f, limit, offset
+			return []service.StockMovementDTO{{ID: 5, ProductID: 3, Delta: -2, Reason: "reserve"}}, 9, nil
+		},
+	}
+
+	rec := serveAdmin(svc, httptest.NewRequest(http.MethodGet,
+		"/admin/stock/movements?product_id=3&reason=reserve&from=2025-01-01T00:00:00Z&limit=1&offset=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got.ProductID != 3 || got.Reason != "reserve" || got.From.IsZero() || !got.To.IsZero() || gotLimit != 1 || gotOffset != 2 {
+		t.Fatalf("unexpected filter/page: %+v %d %d", got, gotLimit, gotOffset)
+	}
+	if rec.Header().Get("X-Total-Count") != "9" {
+		t.Fatalf("expected X-Total-Count 9, got %q", rec.Header().Get("X-Total-Count"))
+	}
+	if rec := serveAdmin(svc, httptest.NewRequest(http.MethodGet, "/admin/stock/movements?product_id=x", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a bad product id, got %d", rec.Code)
+	}
+	if rec := serve(svc, httptest.NewRequest(http.MethodGet, "/admin/stock/movements", nil)); rec.Code != http.StatusForbidden {
+		t.Fatalf("want 403 without admin token, got %d", rec.Code)
+	}
+}
+
+func TestGetCartInCurrency_Handler(t *testing.T) {
+	svc := &fakeService{
+		CartCurrencyFn: func(userID, currency string) (service.ConvertedCartDTO, error) {
+			if currency != "EUR" {
+				return service.ConvertedCartDTO{}, fmt.Errorf("%w: %s", service.ErrUnknownCurrency, currency)
+			}
+			return service.ConvertedCartDTO{UserID: userID, Total: 1000, BaseCurrency: "USD", Currency: "EUR", ConvertedTotal: 900,
+				Items: []service.ConvertedCartLineDTO{{CartDTO: service.CartDTO{ProductID: 1, Quantity: 1, Price: 1000}, ConvertedPrice: 900}}}, nil
+		},
+	}
+
+	rec := serve(svc, httptest.NewRequest(http.MethodGet, "/cart?user_id=u1&currency=EUR", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := decodeBody(t, rec)
+	if body["total"] != 10.0 || body["converted_total"] != 9.0 || body["currency"] != "EUR" {
+		t.Fatalf("unexpected body: %v", body)
+	}
+	line := body["items"].([]interface{})[0].(map[string]interface{})
+	if line["price"] != 10.0 || line["converted_price"] != 9.0 {
+		t.Fatalf("expected base and converted line prices, got %v", line)
+	}
+	rec = serve(svc, httptest.NewRequest(http.MethodGet, "/cart?user_id=u1&currency=XYZ", nil))
+	if rec.Code != http.StatusBadRequest || decodeBody(t, rec)["code"] != string(CodeUnknownCurrency) {
+		t.Fatalf("want 400 UNKNOWN_CURRENCY, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// jsonArray renders n elements produced by elem as a JSON array
+func jsonArray(n int, elem func(i int) string) string {
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = elem(i)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+func TestBatchLimits(t *testing.T) {
+	svc := &fakeService{
+		GetPricesFn: func(ids []int64) (map[int64]money.Cents, error) { return map[int64]money.Cents{}, nil },
+		StatusBatchFn: func(orderIDs []int64, status string, strict bool) ([]int64, error) {
+			return orderIDs, nil
+		},
+		SetBundleFn: func(bundleID int64, components []store.BundleComponent) error { return nil },
+	}
+	id := func(i int) string { return strconv.Itoa(i + 1) }
+	component := func(i int) string { return fmt.Sprintf(`{"product_id":%d,"quantity":1}`, i+2) }
+	cases := []struct {
+		method, path string
+		body         func(n int) string
+	}{
+		{"POST", "/products/prices", func(n int) string { return `{"ids":` + jsonArray(n, id) + `}` }},
+		{"POST", "/admin/orders/status-batch", func(n int) string {
+			return `{"order_ids":` + jsonArray(n, id) + `,"status":"shipped"}`
+		}},
+		{"PUT", "/admin/bundles/1/components", func(n int) string { return `{"components":` + jsonArray(n, component) + `}` }},
+	}
+	for _, tc := range cases {
+		at := serveAdmin(svc, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body(DefaultBatchLimit))))
+		if at.Code != http.StatusOK {
+			t.Fatalf("%s at the limit: want 200, got %d: %s", tc.path, at.Code, at.Body.String())
+		}
+		over := serveAdmin(svc, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body(DefaultBatchLimit+1))))
+		if over.Code != http.StatusRequestEntityTooLarge || decodeBody(t, over)["code"] != string(CodeTooManyItems) {
+			t.Fatalf("%s over the limit: want 413 TOO_MANY_ITEMS, got %d: %s", tc.path, over.Code, over.Body.String())
+		}
+	}
+
+	// per-route override
+	r := mux.NewRouter()
+	h := NewHandler(svc)
+	h.BatchLimits = map[string]int{"/products/prices": 2}
+	h.RegisterRoutes(r)
+	for n, want := range map[int]int{2: http.StatusOK, 3: http.StatusRequestEntityTooLarge} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("POST", "/products/prices", strings.NewReader(`{"ids":`+jsonArray(n, id)+`}`)))
+		if rec.Code != want {
+			t.Fatalf("%d ids with limit 2: want %d, got %d", n, want, rec.Code)
+		}
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	svc := &fakeService{UpdateStockFn: func(int64, int) error { return nil }}
+	post := func(h *Handler, body string) *httptest.ResponseRecorder {
+		r := mux.NewRouter()
+		h.RegisterRoutes(r)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("POST", "/products/stock", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := post(NewHandler(svc), `{"product_id":1,"new_stock":5}`); rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := post(NewHandler(svc), `{"product_id":1,"newstock":5}`)
+	if body := decodeBody(t, rec); rec.Code != http.StatusBadRequest || body["error"] != `unknown field "newstock"` {
+		t.Fatalf("want 400 naming the unknown field, got %d %v", rec.Code, body)
+	}
+
+	h := NewHandler(svc)
+	h.MaxBodyBytes = 64
+	padded := `{"product_id":1,"new_stock":5` + strings.Repeat(" ", 64) + `}`
+	if rec := post(h, padded); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("want 413, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// the default limit is far above that
+	if rec := post(NewHandler(svc), padded); rec.Code != http.StatusOK {
+		t.Fatalf("want 200 under the default limit, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestParseBatchLimits(t *testing.T) {
+	limits, err := ParseBatchLimits("/products/prices=50, /admin/orders/status-batch=200")
+	if err != nil || limits["/products/prices"] != 50 || limits["/admin/orders/status-batch"] != 200 {
+		t.Fatalf("unexpected limits: %v %v", limits, err)
+	}
+	for _, bad := range []string{"/products/prices", "=5", "/products/prices=0", "/products/prices=x"} {
+		if _, err := ParseBatchLimits(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestMetrics_CountCartAndCheckout(t *testing.T) {
+	outOfStock := false
+	svc := &fakeService{
+		AddToCartFn: func(string, int64, int) error {
+			if outOfStock {
+				return fmt.Errorf("%w: product 1", store.ErrInsufficientStock)
+			}
+			return nil
+		},
+		CheckoutFn: func(string, map[string]string, store.CheckoutOptions) (service.OrderDTO, error) {
+			if outOfStock {
+				return service.OrderDTO{}, store.ErrInsufficientStock
+			}
+			return service.OrderDTO{ID: 1}, nil
+		},
+	}
+	h := NewHandler(svc)
+	h.ResponseMode = ResponseEnveloped
+	h.Metrics = NewMetrics(prometheus.NewRegistry())
+	r := mux.NewRouter()
+	h.RegisterRoutes(r)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	post("/cart/add", `{"user_id":"u1","product_id":1,"quantity":1}`)
+	post("/checkout/order", `{"user_id":"u1"}`)
+	outOfStock = true
+	rec := post("/cart/add", `{"user_id":"u1","product_id":1,"quantity":1}`)
+	post("/checkout/order", `{"user_id":"u1"}`)
+
+	// the envelope still applies under the metrics middleware
+	if body := decodeBody(t, rec); body["data"] != nil || body["error"] == nil {
+		t.Fatalf("expected an enveloped error, got %v", body)
+	}
+	for name, want := range map[string]struct {
+		c prometheus.Counter
+		n float64
+	}{
+		"cart_add_total":           {h.Metrics.CartAddTotal, 1},
+		"checkout_total":           {h.Metrics.CheckoutTotal, 1},
+		"checkout_failed_total":    {h.Metrics.CheckoutFailedTotal, 1},
+		"insufficient_stock_total": {h.Metrics.InsufficientStockTotal, 2},
+	} {
+		if got := testutil.ToFloat64(want.c); got != want.n {
+			t.Errorf("%s = %v, want %v", name, got, want.n)
+		}
+	}
+	if n := testutil.CollectAndCount(h.Metrics.RequestDuration); n != 4 {
+		t.Errorf("expected 4 latency series (2 routes x 2 codes), got %d", n)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `http_request_duration_seconds_count{code="409",method="POST",route="/cart/add"} 1`) {
+		t.Fatalf("unexpected /metrics response %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMetrics_OffByDefault(t *testing.T) {
+	rec := serve(&fakeService{}, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404 without metrics, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// overBudget counts requests that ran past their route's latency budget,
+// keyed by route template. Served with the other expvars at /admin/metrics.
+var overBudget = expvar.NewMap("latency_over_budget")
+
+// latencyBudget times each request and, when it takes longer than the budget
+// configured for its route template, bumps overBudget and logs a warning.
+// Routes without a budget pass straight through.
+func latencyBudget(budgets map[string]time.Duration, logger *log.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeTemplate(r)
+			budget, ok := budgets[route]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			if took := time.Since(start); took > budget {
+				overBudget.Add(route, 1)
+				logger.Printf("WARN over latency budget: route=%s method=%s duration=%s budget=%s", route, r.Method, took, budget)
+			}
+		})
+	}
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+// ParseLatencyBudgets parses "route=duration" pairs separated by commas, e.g.
+// "/checkout/order=500ms,/products/list=200ms". Routes are mux templates.
+func ParseLatencyBudgets(s string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		route, dur, ok := strings.Cut(pair, "=")
+		if !ok || route == "" {
+			return nil, fmt.Errorf("invalid budget %q, want route=duration", pair)
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration for %s: %q", route, dur)
+		}
+		out[route] = d
+	}
+	return out, nil
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultMaxBodyBytes is the largest request body accepted unless
+// Handler.MaxBodyBytes says otherwise.
+const DefaultMaxBodyBytes = 1 << 20
+
+// limitBody caps every request body at max bytes. Reading past the cap fails
+// with an *http.MaxBytesError, which writeBodyErr turns into 413.
+func limitBody(max int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decodeJSON decodes the request body into v, rejecting fields v doesn't
+// have. On failure it writes the error (see writeBodyErr) and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}, invalid string) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeBodyErr(w, err, invalid)
+		return false
+	}
+	return true
+}
+
+// writeBodyErr writes 413 for a body over the size limit, 400 naming the
+// field for an unknown one, and 400 with invalid for anything else.
+func writeBodyErr(w http.ResponseWriter, err error, invalid string) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeErr(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		writeErr(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		writeErr(w, http.StatusBadRequest, invalid)
+	}
+}
+
+// concurrencyLimit lets at most max requests run next at once. A request that
+// finds every slot taken waits up to wait for one to free up and otherwise
+// gets 503 with a Retry-After hint.
+func concurrencyLimit(max int, wait time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	slots := make(chan struct{}, max)
+	retryAfter := strconv.Itoa(int(wait.Seconds()) + 1)
+	return func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case slots <- struct{}{}:
+		case <-timer.C:
+			w.Header().Set("Retry-After", retryAfter)
+			writeErr(w, http.StatusServiceUnavailable, "too many concurrent requests, retry later")
+			return
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-slots }()
+		next(w, r)
+	}
+}
+
+// DefaultBatchLimit is the longest array a batch endpoint accepts unless
+// Handler.BatchLimits says otherwise for its route.
+const DefaultBatchLimit = 100
+
+// batchLimit returns the array length limit for a route template
+func (h *Handler) batchLimit(route string) int {
+	if n, ok := h.BatchLimits[route]; ok {
+		return n
+	}
+	return DefaultBatchLimit
+}
+
+// limitArray rejects, with 413, a JSON body whose field array has more than
+// max elements, before next (and any DB work) runs. Bodies it can't make sense
+// of are left for next to reject; on success the body is rewound.
+func limitArray(field string, max int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyErr(w, err, "could not read body")
+			return
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err == nil {
+			var items []json.RawMessage
+			if err := json.Unmarshal(fields[field], &items); err == nil && len(items) > max {
+				writeCodedErr(w, http.StatusRequestEntityTooLarge, CodeTooManyItems,
+					fmt.Sprintf("%s: at most %d items per request, got %d", field, max, len(items)))
+				return
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// ParseBatchLimits parses "route=n" pairs separated by commas, e.g.
+// "/products/prices=50,/admin/orders/status-batch=200". Routes are mux templates.
+func ParseBatchLimits(s string) (map[string]int, error) {
+	out := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		route, v, ok := strings.Cut(pair, "=")
+		if !ok || route == "" {
+			return nil, fmt.Errorf("invalid limit %q, want route=n", pair)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit %q: must be a positive integer", pair)
+		}
+		out[route] = n
+	}
+	return out, nil
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"errors"
+	"inventory-management/store"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus collectors the handlers update, served at
+// GET /metrics from the registry they were created on. A nil *Metrics
+// records nothing.
+type Metrics struct {
+	gatherer prometheus.Gatherer
+
+	CheckoutTotal          prometheus.Counter
+	CheckoutFailedTotal    prometheus.Counter
+	CartAddTotal           prometheus.Counter
+	InsufficientStockTotal prometheus.Counter
+	RequestDuration        *prometheus.HistogramVec
+}
+
+// NewMetrics creates the collectors and registers them on reg; tests pass
+// their own prometheus.NewRegistry().
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		gatherer: reg,
+		CheckoutTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "checkout_total",
+			Help: "Orders placed through /checkout/order or /checkout/pay.",
+		}),
+		CheckoutFailedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "checkout_failed_total",
+			Help: "Checkouts that didn't place an order.",
+		}),
+		CartAddTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cart_add_total",
+			Help: "Successful /cart/add calls.",
+		}),
+		InsufficientStockTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "insufficient_stock_total",
+			Help: "Cart or checkout requests refused for lack of stock.",
+		}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Request latency by route template, method and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+	reg.MustRegister(m.CheckoutTotal, m.CheckoutFailedTotal, m.CartAddTotal, m.InsufficientStockTotal, m.RequestDuration)
+	return m
+}
+
+// checkout counts one checkout attempt and its outcome
+func (m *Metrics) checkout(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.CheckoutFailedTotal.Inc()
+		m.stockErr(err)
+		return
+	}
+	m.CheckoutTotal.Inc()
+}
+
+// cartAdd counts one /cart/add attempt: successes, and stock refusals
+func (m *Metrics) cartAdd(err error) {
+	if m == nil {
+		return
+	}
+	if err == nil {
+		m.CartAddTotal.Inc()
+		return
+	}
+	m.stockErr(err)
+}
+
+// stockErr counts err if it is a stock refusal
+func (m *Metrics) stockErr(err error) {
+	if m != nil && errors.Is(err, store.ErrInsufficientStock) {
+		m.InsufficientStockTotal.Inc()
+	}
+}
+
+// handler serves the registry in the Prometheus text format
+func (m *Metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{})
+}
+
+// middleware observes every request's duration under its route template
+func (m *Metrics) middleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			next.ServeHTTP(rec, r)
+			m.RequestDuration.WithLabelValues(routeTemplate(r), r.Method, strconv.Itoa(rec.status)).
+				Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
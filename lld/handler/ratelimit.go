@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTTL is how long a client's bucket is kept after its last
+// request; a client returning later starts with a full bucket.
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// RateLimit is a token bucket per client: RPS requests a second on average,
+// with bursts of up to Burst (at least 1). Zero RPS disables it.
+type RateLimit struct {
+	RPS   float64
+	Burst int
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter holds one bucket per client key. Idle buckets are swept at
+// most once per idle period, on the request path, so the map only ever holds
+// clients seen within the last two periods.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	idle  time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*rateClient
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimit) *rateLimiter {
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		limit:   rate.Limit(cfg.RPS),
+		burst:   burst,
+		idle:    rateLimiterIdleTTL,
+		now:     time.Now,
+		clients: make(map[string]*rateClient),
+	}
+}
+
+// reserve takes a token from key's bucket, returning 0 if it got one or how
+// long until it would have.
+func (l *rateLimiter) reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= l.idle {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) >= l.idle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	res := c.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// wrap lets a request through to next while its client has tokens left and
+// answers 429 with a Retry-After hint otherwise. Clients are keyed by the
+// authenticated user_id when there is one (so next must sit inside the
+// bearer check), otherwise by the remote IP; X-Forwarded-For is not trusted.
+func (l *rateLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if delay := l.reserve(rateLimitKey(r)); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeErr(w, http.StatusTooManyRequests, "rate limit exceeded, retry later")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func rateLimitKey(r *http.Request) string {
+	if userID, ok := UserFromContext(r.Context()); ok {
+		return "user:" + userID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// schema is the subset of JSON Schema the request bodies use: type, required,
+// properties, additionalProperties, minimum/maximum and minLength/maxLength.
+type schema struct {
+	Type                 string             `json:"type"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+
+	// compiled from AdditionalProperties: extra keys are rejected when
+	// noExtra is set, otherwise validated against extra when non-nil
+	noExtra bool
+	extra   *schema
+}
+
+// schemas holds the compiled schemas keyed by file name without extension.
+var schemas = mustLoadSchemas()
+
+func mustLoadSchemas() map[string]*schema {
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+	out := make(map[string]*schema, len(entries))
+	for _, e := range entries {
+		b, err := schemaFiles.ReadFile("schemas/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		var sc schema
+		if err := json.Unmarshal(b, &sc); err != nil {
+			panic(fmt.Sprintf("schema %s: %v", e.Name(), err))
+		}
+		if err := sc.compile(); err != nil {
+			panic(fmt.Sprintf("schema %s: %v", e.Name(), err))
+		}
+		out[strings.TrimSuffix(e.Name(), ".json")] = &sc
+	}
+	return out
+}
+
+func (sc *schema) compile() error {
+	if raw := bytes.TrimSpace(sc.AdditionalProperties); len(raw) > 0 {
+		switch raw[0] {
+		case 't', 'f':
+			var allowed bool
+			if err := json.Unmarshal(raw, &allowed); err != nil {
+				return err
+			}
+			sc.noExtra = !allowed
+		default:
+			sc.extra = &schema{}
+			if err := json.Unmarshal(raw, sc.extra); err != nil {
+				return err
+			}
+			if err := sc.extra.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range sc.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate appends one message per violation found in v to errs.
+func (sc *schema) validate(path string, v interface{}, errs []string) []string {
+	if !sc.hasType(v) {
+		if path == "" {
+			path = "body"
+		}
+		return append(errs, fmt.Sprintf("%s: must be %s", path, sc.Type))
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sc.Required {
+			if _, ok := val[k]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: is required", joinPath(path, k)))
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := sc.Properties[k]; ok {
+				errs = p.validate(joinPath(path, k), val[k], errs)
+			} else if sc.noExtra {
+				errs = append(errs, fmt.Sprintf("%s: unknown field", joinPath(path, k)))
+			} else if sc.extra != nil {
+				errs = sc.extra.validate(joinPath(path, k), val[k], errs)
+			}
+		}
+	case string:
+		n := len([]rune(val))
+		if sc.MinLength != nil && n < *sc.MinLength {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %d characters", path, *sc.MinLength))
+		}
+		if sc.MaxLength != nil && n > *sc.MaxLength {
+			errs = append(errs, fmt.Sprintf("%s: must be at most %d characters", path, *sc.MaxLength))
+		}
+	case json.Number:
+		f, _ := val.Float64()
+		if sc.Minimum != nil && f < *sc.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: must be >= %v", path, *sc.Minimum))
+		}
+		if sc.Maximum != nil && f > *sc.Maximum {
+			errs = append(errs, fmt.Sprintf("%s: must be <= %v", path, *sc.Maximum))
+		}
+	}
+	return errs
+}
+
+func (sc *schema) hasType(v interface{}) bool {
+	switch sc.Type {
+	case "":
+		return true
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// validateBody checks the request body against the named embedded schema
+// before next runs. Violations are returned as 400 with a "violations" list;
+// on success the body is rewound so next can decode it as usual.
+func validateBody(name string, next http.HandlerFunc) http.HandlerFunc {
+	sc, ok := schemas[name]
+	if !ok {
+		panic("unknown schema " + name)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyErr(w, err, "could not read body")
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		if errs := sc.validate("", v, nil); len(errs) > 0 {
+			writeViolations(w, "request body failed validation", errs)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
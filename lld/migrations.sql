@@ -35,6 +35,191 @@ CREATE TABLE IF NOT EXISTS order_items (
 ALTER TABLE products
   ADD COLUMN IF NOT EXISTS stock INTEGER NOT NULL DEFAULT 0;
 
+ALTER TABLE orders
+  ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+
 
 UPDATE products SET stock = 5 WHERE id = 1; -- speaker
-UPDATE products SET stock = 3 WHERE id = 2; -- laptop
\ No newline at end of file
+UPDATE products SET stock = 3 WHERE id = 2; -- laptop
+ALTER TABLE orders
+  ADD COLUMN IF NOT EXISTS refunded_total NUMERIC(12,2) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS order_returns (
+  id BIGSERIAL PRIMARY KEY,
+  order_id BIGINT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  product_id BIGINT NOT NULL REFERENCES products(id),
+  quantity INTEGER NOT NULL CHECK (quantity > 0),
+  amount NUMERIC(12,2) NOT NULL,
+  restocked BOOLEAN NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS track_inventory BOOLEAN NOT NULL DEFAULT true;
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+  id BIGSERIAL PRIMARY KEY,
+  event_type TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'published', 'failed')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  published_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_status_idx ON outbox_events (status, id);
+
+-- per-line quantity cap enforced at commit time so concurrent adds from
+-- different processes can't both push a line past it (see store.MaxCartLineQuantity)
+DO $$
+BEGIN
+  ALTER TABLE cart_items ADD CONSTRAINT cart_items_quantity_max CHECK (quantity <= 99);
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS weight_grams INTEGER CHECK (weight_grams >= 0);
+
+-- per-user reservation cap for hot products; NULL = store-wide default
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS max_reserved_per_user INTEGER CHECK (max_reserved_per_user > 0);
+
+CREATE TABLE IF NOT EXISTS product_tags (
+  product_id BIGINT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  tag TEXT NOT NULL,
+  PRIMARY KEY (product_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS product_tags_tag_idx ON product_tags (tag, product_id);
+
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS available_from TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS available_until TIMESTAMPTZ;
+
+ALTER TABLE orders
+  ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'placed';
+CREATE INDEX IF NOT EXISTS orders_created_at_idx ON orders (created_at DESC, id DESC);
+
+-- NULL price = "call for price": listed, but can't be added to a cart or checked out
+ALTER TABLE products ALTER COLUMN price DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS purchase_orders (
+  id BIGSERIAL PRIMARY KEY,
+  product_id BIGINT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  quantity INTEGER NOT NULL CHECK (quantity > 0),
+  expected_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS purchase_orders_product_expected_idx ON purchase_orders (product_id, expected_at);
+
+-- unpublished products (drafts) are hidden from public listings
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS published BOOLEAN NOT NULL DEFAULT true;
+-- new products start as drafts; rows that existed before stay published
+ALTER TABLE products ALTER COLUMN published SET DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS reviews (
+  id BIGSERIAL PRIMARY KEY,
+  product_id BIGINT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  user_id TEXT NOT NULL,
+  rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 5),
+  body TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS reviews_product_created_idx ON reviews (product_id, created_at DESC, id DESC);
+
+-- a bundle is a product made of other products; its own stock isn't
+-- tracked, adding it to a cart reserves each component instead
+CREATE TABLE IF NOT EXISTS bundle_components (
+  bundle_id BIGINT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  component_id BIGINT NOT NULL REFERENCES products(id),
+  quantity INTEGER NOT NULL CHECK (quantity > 0),
+  PRIMARY KEY (bundle_id, component_id),
+  CHECK (bundle_id <> component_id)
+);
+
+-- the cart as it stood at checkout (NULL for older orders)
+ALTER TABLE orders
+  ADD COLUMN IF NOT EXISTS cart_snapshot JSONB;
+
+-- stock ledger: one row per change to a product's stock. No FK, so the
+-- history outlives deleted products.
+CREATE TABLE IF NOT EXISTS stock_movements (
+  id BIGSERIAL PRIMARY KEY,
+  product_id BIGINT NOT NULL,
+  delta INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS stock_movements_created_idx ON stock_movements (created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS stock_movements_product_created_idx ON stock_movements (product_id, created_at DESC);
+
+-- a quoted cart whose prices checkout honours until expires_at
+CREATE TABLE IF NOT EXISTS quote_holds (
+  user_id TEXT PRIMARY KEY,
+  lines JSONB NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- orders paid at checkout keep the payment gateway's charge id
+ALTER TABLE orders
+  ADD COLUMN IF NOT EXISTS charge_id TEXT;
+
+-- discount codes: percent_off comes off the order total at checkout. NULL
+-- expires_at never expires, NULL max_uses is unlimited.
+CREATE TABLE IF NOT EXISTS coupons (
+  code TEXT PRIMARY KEY,
+  percent_off INTEGER NOT NULL CHECK (percent_off BETWEEN 1 AND 100),
+  expires_at TIMESTAMPTZ,
+  max_uses INTEGER CHECK (max_uses > 0),
+  uses INTEGER NOT NULL DEFAULT 0
+);
+
+-- the discount a coupon took off an order's total, and its code
+ALTER TABLE orders
+  ADD COLUMN IF NOT EXISTS discount NUMERIC(12,2) NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS coupon_code TEXT REFERENCES coupons(code);
+
+-- storefront navigation; NULL = uncategorised
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS category TEXT;
+CREATE INDEX IF NOT EXISTS products_category_idx ON products (category, id) WHERE published;
+
+-- when a cart line stops holding its stock; NULL = until removed
+ALTER TABLE cart_items
+  ADD COLUMN IF NOT EXISTS reserved_until TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS cart_items_reserved_until_idx ON cart_items (reserved_until) WHERE reserved_until IS NOT NULL;
+
+-- Idempotency-Key of a checkout and the order it placed; a key is honoured
+-- for 24 hours, after which the row is taken over by the next use
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  user_id TEXT NOT NULL,
+  key TEXT NOT NULL,
+  order_id BIGINT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, key)
+);
+
+-- soft delete: a deleted product keeps its row, so orders and returns still
+-- resolve it, but it's hidden from every listing and can't be carted
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS is_deleted BOOLEAN NOT NULL DEFAULT false;
+
+-- ISO 4217 currency a product is priced in, and the one its orders are in
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE orders
+  ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+
+-- bumped by every product update; PUT /products/{id} must name the version
+-- it read, so concurrent edits conflict instead of overwriting each other
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+
+-- updated_at moves with version (UpdateProduct, catalog import), not with
+-- stock; rows that existed before get the time of the migration
+ALTER TABLE products
+  ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS products_created_at_idx ON products (created_at DESC, id DESC) WHERE published;
@@ -0,0 +1,168 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Cents is an amount of money in minor units (hundredths). Sums and
+// multiples of Cents are exact, unlike float64 where 0.1 added ten times is
+// not 1. It reads and writes Postgres numeric columns as decimal text and
+// JSON as a plain number, so neither the schema nor the API changes.
+type Cents int64
+
+// FromFloat rounds f to the nearest cent. Use it at the edges only (rates,
+// percentages); amounts that are already Cents should stay Cents.
+func FromFloat(f float64) Cents {
+	return Cents(math.Round(f * 100))
+}
+
+// Float64 is c in major units, for display or float-only APIs.
+func (c Cents) Float64() float64 {
+	return float64(c) / 100
+}
+
+// Mul is c times n, e.g. a line's unit price times its quantity.
+func (c Cents) Mul(n int) Cents {
+	return c * Cents(n)
+}
+
+// String formats c with exactly two decimals, e.g. "12.30".
+func (c Cents) String() string {
+	sign := ""
+	u := int64(c)
+	if u < 0 {
+		sign, u = "-", -u
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, u/100, u%100)
+}
+
+// Parse reads a decimal amount such as "12.3" or "-0.05" exactly. Digits
+// past the second decimal round half away from zero. Exponent forms fall
+// back to float parsing.
+func Parse(s string) (Cents, error) {
+	s = strings.TrimSpace(s)
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("money: invalid amount %q", s)
+		}
+		return FromFloat(f), nil
+	}
+	neg := strings.HasPrefix(s, "-")
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("money: invalid amount %q", s)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("money: invalid amount %q", s)
+		}
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > math.MaxInt64/100-1 {
+		return 0, fmt.Errorf("money: amount %q out of range", s)
+	}
+	frac += "000"
+	hundredths, _ := strconv.ParseInt(frac[:2], 10, 64)
+	c := units*100 + hundredths
+	if frac[2] >= '5' {
+		c++
+	}
+	if neg {
+		c = -c
+	}
+	return Cents(c), nil
+}
+
+// MarshalJSON writes c as a JSON number without trailing zeros, e.g. 12.3
+// or 10.
+func (c Cents) MarshalJSON() ([]byte, error) {
+	s := c.String()
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	return []byte(s), nil
+}
+
+// UnmarshalJSON reads a JSON number exactly; see Parse.
+func (c *Cents) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		return errors.New("money: amount must be a JSON number")
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*c = v
+	return nil
+}
+
+// Scan implements sql.Scanner for numeric columns. NULL is an error; use
+// NullCents for nullable columns.
+func (c *Cents) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return c.scanText(string(v))
+	case string:
+		return c.scanText(v)
+	case float64:
+		*c = FromFloat(v)
+	case int64:
+		*c = Cents(v * 100)
+	case nil:
+		return errors.New("money: cannot scan NULL into Cents")
+	default:
+		return fmt.Errorf("money: cannot scan %T into Cents", src)
+	}
+	return nil
+}
+
+func (c *Cents) scanText(s string) error {
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*c = v
+	return nil
+}
+
+// Value implements driver.Valuer; the decimal text keeps numeric columns exact.
+func (c Cents) Value() (driver.Value, error) {
+	return c.String(), nil
+}
+
+// NullCents is a Cents that may be NULL, like sql.NullFloat64.
+type NullCents struct {
+	Cents Cents
+	Valid bool // Valid is true if Cents is not NULL
+}
+
+// Scan implements sql.Scanner.
+func (n *NullCents) Scan(src interface{}) error {
+	if src == nil {
+		n.Cents, n.Valid = 0, false
+		return nil
+	}
+	n.Valid = true
+	return n.Cents.Scan(src)
+}
+
+// Value implements driver.Valuer.
+func (n NullCents) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.Cents.Value()
+}
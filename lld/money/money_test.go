@@ -0,0 +1,101 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]Cents{
+		"12.34":  1234,
+		"12.3":   1230,
+		"12":     1200,
+		".5":     50,
+		"0.005":  1,
+		"0.004":  0,
+		"-0.05":  -5,
+		"-1.005": -101,
+		"+3":     300,
+		"1e2":    10000,
+		" 7.10 ": 710,
+	} {
+		if got, err := Parse(in); err != nil || got != want {
+			t.Fatalf("Parse(%q) = %d %v, want %d", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", ".", "1.2.3", "abc", "1,50", "99999999999999999999"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("Parse(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	for c, want := range map[Cents]string{0: "0.00", 5: "0.05", 1230: "12.30", -5: "-0.05", -1234: "-12.34"} {
+		if got := c.String(); got != want {
+			t.Fatalf("%d.String() = %q, want %q", int64(c), got, want)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	type line struct {
+		Price Cents  `json:"price"`
+		Held  *Cents `json:"held"`
+	}
+	b, err := json.Marshal(line{Price: 1230})
+	if err != nil || string(b) != `{"price":12.3,"held":null}` {
+		t.Fatalf("unexpected json %s %v", b, err)
+	}
+	var l line
+	if err := json.Unmarshal([]byte(`{"price":0.1,"held":10}`), &l); err != nil || l.Price != 10 || l.Held == nil || *l.Held != 1000 {
+		t.Fatalf("unexpected line %+v %v", l, err)
+	}
+	if err := json.Unmarshal([]byte(`{"price":"0.1"}`), &l); err == nil {
+		t.Fatalf("expected a string amount to be rejected")
+	}
+}
+
+func TestScan(t *testing.T) {
+	var c Cents
+	for src, want := range map[interface{}]Cents{"12.34": 1234, float64(4.5): 450, int64(3): 300} {
+		if err := c.Scan(src); err != nil || c != want {
+			t.Fatalf("Scan(%v) = %d %v, want %d", src, c, err, want)
+		}
+	}
+	if err := c.Scan([]byte("0.10")); err != nil || c != 10 {
+		t.Fatalf("Scan([]byte) = %d %v", c, err)
+	}
+	if err := c.Scan(nil); err == nil {
+		t.Fatalf("expected NULL to be rejected")
+	}
+
+	n := NullCents{Cents: 5, Valid: true}
+	if err := n.Scan(nil); err != nil || n.Valid || n.Cents != 0 {
+		t.Fatalf("expected NULL to scan as invalid, got %+v %v", n, err)
+	}
+	if v, err := n.Value(); err != nil || v != nil {
+		t.Fatalf("expected nil value, got %v %v", v, err)
+	}
+	if err := n.Scan([]byte("2.50")); err != nil || !n.Valid || n.Cents != 250 {
+		t.Fatalf("unexpected %+v %v", n, err)
+	}
+	if v, err := n.Value(); err != nil || v != "2.50" {
+		t.Fatalf("expected the decimal text, got %v %v", v, err)
+	}
+}
+
+func TestSumIsExact(t *testing.T) {
+	var f float64
+	var c Cents
+	for i := 0; i < 1000; i++ {
+		f += 0.1
+		c += FromFloat(0.1)
+	}
+	if f == 100 {
+		t.Fatalf("expected float64 to drift, got exactly %v", f)
+	}
+	if c != 10000 || c.String() != "100.00" {
+		t.Fatalf("expected exactly 100.00, got %s", c)
+	}
+}
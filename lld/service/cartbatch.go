@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"inventory-management/store"
+)
+
+// Modes for the cart batch operations
+const (
+	BatchAtomic     = "atomic"      // every item or none, in one transaction
+	BatchBestEffort = "best_effort" // each item on its own, failures reported per item
+)
+
+// CartBatchItem is one line of an AddToCartBatch
+type CartBatchItem struct {
+	ProductID int64
+	Quantity  int
+}
+
+// CartBatchResult is the outcome for one item of a batch; Err is nil if it
+// was applied.
+type CartBatchResult struct {
+	ProductID int64
+	Err       error
+}
+
+func batchMode(mode string) (string, error) {
+	switch mode {
+	case "", BatchAtomic:
+		return BatchAtomic, nil
+	case BatchBestEffort:
+		return BatchBestEffort, nil
+	}
+	return "", fmt.Errorf("unknown mode %q, want %s or %s", mode, BatchAtomic, BatchBestEffort)
+}
+
+// AddToCartBatch adds several lines to the user's cart. In atomic mode (the
+// default) they're added in one transaction and any failure is returned as
+// the error; in best-effort mode each item is added like AddToCart on its
+// own and failures only show up in its result.
+func (s *Service) AddToCartBatch(ctx context.Context, userID string, items []CartBatchItem, mode string) ([]CartBatchResult, error) {
+	if userID == "" {
+		return nil, errors.New("user_id required")
+	}
+	if len(items) == 0 {
+		return nil, errors.New("items required")
+	}
+	mode, err := batchMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]CartBatchResult, len(items))
+	if mode == BatchBestEffort {
+		for i, it := range items {
+			results[i] = CartBatchResult{ProductID: it.ProductID, Err: s.AddToCart(ctx, userID, it.ProductID, it.Quantity)}
+		}
+		return results, nil
+	}
+	lines := make([]store.CartRow, len(items))
+	for i, it := range items {
+		lines[i] = store.CartRow{ProductID: it.ProductID, Quantity: it.Quantity}
+		results[i] = CartBatchResult{ProductID: it.ProductID}
+	}
+	if err := s.store.AddToCartBatch(ctx, userID, lines); err != nil {
+		return nil, err
+	}
+	for _, it := range items {
+		s.observeStock(ctx, it.ProductID)
+	}
+	return results, nil
+}
+
+// RemoveFromCartBatch removes several products from the user's cart, all or
+// nothing in atomic mode, each on its own in best-effort mode (see
+// AddToCartBatch).
+func (s *Service) RemoveFromCartBatch(ctx context.Context, userID string, productIDs []int64, mode string) ([]CartBatchResult, error) {
+	if userID == "" {
+		return nil, errors.New("user_id required")
+	}
+	if len(productIDs) == 0 {
+		return nil, errors.New("product_ids required")
+	}
+	mode, err := batchMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]CartBatchResult, len(productIDs))
+	if mode == BatchBestEffort {
+		for i, id := range productIDs {
+			results[i] = CartBatchResult{ProductID: id, Err: s.RemoveFromCart(ctx, userID, id)}
+		}
+		return results, nil
+	}
+	if err := s.store.RemoveFromCartBatch(ctx, userID, productIDs); err != nil {
+		return nil, err
+	}
+	for i, id := range productIDs {
+		results[i] = CartBatchResult{ProductID: id}
+		s.observeStock(ctx, id)
+	}
+	return results, nil
+}
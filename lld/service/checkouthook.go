@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"inventory-management/store"
+	"log"
+)
+
+// EventCheckoutSync is the outbox event type of a post-checkout hook call
+// that failed and is waiting to be retried; its payload is the OrderDTO.
+const EventCheckoutSync = "checkout.sync"
+
+// DefaultPostCheckoutRetries is how many times a failed post-checkout hook
+// call is retried from the outbox before its event is marked failed
+const DefaultPostCheckoutRetries = 5
+
+// PostCheckoutHook is told about every order after it's committed, e.g. to
+// mirror the stock it took to an ERP or WMS. It's called off the request
+// path; a failed call is retried from the outbox by RetryPostCheckoutHooks.
+type PostCheckoutHook interface {
+	AfterCheckout(order OrderDTO) error
+}
+
+// NopPostCheckoutHook does nothing. It's the hook used when none is
+// configured.
+type NopPostCheckoutHook struct{}
+
+func (NopPostCheckoutHook) AfterCheckout(OrderDTO) error { return nil }
+
+// afterCheckout queues a committed order for the webhook and calls the hook
+// for it in the background, queueing it in the outbox if the call fails. The
+// queueing isn't cut short when ctx, usually the request's, is cancelled.
+func (s *Service) afterCheckout(ctx context.Context, od OrderDTO) {
+	if s.OrderWebhook != nil {
+		s.OrderWebhook.Send(od)
+	}
+	if s.PostCheckoutHook == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	s.hooks.Add(1)
+	go func() {
+		defer s.hooks.Done()
+		err := s.PostCheckoutHook.AfterCheckout(od)
+		if err == nil {
+			return
+		}
+		payload, merr := json.Marshal(od)
+		if merr != nil {
+			log.Printf("post-checkout hook: order %d: %v (not queued: %v)", od.ID, err, merr)
+			return
+		}
+		if _, qerr := s.store.EnqueueOutboxEvent(ctx, EventCheckoutSync, payload); qerr != nil {
+			log.Printf("post-checkout hook: order %d: %v (not queued: %v)", od.ID, err, qerr)
+			return
+		}
+		log.Printf("post-checkout hook: order %d: %v (queued for retry)", od.ID, err)
+	}()
+}
+
+// WaitPostCheckoutHooks waits for the hook calls already started to finish
+// (or be queued for retry).
+func (s *Service) WaitPostCheckoutHooks() {
+	s.hooks.Wait()
+}
+
+// RetryPostCheckoutHooks calls the hook again for each pending outbox event
+// of a failed call and returns how many went through. An event that keeps
+// failing is marked failed after PostCheckoutRetries.
+func (s *Service) RetryPostCheckoutHooks(ctx context.Context) (int, error) {
+	if s.PostCheckoutHook == nil {
+		return 0, nil
+	}
+	evs, err := s.store.ListOutboxEvents(ctx, store.OutboxPending)
+	if err != nil {
+		return 0, err
+	}
+	retries := s.PostCheckoutRetries
+	if retries <= 0 {
+		retries = DefaultPostCheckoutRetries
+	}
+	delivered := 0
+	for _, ev := range evs {
+		if ev.EventType != EventCheckoutSync {
+			continue
+		}
+		var od OrderDTO
+		if err := json.Unmarshal(ev.Payload, &od); err != nil {
+			// retrying won't fix the payload
+			if err := s.store.MarkOutboxAttemptFailed(ctx, ev.ID, fmt.Sprintf("bad payload: %v", err), 1); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		if herr := s.PostCheckoutHook.AfterCheckout(od); herr != nil {
+			if err := s.store.MarkOutboxAttemptFailed(ctx, ev.ID, herr.Error(), retries); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		if err := s.store.MarkOutboxPublished(ctx, ev.ID); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
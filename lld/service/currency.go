@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"inventory-management/money"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownCurrency returned when no rate is configured for a currency.
+var ErrUnknownCurrency = errors.New("unknown currency")
+
+// DefaultBaseCurrency is the currency of products created without one
+const DefaultBaseCurrency = "USD"
+
+// CurrencyConverter converts amounts between ISO 4217 currencies.
+type CurrencyConverter interface {
+	Convert(amount float64, from, to string) (float64, error)
+}
+
+// RateTable is a static CurrencyConverter. Rates holds how many units of each
+// currency one unit of Base buys; Base itself is implicitly 1.
+type RateTable struct {
+	Base  string
+	Rates map[string]float64
+}
+
+func (t RateTable) rate(currency string) (float64, bool) {
+	if currency == t.Base {
+		return 1, true
+	}
+	r, ok := t.Rates[currency]
+	return r, ok && r > 0
+}
+
+// Convert converts amount via Base, failing with ErrUnknownCurrency if either
+// side has no rate.
+func (t RateTable) Convert(amount float64, from, to string) (float64, error) {
+	fromRate, ok := t.rate(from)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, from)
+	}
+	toRate, ok := t.rate(to)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, to)
+	}
+	return amount / fromRate * toRate, nil
+}
+
+// normalizeCurrency upper-cases an ISO 4217 code, BaseCurrency when empty;
+// anything but three letters is ErrUnknownCurrency.
+func (s *Service) normalizeCurrency(code string) (string, error) {
+	c := strings.ToUpper(strings.TrimSpace(code))
+	if c == "" {
+		return s.BaseCurrency, nil
+	}
+	if len(c) != 3 || strings.Trim(c, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", fmt.Errorf("%w: %q is not a 3-letter ISO 4217 code", ErrUnknownCurrency, code)
+	}
+	return c, nil
+}
+
+// ParseRates parses "CODE=rate" pairs separated by commas, e.g.
+// "EUR=0.92,GBP=0.79", into rates relative to the base currency.
+func ParseRates(s string) (map[string]float64, error) {
+	out := make(map[string]float64)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		code, v, ok := strings.Cut(pair, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok || len(code) != 3 {
+			return nil, fmt.Errorf("invalid rate %q, want CODE=rate", pair)
+		}
+		r, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid rate %q: must be a positive number", pair)
+		}
+		out[code] = r
+	}
+	return out, nil
+}
+
+// ConvertedCartLineDTO is a cart line with its price in both currencies
+type ConvertedCartLineDTO struct {
+	CartDTO
+	ConvertedPrice money.Cents `json:"converted_price"`
+}
+
+// ConvertedCartDTO is a cart priced in its products' currencies and in
+// Currency. Total is the unconverted sum, so only means something when every
+// line is in the same currency.
+type ConvertedCartDTO struct {
+	UserID         string                 `json:"user_id"`
+	Items          []ConvertedCartLineDTO `json:"items"`
+	BaseCurrency   string                 `json:"base_currency"`
+	Total          money.Cents            `json:"total"`
+	Currency       string                 `json:"currency"`
+	ConvertedTotal money.Cents            `json:"converted_total"`
+	// Unresolved lists lines left out because their product was deleted
+	Unresolved []int64 `json:"unresolved"`
+}
+
+// GetCartInCurrency returns the user's cart with line prices converted from
+// each line's currency to currency (rounded to cents), totalled from the
+// rounded prices.
+func (s *Service) GetCartInCurrency(ctx context.Context, userID, currency string) (ConvertedCartDTO, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		currency = s.BaseCurrency
+	}
+	convert := func(amount float64, from string) (float64, error) {
+		if from == "" {
+			from = s.BaseCurrency
+		}
+		return s.Currency.Convert(amount, from, currency)
+	}
+	// fail on an unknown currency before touching the cart
+	if _, err := convert(0, s.BaseCurrency); err != nil {
+		return ConvertedCartDTO{}, err
+	}
+	lines, total, unresolved, err := s.GetCart(ctx, userID)
+	if err != nil {
+		return ConvertedCartDTO{}, err
+	}
+	out := ConvertedCartDTO{
+		UserID:       userID,
+		Items:        make([]ConvertedCartLineDTO, 0, len(lines)),
+		BaseCurrency: s.BaseCurrency,
+		Total:        total,
+		Currency:     currency,
+		Unresolved:   unresolved,
+	}
+	for _, l := range lines {
+		price, err := convert(l.Price.Float64(), l.Currency)
+		if err != nil {
+			return ConvertedCartDTO{}, err
+		}
+		line := ConvertedCartLineDTO{CartDTO: l, ConvertedPrice: money.FromFloat(price)}
+		out.Items = append(out.Items, line)
+		if !l.Unpriced {
+			out.ConvertedTotal += line.ConvertedPrice.Mul(l.Quantity)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dedupGroup collapses identical calls arriving within a short window into
+// one: the first caller runs fn, the rest wait for it and share its result.
+// Unlike idempotency keys this is in-process and forgets a call as soon as its
+// window has passed; it only exists to absorb double-taps.
+type dedupGroup struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*dedupCall
+}
+
+type dedupCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newDedupGroup() *dedupGroup {
+	return &dedupGroup{entries: make(map[[sha256.Size]byte]*dedupCall)}
+}
+
+// do runs fn unless a call with the same content started less than window ago,
+// in which case it returns that call's result.
+func (g *dedupGroup) do(window time.Duration, fn func() error, content ...interface{}) error {
+	key := sha256.Sum256([]byte(fmt.Sprintf("%q", content)))
+
+	g.mu.Lock()
+	if c, ok := g.entries[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.err
+	}
+	c := &dedupCall{done: make(chan struct{})}
+	g.entries[key] = c
+	g.mu.Unlock()
+
+	time.AfterFunc(window, func() {
+		g.mu.Lock()
+		if g.entries[key] == c {
+			delete(g.entries, key)
+		}
+		g.mu.Unlock()
+	})
+
+	c.err = fn()
+	close(c.done)
+	return c.err
+}
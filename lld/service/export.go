@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"inventory-management/store"
+	"sort"
+	"time"
+)
+
+// ProductExportDTO is a product as written to a catalog backup
+type ProductExportDTO struct {
+	ID                 int64      `json:"id"`
+	Name               string     `json:"name"`
+	Description        string     `json:"description"`
+	Price              *float64   `json:"price"` // null = call for price
+	Stock              int        `json:"stock"`
+	TrackInventory     bool       `json:"track_inventory"`
+	Published          bool       `json:"published"`
+	AvailableFrom      *time.Time `json:"available_from"`
+	AvailableUntil     *time.Time `json:"available_until"`
+	WeightGrams        *int       `json:"weight_grams"`
+	MaxReservedPerUser *int       `json:"max_reserved_per_user"`
+	Tags               []string   `json:"tags"`
+}
+
+// ExportProducts calls fn with every product in the catalog, drafts
+// included, as the store streams them.
+func (s *Service) ExportProducts(ctx context.Context, fn func(ProductExportDTO) error) error {
+	return s.store.ExportProducts(ctx, func(r store.ProductExportRow) error {
+		return fn(toProductExportDTO(r))
+	})
+}
+
+func toProductExportDTO(r store.ProductExportRow) ProductExportDTO {
+	d := ProductExportDTO{
+		ID:             r.ID,
+		Name:           r.Name,
+		Description:    r.Description.String,
+		Stock:          r.Stock,
+		TrackInventory: r.TrackInventory,
+		Published:      r.Published,
+		Tags:           r.Tags,
+	}
+	if d.Tags == nil {
+		d.Tags = []string{}
+	}
+	if r.Price.Valid {
+		p := r.Price.Float64
+		d.Price = &p
+	}
+	if r.AvailableFrom.Valid {
+		t := r.AvailableFrom.Time
+		d.AvailableFrom = &t
+	}
+	if r.AvailableUntil.Valid {
+		t := r.AvailableUntil.Time
+		d.AvailableUntil = &t
+	}
+	if r.WeightGrams.Valid {
+		g := int(r.WeightGrams.Int64)
+		d.WeightGrams = &g
+	}
+	if r.MaxReservedPerUser.Valid {
+		n := int(r.MaxReservedPerUser.Int64)
+		d.MaxReservedPerUser = &n
+	}
+	return d
+}
+
+// ImportBatchSize is how many records ImportProducts writes per transaction
+const ImportBatchSize = 200
+
+// ImportReport is what ImportProducts did with a catalog. Skipped counts
+// records that were invalid (listed in Errors) or already matched the
+// catalog.
+type ImportReport struct {
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Skipped int           `json:"skipped"`
+	Errors  []ImportError `json:"errors"`
+}
+
+// ImportError is a record ImportProducts rejected; Index is its position in
+// the import.
+type ImportError struct {
+	Index int    `json:"index"`
+	ID    int64  `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportProducts upserts an exported catalog by id (see
+// store.ImportProducts), ImportBatchSize records per transaction. Each record
+// is validated like CreateProduct; invalid ones are skipped and reported. If
+// the store fails, the batches written before it stay written and the report
+// covers them.
+func (s *Service) ImportProducts(ctx context.Context, records []ProductExportDTO) (ImportReport, error) {
+	rep := ImportReport{Errors: []ImportError{}}
+	seen := make(map[int64]bool, len(records))
+	batch := make([]store.ProductExportRow, 0, ImportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		outcomes, err := s.store.ImportProducts(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, o := range outcomes {
+			switch o {
+			case store.ImportCreated:
+				rep.Created++
+			case store.ImportUpdated:
+				rep.Updated++
+			default:
+				rep.Skipped++
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for i, rec := range records {
+		row, err := s.importRow(ctx, rec)
+		if err == nil && rec.ID != 0 && seen[rec.ID] {
+			err = errors.New("duplicate id")
+		}
+		if err != nil {
+			rep.Skipped++
+			rep.Errors = append(rep.Errors, ImportError{Index: i, ID: rec.ID, Error: err.Error()})
+			continue
+		}
+		seen[rec.ID] = true
+		batch = append(batch, row)
+		if len(batch) == ImportBatchSize {
+			if err := flush(); err != nil {
+				return rep, err
+			}
+		}
+	}
+	return rep, flush()
+}
+
+// importRow validates an imported record and converts it for the store
+func (s *Service) importRow(ctx context.Context, d ProductExportDTO) (store.ProductExportRow, error) {
+	if d.ID < 0 {
+		return store.ProductExportRow{}, errors.New("id must be >= 0")
+	}
+	if d.Name == "" {
+		return store.ProductExportRow{}, errors.New("name required")
+	}
+	name, err := normalizeText("name", d.Name, s.MaxNameLen)
+	if err != nil {
+		return store.ProductExportRow{}, err
+	}
+	desc, err := normalizeText("description", d.Description, s.MaxDescriptionLen)
+	if err != nil {
+		return store.ProductExportRow{}, err
+	}
+	switch {
+	case d.Price != nil && *d.Price < 0:
+		return store.ProductExportRow{}, errors.New("price must be >= 0")
+	case d.Stock < 0:
+		return store.ProductExportRow{}, errors.New("stock must be >= 0")
+	case d.WeightGrams != nil && *d.WeightGrams < 0:
+		return store.ProductExportRow{}, errors.New("weight_grams must be >= 0")
+	case d.MaxReservedPerUser != nil && *d.MaxReservedPerUser <= 0:
+		return store.ProductExportRow{}, errors.New("max_reserved_per_user must be > 0")
+	case d.AvailableFrom != nil && d.AvailableUntil != nil && !d.AvailableUntil.After(*d.AvailableFrom):
+		return store.ProductExportRow{}, errors.New("available_until must be after available_from")
+	}
+	r := store.ProductExportRow{
+		ID:             d.ID,
+		Name:           name,
+		Description:    sql.NullString{String: desc, Valid: true},
+		Stock:          d.Stock,
+		TrackInventory: d.TrackInventory,
+		Published:      d.Published,
+		Tags:           []string{},
+	}
+	if d.Price != nil {
+		r.Price = sql.NullFloat64{Float64: *d.Price, Valid: true}
+	}
+	if d.AvailableFrom != nil {
+		r.AvailableFrom = sql.NullTime{Time: *d.AvailableFrom, Valid: true}
+	}
+	if d.AvailableUntil != nil {
+		r.AvailableUntil = sql.NullTime{Time: *d.AvailableUntil, Valid: true}
+	}
+	if d.WeightGrams != nil {
+		r.WeightGrams = sql.NullInt64{Int64: int64(*d.WeightGrams), Valid: true}
+	}
+	if d.MaxReservedPerUser != nil {
+		r.MaxReservedPerUser = sql.NullInt64{Int64: int64(*d.MaxReservedPerUser), Valid: true}
+	}
+	tags := make(map[string]bool, len(d.Tags))
+	for _, tag := range d.Tags {
+		t, err := normalizeTag(tag)
+		if err != nil {
+			return store.ProductExportRow{}, fmt.Errorf("tag %q: %w", tag, err)
+		}
+		if !tags[t] {
+			tags[t] = true
+			r.Tags = append(r.Tags, t)
+		}
+	}
+	sort.Strings(r.Tags)
+	return r, nil
+}
@@ -1,11 +1,78 @@
 package service
 
+import (
+	"context"
+	"inventory-management/money"
+	"inventory-management/store"
+	"time"
+)
+
 type ServiceInterface interface {
-	CreateProduct(name, desc string, price float64) (int64, error)
-	ListProducts() ([]ProductDTO, error)
-	AddToCart(userID string, productID int64, qty int) error
-	RemoveFromCart(userID string, productID int64) error
-	GetCart(userID string) ([]CartDTO, float64, error)
-	Checkout(userID string) (OrderDTO, error)
-	UpdateStock(productID int64, newStock int) error
+	Ping(ctx context.Context) error
+	CreateProduct(ctx context.Context, name, desc string, price money.Cents, category, currency string) (int64, error)
+	CreateProducts(ctx context.Context, products []NewProduct) ([]int64, error)
+	GetProduct(ctx context.Context, id int64) (ProductDTO, error)
+	UpdateProduct(ctx context.Context, id int64, name, desc string, price money.Cents, category, currency string, version int) error
+	ListProducts(ctx context.Context, sort string) ([]ProductDTO, error)
+	ListProductsByCategory(ctx context.Context, category string) ([]ProductDTO, error)
+	CloneProduct(ctx context.Context, id int64) (int64, error)
+	SetPublished(ctx context.Context, id int64, published bool) error
+	PublishProducts(ctx context.Context, ids []int64) ([]int64, error)
+	ListAllProducts(ctx context.Context, includeDeleted bool) ([]ProductDTO, error)
+	ListLowStockProducts(ctx context.Context, threshold int) ([]ProductDTO, error)
+	RestoreProduct(ctx context.Context, id int64) error
+	DeleteProduct(ctx context.Context, id int64, strict bool) (int, error)
+	SearchProducts(ctx context.Context, q string) ([]ProductDTO, error)
+	ListProductsPage(ctx context.Context, limit, offset int, sort string) ([]ProductDTO, error)
+	CountProducts(ctx context.Context, exact bool) (int64, error)
+	ListAvailableProducts(ctx context.Context) ([]ProductDTO, error)
+	SetAvailability(ctx context.Context, productID int64, from, until *time.Time) error
+	CreatePurchaseOrder(ctx context.Context, productID int64, qty int, expectedAt time.Time) (int64, error)
+	GetPrices(ctx context.Context, ids []int64) (map[int64]money.Cents, error)
+	ListProductsByTags(ctx context.Context, tags []string) ([]ProductDTO, error)
+	AddTag(ctx context.Context, productID int64, tag string) error
+	RemoveTag(ctx context.Context, productID int64, tag string) error
+	ListTags(ctx context.Context, productID int64) ([]string, error)
+	AddToCart(ctx context.Context, userID string, productID int64, qty int) error
+	RemoveFromCart(ctx context.Context, userID string, productID int64) error
+	UpdateCartQuantity(ctx context.Context, userID string, productID int64, newQty int) error
+	AddToCartBatch(ctx context.Context, userID string, items []CartBatchItem, mode string) ([]CartBatchResult, error)
+	RemoveFromCartBatch(ctx context.Context, userID string, productIDs []int64, mode string) ([]CartBatchResult, error)
+	ClearCart(ctx context.Context, userID string) error
+	GetCart(ctx context.Context, userID string) ([]CartDTO, money.Cents, []int64, error)
+	GetCartInCurrency(ctx context.Context, userID, currency string) (ConvertedCartDTO, error)
+	GetCartDetailed(ctx context.Context, userID string) ([]CartDetailDTO, money.Cents, error)
+	CheckFulfillable(ctx context.Context, userID string) (bool, []int64, error)
+	EstimateShipping(ctx context.Context, userID string, destination string) (float64, error)
+	QuoteCheckout(ctx context.Context, userID string, hold bool) (QuoteDTO, error)
+	Checkout(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions) (OrderDTO, error)
+	CheckoutAndPay(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions, token string) (OrderDTO, error)
+	GetOrderHistory(ctx context.Context, userID string) ([]OrderDTO, error)
+	GetOrder(ctx context.Context, userID string, orderID int64) (OrderDTO, error)
+	CancelOrder(ctx context.Context, orderID int64, userID string) error
+	ListAllOrders(ctx context.Context, filter store.OrderFilter, limit, offset int) ([]OrderDTO, int64, error)
+	OrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time, limit, offset int) ([]ProductOrderDTO, int64, error)
+	UpdateOrderStatus(ctx context.Context, orderID int64, status string) error
+	UpdateOrderStatusBatch(ctx context.Context, orderIDs []int64, status string, strict bool) ([]int64, error)
+	SalesVelocity(ctx context.Context, productID int64, days int) (float64, error)
+	ReorderSuggestion(ctx context.Context, productID int64) (int, error)
+	RestoreCancelledOrderToCart(ctx context.Context, userID string, orderID int64) ([]CartDTO, []int64, error)
+	GetCartSnapshot(ctx context.Context, orderID int64) (CartSnapshotDTO, error)
+	ListReviews(ctx context.Context, productID int64, q store.ReviewQuery) ([]ReviewDTO, int64, error)
+	ReviewSummary(ctx context.Context, productID int64) (ReviewSummaryDTO, error)
+	UpdateOrderMetadata(ctx context.Context, orderID int64, meta map[string]string) error
+	ReturnOrderItem(ctx context.Context, orderID int64, userID string, productID int64, qty int, restock bool) error
+	GetStock(ctx context.Context, productID int64) (int, error)
+	UpdateStock(ctx context.Context, productID int64, newStock int) error
+	AdjustStock(ctx context.Context, productID int64, delta int) error
+	UpdateStockBatch(ctx context.Context, updates []store.StockUpdate) error
+	ListAllStockMovements(ctx context.Context, filter store.MovementFilter, limit, offset int) ([]StockMovementDTO, int64, error)
+	SetTrackInventory(ctx context.Context, productID int64, track bool) error
+	SetReservationLimit(ctx context.Context, productID int64, limit *int) error
+	ExportProducts(ctx context.Context, fn func(ProductExportDTO) error) error
+	ImportProducts(ctx context.Context, records []ProductExportDTO) (ImportReport, error)
+	SetBundleComponents(ctx context.Context, bundleID int64, components []store.BundleComponent) error
+
+	ListOutboxEvents(ctx context.Context, status string) ([]OutboxEventDTO, error)
+	ReplayOutboxEvent(ctx context.Context, id int64) (OutboxEventDTO, error)
 }
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"inventory-management/store"
+	"time"
+)
+
+// MaxMovementPageSize caps the limit accepted by ListAllStockMovements.
+const MaxMovementPageSize = 500
+
+type StockMovementDTO struct {
+	ID        int64     `json:"id"`
+	ProductID int64     `json:"product_id"`
+	Delta     int       `json:"delta"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListAllStockMovements returns one page of the stock ledger across all
+// products, newest first, along with the number of entries matching filter.
+func (s *Service) ListAllStockMovements(ctx context.Context, filter store.MovementFilter, limit, offset int) ([]StockMovementDTO, int64, error) {
+	if limit <= 0 || limit > MaxMovementPageSize {
+		return nil, 0, fmt.Errorf("limit must be between 1 and %d", MaxMovementPageSize)
+	}
+	if offset < 0 {
+		return nil, 0, errors.New("offset must be >= 0")
+	}
+	if filter.ProductID < 0 {
+		return nil, 0, errors.New("product_id must be > 0")
+	}
+	switch filter.Reason {
+	case "", store.MovementReserve, store.MovementRelease, store.MovementReturn, store.MovementAdjustment, store.MovementExpire:
+	default:
+		return nil, 0, fmt.Errorf("unknown reason %q", filter.Reason)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.To.After(filter.From) {
+		return nil, 0, errors.New("to must be after from")
+	}
+	rows, err := s.store.ListAllStockMovements(ctx, filter, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.store.CountStockMovements(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]StockMovementDTO, 0, len(rows))
+	for _, m := range rows {
+		out = append(out, StockMovementDTO{ID: m.ID, ProductID: m.ProductID, Delta: m.Delta, Reason: m.Reason, CreatedAt: m.CreatedAt})
+	}
+	return out, total, nil
+}
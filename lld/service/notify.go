@@ -0,0 +1,207 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Message is an alert rendered for people to read.
+type Message struct {
+	Subject string
+	Body    string
+}
+
+// NotificationChannel delivers messages to people (email, SMS, ...). Send may
+// block and may fail; ChannelNotifier calls it off the request path and
+// retries.
+type NotificationChannel interface {
+	Send(m Message) error
+}
+
+// NopChannel drops every message. It's the channel used when none is
+// configured.
+type NopChannel struct{}
+
+func (NopChannel) Send(Message) error { return nil }
+
+// SMTPChannel emails messages through an SMTP relay.
+type SMTPChannel struct {
+	Addr string // host:port
+	Auth smtp.Auth
+	From string
+	To   []string
+
+	// sendMail is smtp.SendMail unless a test replaces it
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (c SMTPChannel) Send(m Message) error {
+	if len(c.To) == 0 {
+		return fmt.Errorf("smtp: no recipients")
+	}
+	send := c.sendMail
+	if send == nil {
+		send = smtp.SendMail
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", m.Subject)
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return send(c.Addr, c.Auth, c.From, c.To, msg.Bytes())
+}
+
+// SMSProvider sends one text message; implement it for the SMS gateway in use.
+type SMSProvider interface {
+	SendSMS(to, text string) error
+}
+
+// SMSChannel texts messages to each of To through Provider. SMS has no
+// subject line, so the subject leads the text.
+type SMSChannel struct {
+	Provider SMSProvider
+	To       []string
+}
+
+func (c SMSChannel) Send(m Message) error {
+	text := m.Subject
+	if m.Body != "" {
+		text += ": " + m.Body
+	}
+	for _, to := range c.To {
+		if err := c.Provider.SendSMS(to, text); err != nil {
+			return fmt.Errorf("sms to %s: %w", to, err)
+		}
+	}
+	return nil
+}
+
+// Default templates for alert messages; they see the Alert's fields
+const (
+	DefaultAlertSubject = `[{{.Kind}}] product {{.ProductID}}`
+	DefaultAlertBody    = "Product {{.ProductID}}: {{.Message}}\n\nRaised at {{.At.UTC.Format \"2006-01-02 15:04:05\"}} UTC."
+)
+
+// ChannelNotifier is a Notifier that renders alerts with its templates and
+// delivers them on a NotificationChannel from a background goroutine, so
+// Notify never waits on the network. A failed send is retried up to Attempts
+// times in all, with Backoff doubling between tries; alerts that arrive while
+// the queue is full are logged and dropped.
+type ChannelNotifier struct {
+	channel  NotificationChannel
+	subject  *template.Template
+	body     *template.Template
+	attempts int
+	backoff  time.Duration
+
+	queue chan Alert
+	done  chan struct{}
+	once  sync.Once
+}
+
+// ChannelOptions tunes NewChannelNotifier; zero fields take the defaults.
+type ChannelOptions struct {
+	Subject  string        // template, DefaultAlertSubject
+	Body     string        // template, DefaultAlertBody
+	Attempts int           // 3
+	Backoff  time.Duration // 1s
+	Queue    int           // 100 pending alerts
+}
+
+// NewChannelNotifier starts a ChannelNotifier on ch. Call Close to stop it
+// once pending alerts are sent.
+func NewChannelNotifier(ch NotificationChannel, opts ChannelOptions) (*ChannelNotifier, error) {
+	if opts.Subject == "" {
+		opts.Subject = DefaultAlertSubject
+	}
+	if opts.Body == "" {
+		opts.Body = DefaultAlertBody
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = 100
+	}
+	subject, err := template.New("subject").Parse(opts.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("subject template: %w", err)
+	}
+	body, err := template.New("body").Parse(opts.Body)
+	if err != nil {
+		return nil, fmt.Errorf("body template: %w", err)
+	}
+	n := &ChannelNotifier{
+		channel:  ch,
+		subject:  subject,
+		body:     body,
+		attempts: opts.Attempts,
+		backoff:  opts.Backoff,
+		queue:    make(chan Alert, opts.Queue),
+		done:     make(chan struct{}),
+	}
+	go n.run()
+	return n, nil
+}
+
+// Notify queues a for delivery.
+func (n *ChannelNotifier) Notify(a Alert) {
+	select {
+	case n.queue <- a:
+	default:
+		log.Printf("notify: queue full, dropping %s alert for product %d", a.Kind, a.ProductID)
+	}
+}
+
+// Close stops accepting alerts and waits for the queued ones to be delivered
+// (or to run out of attempts).
+func (n *ChannelNotifier) Close() {
+	n.once.Do(func() { close(n.queue) })
+	<-n.done
+}
+
+// Render returns the message a would be sent as.
+func (n *ChannelNotifier) Render(a Alert) (Message, error) {
+	var subject, body bytes.Buffer
+	if err := n.subject.Execute(&subject, a); err != nil {
+		return Message{}, err
+	}
+	if err := n.body.Execute(&body, a); err != nil {
+		return Message{}, err
+	}
+	return Message{Subject: subject.String(), Body: body.String()}, nil
+}
+
+func (n *ChannelNotifier) run() {
+	defer close(n.done)
+	for a := range n.queue {
+		m, err := n.Render(a)
+		if err != nil {
+			log.Printf("notify: rendering %s alert for product %d: %v", a.Kind, a.ProductID, err)
+			continue
+		}
+		wait := n.backoff
+		for attempt := 1; ; attempt++ {
+			err = n.channel.Send(m)
+			if err == nil {
+				break
+			}
+			if attempt == n.attempts {
+				log.Printf("notify: giving up on %s alert for product %d after %d attempts: %v", a.Kind, a.ProductID, attempt, err)
+				break
+			}
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
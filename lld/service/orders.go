@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"inventory-management/money"
+	"inventory-management/store"
+	"math"
+	"time"
+)
+
+// MaxOrderPageSize caps the limit accepted by ListAllOrders.
+const MaxOrderPageSize = 100
+
+// ListAllOrders returns one page of orders across all users, newest first,
+// along with the number of orders matching filter. Items are not loaded.
+func (s *Service) ListAllOrders(ctx context.Context, filter store.OrderFilter, limit, offset int) ([]OrderDTO, int64, error) {
+	if limit <= 0 || limit > MaxOrderPageSize {
+		return nil, 0, fmt.Errorf("limit must be between 1 and %d", MaxOrderPageSize)
+	}
+	if offset < 0 {
+		return nil, 0, errors.New("offset must be >= 0")
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.To.After(filter.From) {
+		return nil, 0, errors.New("to must be after from")
+	}
+	rows, err := s.store.ListAllOrders(ctx, filter, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.store.CountOrders(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]OrderDTO, 0, len(rows))
+	for _, o := range rows {
+		out = append(out, OrderDTO{
+			ID:        o.ID,
+			UserID:    o.UserID,
+			Total:     o.Total,
+			Currency:  o.Currency,
+			Status:    o.Status,
+			Metadata:  o.Metadata,
+			CreatedAt: o.CreatedAt,
+		})
+	}
+	return out, total, nil
+}
+
+// GetOrderHistory returns all of a user's orders with their lines, newest
+// first.
+func (s *Service) GetOrderHistory(ctx context.Context, userID string) ([]OrderDTO, error) {
+	if userID == "" {
+		return nil, errors.New("user_id required")
+	}
+	rows, err := s.store.ListOrders(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]OrderDTO, 0, len(rows))
+	for _, o := range rows {
+		items, err := s.store.ListOrderItems(ctx, o.ID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, orderDTO(o, items))
+	}
+	return out, nil
+}
+
+// ErrForbidden returned when a user asks for another user's order
+var ErrForbidden = errors.New("forbidden")
+
+// GetOrder returns one of the user's orders with its lines. An unknown order
+// is sql.ErrNoRows; another user's order is ErrForbidden.
+func (s *Service) GetOrder(ctx context.Context, userID string, orderID int64) (OrderDTO, error) {
+	if userID == "" {
+		return OrderDTO{}, errors.New("user_id required")
+	}
+	if orderID <= 0 {
+		return OrderDTO{}, errors.New("order id must be > 0")
+	}
+	o, items, err := s.store.GetOrder(ctx, orderID)
+	if err != nil {
+		return OrderDTO{}, err
+	}
+	if o.UserID != userID {
+		return OrderDTO{}, fmt.Errorf("%w: order %d belongs to another user", ErrForbidden, orderID)
+	}
+	return orderDTO(o, items), nil
+}
+
+func orderDTO(o store.OrderRow, items []store.OrderItemRow) OrderDTO {
+	od := OrderDTO{
+		ID:         o.ID,
+		UserID:     o.UserID,
+		Total:      o.Total,
+		Currency:   o.Currency,
+		Status:     o.Status,
+		Metadata:   o.Metadata,
+		CreatedAt:  o.CreatedAt,
+		Items:      make([]CartDTO, 0, len(items)),
+		Discount:   o.Discount,
+		CouponCode: o.CouponCode,
+	}
+	for _, it := range items {
+		od.Items = append(od.Items, CartDTO{ProductID: it.ProductID, Quantity: it.Quantity, Price: it.Price, Currency: o.Currency, Name: it.Name})
+	}
+	return od
+}
+
+// ProductOrderDTO is an order containing some product, with how many of it
+// the order has and at what price
+type ProductOrderDTO struct {
+	OrderDTO
+	Quantity int         `json:"quantity"`
+	Price    money.Cents `json:"price"`
+}
+
+// OrdersContainingProduct returns one page of the orders a product was bought
+// in, placed within [from, to) (zero times are open ends), newest first,
+// along with how many there are in all.
+func (s *Service) OrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time, limit, offset int) ([]ProductOrderDTO, int64, error) {
+	if productID <= 0 {
+		return nil, 0, errors.New("product id must be > 0")
+	}
+	if limit <= 0 || limit > MaxOrderPageSize {
+		return nil, 0, fmt.Errorf("limit must be between 1 and %d", MaxOrderPageSize)
+	}
+	if offset < 0 {
+		return nil, 0, errors.New("offset must be >= 0")
+	}
+	if !from.IsZero() && !to.IsZero() && !to.After(from) {
+		return nil, 0, errors.New("to must be after from")
+	}
+	rows, err := s.store.OrdersContainingProduct(ctx, productID, from, to, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.store.CountOrdersContainingProduct(ctx, productID, from, to)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]ProductOrderDTO, 0, len(rows))
+	for _, o := range rows {
+		out = append(out, ProductOrderDTO{
+			OrderDTO: OrderDTO{
+				ID:        o.ID,
+				UserID:    o.UserID,
+				Total:     o.Total,
+				Currency:  o.Currency,
+				Status:    o.Status,
+				Metadata:  o.Metadata,
+				CreatedAt: o.CreatedAt,
+			},
+			Quantity: o.Quantity,
+			Price:    o.Price,
+		})
+	}
+	return out, total, nil
+}
+
+// checkStatusTarget accepts the statuses an order can be moved to by a plain
+// status change: placed/pending/paid are set by checkout and payment, and
+// cancelling goes through CancelOrder, which restocks.
+func checkStatusTarget(status string) error {
+	switch status {
+	case store.OrderStatusShipped, store.OrderStatusDelivered:
+		return nil
+	case store.OrderStatusPlaced, store.OrderStatusPending, store.OrderStatusPaid, store.OrderStatusCancelled:
+		return fmt.Errorf("%w: orders can't be moved to %s by a status change", store.ErrInvalidTransition, status)
+	}
+	return fmt.Errorf("unknown status %q", status)
+}
+
+// UpdateOrderStatus moves one order along its fulfilment lifecycle (to
+// shipped, then delivered). An unknown order is sql.ErrNoRows; a move its
+// current status doesn't allow is store.ErrInvalidTransition.
+func (s *Service) UpdateOrderStatus(ctx context.Context, orderID int64, status string) error {
+	if orderID <= 0 {
+		return errors.New("order id must be > 0")
+	}
+	if err := checkStatusTarget(status); err != nil {
+		return err
+	}
+	return s.store.UpdateOrderStatus(ctx, orderID, status)
+}
+
+// MaxOrderStatusBatch caps how many orders one UpdateOrderStatusBatch call
+// may touch.
+const MaxOrderStatusBatch = 100
+
+// UpdateOrderStatusBatch moves the given orders to status and returns the
+// ids that were updated. Duplicate ids are ignored. With strict set one
+// missing order or invalid transition fails the whole batch; otherwise such
+// orders are skipped.
+func (s *Service) UpdateOrderStatusBatch(ctx context.Context, orderIDs []int64, status string, strict bool) ([]int64, error) {
+	if len(orderIDs) == 0 {
+		return nil, errors.New("order_ids required")
+	}
+	if len(orderIDs) > MaxOrderStatusBatch {
+		return nil, fmt.Errorf("%w: at most %d per request", ErrTooManyIDs, MaxOrderStatusBatch)
+	}
+	if err := checkStatusTarget(status); err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]bool, len(orderIDs))
+	ids := make([]int64, 0, len(orderIDs))
+	for _, id := range orderIDs {
+		if id <= 0 {
+			return nil, errors.New("order ids must be > 0")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	updated, err := s.store.UpdateOrderStatusBatch(ctx, ids, status, strict)
+	if err != nil {
+		return nil, err
+	}
+	if updated == nil {
+		updated = []int64{}
+	}
+	return updated, nil
+}
+
+// MaxVelocityDays caps the window accepted by SalesVelocity.
+const MaxVelocityDays = 365
+
+// SalesVelocity returns a product's average units sold per day over the last
+// days days.
+func (s *Service) SalesVelocity(ctx context.Context, productID int64, days int) (float64, error) {
+	if productID <= 0 {
+		return 0, errors.New("product id must be > 0")
+	}
+	if days <= 0 || days > MaxVelocityDays {
+		return 0, fmt.Errorf("days must be between 1 and %d", MaxVelocityDays)
+	}
+	return s.store.SalesVelocity(ctx, productID, time.Duration(days)*24*time.Hour)
+}
+
+// ReorderPolicy parameterizes ReorderSuggestion.
+type ReorderPolicy struct {
+	LeadDays     int // days between placing a purchase order and receiving it
+	SafetyStock  int // units to keep on hand on top of lead-time demand
+	VelocityDays int // sales window the demand estimate is based on
+}
+
+// DefaultReorderPolicy is used by NewService.
+var DefaultReorderPolicy = ReorderPolicy{LeadDays: 14, SafetyStock: 5, VelocityDays: 30}
+
+// ReorderSuggestion returns how many units to order now so stock covers the
+// lead time plus safety stock: max(0, velocity*leadDays + safetyStock - stock),
+// rounded up. A product with no sales only gets topped up to safety stock.
+func (s *Service) ReorderSuggestion(ctx context.Context, productID int64) (int, error) {
+	if productID <= 0 {
+		return 0, errors.New("product id must be > 0")
+	}
+	stock, err := s.store.GetStock(ctx, productID)
+	if err != nil {
+		return 0, err
+	}
+	if stock == store.UntrackedStock {
+		return 0, fmt.Errorf("%w: product %d", store.ErrUntrackedInventory, productID)
+	}
+	p := s.ReorderPolicy
+	velocity, err := s.store.SalesVelocity(ctx, productID, time.Duration(p.VelocityDays)*24*time.Hour)
+	if err != nil {
+		return 0, err
+	}
+	need := int(math.Ceil(velocity*float64(p.LeadDays))) + p.SafetyStock - stock
+	if need < 0 {
+		return 0, nil
+	}
+	return need, nil
+}
+
+// CancelOrder cancels one of the user's placed orders and restocks its lines;
+// see store.CancelOrder. Another user's order is ErrForbidden.
+func (s *Service) CancelOrder(ctx context.Context, orderID int64, userID string) error {
+	if userID == "" {
+		return errors.New("user_id required")
+	}
+	if orderID <= 0 {
+		return errors.New("order id must be > 0")
+	}
+	if err := s.store.CancelOrder(ctx, orderID, userID); err != nil {
+		if errors.Is(err, store.ErrNotOrderOwner) {
+			return fmt.Errorf("%w: order %d belongs to another user", ErrForbidden, orderID)
+		}
+		return err
+	}
+	return nil
+}
+
+// ErrOrderNotCancelled returned when restoring the cart of an order that
+// wasn't cancelled.
+var ErrOrderNotCancelled = errors.New("order is not cancelled")
+
+// RestoreCancelledOrderToCart re-adds every line of the user's cancelled order
+// to their cart, reserving current stock. Lines that can't be reserved (out of
+// stock, unpublished, unpriced, gone) are skipped and their product ids
+// returned; the rest come back as the restored cart lines. Orders of other
+// users are reported as not found.
+func (s *Service) RestoreCancelledOrderToCart(ctx context.Context, userID string, orderID int64) ([]CartDTO, []int64, error) {
+	if userID == "" {
+		return nil, nil, errors.New("user_id required")
+	}
+	if orderID <= 0 {
+		return nil, nil, errors.New("order id must be > 0")
+	}
+	order, items, err := s.store.GetOrder(ctx, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if order.UserID != userID {
+		return nil, nil, sql.ErrNoRows
+	}
+	if order.Status != store.OrderStatusCancelled {
+		return nil, nil, fmt.Errorf("%w: order %d is %s", ErrOrderNotCancelled, orderID, order.Status)
+	}
+	restored := make([]CartDTO, 0, len(items))
+	var unavailable []int64
+	for _, it := range items {
+		err := s.AddToCart(ctx, userID, it.ProductID, it.Quantity)
+		switch {
+		case err == nil:
+			restored = append(restored, CartDTO{ProductID: it.ProductID, Quantity: it.Quantity})
+		case unrestorable(err):
+			unavailable = append(unavailable, it.ProductID)
+		default:
+			return restored, unavailable, err
+		}
+	}
+	return restored, unavailable, nil
+}
+
+// unrestorable reports whether err means the line can't be added right now,
+// as opposed to a failure that should abort the restore.
+func unrestorable(err error) bool {
+	for _, target := range []error{
+		store.ErrInsufficientStock, store.ErrQuantityOutOfRange, store.ErrNotPublished,
+		store.ErrNoPrice, store.ErrNotAvailableYet, store.ErrNoLongerAvailable, sql.ErrNoRows,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// CartSnapshotDTO is the cart an order was placed from, as it stood at
+// checkout (lines dropped by remove_unavailable included).
+type CartSnapshotDTO struct {
+	OrderID int64                 `json:"order_id"`
+	UserID  string                `json:"user_id"`
+	Items   []CartSnapshotLineDTO `json:"items"`
+}
+
+type CartSnapshotLineDTO struct {
+	ProductID int64        `json:"product_id"`
+	Quantity  int          `json:"quantity"`
+	Price     *money.Cents `json:"price"`
+	Removed   bool         `json:"removed,omitempty"`
+}
+
+// GetCartSnapshot returns the cart snapshot kept on an order at checkout.
+func (s *Service) GetCartSnapshot(ctx context.Context, orderID int64) (CartSnapshotDTO, error) {
+	if orderID <= 0 {
+		return CartSnapshotDTO{}, errors.New("order_id must be > 0")
+	}
+	userID, lines, err := s.store.GetCartSnapshot(ctx, orderID)
+	if err != nil {
+		return CartSnapshotDTO{}, err
+	}
+	out := CartSnapshotDTO{OrderID: orderID, UserID: userID, Items: make([]CartSnapshotLineDTO, 0, len(lines))}
+	for _, l := range lines {
+		out.Items = append(out.Items, CartSnapshotLineDTO{ProductID: l.ProductID, Quantity: l.Quantity, Price: l.Price, Removed: l.Removed})
+	}
+	return out, nil
+}
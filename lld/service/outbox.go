@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"inventory-management/store"
+	"time"
+)
+
+// ErrOutboxAlreadyPending returned when replaying an event that hasn't been
+// attempted yet.
+var ErrOutboxAlreadyPending = errors.New("outbox event already pending")
+
+// OutboxEventDTO is an outbox event as shown to admins
+type OutboxEventDTO struct {
+	ID          int64           `json:"id"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	PublishedAt *time.Time      `json:"published_at,omitempty"`
+}
+
+// ListOutboxEvents returns outbox events in the given status
+func (s *Service) ListOutboxEvents(ctx context.Context, status string) ([]OutboxEventDTO, error) {
+	switch status {
+	case store.OutboxPending, store.OutboxPublished, store.OutboxFailed:
+	default:
+		return nil, fmt.Errorf("unknown outbox status %q", status)
+	}
+	rows, err := s.store.ListOutboxEvents(ctx, status)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]OutboxEventDTO, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, toOutboxEventDTO(r))
+	}
+	return out, nil
+}
+
+// ReplayOutboxEvent re-queues an event for the publisher and returns it as
+// it was before the reset.
+func (s *Service) ReplayOutboxEvent(ctx context.Context, id int64) (OutboxEventDTO, error) {
+	ev, err := s.store.GetOutboxEvent(ctx, id)
+	if err != nil {
+		return OutboxEventDTO{}, err
+	}
+	if ev.Status == store.OutboxPending {
+		return OutboxEventDTO{}, ErrOutboxAlreadyPending
+	}
+	if err := s.store.MarkOutboxUnpublished(ctx, id); err != nil {
+		return OutboxEventDTO{}, err
+	}
+	return toOutboxEventDTO(ev), nil
+}
+
+func toOutboxEventDTO(r store.OutboxRow) OutboxEventDTO {
+	d := OutboxEventDTO{
+		ID:        r.ID,
+		EventType: r.EventType,
+		Payload:   json.RawMessage(r.Payload),
+		Status:    r.Status,
+		Attempts:  r.Attempts,
+		CreatedAt: r.CreatedAt,
+	}
+	if r.LastError.Valid {
+		d.LastError = r.LastError.String
+	}
+	if r.PublishedAt.Valid {
+		t := r.PublishedAt.Time
+		d.PublishedAt = &t
+	}
+	return d
+}
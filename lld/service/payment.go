@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"inventory-management/money"
+	"inventory-management/store"
+	"log"
+	"time"
+)
+
+// DefaultPaymentTimeout bounds one PaymentGateway.Charge call
+const DefaultPaymentTimeout = 30 * time.Second
+
+// PaymentGateway charges a customer for an order; amount is the order total
+// in cents. token is the payment method as tokenised by the client; the
+// returned charge id is kept on the order. Charge should give up, without
+// charging, once ctx is done.
+type PaymentGateway interface {
+	Charge(ctx context.Context, amount money.Cents, token string) (chargeID string, err error)
+}
+
+var (
+	// ErrPaymentDeclined is what a gateway wraps when the charge is refused
+	ErrPaymentDeclined = errors.New("payment declined")
+	// ErrPaymentTimeout returned when the gateway didn't answer within
+	// PaymentTimeout
+	ErrPaymentTimeout = errors.New("payment timed out")
+	// ErrPaymentFailed returned for any other gateway failure
+	ErrPaymentFailed = errors.New("payment failed")
+	// ErrNoPaymentGateway returned by CheckoutAndPay when no gateway is set
+	ErrNoPaymentGateway = errors.New("payments are not configured")
+)
+
+// CheckoutAndPay checks the cart out as a pending order and charges its
+// total through Payments. A successful charge marks the order paid; a
+// declined, failed or timed-out one cancels it and gives its stock back, so
+// the reservation never outlives the attempt.
+func (s *Service) CheckoutAndPay(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions, token string) (OrderDTO, error) {
+	if s.Payments == nil {
+		return OrderDTO{}, ErrNoPaymentGateway
+	}
+	if token == "" {
+		return OrderDTO{}, errors.New("payment_token required")
+	}
+	opts.PendingPayment = true
+	od, err := s.placeOrder(ctx, userID, meta, opts)
+	if err != nil {
+		return OrderDTO{}, err
+	}
+
+	timeout := s.PaymentTimeout
+	if timeout <= 0 {
+		timeout = DefaultPaymentTimeout
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	chargeID, err := s.Payments.Charge(cctx, od.Total, token)
+	// Settling the order must happen even if the client went away during the
+	// charge: a pending order left behind would hold its stock forever, and a
+	// charge not recorded would never be marked paid.
+	sctx := context.WithoutCancel(ctx)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrPaymentDeclined):
+		case errors.Is(err, context.DeadlineExceeded) || errors.Is(cctx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("%w after %v", ErrPaymentTimeout, timeout)
+		default:
+			err = fmt.Errorf("%w: %v", ErrPaymentFailed, err)
+		}
+		if cerr := s.store.CancelPendingOrder(sctx, od.ID); cerr != nil {
+			log.Printf("payment: order %d: %v, and cancelling it failed: %v", od.ID, err, cerr)
+			return OrderDTO{}, fmt.Errorf("%w (order %d not cancelled: %v)", err, od.ID, cerr)
+		}
+		return OrderDTO{}, err
+	}
+	if err := s.store.MarkOrderPaid(sctx, od.ID, chargeID); err != nil {
+		log.Printf("payment: order %d charged as %s but not marked paid: %v", od.ID, chargeID, err)
+		return OrderDTO{}, fmt.Errorf("order %d charged as %s but not marked paid: %w", od.ID, chargeID, err)
+	}
+	od.Status = store.OrderStatusPaid
+	od.ChargeID = chargeID
+	s.afterCheckout(ctx, od)
+	return od, nil
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"inventory-management/store"
+	"time"
+)
+
+// CreatePurchaseOrder records an inbound purchase order; expectedAt must be
+// in the future.
+func (s *Service) CreatePurchaseOrder(ctx context.Context, productID int64, qty int, expectedAt time.Time) (int64, error) {
+	if productID <= 0 {
+		return 0, errors.New("product_id must be > 0")
+	}
+	if qty <= 0 {
+		return 0, errors.New("quantity must be > 0")
+	}
+	if !expectedAt.After(time.Now()) {
+		return 0, errors.New("expected_at must be in the future")
+	}
+	return s.store.CreatePurchaseOrder(ctx, productID, qty, expectedAt)
+}
+
+// productDTOs maps product rows for listings: tags for every product, plus
+// the restock ETA for those that are out of stock.
+func (s *Service) productDTOs(ctx context.Context, rows []store.ProductRow) ([]ProductDTO, error) {
+	ps, err := s.withTags(ctx, toProductDTOs(rows))
+	if err != nil {
+		return nil, err
+	}
+	var out []int64
+	for _, r := range rows {
+		if r.Stock <= 0 {
+			out = append(out, r.ID)
+		}
+	}
+	if len(out) == 0 {
+		return ps, nil
+	}
+	etas, err := s.store.ListInboundETAs(ctx, out)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ps {
+		if eta, ok := etas[ps[i].ID]; ok {
+			ps[i].ExpectedRestock = &eta
+		}
+	}
+	return ps, nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"inventory-management/money"
+	"inventory-management/store"
+	"time"
+)
+
+// DefaultQuoteHoldTTL is how long a held quote is honoured by Checkout
+const DefaultQuoteHoldTTL = 15 * time.Minute
+
+// QuoteDTO is what checking out the cart would cost right now
+type QuoteDTO struct {
+	UserID      string      `json:"user_id"`
+	Items       []CartDTO   `json:"items"`
+	Total       money.Cents `json:"total"`
+	Fulfillable bool        `json:"fulfillable"`
+	Unavailable []int64     `json:"unavailable"`
+	// HoldExpiresAt is set when the quote was held: checking out the same
+	// cart before then pays the quoted prices
+	HoldExpiresAt *time.Time `json:"hold_expires_at,omitempty"`
+}
+
+// QuoteCheckout prices the user's cart without placing an order. With hold,
+// the quoted prices are also held for QuoteHoldTTL: a Checkout of the same
+// lines before then pays them even if prices have changed. Stock needs no
+// hold, the cart lines already reserve it. A cart with unavailable lines
+// can't be held.
+func (s *Service) QuoteCheckout(ctx context.Context, userID string, hold bool) (QuoteDTO, error) {
+	if userID == "" {
+		return QuoteDTO{}, errors.New("user_id required")
+	}
+	lines, err := s.store.GetCartContext(ctx, userID)
+	if err != nil {
+		return QuoteDTO{}, err
+	}
+	if len(lines) == 0 {
+		return QuoteDTO{}, store.ErrCartEmpty
+	}
+	q := QuoteDTO{UserID: userID, Items: make([]CartDTO, 0, len(lines)), Unavailable: []int64{}}
+	held := make([]store.QuoteHoldLine, 0, len(lines))
+	for _, l := range lines {
+		if l.Deleted || !l.Published || !l.Price.Valid {
+			q.Unavailable = append(q.Unavailable, l.ProductID)
+			q.Items = append(q.Items, CartDTO{ProductID: l.ProductID, Quantity: l.Quantity, Name: l.Name, Unpriced: !l.Price.Valid, Unavailable: true})
+			continue
+		}
+		q.Items = append(q.Items, CartDTO{ProductID: l.ProductID, Quantity: l.Quantity, Name: l.Name, Price: l.Price.Cents})
+		q.Total += l.Price.Cents.Mul(l.Quantity)
+		held = append(held, store.QuoteHoldLine{ProductID: l.ProductID, Quantity: l.Quantity, Price: l.Price.Cents})
+	}
+	q.Fulfillable = len(q.Unavailable) == 0
+	if !hold {
+		return q, nil
+	}
+	if !q.Fulfillable {
+		return QuoteDTO{}, fmt.Errorf("%w: can't hold a quote with unavailable lines %v", store.ErrItemUnavailable, q.Unavailable)
+	}
+	expires := time.Now().Add(s.QuoteHoldTTL)
+	if err := s.store.PutQuoteHold(ctx, store.QuoteHold{UserID: userID, Lines: held, ExpiresAt: expires}); err != nil {
+		return QuoteDTO{}, err
+	}
+	q.HoldExpiresAt = &expires
+	return q, nil
+}
+
+// heldPrices returns the prices of the user's quote hold if it hasn't expired
+// and the cart still has exactly the quoted lines, nil otherwise (so Checkout
+// validates and prices the cart afresh).
+func (s *Service) heldPrices(ctx context.Context, userID string) (map[int64]money.Cents, error) {
+	h, err := s.store.GetQuoteHold(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !h.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	lines, err := s.store.GetCartContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) != len(h.Lines) {
+		return nil, nil
+	}
+	quoted := make(map[int64]store.QuoteHoldLine, len(h.Lines))
+	for _, l := range h.Lines {
+		quoted[l.ProductID] = l
+	}
+	prices := make(map[int64]money.Cents, len(lines))
+	for _, l := range lines {
+		q, ok := quoted[l.ProductID]
+		if !ok || q.Quantity != l.Quantity {
+			return nil, nil
+		}
+		prices[l.ProductID] = q.Price
+	}
+	return prices, nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"inventory-management/store"
+	"time"
+)
+
+// MaxReviewPageSize caps the limit accepted by ListReviews.
+const MaxReviewPageSize = 100
+
+type ReviewDTO struct {
+	ID        int64     `json:"id"`
+	ProductID int64     `json:"product_id"`
+	UserID    string    `json:"user_id"`
+	Rating    int       `json:"rating"`
+	Body      string    `json:"body,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReviewSummaryDTO is a product's rating distribution. Counts has an entry
+// for every star from 1 to 5; Average is 0 when there are no reviews.
+type ReviewSummaryDTO struct {
+	ProductID int64         `json:"product_id"`
+	Counts    map[int]int64 `json:"counts"`
+	Total     int64         `json:"total"`
+	Average   float64       `json:"average"`
+}
+
+// ListReviews returns one page of a product's reviews along with the number
+// of reviews matching q.MinRating.
+func (s *Service) ListReviews(ctx context.Context, productID int64, q store.ReviewQuery) ([]ReviewDTO, int64, error) {
+	if productID <= 0 {
+		return nil, 0, errors.New("product id must be > 0")
+	}
+	if q.Limit <= 0 || q.Limit > MaxReviewPageSize {
+		return nil, 0, fmt.Errorf("limit must be between 1 and %d", MaxReviewPageSize)
+	}
+	if q.Offset < 0 {
+		return nil, 0, errors.New("offset must be >= 0")
+	}
+	if q.MinRating < 0 || q.MinRating > 5 {
+		return nil, 0, errors.New("min_rating must be between 0 and 5")
+	}
+	if q.Sort == "" {
+		q.Sort = s.DefaultReviewSort
+	}
+	switch q.Sort {
+	case "", store.ReviewSortNewest, store.ReviewSortHighest, store.ReviewSortLowest:
+	default:
+		return nil, 0, fmt.Errorf("sort must be %q, %q or %q", store.ReviewSortNewest, store.ReviewSortHighest, store.ReviewSortLowest)
+	}
+	rows, err := s.store.ListReviews(ctx, productID, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.store.CountReviews(ctx, productID, q.MinRating)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]ReviewDTO, 0, len(rows))
+	for _, rv := range rows {
+		out = append(out, ReviewDTO{
+			ID:        rv.ID,
+			ProductID: rv.ProductID,
+			UserID:    rv.UserID,
+			Rating:    rv.Rating,
+			Body:      rv.Body,
+			CreatedAt: rv.CreatedAt,
+		})
+	}
+	return out, total, nil
+}
+
+// ReviewSummary returns how many reviews a product got per star.
+func (s *Service) ReviewSummary(ctx context.Context, productID int64) (ReviewSummaryDTO, error) {
+	if productID <= 0 {
+		return ReviewSummaryDTO{}, errors.New("product id must be > 0")
+	}
+	dist, err := s.store.ReviewDistribution(ctx, productID)
+	if err != nil {
+		return ReviewSummaryDTO{}, err
+	}
+	sum := ReviewSummaryDTO{ProductID: productID, Counts: make(map[int]int64, 5)}
+	var stars int64
+	for rating := 1; rating <= 5; rating++ {
+		n := dist[rating]
+		sum.Counts[rating] = n
+		sum.Total += n
+		stars += int64(rating) * n
+	}
+	if sum.Total > 0 {
+		sum.Average = float64(stars) / float64(sum.Total)
+	}
+	return sum, nil
+}
@@ -1,147 +1,1016 @@
 package service
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"inventory-management/money"
 	"inventory-management/store"
+	"strings"
+	"sync"
 	"time"
 )
 
+// CountMode selects how product totals (X-Total-Count) are computed
+type CountMode string
+
+const (
+	// CountExact runs a full COUNT(*) on every request
+	CountExact CountMode = "exact"
+	// CountApproximate uses the planner estimate from pg_class.reltuples
+	CountApproximate CountMode = "approximate"
+)
+
 type Service struct {
 	store store.Store
+
+	// CountMode is used by CountProducts unless the caller asks for an exact count
+	CountMode CountMode
+
+	// DefaultProductSort and DefaultReviewSort apply to pages requested
+	// without a sort; empty means by id and newest first
+	DefaultProductSort string
+	DefaultReviewSort  string
+
+	// ShippingRates prices EstimateShipping
+	ShippingRates ShippingRates
+
+	// BaseCurrency is the currency of products created without one, and
+	// GetCartInCurrency's default; Currency converts between currencies for it
+	BaseCurrency string
+	Currency     CurrencyConverter
+
+	// AddToCartDedupWindow collapses identical AddToCart calls (same user,
+	// product and quantity) arriving within the window into one (0 = off).
+	AddToCartDedupWindow time.Duration
+	addDedup             *dedupGroup
+
+	// MaxNameLen / MaxDescriptionLen cap product text, in characters
+	MaxNameLen        int
+	MaxDescriptionLen int
+
+	// ReorderPolicy drives ReorderSuggestion
+	ReorderPolicy ReorderPolicy
+
+	// QuoteHoldTTL is how long QuoteCheckout(hold) prices are honoured
+	QuoteHoldTTL time.Duration
+
+	// StockDropAlert sends Notifier an alert when a product's stock falls
+	// too fast (off unless both are set)
+	StockDropAlert StockDropPolicy
+	Notifier       Notifier
+	stockMon       *stockMonitor
+
+	// LowStockThreshold is ListLowStockProducts' default; with LowStockAlert
+	// Notifier is also sent an alert when a product's stock falls to it
+	LowStockThreshold int
+	LowStockAlert     bool
+
+	// PostCheckoutHook is called after each committed checkout;
+	// PostCheckoutRetries bounds its retries from the outbox
+	PostCheckoutHook    PostCheckoutHook
+	PostCheckoutRetries int
+	hooks               sync.WaitGroup
+
+	// OrderWebhook is sent every committed order (off when nil)
+	OrderWebhook *OrderWebhook
+
+	// Payments charges CheckoutAndPay orders, giving up after PaymentTimeout
+	Payments       PaymentGateway
+	PaymentTimeout time.Duration
+
+	// StrictCart makes GetCart fail on a line whose product was deleted
+	// instead of leaving it out
+	StrictCart bool
 }
 
 func NewService(s store.Store) *Service {
-	return &Service{store: s}
+	return &Service{
+		store:               s,
+		CountMode:           CountExact,
+		ShippingRates:       DefaultShippingRates,
+		BaseCurrency:        DefaultBaseCurrency,
+		Currency:            RateTable{Base: DefaultBaseCurrency},
+		addDedup:            newDedupGroup(),
+		MaxNameLen:          DefaultMaxNameLen,
+		MaxDescriptionLen:   DefaultMaxDescriptionLen,
+		ReorderPolicy:       DefaultReorderPolicy,
+		QuoteHoldTTL:        DefaultQuoteHoldTTL,
+		stockMon:            newStockMonitor(),
+		LowStockThreshold:   DefaultLowStockThreshold,
+		PostCheckoutHook:    NopPostCheckoutHook{},
+		PostCheckoutRetries: DefaultPostCheckoutRetries,
+		PaymentTimeout:      DefaultPaymentTimeout,
+	}
+}
+
+// Ping reports whether the store's database is reachable.
+func (s *Service) Ping(ctx context.Context) error { return s.store.Ping(ctx) }
+
+// CreateProduct creates a product priced in currency (BaseCurrency if empty)
+func (s *Service) CreateProduct(ctx context.Context, name, desc string, price money.Cents, category, currency string) (int64, error) {
+	p, err := s.checkNewProduct(NewProduct{Name: name, Description: desc, Price: price, Category: category, Currency: currency})
+	if err != nil {
+		return 0, err
+	}
+	return s.store.CreateProduct(ctx, p.Name, p.Description, p.Price, p.Category, p.Currency)
+}
+
+// NewProduct is one product to create with CreateProducts
+type NewProduct struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Price       money.Cents `json:"price"`
+	Category    string      `json:"category,omitempty"`
+	Currency    string      `json:"currency,omitempty"` // BaseCurrency if empty
+}
+
+// MaxCreateProductsBatch caps how many products one CreateProducts call may
+// create
+const MaxCreateProductsBatch = 500
+
+// CreateProducts creates products together, validated like CreateProduct,
+// and returns their ids in order. One invalid product fails the batch with
+// an error naming its index, and nothing is created.
+func (s *Service) CreateProducts(ctx context.Context, products []NewProduct) ([]int64, error) {
+	if len(products) == 0 {
+		return nil, errors.New("products required")
+	}
+	if len(products) > MaxCreateProductsBatch {
+		return nil, fmt.Errorf("at most %d products per request, got %d", MaxCreateProductsBatch, len(products))
+	}
+	rows := make([]store.ProductRow, 0, len(products))
+	for i, p := range products {
+		p, err := s.checkNewProduct(p)
+		if err != nil {
+			return nil, fmt.Errorf("products[%d]: %w", i, err)
+		}
+		rows = append(rows, store.ProductRow{
+			Name:        p.Name,
+			Description: sql.NullString{String: p.Description, Valid: true},
+			Price:       money.NullCents{Cents: p.Price, Valid: true},
+			Category:    sql.NullString{String: p.Category, Valid: p.Category != ""},
+			Currency:    p.Currency,
+		})
+	}
+	return s.store.CreateProductsBatch(ctx, rows)
+}
+
+// checkNewProduct validates p and returns it with its text normalised
+func (s *Service) checkNewProduct(p NewProduct) (NewProduct, error) {
+	if p.Name == "" {
+		return p, errors.New("name required")
+	}
+	if p.Price < 0 {
+		return p, errors.New("price must be >= 0")
+	}
+	var err error
+	if p.Name, err = normalizeText("name", p.Name, s.MaxNameLen); err != nil {
+		return p, err
+	}
+	if p.Description, err = normalizeText("description", p.Description, s.MaxDescriptionLen); err != nil {
+		return p, err
+	}
+	if p.Category, err = normalizeCategory(p.Category); err != nil {
+		return p, err
+	}
+	if p.Currency, err = s.normalizeCurrency(p.Currency); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// GetProduct returns one published product, with its tags, restock ETA and
+// current stock
+func (s *Service) GetProduct(ctx context.Context, id int64) (ProductDTO, error) {
+	if id <= 0 {
+		return ProductDTO{}, errors.New("product id must be > 0")
+	}
+	row, err := s.store.GetProduct(ctx, id)
+	if err != nil {
+		return ProductDTO{}, err
+	}
+	ps, err := s.productDTOs(ctx, []store.ProductRow{row})
+	if err != nil {
+		return ProductDTO{}, err
+	}
+	return ps[0], nil
 }
 
-func (s *Service) CreateProduct(name, desc string, price float64) (int64, error) {
+// UpdateProduct replaces a product's name, description, price, category and
+// currency, validated like CreateProduct, if it is still at version (see
+// ProductDTO.Version); store.ErrVersionConflict otherwise. A new price isn't retroactive for what's already been
+// bought or quoted: orders keep the price they were placed at and a held
+// quote is still honoured at checkout. Cart lines carry no price of their
+// own, so they (and their reserved stock) simply follow the product.
+func (s *Service) UpdateProduct(ctx context.Context, id int64, name, desc string, price money.Cents, category, currency string, version int) error {
+	if id <= 0 {
+		return errors.New("product id must be > 0")
+	}
+	if version <= 0 {
+		return errors.New("version must be > 0")
+	}
 	if name == "" {
-		return 0, errors.New("name required")
+		return errors.New("name required")
 	}
 	if price < 0 {
-		return 0, errors.New("price must be >= 0")
+		return errors.New("price must be >= 0")
+	}
+	name, err := normalizeText("name", name, s.MaxNameLen)
+	if err != nil {
+		return err
+	}
+	if desc, err = normalizeText("description", desc, s.MaxDescriptionLen); err != nil {
+		return err
+	}
+	if category, err = normalizeCategory(category); err != nil {
+		return err
+	}
+	if currency, err = s.normalizeCurrency(currency); err != nil {
+		return err
 	}
-	return s.store.CreateProduct(name, desc, price)
+	return s.store.UpdateProduct(ctx, id, name, desc, price, category, currency, version)
 }
 
-func (s *Service) ListProducts() ([]ProductDTO, error) {
-	rows, err := s.store.ListProducts()
+// ListProducts returns the whole published catalog in sort order (by id
+// when empty); see ListProductsPage for the sorts
+func (s *Service) ListProducts(ctx context.Context, sort string) ([]ProductDTO, error) {
+	if err := checkProductSort(sort); err != nil {
+		return nil, err
+	}
+	rows, err := s.store.ListProducts(ctx, sort)
 	if err != nil {
 		return nil, err
 	}
-	out := make([]ProductDTO, 0, len(rows))
-	for _, r := range rows {
-		p := ProductDTO{
-			ID:          r.ID,
-			Name:        r.Name,
-			Description: "",
-			Price:       r.Price,
+	return s.productDTOs(ctx, rows)
+}
+
+// MaxCategoryLen is the longest category accepted, in bytes
+const MaxCategoryLen = 50
+
+// normalizeCategory lower-cases and trims a category; "" means none.
+func normalizeCategory(category string) (string, error) {
+	c := strings.ToLower(strings.TrimSpace(category))
+	if len(c) > MaxCategoryLen {
+		return "", fmt.Errorf("category longer than %d bytes", MaxCategoryLen)
+	}
+	return c, nil
+}
+
+// ListProductsByCategory returns the published products in category; an
+// unknown category is just an empty list
+func (s *Service) ListProductsByCategory(ctx context.Context, category string) ([]ProductDTO, error) {
+	c, err := normalizeCategory(category)
+	if err != nil {
+		return nil, err
+	}
+	if c == "" {
+		return nil, errors.New("category required")
+	}
+	rows, err := s.store.ListProductsByCategory(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return s.productDTOs(ctx, rows)
+}
+
+// CloneProduct copies a product as an unpublished draft with zero stock
+func (s *Service) CloneProduct(ctx context.Context, id int64) (int64, error) {
+	if id <= 0 {
+		return 0, errors.New("product id must be > 0")
+	}
+	return s.store.CloneProduct(ctx, id)
+}
+
+// SetPublished shows (true) or hides (false) a product in public listings
+func (s *Service) SetPublished(ctx context.Context, id int64, published bool) error {
+	if id <= 0 {
+		return errors.New("product id must be > 0")
+	}
+	return s.store.SetPublished(ctx, id, published)
+}
+
+// MaxPublishBatch caps how many products one PublishProducts call may touch
+const MaxPublishBatch = 100
+
+// PublishProducts publishes the given drafts together and returns the ids
+// that went live. Duplicate ids are ignored; one unknown id fails the batch.
+func (s *Service) PublishProducts(ctx context.Context, ids []int64) ([]int64, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("ids required")
+	}
+	if len(ids) > MaxPublishBatch {
+		return nil, fmt.Errorf("%w: at most %d per request", ErrTooManyIDs, MaxPublishBatch)
+	}
+	seen := make(map[int64]bool, len(ids))
+	unique := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, errors.New("product ids must be > 0")
 		}
-		if r.Description.Valid {
-			p.Description = r.Description.String
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
 		}
-		out = append(out, p)
 	}
-	return out, nil
+	published, err := s.store.PublishProducts(ctx, unique)
+	if err != nil {
+		return nil, err
+	}
+	if published == nil {
+		published = []int64{}
+	}
+	return published, nil
+}
+
+// DeleteProduct soft-deletes a product and cleans it out of every cart,
+// returning the number of carts affected. Orders keep showing it. Deleting an
+// already deleted product succeeds; with strict it's not found instead, and a
+// product still in a cart is kept.
+func (s *Service) DeleteProduct(ctx context.Context, id int64, strict bool) (int, error) {
+	if id <= 0 {
+		return 0, errors.New("product id must be > 0")
+	}
+	return s.store.DeleteProduct(ctx, id, strict)
+}
+
+// RestoreProduct undeletes a product; it comes back unpublished
+func (s *Service) RestoreProduct(ctx context.Context, id int64) error {
+	if id <= 0 {
+		return errors.New("product id must be > 0")
+	}
+	return s.store.RestoreProduct(ctx, id)
+}
+
+// ListAllProducts returns every product, unpublished included (admin view),
+// and with includeDeleted the deleted ones too
+func (s *Service) ListAllProducts(ctx context.Context, includeDeleted bool) ([]ProductDTO, error) {
+	rows, err := s.store.ListAllProducts(ctx, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	return s.productDTOs(ctx, rows)
+}
+
+// MaxSearchQueryLen caps the length of a SearchProducts query
+const MaxSearchQueryLen = 100
+
+// SearchProducts returns published products matching q in name or
+// description, name matches first, at most store.MaxSearchResults of them.
+func (s *Service) SearchProducts(ctx context.Context, q string) ([]ProductDTO, error) {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return nil, errors.New("q required")
+	}
+	if len([]rune(q)) > MaxSearchQueryLen {
+		return nil, fmt.Errorf("q must be at most %d characters", MaxSearchQueryLen)
+	}
+	rows, err := s.store.SearchProducts(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return s.productDTOs(ctx, rows)
 }
 
-func (s *Service) AddToCart(userID string, productID int64, qty int) error {
+// ListAvailableProducts returns products inside their availability window
+func (s *Service) ListAvailableProducts(ctx context.Context) ([]ProductDTO, error) {
+	rows, err := s.store.ListAvailableProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.productDTOs(ctx, rows)
+}
+
+// SetAvailability sets a product's availability window; nil bounds are open
+func (s *Service) SetAvailability(ctx context.Context, productID int64, from, until *time.Time) error {
+	if productID <= 0 {
+		return errors.New("product_id must be > 0")
+	}
+	if from != nil && until != nil && !until.After(*from) {
+		return errors.New("available_until must be after available_from")
+	}
+	return s.store.SetAvailability(ctx, productID, from, until)
+}
+
+// ListProductsPage returns one page of products in sort order, or
+// DefaultProductSort when sort is empty
+func (s *Service) ListProductsPage(ctx context.Context, limit, offset int, sort string) ([]ProductDTO, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be > 0")
+	}
+	if offset < 0 {
+		return nil, errors.New("offset must be >= 0")
+	}
+	if sort == "" {
+		sort = s.DefaultProductSort
+	}
+	if err := checkProductSort(sort); err != nil {
+		return nil, err
+	}
+	rows, err := s.store.ListProductsPage(ctx, limit, offset, sort)
+	if err != nil {
+		return nil, err
+	}
+	return s.productDTOs(ctx, rows)
+}
+
+// checkProductSort rejects a sort store.ListProductsPage doesn't know; empty
+// is by id
+func checkProductSort(sort string) error {
+	if sort != "" && !store.IsProductSort(sort) {
+		return fmt.Errorf("sort must be %q, %q, %q, %q or %q", store.ProductSortID,
+			store.ProductSortPriceAsc, store.ProductSortPriceDesc, store.ProductSortName, store.ProductSortNewest)
+	}
+	return nil
+}
+
+// MaxPriceLookupIDs caps how many products one GetPrices call may ask for
+const MaxPriceLookupIDs = 100
+
+// ErrTooManyIDs returned when a batch lookup asks for more ids than allowed.
+var ErrTooManyIDs = errors.New("too many ids")
+
+// GetPrices returns current prices for the given products; unknown ids and
+// products the storefront doesn't show are left out of the result.
+func (s *Service) GetPrices(ctx context.Context, ids []int64) (map[int64]money.Cents, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("ids required")
+	}
+	if len(ids) > MaxPriceLookupIDs {
+		return nil, fmt.Errorf("%w: at most %d per request", ErrTooManyIDs, MaxPriceLookupIDs)
+	}
+	return s.store.GetPrices(ctx, ids)
+}
+
+// CountProducts returns the number of published products; the approximate
+// estimate is scoped the same way, so it tracks the exact count. With
+// exact=false the configured CountMode decides; an approximate estimate that
+// isn't available yet (table never analyzed) falls back to an exact count.
+func (s *Service) CountProducts(ctx context.Context, exact bool) (int64, error) {
+	if !exact && s.CountMode == CountApproximate {
+		n, err := s.store.EstimateProductCount(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if n >= 0 {
+			return n, nil
+		}
+	}
+	return s.store.CountProducts(ctx)
+}
+
+func toProductDTO(r store.ProductRow) ProductDTO {
+	p := ProductDTO{
+		ID:          r.ID,
+		Name:        r.Name,
+		Description: "",
+		Currency:    r.Currency,
+		Stock:       r.Stock,
+		Version:     r.Version,
+		Deleted:     r.Deleted,
+	}
+	if r.Description.Valid {
+		p.Description = r.Description.String
+	}
+	if r.Category.Valid {
+		p.Category = r.Category.String
+	}
+	if r.Price.Valid {
+		price := r.Price.Cents
+		p.Price = &price
+	}
+	if !r.CreatedAt.IsZero() {
+		created, updated := r.CreatedAt, r.UpdatedAt
+		p.CreatedAt, p.UpdatedAt = &created, &updated
+	}
+	return p
+}
+
+func toProductDTOs(rows []store.ProductRow) []ProductDTO {
+	out := make([]ProductDTO, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, toProductDTO(r))
+	}
+	return out
+}
+
+func (s *Service) AddToCart(ctx context.Context, userID string, productID int64, qty int) error {
 	if userID == "" {
 		return errors.New("user_id required")
 	}
 	if qty <= 0 {
 		return errors.New("quantity must be > 0")
 	}
-	return s.store.AddToCart(userID, productID, qty)
+	if qty > store.MaxCartLineQuantity {
+		return store.ErrQuantityOutOfRange
+	}
+	add := func() error {
+		if err := s.store.AddToCart(ctx, userID, productID, qty); err != nil {
+			return err
+		}
+		s.observeStock(ctx, productID)
+		return nil
+	}
+	if s.AddToCartDedupWindow > 0 && s.addDedup != nil {
+		return s.addDedup.do(s.AddToCartDedupWindow, add, userID, productID, qty)
+	}
+	return add()
+}
+
+func (s *Service) RemoveFromCart(ctx context.Context, userID string, productID int64) error {
+	if userID == "" {
+		return errors.New("user_id required")
+	}
+	if err := s.store.RemoveFromCart(ctx, userID, productID); err != nil {
+		return err
+	}
+	s.observeStock(ctx, productID)
+	return nil
+}
+
+// UpdateCartQuantity sets the quantity of a line already in the user's
+// cart; 0 removes it
+func (s *Service) UpdateCartQuantity(ctx context.Context, userID string, productID int64, newQty int) error {
+	if userID == "" {
+		return errors.New("user_id required")
+	}
+	if newQty < 0 {
+		return errors.New("quantity must be >= 0")
+	}
+	if newQty > store.MaxCartLineQuantity {
+		return store.ErrQuantityOutOfRange
+	}
+	if err := s.store.UpdateCartQuantity(ctx, userID, productID, newQty); err != nil {
+		return err
+	}
+	s.observeStock(ctx, productID)
+	return nil
 }
 
-func (s *Service) RemoveFromCart(userID string, productID int64) error {
+// ClearCart empties the user's cart and releases what it reserved
+func (s *Service) ClearCart(ctx context.Context, userID string) error {
 	if userID == "" {
 		return errors.New("user_id required")
 	}
-	return s.store.RemoveFromCart(userID, productID)
+	return s.store.ClearCart(ctx, userID)
+}
+
+// ReleaseExpiredReservations drops every cart line whose reservation has run
+// out, giving its stock back, and returns how many it dropped. main calls it
+// on a ticker.
+func (s *Service) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	return s.store.ReleaseExpiredReservations(ctx, time.Now())
 }
 
-func (s *Service) GetCart(userID string) ([]CartDTO, float64, error) {
+// ErrProductNotFound returned when a cart line's product has been deleted
+// out from under the cart, by a strict GetCart or by Checkout.
+var ErrProductNotFound = errors.New("product not found")
+
+// GetCart returns the user's cart lines and their total, plus the ids of
+// lines whose product was deleted: those are left out and the rest of the
+// cart is still returned, unless StrictCart is set, which fails on them with
+// ErrProductNotFound.
+func (s *Service) GetCart(ctx context.Context, userID string) ([]CartDTO, money.Cents, []int64, error) {
+	if userID == "" {
+		return nil, 0, nil, errors.New("user_id required")
+	}
+	lines, err := s.store.GetCartContext(ctx, userID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	var total money.Cents
+	out := make([]CartDTO, 0, len(lines))
+	unresolved := []int64{}
+	for _, l := range lines {
+		if l.Deleted {
+			if s.StrictCart {
+				return nil, 0, nil, fmt.Errorf("%w: product %d", ErrProductNotFound, l.ProductID)
+			}
+			unresolved = append(unresolved, l.ProductID)
+			continue
+		}
+		line := CartDTO{ProductID: l.ProductID, Quantity: l.Quantity, Name: l.Name, Currency: l.Currency, Unavailable: !l.Published}
+		if l.Price.Valid {
+			line.Price = l.Price.Cents
+			total += l.Price.Cents.Mul(l.Quantity)
+		} else {
+			line.Unpriced = true
+		}
+		out = append(out, line)
+	}
+	return out, total, unresolved, nil
+}
+
+// GetCartDetailed returns cart lines with full product details. Lines whose
+// product was deleted are flagged Missing and left out of the total.
+func (s *Service) GetCartDetailed(ctx context.Context, userID string) ([]CartDetailDTO, money.Cents, error) {
 	if userID == "" {
 		return nil, 0, errors.New("user_id required")
 	}
-	rows, err := s.store.GetCart(userID)
+	rows, err := s.store.GetCartDetailed(ctx, userID)
 	if err != nil {
 		return nil, 0, err
 	}
+	var total money.Cents
+	out := make([]CartDetailDTO, 0, len(rows))
+	for _, r := range rows {
+		line := CartDetailDTO{ProductID: r.ProductID, Quantity: r.Quantity}
+		if r.Product == nil {
+			line.Missing = true
+		} else {
+			p := toProductDTO(*r.Product)
+			line.Product = &p
+			line.Stock = r.Product.Stock
+			total += r.Product.Price.Cents.Mul(r.Quantity) // unpriced lines add 0
+		}
+		out = append(out, line)
+	}
+	return out, total, nil
+}
 
-	// need product prices; for simplicity, call ListProducts and build map
-	products, err := s.store.ListProducts()
+// CheckFulfillable reports whether every cart line can still be checked out,
+// returning the ids of the products that can't otherwise: deleted, unpublished
+// or outside their availability window, or whose reservation has expired.
+// Stock isn't compared, since AddToCart already took each line's units off it.
+// It reserves nothing.
+func (s *Service) CheckFulfillable(ctx context.Context, userID string) (bool, []int64, error) {
+	if userID == "" {
+		return false, nil, errors.New("user_id required")
+	}
+	lines, err := s.store.GetCartContext(ctx, userID)
 	if err != nil {
-		return nil, 0, err
+		return false, nil, err
 	}
-	priceMap := map[int64]float64{}
-	for _, p := range products {
-		priceMap[p.ID] = p.Price
+	short := []int64{}
+	for _, l := range lines {
+		if l.Deleted || !l.Published || l.Unavailable || l.ReservationExpired {
+			short = append(short, l.ProductID)
+		}
 	}
+	return len(short) == 0, short, nil
+}
 
-	var total float64
-	out := make([]CartDTO, 0, len(rows))
-	for _, r := range rows {
-		price, ok := priceMap[r.ProductID]
-		if !ok {
-			return nil, 0, fmt.Errorf("product %d not found", r.ProductID)
+// Order metadata caps
+const (
+	MaxMetadataKeys     = 20
+	MaxMetadataKeyLen   = 64
+	MaxMetadataValueLen = 512
+)
+
+// ErrMetadataTooLarge returned when order metadata exceeds the caps above.
+var ErrMetadataTooLarge = errors.New("metadata too large")
+
+func validateMetadata(meta map[string]string) error {
+	if len(meta) > MaxMetadataKeys {
+		return fmt.Errorf("%w: at most %d keys", ErrMetadataTooLarge, MaxMetadataKeys)
+	}
+	for k, v := range meta {
+		if k == "" {
+			return errors.New("metadata keys must be non-empty")
+		}
+		if len(k) > MaxMetadataKeyLen {
+			return fmt.Errorf("%w: key %q longer than %d bytes", ErrMetadataTooLarge, k, MaxMetadataKeyLen)
+		}
+		if len(v) > MaxMetadataValueLen {
+			return fmt.Errorf("%w: value for %q longer than %d bytes", ErrMetadataTooLarge, k, MaxMetadataValueLen)
 		}
-		out = append(out, CartDTO{ProductID: r.ProductID, Quantity: r.Quantity, Price: price})
-		total += price * float64(r.Quantity)
 	}
-	return out, total, nil
+	return nil
+}
+
+// MaxIdempotencyKeyLen caps the length of a checkout's idempotency key
+const MaxIdempotencyKeyLen = 255
+
+// Checkout places the user's cart as an order. With opts.RemoveUnavailable,
+// lines that can no longer be fulfilled are dropped and listed in
+// RemovedProductIDs instead of failing the checkout. With
+// opts.IdempotencyKey, repeating a checkout the user already placed under
+// that key (within store.IdempotencyKeyTTL) returns the same order, as it
+// stands now, instead of placing another.
+func (s *Service) Checkout(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions) (OrderDTO, error) {
+	if opts.IdempotencyKey != "" {
+		if userID == "" {
+			return OrderDTO{}, errors.New("user_id required")
+		}
+		if len(opts.IdempotencyKey) > MaxIdempotencyKeyLen {
+			return OrderDTO{}, fmt.Errorf("idempotency key must be at most %d bytes", MaxIdempotencyKeyLen)
+		}
+		if od, ok, err := s.replayCheckout(ctx, userID, opts.IdempotencyKey); err != nil || ok {
+			return od, err
+		}
+	}
+	od, err := s.placeOrder(ctx, userID, meta, opts)
+	if errors.Is(err, store.ErrIdempotencyKeyInUse) {
+		// a concurrent request with the same key got there first
+		if od, ok, rerr := s.replayCheckout(ctx, userID, opts.IdempotencyKey); rerr == nil && ok {
+			return od, nil
+		}
+	}
+	if err != nil {
+		return OrderDTO{}, err
+	}
+	s.afterCheckout(ctx, od)
+	return od, nil
+}
+
+// replayCheckout returns the order the user placed under key, if any.
+func (s *Service) replayCheckout(ctx context.Context, userID, key string) (OrderDTO, bool, error) {
+	orderID, err := s.store.GetOrderByIdempotencyKey(ctx, userID, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OrderDTO{}, false, nil
+	}
+	if err != nil {
+		return OrderDTO{}, false, err
+	}
+	o, items, err := s.store.GetOrder(ctx, orderID)
+	if err != nil {
+		return OrderDTO{}, false, err
+	}
+	return orderDTO(o, items), true, nil
 }
 
-func (s *Service) Checkout(userID string) (OrderDTO, error) {
+// placeOrder is Checkout without the post-checkout hook.
+func (s *Service) placeOrder(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions) (OrderDTO, error) {
 	if userID == "" {
 		return OrderDTO{}, errors.New("user_id required")
 	}
-	orderRow, items, err := s.store.Checkout(userID)
+	if err := validateMetadata(meta); err != nil {
+		return OrderDTO{}, err
+	}
+	// catch the common empty cart before the store opens a transaction; the
+	// store still checks, in case the cart empties in between. A line whose
+	// product is gone fails the checkout too, unless unavailable lines are
+	// being dropped anyway.
+	lines, err := s.store.GetCartContext(ctx, userID)
+	if err != nil {
+		return OrderDTO{}, err
+	}
+	if len(lines) == 0 {
+		return OrderDTO{}, store.ErrCartEmpty
+	}
+	if !opts.RemoveUnavailable {
+		for _, l := range lines {
+			if l.Deleted {
+				return OrderDTO{}, fmt.Errorf("%w: product %d", ErrProductNotFound, l.ProductID)
+			}
+		}
+	}
+	if opts.CouponCode != "" {
+		// same idea for a coupon that's plainly no good
+		c, err := s.store.GetCoupon(ctx, opts.CouponCode)
+		if errors.Is(err, sql.ErrNoRows) {
+			return OrderDTO{}, fmt.Errorf("%w: %s", store.ErrUnknownCoupon, opts.CouponCode)
+		}
+		if err != nil {
+			return OrderDTO{}, err
+		}
+		if err := c.Check(time.Now()); err != nil {
+			return OrderDTO{}, err
+		}
+	}
+	if opts.HeldPrices == nil {
+		held, err := s.heldPrices(ctx, userID)
+		if err != nil {
+			return OrderDTO{}, err
+		}
+		opts.HeldPrices = held
+	}
+	orderRow, items, removed, err := s.store.Checkout(ctx, userID, meta, opts)
 	if err != nil {
 		return OrderDTO{}, err
 	}
 	od := OrderDTO{
-		ID:        orderRow.ID,
-		UserID:    orderRow.UserID,
-		Total:     orderRow.Total,
-		CreatedAt: time.Now(),
-		Items:     make([]CartDTO, 0, len(items)),
+		ID:                orderRow.ID,
+		UserID:            orderRow.UserID,
+		Total:             orderRow.Total,
+		Currency:          orderRow.Currency,
+		Status:            orderRow.Status,
+		Metadata:          orderRow.Metadata,
+		CreatedAt:         orderRow.CreatedAt,
+		Items:             make([]CartDTO, 0, len(items)),
+		RemovedProductIDs: removed,
+		QuoteHonored:      opts.HeldPrices != nil,
+		Discount:          orderRow.Discount,
+		CouponCode:        orderRow.CouponCode,
 	}
 	for _, it := range items {
-		od.Items = append(od.Items, CartDTO{ProductID: it.ProductID, Quantity: it.Quantity, Price: it.Price})
+		od.Items = append(od.Items, CartDTO{ProductID: it.ProductID, Quantity: it.Quantity, Price: it.Price, Currency: orderRow.Currency})
 	}
 	return od, nil
 }
 
-func (s *Service) UpdateStock(productID int64, newStock int) error {
+// UpdateOrderMetadata replaces an order's metadata, applying the checkout caps
+func (s *Service) UpdateOrderMetadata(ctx context.Context, orderID int64, meta map[string]string) error {
+	if orderID <= 0 {
+		return errors.New("order id must be > 0")
+	}
+	if err := validateMetadata(meta); err != nil {
+		return err
+	}
+	return s.store.UpdateOrderMetadata(ctx, orderID, meta)
+}
+
+// SetReservationLimit caps how many units of a product one user can hold in
+// their cart (nil = the store-wide limit). A limit above
+// store.MaxCartLineQuantity is allowed but never reached.
+func (s *Service) SetReservationLimit(ctx context.Context, productID int64, limit *int) error {
+	if productID <= 0 {
+		return errors.New("product_id must be > 0")
+	}
+	if limit != nil && *limit <= 0 {
+		return errors.New("max_per_user must be > 0")
+	}
+	return s.store.SetReservationLimit(ctx, productID, limit)
+}
+
+// SetTrackInventory enables or disables inventory tracking for a product.
+// Untracked products are never reserved or stock-checked.
+func (s *Service) SetTrackInventory(ctx context.Context, productID int64, track bool) error {
+	if productID <= 0 {
+		return errors.New("product_id must be > 0")
+	}
+	return s.store.SetTrackInventory(ctx, productID, track)
+}
+
+// SetBundleComponents makes a product a bundle of the given components (or a
+// plain product again when components is empty).
+func (s *Service) SetBundleComponents(ctx context.Context, bundleID int64, components []store.BundleComponent) error {
+	if bundleID <= 0 {
+		return errors.New("product_id must be > 0")
+	}
+	seen := make(map[int64]bool, len(components))
+	for _, c := range components {
+		if c.ProductID <= 0 {
+			return errors.New("component product_id must be > 0")
+		}
+		if c.Quantity <= 0 {
+			return fmt.Errorf("%w: quantity for component %d must be > 0", store.ErrInvalidBundle, c.ProductID)
+		}
+		if c.ProductID == bundleID {
+			return fmt.Errorf("%w: a bundle can't contain itself", store.ErrInvalidBundle)
+		}
+		if seen[c.ProductID] {
+			return fmt.Errorf("%w: component %d listed twice", store.ErrInvalidBundle, c.ProductID)
+		}
+		seen[c.ProductID] = true
+	}
+	return s.store.SetBundleComponents(ctx, bundleID, components)
+}
+
+// ReturnOrderItem records a (partial) return of one of the user's order
+// lines. Another user's order is ErrForbidden.
+func (s *Service) ReturnOrderItem(ctx context.Context, orderID int64, userID string, productID int64, qty int, restock bool) error {
+	if userID == "" {
+		return errors.New("user_id required")
+	}
+	if orderID <= 0 {
+		return errors.New("order id must be > 0")
+	}
+	if productID <= 0 {
+		return errors.New("product_id must be > 0")
+	}
+	if qty <= 0 {
+		return errors.New("quantity must be > 0")
+	}
+	if err := s.store.ReturnOrderItem(ctx, orderID, userID, productID, qty, restock); err != nil {
+		if errors.Is(err, store.ErrNotOrderOwner) {
+			return fmt.Errorf("%w: order %d belongs to another user", ErrForbidden, orderID)
+		}
+		return err
+	}
+	return nil
+}
+
+// GetStock returns a product's current stock (for a bundle, how many can be
+// assembled from its components), or store.UntrackedStock if its inventory
+// isn't tracked. An unknown product is sql.ErrNoRows.
+func (s *Service) GetStock(ctx context.Context, productID int64) (int, error) {
+	if productID <= 0 {
+		return 0, errors.New("product id must be > 0")
+	}
+	return s.store.GetStock(ctx, productID)
+}
+
+func (s *Service) UpdateStock(ctx context.Context, productID int64, newStock int) error {
 	if newStock < 0 {
 		return errors.New("stock cannot be negative")
 	}
-	return s.store.UpdateStock(productID, newStock)
+	if err := s.store.UpdateStock(ctx, productID, newStock); err != nil {
+		return err
+	}
+	s.observeStock(ctx, productID)
+	return nil
+}
+
+// AdjustStock adds delta to a tracked product's stock; see
+// store.AdjustStock. Prefer it to UpdateStock for restocks and corrections.
+func (s *Service) AdjustStock(ctx context.Context, productID int64, delta int) error {
+	if delta == 0 {
+		return errors.New("delta must not be zero")
+	}
+	if err := s.store.AdjustStock(ctx, productID, delta); err != nil {
+		return err
+	}
+	s.observeStock(ctx, productID)
+	return nil
+}
+
+// MaxStockBatch caps how many products one UpdateStockBatch call may touch
+const MaxStockBatch = 500
+
+// UpdateStockBatch sets the stock of several products at once, e.g. when a
+// shipment is received; see store.UpdateStockBatch. A product may appear only
+// once. All are set or, if one fails, none.
+func (s *Service) UpdateStockBatch(ctx context.Context, updates []store.StockUpdate) error {
+	if len(updates) == 0 {
+		return errors.New("updates required")
+	}
+	if len(updates) > MaxStockBatch {
+		return fmt.Errorf("%w: at most %d per request", ErrTooManyIDs, MaxStockBatch)
+	}
+	seen := make(map[int64]bool, len(updates))
+	for i, u := range updates {
+		if u.ProductID <= 0 {
+			return fmt.Errorf("updates[%d]: product_id must be > 0", i)
+		}
+		if u.NewStock < 0 {
+			return fmt.Errorf("updates[%d]: new_stock must be >= 0", i)
+		}
+		if seen[u.ProductID] {
+			return fmt.Errorf("updates[%d]: duplicate product_id %d", i, u.ProductID)
+		}
+		seen[u.ProductID] = true
+	}
+	if err := s.store.UpdateStockBatch(ctx, updates); err != nil {
+		return err
+	}
+	for _, u := range updates {
+		s.observeStock(ctx, u.ProductID)
+	}
+	return nil
 }
 
 // DTOs
 type ProductDTO struct {
-	ID          int64     `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          int64        `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Price       *money.Cents `json:"price"` // null = call for price
+	Currency    string       `json:"currency,omitempty"`
+	Category    string       `json:"category,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	// Stock is the current stock; 0 means out of stock
+	Stock int `json:"stock"`
+	// ExpectedRestock is set for out-of-stock products with a purchase order inbound
+	ExpectedRestock *time.Time `json:"expected_restock,omitempty"`
+	// CreatedAt and UpdatedAt are reported by GetProduct and the unfiltered
+	// product list; UpdatedAt is when the details (not the stock) last changed
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// Version is only reported by GetProduct; an update must send it back
+	Version int `json:"version,omitempty"`
+	// Deleted is only ever set in the admin listing with include_deleted
+	Deleted bool `json:"deleted,omitempty"`
 }
 
 type CartDTO struct {
-	ProductID int64   `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID int64       `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Cents `json:"price"`
+	Currency  string      `json:"currency,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Unpriced  bool        `json:"unpriced,omitempty"` // price was removed after the add; not in total
+	// Unavailable is set when the product was unpublished after the add
+	Unavailable bool `json:"unavailable,omitempty"`
+}
+
+// CartDetailDTO is a cart line enriched with its product
+type CartDetailDTO struct {
+	ProductID int64       `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	Product   *ProductDTO `json:"product,omitempty"`
+	Stock     int         `json:"stock"`
+	Missing   bool        `json:"missing"`
 }
 
 type OrderDTO struct {
-	ID        int64     `json:"id"`
-	UserID    string    `json:"user_id"`
-	Items     []CartDTO `json:"items"`
-	Total     float64   `json:"total"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int64             `json:"id"`
+	UserID    string            `json:"user_id"`
+	Items     []CartDTO         `json:"items,omitempty"`
+	Total     money.Cents       `json:"total"`
+	Currency  string            `json:"currency,omitempty"`
+	Status    string            `json:"status"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	// RemovedProductIDs lists cart lines dropped at checkout (remove_unavailable)
+	RemovedProductIDs []int64 `json:"removed_product_ids,omitempty"`
+	// QuoteHonored is set when the order was priced from a held quote
+	QuoteHonored bool `json:"quote_honored,omitempty"`
+	// ChargeID is the payment gateway's charge for an order paid at checkout
+	ChargeID string `json:"charge_id,omitempty"`
+	// Discount is what CouponCode took off Total at checkout
+	Discount   money.Cents `json:"discount,omitempty"`
+	CouponCode string      `json:"coupon_code,omitempty"`
 }
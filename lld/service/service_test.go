@@ -1,66 +1,407 @@
 package service
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"inventory-management/money"
 	"inventory-management/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 // ---- fakeStore implementing store.Store partially for tests ----
 type fakeStore struct {
-	CreateProductFn  func(name, desc string, price float64) (int64, error)
-	ListProductsFn   func() ([]store.ProductRow, error)
-	AddToCartFn      func(userID string, productID int64, qty int) error
-	RemoveFromCartFn func(userID string, productID int64) error
-	GetCartFn        func(userID string) ([]store.CartRow, error)
-	CheckoutFn       func(userID string) (store.OrderRow, []store.OrderItemRow, error)
-	UpdateStockFn    func(productID int64, newStock int) error
+	CreateProductFn   func(name, desc string, price money.Cents, category, currency string) (int64, error)
+	CreateBatchFn     func(products []store.ProductRow) ([]int64, error)
+	UpdateProductFn   func(id int64, name, desc string, price money.Cents, category, currency string, version int) error
+	GetProductFn      func(id int64) (store.ProductRow, error)
+	ListProductsFn    func(sort string) ([]store.ProductRow, error)
+	ListByCategoryFn  func(category string) ([]store.ProductRow, error)
+	ListAllProductsFn func(includeDeleted bool) ([]store.ProductRow, error)
+	RestoreProductFn  func(id int64) error
+	SearchFn          func(query string) ([]store.ProductRow, error)
+	DeleteProductFn   func(id int64, strict bool) (int, error)
+	CloneProductFn    func(id int64) (int64, error)
+	SetPublishedFn    func(id int64, published bool) error
+	ListPageFn        func(limit, offset int, sort string) ([]store.ProductRow, error)
+	GetPricesFn       func(ids []int64) (map[int64]money.Cents, error)
+	CountFn           func() (int64, error)
+	EstimateCountFn   func() (int64, error)
+	AddTagFn          func(productID int64, tag string) error
+	RemoveTagFn       func(productID int64, tag string) error
+	ListTagsFn        func(productID int64) ([]string, error)
+	TagsForFn         func(ids []int64) (map[int64][]string, error)
+	InboundETAsFn     func(ids []int64) (map[int64]time.Time, error)
+	ListByTagsFn      func(tags []string) ([]store.ProductRow, error)
+	AddToCartFn       func(userID string, productID int64, qty int) error
+	RemoveFromCartFn  func(userID string, productID int64) error
+	AddBatchFn        func(userID string, lines []store.CartRow) error
+	RemoveBatchFn     func(userID string, productIDs []int64) error
+	ClearCartFn       func(userID string) error
+	ReleaseExpiredFn  func(now time.Time) (int, error)
+	UpdateQtyFn       func(userID string, productID int64, newQty int) error
+	GetCartFn         func(userID string) ([]store.CartRow, error)
+	GetCartStockFn    func(userID string) ([]store.CartStockRow, error)
+	GetCartContextFn  func(userID string) ([]store.CartLineContext, error)
+	GetCartDetailFn   func(userID string) ([]store.CartDetailRow, error)
+	GetCartWeightsFn  func(userID string) ([]store.CartWeightRow, error)
+	CheckoutFn        func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error)
+	ListAllOrdersFn   func(filter store.OrderFilter, limit, offset int) ([]store.OrderRow, error)
+	CountOrdersFn     func(filter store.OrderFilter) (int64, error)
+	ProductOrdersFn   func(productID int64, from, to time.Time, limit, offset int) ([]store.ProductOrderRow, error)
+	CountProdOrdersFn func(productID int64, from, to time.Time) (int64, error)
+	VelocityFn        func(productID int64, window time.Duration) (float64, error)
+	GetOrderFn        func(orderID int64) (store.OrderRow, []store.OrderItemRow, error)
+	GetOrderByKeyFn   func(userID, key string) (int64, error)
+	ListOrdersFn      func(userID string) ([]store.OrderRow, error)
+	ListOrderItemsFn  func(orderID int64) ([]store.OrderItemRow, error)
+	CartSnapshotFn    func(orderID int64) (string, []store.CartSnapshotLine, error)
+	PutQuoteHoldFn    func(h store.QuoteHold) error
+	GetQuoteHoldFn    func(userID string) (store.QuoteHold, error)
+	GetStockFn        func(productID int64) (int, error)
+	LowStockFn        func(threshold int) ([]store.ProductRow, error)
+	StatusBatchFn     func(orderIDs []int64, status string, strict bool) ([]int64, error)
+	OrderStatusFn     func(orderID int64, status string) error
+	PublishBatchFn    func(ids []int64) ([]int64, error)
+	ListReviewsFn     func(productID int64, q store.ReviewQuery) ([]store.ReviewRow, error)
+	CountReviewsFn    func(productID int64, minRating int) (int64, error)
+	ReviewDistFn      func(productID int64) (map[int]int64, error)
+	UpdateOrderMetaFn func(orderID int64, meta map[string]string) error
+	ReturnItemFn      func(orderID int64, userID string, productID int64, qty int, restock bool) error
+	UpdateStockFn     func(productID int64, newStock int) error
+	StockBatchFn      func(updates []store.StockUpdate) error
+	AdjustStockFn     func(productID int64, delta int) error
+	ListMovementsFn   func(filter store.MovementFilter, limit, offset int) ([]store.StockMovementRow, error)
+	CountMovementsFn  func(filter store.MovementFilter) (int64, error)
+	SetTrackFn        func(productID int64, track bool) error
+	SetLimitFn        func(productID int64, limit *int) error
+	ExportFn          func(fn func(store.ProductExportRow) error) error
+	ImportFn          func(rows []store.ProductExportRow) ([]string, error)
+	SetBundleFn       func(bundleID int64, components []store.BundleComponent) error
+	GetOutboxFn       func(id int64) (store.OutboxRow, error)
+	ListOutboxFn      func(status string) ([]store.OutboxRow, error)
+	MarkUnpublishedFn func(id int64) error
+	EnqueueOutboxFn   func(eventType string, payload []byte) (int64, error)
+	MarkPublishedFn   func(id int64) error
+	MarkAttemptFn     func(id int64, lastErr string, maxAttempts int) error
+	MarkPaidFn        func(orderID int64, chargeID string) error
+	CancelPendingFn   func(orderID int64) error
+	CancelOrderFn     func(orderID int64, userID string) error
+	GetCouponFn       func(code string) (store.CouponRow, error)
 }
 
-func (f *fakeStore) CreateProduct(name, desc string, price float64) (int64, error) {
-	return f.CreateProductFn(name, desc, price)
+func (f *fakeStore) CreateProduct(ctx context.Context, name, desc string, price money.Cents, category, currency string) (int64, error) {
+	return f.CreateProductFn(name, desc, price, category, currency)
 }
-func (f *fakeStore) ListProducts() ([]store.ProductRow, error) { return f.ListProductsFn() }
-func (f *fakeStore) AddToCart(userID string, productID int64, qty int) error {
+func (f *fakeStore) CreateProductsBatch(ctx context.Context, products []store.ProductRow) ([]int64, error) {
+	return f.CreateBatchFn(products)
+}
+func (f *fakeStore) GetProduct(ctx context.Context, id int64) (store.ProductRow, error) {
+	return f.GetProductFn(id)
+}
+func (f *fakeStore) UpdateProduct(ctx context.Context, id int64, name, desc string, price money.Cents, category, currency string, version int) error {
+	return f.UpdateProductFn(id, name, desc, price, category, currency, version)
+}
+func (f *fakeStore) ListProducts(ctx context.Context, sort string) ([]store.ProductRow, error) {
+	return f.ListProductsFn(sort)
+}
+func (f *fakeStore) ListProductsByCategory(ctx context.Context, category string) ([]store.ProductRow, error) {
+	return f.ListByCategoryFn(category)
+}
+func (f *fakeStore) ListAllProducts(ctx context.Context, includeDeleted bool) ([]store.ProductRow, error) {
+	return f.ListAllProductsFn(includeDeleted)
+}
+func (f *fakeStore) RestoreProduct(ctx context.Context, id int64) error {
+	return f.RestoreProductFn(id)
+}
+func (f *fakeStore) DeleteProduct(ctx context.Context, id int64, strict bool) (int, error) {
+	return f.DeleteProductFn(id, strict)
+}
+func (f *fakeStore) SearchProducts(ctx context.Context, query string) ([]store.ProductRow, error) {
+	return f.SearchFn(query)
+}
+func (f *fakeStore) CloneProduct(ctx context.Context, id int64) (int64, error) {
+	return f.CloneProductFn(id)
+}
+func (f *fakeStore) SetPublished(ctx context.Context, id int64, published bool) error {
+	return f.SetPublishedFn(id, published)
+}
+func (f *fakeStore) ListProductsPage(ctx context.Context, limit, offset int, sort string) ([]store.ProductRow, error) {
+	return f.ListPageFn(limit, offset, sort)
+}
+func (f *fakeStore) GetPrices(ctx context.Context, ids []int64) (map[int64]money.Cents, error) {
+	return f.GetPricesFn(ids)
+}
+func (f *fakeStore) CountProducts(ctx context.Context) (int64, error) { return f.CountFn() }
+func (f *fakeStore) EstimateProductCount(ctx context.Context) (int64, error) {
+	return f.EstimateCountFn()
+}
+func (f *fakeStore) AddTag(ctx context.Context, productID int64, tag string) error {
+	return f.AddTagFn(productID, tag)
+}
+func (f *fakeStore) RemoveTag(ctx context.Context, productID int64, tag string) error {
+	return f.RemoveTagFn(productID, tag)
+}
+func (f *fakeStore) ListTags(ctx context.Context, productID int64) ([]string, error) {
+	return f.ListTagsFn(productID)
+}
+
+// ListInboundETAs defaults to "nothing inbound"
+func (f *fakeStore) ListInboundETAs(ctx context.Context, ids []int64) (map[int64]time.Time, error) {
+	if f.InboundETAsFn == nil {
+		return map[int64]time.Time{}, nil
+	}
+	return f.InboundETAsFn(ids)
+}
+func (f *fakeStore) CreatePurchaseOrder(ctx context.Context, productID int64, qty int, expectedAt time.Time) (int64, error) {
+	return 1, nil
+}
+func (f *fakeStore) GetInboundETA(ctx context.Context, productID int64) (*time.Time, error) {
+	return nil, nil
+}
+
+// ListTagsForProducts defaults to "no tags" so listing tests needn't stub it
+func (f *fakeStore) ListTagsForProducts(ctx context.Context, ids []int64) (map[int64][]string, error) {
+	if f.TagsForFn == nil {
+		return map[int64][]string{}, nil
+	}
+	return f.TagsForFn(ids)
+}
+func (f *fakeStore) ListProductsByTags(ctx context.Context, tags []string) ([]store.ProductRow, error) {
+	return f.ListByTagsFn(tags)
+}
+func (f *fakeStore) AddToCart(ctx context.Context, userID string, productID int64, qty int) error {
 	return f.AddToCartFn(userID, productID, qty)
 }
-func (f *fakeStore) RemoveFromCart(userID string, productID int64) error {
+func (f *fakeStore) RemoveFromCart(ctx context.Context, userID string, productID int64) error {
 	return f.RemoveFromCartFn(userID, productID)
 }
-func (f *fakeStore) GetCart(userID string) ([]store.CartRow, error) { return f.GetCartFn(userID) }
-func (f *fakeStore) Checkout(userID string) (store.OrderRow, []store.OrderItemRow, error) {
-	return f.CheckoutFn(userID)
+func (f *fakeStore) AddToCartBatch(ctx context.Context, userID string, lines []store.CartRow) error {
+	return f.AddBatchFn(userID, lines)
+}
+func (f *fakeStore) ClearCart(ctx context.Context, userID string) error { return f.ClearCartFn(userID) }
+func (f *fakeStore) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error) {
+	return f.ReleaseExpiredFn(now)
+}
+func (f *fakeStore) UpdateCartQuantity(ctx context.Context, userID string, productID int64, newQty int) error {
+	return f.UpdateQtyFn(userID, productID, newQty)
+}
+func (f *fakeStore) RemoveFromCartBatch(ctx context.Context, userID string, productIDs []int64) error {
+	return f.RemoveBatchFn(userID, productIDs)
+}
+func (f *fakeStore) GetCart(ctx context.Context, userID string) ([]store.CartRow, error) {
+	return f.GetCartFn(userID)
+}
+
+// GetCartContext defaults to GetCartFn's lines, every product live
+func (f *fakeStore) GetCartContext(ctx context.Context, userID string) ([]store.CartLineContext, error) {
+	if f.GetCartContextFn == nil {
+		rows, err := f.GetCartFn(userID)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]store.CartLineContext, 0, len(rows))
+		for _, r := range rows {
+			out = append(out, store.CartLineContext{ProductID: r.ProductID, Quantity: r.Quantity, Published: true})
+		}
+		return out, nil
+	}
+	return f.GetCartContextFn(userID)
+}
+func (f *fakeStore) GetCartDetailed(ctx context.Context, userID string) ([]store.CartDetailRow, error) {
+	return f.GetCartDetailFn(userID)
+}
+func (f *fakeStore) GetCartWeights(ctx context.Context, userID string) ([]store.CartWeightRow, error) {
+	return f.GetCartWeightsFn(userID)
+}
+func (f *fakeStore) GetCartStock(ctx context.Context, userID string) ([]store.CartStockRow, error) {
+	return f.GetCartStockFn(userID)
+}
+func (f *fakeStore) OrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time, limit, offset int) ([]store.ProductOrderRow, error) {
+	return f.ProductOrdersFn(productID, from, to, limit, offset)
+}
+func (f *fakeStore) CountOrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time) (int64, error) {
+	return f.CountProdOrdersFn(productID, from, to)
+}
+func (f *fakeStore) ListAllOrders(ctx context.Context, filter store.OrderFilter, limit, offset int) ([]store.OrderRow, error) {
+	return f.ListAllOrdersFn(filter, limit, offset)
+}
+func (f *fakeStore) SalesVelocity(ctx context.Context, productID int64, window time.Duration) (float64, error) {
+	return f.VelocityFn(productID, window)
+}
+func (f *fakeStore) PublishProducts(ctx context.Context, ids []int64) ([]int64, error) {
+	return f.PublishBatchFn(ids)
+}
+func (f *fakeStore) UpdateOrderStatusBatch(ctx context.Context, orderIDs []int64, status string, strict bool) ([]int64, error) {
+	return f.StatusBatchFn(orderIDs, status, strict)
+}
+func (f *fakeStore) UpdateOrderStatus(ctx context.Context, orderID int64, status string) error {
+	return f.OrderStatusFn(orderID, status)
+}
+func (f *fakeStore) GetStock(ctx context.Context, productID int64) (int, error) {
+	return f.GetStockFn(productID)
+}
+func (f *fakeStore) ListLowStockProducts(ctx context.Context, threshold int) ([]store.ProductRow, error) {
+	return f.LowStockFn(threshold)
+}
+func (f *fakeStore) SetBundleComponents(ctx context.Context, bundleID int64, components []store.BundleComponent) error {
+	return f.SetBundleFn(bundleID, components)
+}
+func (f *fakeStore) GetOrder(ctx context.Context, orderID int64) (store.OrderRow, []store.OrderItemRow, error) {
+	return f.GetOrderFn(orderID)
+}
+func (f *fakeStore) GetOrderByIdempotencyKey(ctx context.Context, userID, key string) (int64, error) {
+	return f.GetOrderByKeyFn(userID, key)
 }
-func (f *fakeStore) UpdateStock(productID int64, newStock int) error {
+func (f *fakeStore) ListOrders(ctx context.Context, userID string) ([]store.OrderRow, error) {
+	return f.ListOrdersFn(userID)
+}
+func (f *fakeStore) ListOrderItems(ctx context.Context, orderID int64) ([]store.OrderItemRow, error) {
+	return f.ListOrderItemsFn(orderID)
+}
+func (f *fakeStore) GetCartSnapshot(ctx context.Context, orderID int64) (string, []store.CartSnapshotLine, error) {
+	return f.CartSnapshotFn(orderID)
+}
+func (f *fakeStore) PutQuoteHold(ctx context.Context, h store.QuoteHold) error {
+	return f.PutQuoteHoldFn(h)
+}
+
+// GetQuoteHold defaults to "no hold" so checkout tests needn't stub it
+func (f *fakeStore) GetQuoteHold(ctx context.Context, userID string) (store.QuoteHold, error) {
+	if f.GetQuoteHoldFn == nil {
+		return store.QuoteHold{}, sql.ErrNoRows
+	}
+	return f.GetQuoteHoldFn(userID)
+}
+func (f *fakeStore) ListReviews(ctx context.Context, productID int64, q store.ReviewQuery) ([]store.ReviewRow, error) {
+	return f.ListReviewsFn(productID, q)
+}
+func (f *fakeStore) CountReviews(ctx context.Context, productID int64, minRating int) (int64, error) {
+	return f.CountReviewsFn(productID, minRating)
+}
+func (f *fakeStore) ReviewDistribution(ctx context.Context, productID int64) (map[int]int64, error) {
+	return f.ReviewDistFn(productID)
+}
+func (f *fakeStore) CountOrders(ctx context.Context, filter store.OrderFilter) (int64, error) {
+	return f.CountOrdersFn(filter)
+}
+func (f *fakeStore) Checkout(ctx context.Context, userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+	return f.CheckoutFn(userID, meta, opts)
+}
+func (f *fakeStore) UpdateOrderMetadata(ctx context.Context, orderID int64, meta map[string]string) error {
+	return f.UpdateOrderMetaFn(orderID, meta)
+}
+func (f *fakeStore) ReturnOrderItem(ctx context.Context, orderID int64, userID string, productID int64, qty int, restock bool) error {
+	return f.ReturnItemFn(orderID, userID, productID, qty, restock)
+}
+func (f *fakeStore) UpdateStock(ctx context.Context, productID int64, newStock int) error {
 	return f.UpdateStockFn(productID, newStock)
 }
-func (f *fakeStore) Close() error { return nil }
+func (f *fakeStore) AdjustStock(ctx context.Context, productID int64, delta int) error {
+	return f.AdjustStockFn(productID, delta)
+}
+func (f *fakeStore) UpdateStockBatch(ctx context.Context, updates []store.StockUpdate) error {
+	return f.StockBatchFn(updates)
+}
+func (f *fakeStore) ListAllStockMovements(ctx context.Context, filter store.MovementFilter, limit, offset int) ([]store.StockMovementRow, error) {
+	return f.ListMovementsFn(filter, limit, offset)
+}
+func (f *fakeStore) CountStockMovements(ctx context.Context, filter store.MovementFilter) (int64, error) {
+	return f.CountMovementsFn(filter)
+}
+func (f *fakeStore) SetAvailability(ctx context.Context, productID int64, from, until *time.Time) error {
+	return nil
+}
+func (f *fakeStore) ListAvailableProducts(ctx context.Context) ([]store.ProductRow, error) {
+	return nil, nil
+}
+func (f *fakeStore) ImportProducts(ctx context.Context, rows []store.ProductExportRow) ([]string, error) {
+	return f.ImportFn(rows)
+}
+func (f *fakeStore) ExportProducts(ctx context.Context, fn func(store.ProductExportRow) error) error {
+	return f.ExportFn(fn)
+}
+func (f *fakeStore) SetReservationLimit(ctx context.Context, productID int64, limit *int) error {
+	return f.SetLimitFn(productID, limit)
+}
+func (f *fakeStore) SetTrackInventory(ctx context.Context, productID int64, track bool) error {
+	return f.SetTrackFn(productID, track)
+}
+func (f *fakeStore) GetOutboxEvent(ctx context.Context, id int64) (store.OutboxRow, error) {
+	return f.GetOutboxFn(id)
+}
+func (f *fakeStore) ListOutboxEvents(ctx context.Context, status string) ([]store.OutboxRow, error) {
+	return f.ListOutboxFn(status)
+}
+func (f *fakeStore) MarkOutboxUnpublished(ctx context.Context, id int64) error {
+	return f.MarkUnpublishedFn(id)
+}
+func (f *fakeStore) EnqueueOutboxEvent(ctx context.Context, eventType string, payload []byte) (int64, error) {
+	return f.EnqueueOutboxFn(eventType, payload)
+}
+func (f *fakeStore) MarkOutboxPublished(ctx context.Context, id int64) error {
+	return f.MarkPublishedFn(id)
+}
+func (f *fakeStore) MarkOutboxAttemptFailed(ctx context.Context, id int64, lastErr string, maxAttempts int) error {
+	return f.MarkAttemptFn(id, lastErr, maxAttempts)
+}
+func (f *fakeStore) MarkOrderPaid(ctx context.Context, orderID int64, chargeID string) error {
+	return f.MarkPaidFn(orderID, chargeID)
+}
+func (f *fakeStore) CancelPendingOrder(ctx context.Context, orderID int64) error {
+	return f.CancelPendingFn(orderID)
+}
+func (f *fakeStore) CancelOrder(ctx context.Context, orderID int64, userID string) error {
+	return f.CancelOrderFn(orderID, userID)
+}
+func (f *fakeStore) GetCoupon(ctx context.Context, code string) (store.CouponRow, error) {
+	return f.GetCouponFn(code)
+}
+func (f *fakeStore) IncrementCouponUse(ctx context.Context, code string) error { return nil }
+func (f *fakeStore) Ping(ctx context.Context) error                            { return nil }
+func (f *fakeStore) Close() error                                              { return nil }
+
+// priced is a non-NULL product price
+func priced(p float64) money.NullCents {
+	return money.NullCents{Cents: money.FromFloat(p), Valid: true}
+}
+
+// oneLineCart is a GetCartFn for tests that only need the cart not to be empty
+func oneLineCart(string) ([]store.CartRow, error) {
+	return []store.CartRow{{ProductID: 1, Quantity: 1}}, nil
+}
 
 // ---- Tests ----
 
 func TestCreateProductValidationAndForwarding(t *testing.T) {
 	svc := NewService(&fakeStore{
-		CreateProductFn: func(name, desc string, price float64) (int64, error) {
+		CreateProductFn: func(name, desc string, price money.Cents, category, currency string) (int64, error) {
 			return 123, nil
 		},
 	})
 
 	// name empty -> error
-	if _, err := svc.CreateProduct("", "d", 10); err == nil {
+	if _, err := svc.CreateProduct(context.Background(), "", "d", 10, "", ""); err == nil {
 		t.Fatalf("expected error for empty name")
 	}
 
 	// negative price -> error
-	if _, err := svc.CreateProduct("n", "d", -1); err == nil {
+	if _, err := svc.CreateProduct(context.Background(), "n", "d", -1, "", ""); err == nil {
 		t.Fatalf("expected error for negative price")
 	}
 
 	// OK path -> forwards to store
-	id, err := svc.CreateProduct("n", "desc", 12.5)
+	id, err := svc.CreateProduct(context.Background(), "n", "desc", 1250, "", "")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -69,26 +410,116 @@ func TestCreateProductValidationAndForwarding(t *testing.T) {
 	}
 }
 
+func TestCreateProduct_Currency(t *testing.T) {
+	var got string
+	svc := NewService(&fakeStore{
+		CreateProductFn: func(name, desc string, price money.Cents, category, currency string) (int64, error) {
+			got = currency
+			return 1, nil
+		},
+	})
+	if _, err := svc.CreateProduct(context.Background(), "mug", "", 4, "", ""); err != nil || got != "USD" {
+		t.Fatalf("expected the USD default, got %q %v", got, err)
+	}
+	if _, err := svc.CreateProduct(context.Background(), "mug", "", 4, "", " eur "); err != nil || got != "EUR" {
+		t.Fatalf("expected EUR, got %q %v", got, err)
+	}
+	for _, bad := range []string{"EU", "EURO", "E1R"} {
+		if _, err := svc.CreateProduct(context.Background(), "mug", "", 4, "", bad); !errors.Is(err, ErrUnknownCurrency) {
+			t.Fatalf("%q: expected ErrUnknownCurrency, got %v", bad, err)
+		}
+	}
+}
+
+func TestCreateProducts_Batch(t *testing.T) {
+	var got []store.ProductRow
+	svc := NewService(&fakeStore{CreateBatchFn: func(products []store.ProductRow) ([]int64, error) {
+		got = products
+		return []int64{10, 11}, nil
+	}})
+
+	ids, err := svc.CreateProducts(context.Background(), []NewProduct{
+		{Name: "mug", Price: 450},
+		{Name: "tee", Price: 1200, Category: "Apparel"},
+	})
+	if err != nil || !reflect.DeepEqual(ids, []int64{10, 11}) {
+		t.Fatalf("unexpected result %v %v", ids, err)
+	}
+	if len(got) != 2 || got[0].Name != "mug" || got[0].Price.Cents != 450 || got[0].Category.Valid || !got[1].Category.Valid {
+		t.Fatalf("store got %+v", got)
+	}
+
+	// one bad entry fails the batch before the store sees any of it
+	got = nil
+	_, err = svc.CreateProducts(context.Background(), []NewProduct{
+		{Name: "mug", Price: 450},
+		{Name: "tee", Price: -1},
+	})
+	if err == nil || !strings.Contains(err.Error(), "products[1]") || got != nil {
+		t.Fatalf("expected products[1] to be reported and nothing stored, got %v %+v", err, got)
+	}
+	if _, err := svc.CreateProducts(context.Background(), nil); err == nil {
+		t.Fatalf("expected an empty batch to be rejected")
+	}
+}
+
+func TestCreateProduct_UnicodeLimits(t *testing.T) {
+	var gotName, gotDesc string
+	svc := NewService(&fakeStore{
+		CreateProductFn: func(name, desc string, price money.Cents, category, currency string) (int64, error) {
+			gotName, gotDesc = name, desc
+			return 1, nil
+		},
+	})
+	svc.MaxNameLen = 4
+	svc.MaxDescriptionLen = 3
+
+	// 4 runes but 16 bytes: within the limit
+	if _, err := svc.CreateProduct(context.Background(), "🍣🍣🍣🍣", "日本語", 1, "", ""); err != nil {
+		t.Fatalf("multibyte text at the limit rejected: %v", err)
+	}
+	if _, err := svc.CreateProduct(context.Background(), "🍣🍣🍣🍣🍣", "", 1, "", ""); !errors.Is(err, ErrTextTooLong) {
+		t.Fatalf("expected ErrTextTooLong for 5 runes, got %v", err)
+	}
+	if _, err := svc.CreateProduct(context.Background(), "ok", "日本語!", 1, "", ""); !errors.Is(err, ErrTextTooLong) {
+		t.Fatalf("expected ErrTextTooLong for a 4 rune description, got %v", err)
+	}
+
+	// "Café" spelled with a combining accent (NFD) is 5 runes; stored as the
+	// 4 rune NFC form, identical to the precomposed spelling
+	nfd, nfc := "Cafe\u0301", "Caf\u00e9"
+	if _, err := svc.CreateProduct(context.Background(), nfd, "", 1, "", ""); err != nil {
+		t.Fatalf("NFD name rejected: %v", err)
+	}
+	if gotName != nfc {
+		t.Fatalf("expected NFC %q stored, got %q", nfc, gotName)
+	}
+	if _, err := svc.CreateProduct(context.Background(), nfc, "e\u0301", 1, "", ""); err != nil || gotName != nfc || gotDesc != "\u00e9" {
+		t.Fatalf("unexpected normalization: %q %q %v", gotName, gotDesc, err)
+	}
+}
+
 func TestListProductsMapping(t *testing.T) {
 	sRows := []store.ProductRow{
 		{
 			ID:          1,
 			Name:        "p1",
 			Description: sql.NullString{String: "d1", Valid: true},
-			Price:       99.5,
+			Price:       priced(99.5),
+			Stock:       7,
 		},
 		{
 			ID:          2,
 			Name:        "p2",
 			Description: sql.NullString{Valid: false},
-			Price:       10.0,
+			Price:       priced(10.0),
 		},
 	}
 	svc := NewService(&fakeStore{
-		ListProductsFn: func() ([]store.ProductRow, error) { return sRows, nil },
+		ListProductsFn: func(sort string) ([]store.ProductRow, error) { return sRows, nil },
 	})
 
-	out, err := svc.ListProducts()
+	out, err := svc.ListProducts(context.Background(), "")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -101,6 +532,154 @@ func TestListProductsMapping(t *testing.T) {
 	if out[1].Description != "" {
 		t.Fatalf("expected empty desc for second product, got %q", out[1].Description)
 	}
+	// out of stock is still reported, as 0
+	if out[0].Stock != 7 || out[1].Stock != 0 {
+		t.Fatalf("expected stock 7 and 0, got %d and %d", out[0].Stock, out[1].Stock)
+	}
+}
+
+func TestListProductsByCategory(t *testing.T) {
+	var got string
+	svc := NewService(&fakeStore{
+		ListByCategoryFn: func(category string) ([]store.ProductRow, error) {
+			got = category
+			if category != "electronics" {
+				return []store.ProductRow{}, nil
+			}
+			return []store.ProductRow{{ID: 3, Name: "cable", Category: sql.NullString{String: "electronics", Valid: true}}}, nil
+		},
+	})
+
+	out, err := svc.ListProductsByCategory(context.Background(), " Electronics ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "electronics" {
+		t.Fatalf("expected the category normalised, got %q", got)
+	}
+	if len(out) != 1 || out[0].ID != 3 || out[0].Category != "electronics" {
+		t.Fatalf("unexpected products %+v", out)
+	}
+
+	// an unknown category is an empty list, not an error
+	if out, err := svc.ListProductsByCategory(context.Background(), "garden"); err != nil || len(out) != 0 {
+		t.Fatalf("expected no products, got %v %v", out, err)
+	}
+	if _, err := svc.ListProductsByCategory(context.Background(), "  "); err == nil {
+		t.Fatalf("expected error for a blank category")
+	}
+}
+
+func TestCreateProduct_Category(t *testing.T) {
+	var got string
+	svc := NewService(&fakeStore{
+		CreateProductFn: func(name, desc string, price money.Cents, category, currency string) (int64, error) {
+			got = category
+			return 1, nil
+		},
+	})
+	if _, err := svc.CreateProduct(context.Background(), "cable", "", 8, "Electronics", ""); err != nil || got != "electronics" {
+		t.Fatalf("expected category stored lower-cased, got %q %v", got, err)
+	}
+	if _, err := svc.CreateProduct(context.Background(), "cable", "", 8, strings.Repeat("x", MaxCategoryLen+1), ""); err == nil {
+		t.Fatalf("expected error for an over-long category")
+	}
+}
+
+func TestListProductsPageValidationAndForwarding(t *testing.T) {
+	svc := NewService(&fakeStore{
+		ListPageFn: func(limit, offset int, sort string) ([]store.ProductRow, error) {
+			if limit != 2 || offset != 4 || sort != store.ProductSortPriceAsc {
+				return nil, fmt.Errorf("unexpected args %d %d %q", limit, offset, sort)
+			}
+			return []store.ProductRow{{ID: 5, Name: "p5"}, {ID: 6, Name: "p6"}}, nil
+		},
+	})
+	svc.DefaultProductSort = store.ProductSortPriceAsc
+	if _, err := svc.ListProductsPage(context.Background(), 0, 0, ""); err == nil {
+		t.Fatalf("expected error for limit <= 0")
+	}
+	if _, err := svc.ListProductsPage(context.Background(), 2, -1, ""); err == nil {
+		t.Fatalf("expected error for negative offset")
+	}
+	if _, err := svc.ListProductsPage(context.Background(), 2, 4, "cheapest"); err == nil {
+		t.Fatalf("expected error for unknown sort")
+	}
+	// no sort given: the configured default is used
+	out, err := svc.ListProductsPage(context.Background(), 2, 4, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != 2 || out[0].ID != 5 {
+		t.Fatalf("unexpected page: %+v", out)
+	}
+}
+
+func TestCountProductsExactAndApproximate(t *testing.T) {
+	exactCalls, estimateCalls := 0, 0
+	estimate := int64(990)
+	fs := &fakeStore{
+		CountFn:         func() (int64, error) { exactCalls++; return 1000, nil },
+		EstimateCountFn: func() (int64, error) { estimateCalls++; return estimate, nil },
+	}
+
+	// exact mode (default) never consults the estimate
+	svc := NewService(fs)
+	if n, err := svc.CountProducts(context.Background(), false); err != nil || n != 1000 {
+		t.Fatalf("expected exact 1000, got %d (%v)", n, err)
+	}
+	if exactCalls != 1 || estimateCalls != 0 {
+		t.Fatalf("unexpected calls exact=%d estimate=%d", exactCalls, estimateCalls)
+	}
+
+	// approximate mode uses the estimate
+	svc.CountMode = CountApproximate
+	if n, err := svc.CountProducts(context.Background(), false); err != nil || n != 990 {
+		t.Fatalf("expected approximate 990, got %d (%v)", n, err)
+	}
+	// ...unless the caller forces an exact count
+	if n, err := svc.CountProducts(context.Background(), true); err != nil || n != 1000 {
+		t.Fatalf("expected forced exact 1000, got %d (%v)", n, err)
+	}
+	if exactCalls != 2 || estimateCalls != 1 {
+		t.Fatalf("unexpected calls exact=%d estimate=%d", exactCalls, estimateCalls)
+	}
+
+	// never-analyzed table reports -1 -> fall back to exact
+	estimate = -1
+	if n, err := svc.CountProducts(context.Background(), false); err != nil || n != 1000 {
+		t.Fatalf("expected fallback to exact 1000, got %d (%v)", n, err)
+	}
+}
+
+func TestCountProductsApproximateExcludesDrafts(t *testing.T) {
+	// 3 published, 2 drafts (one of them a soft-deleted product); both counts
+	// must only see the published rows, so a fresh estimate agrees with the
+	// exact count instead of reporting the whole table
+	published := []bool{true, false, true, false, true}
+	countPublished := func() (int64, error) {
+		var n int64
+		for _, p := range published {
+			if p {
+				n++
+			}
+		}
+		return n, nil
+	}
+	svc := NewService(&fakeStore{CountFn: countPublished, EstimateCountFn: countPublished})
+	svc.CountMode = CountApproximate
+
+	approx, err := svc.CountProducts(context.Background(), false)
+	if err != nil {
+		t.Fatalf("approximate count: %v", err)
+	}
+	exact, err := svc.CountProducts(context.Background(), true)
+	if err != nil {
+		t.Fatalf("exact count: %v", err)
+	}
+	if approx != 3 || exact != 3 {
+		t.Fatalf("expected 3 published products from both counts, got approximate=%d exact=%d", approx, exact)
+	}
 }
 
 func TestAddToCartValidationAndForwarding(t *testing.T) {
@@ -117,17 +696,25 @@ func TestAddToCartValidationAndForwarding(t *testing.T) {
 	svc := NewService(fs)
 
 	// missing user
-	if err := svc.AddToCart("", 1, 1); err == nil {
+	if err := svc.AddToCart(context.Background(), "", 1, 1); err == nil {
 		t.Fatalf("expected error for missing user")
 	}
 
 	// invalid qty
-	if err := svc.AddToCart("u", 1, 0); err == nil {
+	if err := svc.AddToCart(context.Background(), "u", 1, 0); err == nil {
 		t.Fatalf("expected error for qty <= 0")
 	}
 
+	// above the per-line cap -> rejected before reaching the store
+	if err := svc.AddToCart(context.Background(), "u", 1, store.MaxCartLineQuantity+1); !errors.Is(err, store.ErrQuantityOutOfRange) {
+		t.Fatalf("expected ErrQuantityOutOfRange, got %v", err)
+	}
+	if called {
+		t.Fatalf("store should not be called for out-of-range qty")
+	}
+
 	// ok
-	if err := svc.AddToCart("u", 1, 2); err != nil {
+	if err := svc.AddToCart(context.Background(), "u", 1, 2); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if !called {
@@ -148,10 +735,10 @@ func TestRemoveFromCartValidationAndForwarding(t *testing.T) {
 	}
 	svc := NewService(fs)
 
-	if err := svc.RemoveFromCart("", 1); err == nil {
+	if err := svc.RemoveFromCart(context.Background(), "", 1); err == nil {
 		t.Fatalf("expected error for empty user")
 	}
-	if err := svc.RemoveFromCart("u", 1); err != nil {
+	if err := svc.RemoveFromCart(context.Background(), "u", 1); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if !called {
@@ -160,173 +747,2393 @@ func TestRemoveFromCartValidationAndForwarding(t *testing.T) {
 }
 
 func TestGetCartSuccessAndMissingProduct(t *testing.T) {
-	// Setup fake store: GetCart returns one cart row; ListProducts returns the corresponding product price
+	// Setup fake store: GetCartContext returns one cart line with its product
+	// price (no ListProductsFn: pricing the cart mustn't load the catalog)
 	fs := &fakeStore{
-		GetCartFn: func(userID string) ([]store.CartRow, error) {
-			return []store.CartRow{{ProductID: 101, Quantity: 2}}, nil
-		},
-		ListProductsFn: func() ([]store.ProductRow, error) {
-			return []store.ProductRow{{ID: 101, Name: "p", Description: sql.NullString{Valid: false}, Price: 50.0}}, nil
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{{ProductID: 101, Quantity: 2, Name: "p", Price: priced(50.0), Published: true}}, nil
 		},
 	}
 	svc := NewService(fs)
 
-	items, total, err := svc.GetCart("u1")
+	items, total, _, err := svc.GetCart(context.Background(), "u1")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if len(items) != 1 {
 		t.Fatalf("expected 1 item, got %d", len(items))
 	}
-	if total != 100.0 {
+	if total != 10000 {
 		t.Fatalf("expected total 100.0, got %v", total)
 	}
 
-	// missing product case
+	// missing product case, strict
 	fs2 := &fakeStore{
-		GetCartFn: func(userID string) ([]store.CartRow, error) {
-			return []store.CartRow{{ProductID: 202, Quantity: 1}}, nil
-		},
-		ListProductsFn: func() ([]store.ProductRow, error) {
-			return []store.ProductRow{}, nil
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{{ProductID: 202, Quantity: 1, Deleted: true}}, nil
 		},
 	}
 	svc2 := NewService(fs2)
-	_, _, err = svc2.GetCart("u2")
-	if err == nil {
-		t.Fatalf("expected error for missing product")
+	svc2.StrictCart = true
+	_, _, _, err = svc2.GetCart(context.Background(), "u2")
+	if !errors.Is(err, ErrProductNotFound) || err.Error() != "product not found: product 202" {
+		t.Fatalf("expected product not found error, got %v", err)
 	}
 }
 
-func TestCheckoutFlow(t *testing.T) {
-	// empty user validation
-	svc := NewService(&fakeStore{})
-	if _, err := svc.Checkout(""); err == nil {
-		t.Fatalf("expected error for empty user")
-	}
-
-	// success case: store.Checkout returns order row and order items
+func TestGetCart_MissingProductLeftOut(t *testing.T) {
 	fs := &fakeStore{
-		CheckoutFn: func(userID string) (store.OrderRow, []store.OrderItemRow, error) {
-			return store.OrderRow{ID: 55, UserID: userID, Total: 200.0, CreatedAt: time.Now()},
-				[]store.OrderItemRow{{ProductID: 11, Quantity: 2, Price: 100.0}},
-				nil
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 101, Quantity: 2, Name: "p", Price: priced(50.0), Published: true},
+				{ProductID: 202, Quantity: 1, Deleted: true},
+			}, nil
 		},
 	}
-	svc2 := NewService(fs)
-	od, err := svc2.Checkout("u1")
+	svc := NewService(fs)
+	items, total, unresolved, err := svc.GetCart(context.Background(), "u1")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if od.ID != 55 || od.UserID != "u1" || od.Total != 200.0 {
-		t.Fatalf("unexpected order dto: %+v", od)
+	if len(items) != 1 || items[0].ProductID != 101 || total != 10000 {
+		t.Fatalf("expected only the resolvable line, got %+v total=%v", items, total)
 	}
-	if len(od.Items) != 1 || od.Items[0].ProductID != 11 || od.Items[0].Quantity != 2 {
-		t.Fatalf("unexpected items mapping: %+v", od.Items)
+	if !reflect.DeepEqual(unresolved, []int64{202}) {
+		t.Fatalf("expected product 202 unresolved, got %v", unresolved)
 	}
 
-	// store error propagation
-	fs2 := &fakeStore{
-		CheckoutFn: func(userID string) (store.OrderRow, []store.OrderItemRow, error) {
-			return store.OrderRow{}, nil, errors.New("db err")
-		},
-	}
-	svc3 := NewService(fs2)
-	if _, err := svc3.Checkout("u1"); err == nil {
-		t.Fatalf("expected error from store to propagate")
+	svc.StrictCart = true
+	if _, _, _, err := svc.GetCart(context.Background(), "u1"); !errors.Is(err, ErrProductNotFound) {
+		t.Fatalf("expected strict GetCart to fail, got %v", err)
 	}
 }
 
-func TestUpdateStockValidationAndForwarding(t *testing.T) {
-	// negative newStock validation
-	svc := NewService(&fakeStore{})
-	if err := svc.UpdateStock(1, -5); err == nil {
-		t.Fatalf("expected error for negative stock")
-	}
-
-	called := false
+func TestGetCart_Names(t *testing.T) {
 	fs := &fakeStore{
-		UpdateStockFn: func(productID int64, newStock int) error {
-			called = true
-			if productID != 7 || newStock != 10 {
-				return fmt.Errorf("unexpected args")
-			}
-			return nil
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 2, Name: "mug", Price: priced(4.5), Published: true},
+				{ProductID: 2, Quantity: 1, Name: "teapot", Price: priced(20), Published: true},
+				{ProductID: 3, Quantity: 3, Name: "spoon", Price: priced(1), Published: true},
+			}, nil
 		},
 	}
-	svc2 := NewService(fs)
-	if err := svc2.UpdateStock(7, 10); err != nil {
+	items, total, _, err := NewService(fs).GetCart(context.Background(), "u1")
+	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if !called {
-		t.Fatalf("expected UpdateStock to call store")
-	}
-}
-
-// Extra: test ListProducts forwarding error
-func TestListProductsStoreError(t *testing.T) {
-	fs := &fakeStore{
-		ListProductsFn: func() ([]store.ProductRow, error) { return nil, errors.New("db down") },
-	}
-	svc := NewService(fs)
-	if _, err := svc.ListProducts(); err == nil {
-		t.Fatalf("expected store error to propagate")
+	var names []string
+	for _, it := range items {
+		names = append(names, it.Name)
 	}
-}
-
-// Extra: test GetCart store error propagation
-func TestGetCartStoreError(t *testing.T) {
-	fs := &fakeStore{
-		GetCartFn: func(userID string) ([]store.CartRow, error) { return nil, errors.New("db fail") },
+	if !reflect.DeepEqual(names, []string{"mug", "teapot", "spoon"}) {
+		t.Fatalf("unexpected names %v", names)
 	}
-	svc := NewService(fs)
-	if _, _, err := svc.GetCart("u"); err == nil {
-		t.Fatalf("expected error from GetCart to propagate")
+	if total != 3200 {
+		t.Fatalf("expected total 32, got %v", total)
 	}
 }
 
-// Extra: test AddToCart store error propagation
-func TestAddToCartStoreError(t *testing.T) {
-	fs := &fakeStore{
-		AddToCartFn: func(userID string, productID int64, qty int) error { return errors.New("insufficient") },
+func TestGetCart_TotalDoesNotDrift(t *testing.T) {
+	// summed as float64, these lines come to 29.99999999999995
+	var lines []store.CartLineContext
+	var floatTotal float64
+	for i := int64(1); i <= 100; i++ {
+		price := 0.1
+		if i%2 == 0 {
+			price = 0.2
+		}
+		lines = append(lines, store.CartLineContext{ProductID: i, Quantity: 2, Price: priced(price), Published: true})
+		floatTotal += price * 2
 	}
-	svc := NewService(fs)
-	if err := svc.AddToCart("u", 1, 1); err == nil {
-		t.Fatalf("expected store error to propagate")
+	fs := &fakeStore{GetCartContextFn: func(string) ([]store.CartLineContext, error) { return lines, nil }}
+	_, total, _, err := NewService(fs).GetCart(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-}
-
-// Extra: test RemoveFromCart store error propagation
-func TestRemoveFromCartStoreError(t *testing.T) {
-	fs := &fakeStore{
-		RemoveFromCartFn: func(userID string, productID int64) error { return errors.New("no row") },
+	if floatTotal == 30 {
+		t.Fatalf("expected the float64 sum to drift, got exactly %v", floatTotal)
 	}
-	svc := NewService(fs)
-	if err := svc.RemoveFromCart("u", 1); err == nil {
-		t.Fatalf("expected store error to propagate")
+	if total != 3000 {
+		t.Fatalf("expected exactly 30.00, got %s", total)
 	}
 }
 
-// Utility: ensure struct equality of DTOs produced (sanity)
-func TestProductDTOEquality(t *testing.T) {
+func TestGetCartDetailedEnrichesAndFlagsMissing(t *testing.T) {
 	fs := &fakeStore{
-		ListProductsFn: func() ([]store.ProductRow, error) {
-			return []store.ProductRow{
-				{ID: 10, Name: "x", Description: sql.NullString{String: "d", Valid: true}, Price: 1.5},
+		GetCartDetailFn: func(userID string) ([]store.CartDetailRow, error) {
+			return []store.CartDetailRow{
+				{ProductID: 1, Quantity: 2, Product: &store.ProductRow{
+					ID: 1, Name: "speaker", Description: sql.NullString{String: "loud", Valid: true}, Price: priced(25), Stock: 4,
+				}},
+				{ProductID: 2, Quantity: 1}, // product deleted
 			}, nil
 		},
 	}
-	svc := NewService(fs)
-	out, err := svc.ListProducts()
+	items, total, err := NewService(fs).GetCartDetailed(context.Background(), "u1")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := []ProductDTO{{ID: 10, Name: "x", Description: "d", Price: 1.5}}
-	// ignore CreatedAt in comparison
-	for i := range out {
-		out[i].CreatedAt = time.Time{}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(items))
 	}
-	if !reflect.DeepEqual(out, expected) {
+	if items[0].Missing || items[0].Product == nil || items[0].Product.Name != "speaker" ||
+		items[0].Product.Description != "loud" || items[0].Stock != 4 {
+		t.Fatalf("unexpected enriched line: %+v", items[0])
+	}
+	if !items[1].Missing || items[1].Product != nil {
+		t.Fatalf("expected deleted product flagged missing, got %+v", items[1])
+	}
+	if total != 5000 {
+		t.Fatalf("expected total 50 excluding missing line, got %v", total)
+	}
+}
+
+func TestCheckFulfillable(t *testing.T) {
+	svc := NewService(&fakeStore{})
+	if _, _, err := svc.CheckFulfillable(context.Background(), ""); err == nil {
+		t.Fatalf("expected error for empty user")
+	}
+
+	// reserved lines are covered, even when their units were the last ones
+	// (AddToCart took them off stock, leaving 0)
+	fs := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 5, Stock: 0, Tracked: true, Published: true},
+				{ProductID: 2, Quantity: 3, Stock: 3, Tracked: true, Published: true},
+			}, nil
+		},
+	}
+	ok, short, err := NewService(fs).CheckFulfillable(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ok || len(short) != 0 {
+		t.Fatalf("expected fulfillable cart, got ok=%v short=%v", ok, short)
+	}
+
+	// unpublished, outside the availability window and expired reservation
+	// lines can't be fulfilled; the live one can
+	fs2 := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 2, Stock: 1, Tracked: true, Published: false},
+				{ProductID: 2, Quantity: 1, Stock: 0, Tracked: true, Published: true},
+				{ProductID: 3, Quantity: 4, Stock: 9, Tracked: true, Published: true, Unavailable: true},
+				{ProductID: 4, Quantity: 1, Stock: 9, Tracked: true, Published: true, ReservationExpired: true},
+			}, nil
+		},
+	}
+	ok, short, err = NewService(fs2).CheckFulfillable(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected cart to be unfulfillable")
+	}
+	if !reflect.DeepEqual(short, []int64{1, 3, 4}) {
+		t.Fatalf("expected short ids [1 3 4], got %v", short)
+	}
+
+	// untracked products are never short, whatever their stock column says
+	fs3 := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{{ProductID: 8, Quantity: 1000, Stock: 0, Tracked: false, Published: true}}, nil
+		},
+	}
+	ok, short, err = NewService(fs3).CheckFulfillable(context.Background(), "u1")
+	if err != nil || !ok || len(short) != 0 {
+		t.Fatalf("expected untracked line fulfillable, got ok=%v short=%v err=%v", ok, short, err)
+	}
+
+	// a line whose product was deleted can't be fulfilled
+	fs4 := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{{ProductID: 9, Quantity: 1, Deleted: true}}, nil
+		},
+	}
+	ok, short, err = NewService(fs4).CheckFulfillable(context.Background(), "u1")
+	if err != nil || ok || !reflect.DeepEqual(short, []int64{9}) {
+		t.Fatalf("expected deleted line short, got ok=%v short=%v err=%v", ok, short, err)
+	}
+}
+
+func TestCheckoutFlow(t *testing.T) {
+	// empty user validation
+	svc := NewService(&fakeStore{})
+	if _, err := svc.Checkout(context.Background(), "", nil, store.CheckoutOptions{}); err == nil {
+		t.Fatalf("expected error for empty user")
+	}
+
+	// success case: store.Checkout returns order row and order items
+	fs := &fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			return store.OrderRow{ID: 55, UserID: userID, Total: 20000, CreatedAt: time.Now()},
+				[]store.OrderItemRow{{ProductID: 11, Quantity: 2, Price: 10000}},
+				nil, nil
+		},
+	}
+	svc2 := NewService(fs)
+	od, err := svc2.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if od.ID != 55 || od.UserID != "u1" || od.Total != 20000 {
+		t.Fatalf("unexpected order dto: %+v", od)
+	}
+	if len(od.Items) != 1 || od.Items[0].ProductID != 11 || od.Items[0].Quantity != 2 {
+		t.Fatalf("unexpected items mapping: %+v", od.Items)
+	}
+
+	// store error propagation
+	fs2 := &fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			return store.OrderRow{}, nil, nil, errors.New("db err")
+		},
+	}
+	svc3 := NewService(fs2)
+	if _, err := svc3.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{}); err == nil {
+		t.Fatalf("expected error from store to propagate")
+	}
+}
+
+func TestCheckout_EmptyCartSkipsStore(t *testing.T) {
+	fs := &fakeStore{
+		GetCartFn: func(string) ([]store.CartRow, error) { return nil, nil },
+		CheckoutFn: func(string, map[string]string, store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			t.Fatalf("store.Checkout called for an empty cart")
+			return store.OrderRow{}, nil, nil, nil
+		},
+	}
+	svc := NewService(fs)
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{}); !errors.Is(err, store.ErrCartEmpty) {
+		t.Fatalf("expected ErrCartEmpty, got %v", err)
+	}
+}
+
+func TestCheckout_DeletedProduct(t *testing.T) {
+	storeCalled := false
+	fs := &fakeStore{
+		GetCartContextFn: func(string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 1, Name: "p", Price: priced(10), Published: true},
+				{ProductID: 7, Quantity: 2, Deleted: true},
+			}, nil
+		},
+		CheckoutFn: func(string, map[string]string, store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			storeCalled = true
+			return store.OrderRow{ID: 3, UserID: "u1"}, []store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 1000}}, []int64{7}, nil
+		},
+	}
+	svc := NewService(fs)
+	_, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{})
+	if !errors.Is(err, ErrProductNotFound) || !strings.Contains(err.Error(), "product 7") {
+		t.Fatalf("expected ErrProductNotFound for product 7, got %v", err)
+	}
+	if storeCalled {
+		t.Fatalf("store.Checkout called for a cart with a deleted product")
+	}
+
+	// dropping unavailable lines drops the deleted one too
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{RemoveUnavailable: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !storeCalled {
+		t.Fatalf("expected store.Checkout with RemoveUnavailable")
+	}
+}
+
+func TestCheckoutMetadata(t *testing.T) {
+	var stored map[string]string
+	fs := &fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			stored = meta
+			return store.OrderRow{ID: 1, UserID: userID, Total: 1000, Metadata: meta},
+				[]store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 1000}}, nil, nil
+		},
+	}
+	svc := NewService(fs)
+
+	meta := map[string]string{"campaign": "spring", "referrer": "newsletter"}
+	od, err := svc.Checkout(context.Background(), "u1", meta, store.CheckoutOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(stored, meta) {
+		t.Fatalf("expected metadata forwarded to store, got %v", stored)
+	}
+	if !reflect.DeepEqual(od.Metadata, meta) {
+		t.Fatalf("expected metadata on dto, got %v", od.Metadata)
+	}
+
+	// too many keys -> rejected before reaching the store
+	stored = nil
+	big := map[string]string{}
+	for i := 0; i <= MaxMetadataKeys; i++ {
+		big[fmt.Sprintf("k%d", i)] = "v"
+	}
+	if _, err := svc.Checkout(context.Background(), "u1", big, store.CheckoutOptions{}); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expected ErrMetadataTooLarge for key count, got %v", err)
+	}
+	// oversized value
+	long := map[string]string{"note": string(make([]byte, MaxMetadataValueLen+1))}
+	if _, err := svc.Checkout(context.Background(), "u1", long, store.CheckoutOptions{}); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expected ErrMetadataTooLarge for value size, got %v", err)
+	}
+	if stored != nil {
+		t.Fatalf("store should not be called for invalid metadata")
+	}
+}
+
+func TestUpdateOrderMetadata(t *testing.T) {
+	var gotID int64
+	fs := &fakeStore{
+		UpdateOrderMetaFn: func(orderID int64, meta map[string]string) error {
+			gotID = orderID
+			return nil
+		},
+	}
+	svc := NewService(fs)
+	if err := svc.UpdateOrderMetadata(context.Background(), 0, nil); err == nil {
+		t.Fatalf("expected error for invalid order id")
+	}
+	big := map[string]string{string(make([]byte, MaxMetadataKeyLen+1)): "v"}
+	if err := svc.UpdateOrderMetadata(context.Background(), 3, big); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expected ErrMetadataTooLarge, got %v", err)
+	}
+	if err := svc.UpdateOrderMetadata(context.Background(), 3, map[string]string{"a": "b"}); err != nil || gotID != 3 {
+		t.Fatalf("expected forwarding to store, got id=%d err=%v", gotID, err)
+	}
+}
+
+func TestUpdateStockValidationAndForwarding(t *testing.T) {
+	// negative newStock validation
+	svc := NewService(&fakeStore{})
+	if err := svc.UpdateStock(context.Background(), 1, -5); err == nil {
+		t.Fatalf("expected error for negative stock")
+	}
+
+	called := false
+	fs := &fakeStore{
+		UpdateStockFn: func(productID int64, newStock int) error {
+			called = true
+			if productID != 7 || newStock != 10 {
+				return fmt.Errorf("unexpected args")
+			}
+			return nil
+		},
+	}
+	svc2 := NewService(fs)
+	if err := svc2.UpdateStock(context.Background(), 7, 10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Fatalf("expected UpdateStock to call store")
+	}
+}
+
+func TestUpdateStockBatch(t *testing.T) {
+	var got []store.StockUpdate
+	svc := NewService(&fakeStore{StockBatchFn: func(updates []store.StockUpdate) error {
+		got = updates
+		return nil
+	}})
+	for _, bad := range [][]store.StockUpdate{
+		nil,
+		{{ProductID: 0, NewStock: 1}},
+		{{ProductID: 1, NewStock: -1}},
+		{{ProductID: 1, NewStock: 5}, {ProductID: 1, NewStock: 6}},
+	} {
+		if err := svc.UpdateStockBatch(context.Background(), bad); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+	if got != nil {
+		t.Fatalf("expected invalid batches not to reach the store, got %+v", got)
+	}
+
+	updates := []store.StockUpdate{{ProductID: 1, NewStock: 100}, {ProductID: 2, NewStock: 0}}
+	if err := svc.UpdateStockBatch(context.Background(), updates); err != nil || !reflect.DeepEqual(got, updates) {
+		t.Fatalf("unexpected %+v %v", got, err)
+	}
+}
+
+func TestAdjustStockValidationAndForwarding(t *testing.T) {
+	if err := NewService(&fakeStore{}).AdjustStock(context.Background(), 1, 0); err == nil {
+		t.Fatalf("expected error for zero delta")
+	}
+
+	var gotID int64
+	var gotDelta int
+	fs := &fakeStore{AdjustStockFn: func(productID int64, delta int) error {
+		gotID, gotDelta = productID, delta
+		if delta < -5 {
+			return store.ErrInsufficientStock
+		}
+		return nil
+	}}
+	svc := NewService(fs)
+	if err := svc.AdjustStock(context.Background(), 7, -3); err != nil || gotID != 7 || gotDelta != -3 {
+		t.Fatalf("expected forwarding to store, got %d/%d %v", gotID, gotDelta, err)
+	}
+	if err := svc.AdjustStock(context.Background(), 7, -6); !errors.Is(err, store.ErrInsufficientStock) {
+		t.Fatalf("expected ErrInsufficientStock, got %v", err)
+	}
+}
+
+// Extra: test ListProducts forwarding error
+func TestListProductsStoreError(t *testing.T) {
+	fs := &fakeStore{
+		ListProductsFn: func(sort string) ([]store.ProductRow, error) { return nil, errors.New("db down") },
+	}
+	svc := NewService(fs)
+	if _, err := svc.ListProducts(context.Background(), ""); err == nil {
+		t.Fatalf("expected store error to propagate")
+	}
+}
+
+// Extra: test GetCart store error propagation
+func TestGetCartStoreError(t *testing.T) {
+	fs := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) { return nil, errors.New("db fail") },
+	}
+	svc := NewService(fs)
+	if _, _, _, err := svc.GetCart(context.Background(), "u"); err == nil {
+		t.Fatalf("expected error from GetCart to propagate")
+	}
+}
+
+func TestAddToCartBatch_BestEffortPerItem(t *testing.T) {
+	var added []int64
+	fs := &fakeStore{
+		AddToCartFn: func(userID string, productID int64, qty int) error {
+			if productID == 2 {
+				return store.ErrInsufficientStock
+			}
+			added = append(added, productID)
+			return nil
+		},
+	}
+	svc := NewService(fs)
+	items := []CartBatchItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 5}, {ProductID: 3, Quantity: 0}, {ProductID: 4, Quantity: 2}}
+	results, err := svc.AddToCartBatch(context.Background(), "u", items, BatchBestEffort)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 4 || results[0].Err != nil || results[3].Err != nil {
+		t.Fatalf("expected items 1 and 4 to succeed, got %+v", results)
+	}
+	if !errors.Is(results[1].Err, store.ErrInsufficientStock) || results[2].Err == nil {
+		t.Fatalf("expected items 2 and 3 to fail on their own, got %+v", results)
+	}
+	if len(added) != 2 {
+		t.Fatalf("expected one store call per valid item, got %v", added)
+	}
+	if _, err := svc.AddToCartBatch(context.Background(), "u", items, "sometimes"); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+}
+
+func TestAddToCartBatch_AtomicUsesOneStoreCall(t *testing.T) {
+	var got []store.CartRow
+	fs := &fakeStore{
+		AddBatchFn: func(userID string, lines []store.CartRow) error {
+			got = lines
+			return nil
+		},
+	}
+	svc := NewService(fs)
+	results, err := svc.AddToCartBatch(context.Background(), "u", []CartBatchItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 3}}, "")
+	if err != nil || len(results) != 2 || results[1].Err != nil {
+		t.Fatalf("unexpected results %+v, %v", results, err)
+	}
+	if len(got) != 2 || got[1] != (store.CartRow{ProductID: 2, Quantity: 3}) {
+		t.Fatalf("unexpected store lines %+v", got)
+	}
+
+	fs.AddBatchFn = func(string, []store.CartRow) error {
+		return fmt.Errorf("product 2: %w", store.ErrInsufficientStock)
+	}
+	if _, err := svc.AddToCartBatch(context.Background(), "u", []CartBatchItem{{ProductID: 2, Quantity: 3}}, BatchAtomic); !errors.Is(err, store.ErrInsufficientStock) {
+		t.Fatalf("expected the batch to fail as a whole, got %v", err)
+	}
+}
+
+func TestRemoveFromCartBatch_BestEffortPerItem(t *testing.T) {
+	fs := &fakeStore{
+		RemoveFromCartFn: func(userID string, productID int64) error {
+			if productID == 5 {
+				return sql.ErrNoRows
+			}
+			return nil
+		},
+	}
+	svc := NewService(fs)
+	results, err := svc.RemoveFromCartBatch(context.Background(), "u", []int64{4, 5}, BatchBestEffort)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results[0].Err != nil || !errors.Is(results[1].Err, sql.ErrNoRows) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if _, err := svc.RemoveFromCartBatch(context.Background(), "u", nil, BatchBestEffort); err == nil {
+		t.Fatalf("expected empty batch to be rejected")
+	}
+}
+
+func TestDeleteProductValidationAndForwarding(t *testing.T) {
+	var gotStrict bool
+	svc := NewService(&fakeStore{
+		DeleteProductFn: func(id int64, strict bool) (int, error) {
+			gotStrict = strict
+			return 1, nil
+		},
+	})
+	if _, err := svc.DeleteProduct(context.Background(), 0, true); err == nil {
+		t.Fatalf("expected error for id <= 0")
+	}
+	if n, err := svc.DeleteProduct(context.Background(), 3, true); err != nil || n != 1 || !gotStrict {
+		t.Fatalf("expected strict delete to be forwarded, got %d %v strict=%v", n, err, gotStrict)
+	}
+}
+
+func TestPublishProductsValidationAndDedup(t *testing.T) {
+	var got []int64
+	svc := NewService(&fakeStore{
+		PublishBatchFn: func(ids []int64) ([]int64, error) {
+			got = ids
+			return nil, nil
+		},
+	})
+	if _, err := svc.PublishProducts(context.Background(), nil); err == nil {
+		t.Fatalf("expected error for no ids")
+	}
+	if _, err := svc.PublishProducts(context.Background(), []int64{1, 0}); err == nil {
+		t.Fatalf("expected error for id <= 0")
+	}
+	if _, err := svc.PublishProducts(context.Background(), make([]int64, MaxPublishBatch+1)); !errors.Is(err, ErrTooManyIDs) {
+		t.Fatalf("expected ErrTooManyIDs, got %v", err)
+	}
+	out, err := svc.PublishProducts(context.Background(), []int64{3, 2, 3})
+	if err != nil || out == nil || !reflect.DeepEqual(got, []int64{3, 2}) {
+		t.Fatalf("expected deduplicated ids forwarded, got %v (out %v, err %v)", got, out, err)
+	}
+}
+
+func TestGetProduct(t *testing.T) {
+	svc := NewService(&fakeStore{
+		GetProductFn: func(id int64) (store.ProductRow, error) {
+			if id != 2 {
+				return store.ProductRow{}, sql.ErrNoRows
+			}
+			return store.ProductRow{ID: 2, Name: "b", Price: priced(3), Stock: 4}, nil
+		},
+	})
+	if _, err := svc.GetProduct(context.Background(), 0); err == nil {
+		t.Fatalf("expected error for id <= 0")
+	}
+	if _, err := svc.GetProduct(context.Background(), 5); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	p, err := svc.GetProduct(context.Background(), 2)
+	if err != nil || p.Stock != 4 || p.Price == nil || *p.Price != 300 {
+		t.Fatalf("unexpected product %+v %v", p, err)
+	}
+}
+
+func TestUpdateProductValidation(t *testing.T) {
+	called := false
+	svc := NewService(&fakeStore{
+		UpdateProductFn: func(id int64, name, desc string, price money.Cents, category, currency string, version int) error {
+			called = true
+			if id != 3 || name != "Widget" || price != 450 || version != 2 {
+				return fmt.Errorf("unexpected args %d %q %v %d", id, name, price, version)
+			}
+			return nil
+		},
+	})
+	for _, tc := range []struct {
+		id      int64
+		name    string
+		price   money.Cents
+		version int
+	}{{0, "Widget", 100, 1}, {3, "", 100, 1}, {3, "Widget", -1, 1}, {3, "Widget", 100, 0}} {
+		if err := svc.UpdateProduct(context.Background(), tc.id, tc.name, "", tc.price, "", "", tc.version); err == nil {
+			t.Fatalf("expected %+v to be rejected", tc)
+		}
+	}
+	if called {
+		t.Fatalf("store called for an invalid update")
+	}
+	if err := svc.UpdateProduct(context.Background(), 3, "Widget", "", 450, "", "", 2); err != nil || !called {
+		t.Fatalf("expected update to be forwarded, got %v", err)
+	}
+}
+
+func TestUpdateProduct_PriceChangeAndCarts(t *testing.T) {
+	price := money.Cents(1000)
+	fs := &fakeStore{
+		UpdateProductFn: func(id int64, name, desc string, p money.Cents, category, currency string, version int) error {
+			price = p
+			return nil
+		},
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{{ProductID: 1, Quantity: 2, Name: "a", Price: money.NullCents{Cents: price, Valid: true}, Published: true}}, nil
+		},
+		GetQuoteHoldFn: func(userID string) (store.QuoteHold, error) {
+			return store.QuoteHold{UserID: userID, Lines: []store.QuoteHoldLine{{ProductID: 1, Quantity: 2, Price: 1000}},
+				ExpiresAt: time.Now().Add(time.Minute)}, nil
+		},
+	}
+	svc := NewService(fs)
+	if err := svc.UpdateProduct(context.Background(), 1, "a", "", 1200, "", "", 1); err != nil {
+		t.Fatalf("UpdateProduct: %v", err)
+	}
+	// the cart line follows the product...
+	lines, total, _, err := svc.GetCart(context.Background(), "u1")
+	if err != nil || lines[0].Price != 1200 || total != 2400 {
+		t.Fatalf("expected cart at the new price, got %+v %v %v", lines, total, err)
+	}
+	// ...but a held quote keeps the price it promised
+	held, err := svc.heldPrices(context.Background(), "u1")
+	if err != nil || held[1] != 1000 {
+		t.Fatalf("expected the held price to survive the change, got %v %v", held, err)
+	}
+}
+
+func TestOrdersContainingProduct(t *testing.T) {
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	svc := NewService(&fakeStore{
+		ProductOrdersFn: func(productID int64, f, to time.Time, limit, offset int) ([]store.ProductOrderRow, error) {
+			return []store.ProductOrderRow{{OrderRow: store.OrderRow{ID: 3, UserID: "u1", Currency: "EUR", Status: "placed"}, Quantity: 2, Price: 400}}, nil
+		},
+		CountProdOrdersFn: func(int64, time.Time, time.Time) (int64, error) { return 1, nil },
+	})
+	if _, _, err := svc.OrdersContainingProduct(context.Background(), 0, from, time.Time{}, 10, 0); err == nil {
+		t.Fatalf("expected error for product id <= 0")
+	}
+	if _, _, err := svc.OrdersContainingProduct(context.Background(), 1, from, from, 10, 0); err == nil {
+		t.Fatalf("expected error for an empty window")
+	}
+	if _, _, err := svc.OrdersContainingProduct(context.Background(), 1, from, time.Time{}, MaxOrderPageSize+1, 0); err == nil {
+		t.Fatalf("expected error for limit over the cap")
+	}
+	out, total, err := svc.OrdersContainingProduct(context.Background(), 1, from, time.Time{}, 10, 0)
+	if err != nil || total != 1 || len(out) != 1 || out[0].ID != 3 || out[0].Quantity != 2 || out[0].Currency != "EUR" {
+		t.Fatalf("unexpected result %+v %d %v", out, total, err)
+	}
+}
+
+// Extra: test AddToCart store error propagation
+func TestAddToCartStoreError(t *testing.T) {
+	fs := &fakeStore{
+		AddToCartFn: func(userID string, productID int64, qty int) error { return errors.New("insufficient") },
+	}
+	svc := NewService(fs)
+	if err := svc.AddToCart(context.Background(), "u", 1, 1); err == nil {
+		t.Fatalf("expected store error to propagate")
+	}
+}
+
+// Extra: test RemoveFromCart store error propagation
+func TestRemoveFromCartStoreError(t *testing.T) {
+	fs := &fakeStore{
+		RemoveFromCartFn: func(userID string, productID int64) error { return errors.New("no row") },
+	}
+	svc := NewService(fs)
+	if err := svc.RemoveFromCart(context.Background(), "u", 1); err == nil {
+		t.Fatalf("expected store error to propagate")
+	}
+}
+
+// Utility: ensure struct equality of DTOs produced (sanity)
+func TestProductDTOEquality(t *testing.T) {
+	created := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	updated := created.Add(time.Hour)
+	fs := &fakeStore{
+		ListProductsFn: func(sort string) ([]store.ProductRow, error) {
+			return []store.ProductRow{
+				{ID: 10, Name: "x", Description: sql.NullString{String: "d", Valid: true}, Price: priced(1.5), Stock: 3, CreatedAt: created, UpdatedAt: updated},
+			}, nil
+		},
+	}
+	svc := NewService(fs)
+	out, err := svc.ListProducts(context.Background(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	price := money.Cents(150)
+	expected := []ProductDTO{{ID: 10, Name: "x", Description: "d", Price: &price, Stock: 3, CreatedAt: &created, UpdatedAt: &updated}}
+	if !reflect.DeepEqual(out, expected) {
 		t.Fatalf("unexpected mapping. got %+v, want %+v", out, expected)
 	}
 }
+
+func TestExportProducts_MapsNullColumns(t *testing.T) {
+	fs := &fakeStore{ExportFn: func(fn func(store.ProductExportRow) error) error {
+		if err := fn(store.ProductExportRow{ID: 1, Name: "a", Price: sql.NullFloat64{Float64: 2, Valid: true}, WeightGrams: sql.NullInt64{Int64: 300, Valid: true}, Tags: []string{"x"}}); err != nil {
+			return err
+		}
+		return fn(store.ProductExportRow{ID: 2, Name: "b"})
+	}}
+	var got []ProductExportDTO
+	if err := NewService(fs).ExportProducts(context.Background(), func(p ProductExportDTO) error { got = append(got, p); return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 || *got[0].Price != 2 || *got[0].WeightGrams != 300 || got[0].MaxReservedPerUser != nil {
+		t.Fatalf("unexpected first product: %+v", got)
+	}
+	if got[1].Price != nil || got[1].AvailableFrom != nil || got[1].Tags == nil {
+		t.Fatalf("want nulls as nil and tags as [], got %+v", got[1])
+	}
+}
+
+func TestImportProducts_ReportsCounts(t *testing.T) {
+	var batches [][]store.ProductExportRow
+	existing := map[int64]string{1: "cable", 2: "draft"}
+	fs := &fakeStore{ImportFn: func(rows []store.ProductExportRow) ([]string, error) {
+		batches = append(batches, rows)
+		out := make([]string, 0, len(rows))
+		for _, r := range rows {
+			switch name, ok := existing[r.ID]; {
+			case !ok:
+				out = append(out, store.ImportCreated)
+			case name == r.Name:
+				out = append(out, store.ImportUnchanged)
+			default:
+				out = append(out, store.ImportUpdated)
+			}
+		}
+		return out, nil
+	}}
+	svc := NewService(fs)
+	neg := -1.0
+	rep, err := svc.ImportProducts(context.Background(), []ProductExportDTO{
+		{ID: 1, Name: "cable v2", Tags: []string{"USB", "usb", "sale"}}, // updated
+		{ID: 2, Name: "draft"},            // unchanged: skipped
+		{ID: 7, Name: "lamp"},             // created with its id
+		{Name: "mat"},                     // created with a fresh id
+		{ID: 8, Name: ""},                 // invalid
+		{ID: 9, Name: "bad", Price: &neg}, // invalid
+		{ID: 7, Name: "lamp again"},       // duplicate id
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rep.Created != 2 || rep.Updated != 1 || rep.Skipped != 4 || len(rep.Errors) != 3 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if e := rep.Errors[2]; e.Index != 6 || e.ID != 7 || e.Error != "duplicate id" {
+		t.Fatalf("unexpected error entry: %+v", e)
+	}
+	if tags := batches[0][0].Tags; !reflect.DeepEqual(tags, []string{"sale", "usb"}) {
+		t.Fatalf("tags not normalized: %v", tags)
+	}
+
+	// large imports are written in batches
+	batches = nil
+	many := make([]ProductExportDTO, ImportBatchSize+1)
+	for i := range many {
+		many[i] = ProductExportDTO{ID: int64(100 + i), Name: "p"}
+	}
+	if rep, err := svc.ImportProducts(context.Background(), many); err != nil || rep.Created != ImportBatchSize+1 || len(batches) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("want 2 batches creating %d, got %d batches, %+v, %v", ImportBatchSize+1, len(batches), rep, err)
+	}
+}
+
+func TestListOutboxEvents(t *testing.T) {
+	fs := &fakeStore{
+		ListOutboxFn: func(status string) ([]store.OutboxRow, error) {
+			if status != store.OutboxFailed {
+				return nil, fmt.Errorf("unexpected status %q", status)
+			}
+			return []store.OutboxRow{{
+				ID: 3, EventType: "order.created", Payload: []byte(`{"id":1}`), Status: store.OutboxFailed,
+				Attempts: 5, LastError: sql.NullString{String: "timeout", Valid: true},
+			}}, nil
+		},
+	}
+	svc := NewService(fs)
+	if _, err := svc.ListOutboxEvents(context.Background(), "bogus"); err == nil {
+		t.Fatalf("expected error for unknown status")
+	}
+	out, err := svc.ListOutboxEvents(context.Background(), store.OutboxFailed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != 3 || out[0].LastError != "timeout" || string(out[0].Payload) != `{"id":1}` {
+		t.Fatalf("unexpected events: %+v", out)
+	}
+}
+
+func TestReplayOutboxEvent(t *testing.T) {
+	reset := []int64{}
+	fs := &fakeStore{
+		GetOutboxFn: func(id int64) (store.OutboxRow, error) {
+			switch id {
+			case 1:
+				return store.OutboxRow{ID: 1, Status: store.OutboxFailed}, nil
+			case 2:
+				return store.OutboxRow{ID: 2, Status: store.OutboxPending}, nil
+			}
+			return store.OutboxRow{}, sql.ErrNoRows
+		},
+		MarkUnpublishedFn: func(id int64) error {
+			reset = append(reset, id)
+			return nil
+		},
+	}
+	svc := NewService(fs)
+
+	ev, err := svc.ReplayOutboxEvent(context.Background(), 1)
+	if err != nil || ev.ID != 1 {
+		t.Fatalf("expected replay of event 1, got %+v (%v)", ev, err)
+	}
+	if _, err := svc.ReplayOutboxEvent(context.Background(), 2); !errors.Is(err, ErrOutboxAlreadyPending) {
+		t.Fatalf("expected ErrOutboxAlreadyPending, got %v", err)
+	}
+	if _, err := svc.ReplayOutboxEvent(context.Background(), 9); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if !reflect.DeepEqual(reset, []int64{1}) {
+		t.Fatalf("expected only event 1 reset, got %v", reset)
+	}
+}
+
+// hookFunc adapts a func to PostCheckoutHook
+type hookFunc func(OrderDTO) error
+
+func (f hookFunc) AfterCheckout(od OrderDTO) error { return f(od) }
+
+// fakeGateway is a PaymentGateway for tests. It answers after delay (or
+// when ctx is done, whichever is first), declining when decline is set.
+type fakeGateway struct {
+	decline bool
+	delay   time.Duration
+	charged []money.Cents
+}
+
+func (g *fakeGateway) Charge(ctx context.Context, amount money.Cents, token string) (string, error) {
+	select {
+	case <-time.After(g.delay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if g.decline {
+		return "", fmt.Errorf("%w: insufficient funds", ErrPaymentDeclined)
+	}
+	g.charged = append(g.charged, amount)
+	return fmt.Sprintf("ch_%d", len(g.charged)), nil
+}
+
+// payStore is a fakeStore whose checkout creates order 7 for 20.00 and
+// records how it was settled
+func payStore(gotOpts *store.CheckoutOptions, paid *string, cancelled *bool) *fakeStore {
+	return &fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			*gotOpts = opts
+			return store.OrderRow{ID: 7, UserID: userID, Total: 2000, Status: store.OrderStatusPending},
+				[]store.OrderItemRow{{ProductID: 1, Quantity: 2, Price: 1000}}, nil, nil
+		},
+		MarkPaidFn:      func(orderID int64, chargeID string) error { *paid = chargeID; return nil },
+		CancelPendingFn: func(orderID int64) error { *cancelled = orderID == 7; return nil },
+	}
+}
+
+func TestCheckout_CreatedAtFromStore(t *testing.T) {
+	created := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	svc := NewService(&fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			return store.OrderRow{ID: 1, UserID: userID, Total: 500, CreatedAt: created}, []store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 500}}, nil, nil
+		},
+	})
+	od, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !od.CreatedAt.Equal(created) {
+		t.Fatalf("expected created_at %v from the store, got %v", created, od.CreatedAt)
+	}
+}
+
+func TestCheckout_Coupon(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	coupons := map[string]store.CouponRow{
+		"SPRING10": {Code: "SPRING10", PercentOff: 10},
+		"OLD":      {Code: "OLD", PercentOff: 50, ExpiresAt: &expired},
+	}
+	var got store.CheckoutOptions
+	svc := NewService(&fakeStore{
+		GetCartFn: oneLineCart,
+		GetCouponFn: func(code string) (store.CouponRow, error) {
+			c, ok := coupons[code]
+			if !ok {
+				return c, sql.ErrNoRows
+			}
+			return c, nil
+		},
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			got = opts
+			return store.OrderRow{ID: 1, UserID: userID, Total: 450, Discount: 50, CouponCode: opts.CouponCode},
+				[]store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 500}}, nil, nil
+		},
+	})
+
+	od, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{CouponCode: "SPRING10"})
+	if err != nil || got.CouponCode != "SPRING10" {
+		t.Fatalf("expected the coupon passed to the store, got %+v %v", got, err)
+	}
+	if od.Total != 450 || od.Discount != 50 || od.CouponCode != "SPRING10" {
+		t.Fatalf("unexpected order %+v", od)
+	}
+
+	// bad codes are turned away before the store's checkout runs
+	got = store.CheckoutOptions{}
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{CouponCode: "OLD"}); !errors.Is(err, store.ErrCouponExpired) {
+		t.Fatalf("expected ErrCouponExpired, got %v", err)
+	}
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{CouponCode: "NOPE"}); !errors.Is(err, store.ErrUnknownCoupon) {
+		t.Fatalf("expected ErrUnknownCoupon, got %v", err)
+	}
+	if got.CouponCode != "" {
+		t.Fatalf("store checkout ran with a bad coupon")
+	}
+}
+
+func TestCheckout_IdempotencyKey(t *testing.T) {
+	keys := map[string]int64{}
+	orders := map[int64]store.OrderRow{}
+	checkouts := 0
+	svc := NewService(&fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			checkouts++
+			o := store.OrderRow{ID: int64(checkouts), UserID: userID, Total: 500, Status: store.OrderStatusPlaced}
+			orders[o.ID] = o
+			keys[userID+"/"+opts.IdempotencyKey] = o.ID
+			return o, []store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 500}}, nil, nil
+		},
+		GetOrderByKeyFn: func(userID, key string) (int64, error) {
+			id, ok := keys[userID+"/"+key]
+			if !ok {
+				return 0, sql.ErrNoRows
+			}
+			return id, nil
+		},
+		GetOrderFn: func(orderID int64) (store.OrderRow, []store.OrderItemRow, error) {
+			return orders[orderID], []store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 500}}, nil
+		},
+	})
+	checkout := func(userID, key string) OrderDTO {
+		t.Helper()
+		od, err := svc.Checkout(context.Background(), userID, nil, store.CheckoutOptions{IdempotencyKey: key})
+		if err != nil {
+			t.Fatalf("Checkout(%s, %s) failed: %v", userID, key, err)
+		}
+		return od
+	}
+
+	first := checkout("u1", "k1")
+	again := checkout("u1", "k1")
+	if checkouts != 1 || again.ID != first.ID || len(again.Items) != 1 || again.Total != 500 {
+		t.Fatalf("expected the repeat to return order %d without checking out, got %+v after %d checkouts", first.ID, again, checkouts)
+	}
+	// keys are per user, and a new key is a new order
+	if od := checkout("u2", "k1"); od.ID == first.ID {
+		t.Fatalf("another user's key returned order %d", od.ID)
+	}
+	if od := checkout("u1", "k2"); od.ID == first.ID || checkouts != 3 {
+		t.Fatalf("a new key returned order %d after %d checkouts", od.ID, checkouts)
+	}
+
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{IdempotencyKey: strings.Repeat("k", MaxIdempotencyKeyLen+1)}); err == nil {
+		t.Fatalf("expected an over-long key to be refused")
+	}
+}
+
+func TestCheckout_IdempotencyKeyReplaysCoupon(t *testing.T) {
+	// the store keeps the order as placed, and GetOrder reads it back
+	var saved store.OrderRow
+	svc := NewService(&fakeStore{
+		GetCartFn: oneLineCart,
+		GetCouponFn: func(code string) (store.CouponRow, error) {
+			return store.CouponRow{Code: code, PercentOff: 10}, nil
+		},
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			saved = store.OrderRow{ID: 3, UserID: userID, Total: 450, Currency: "USD", Status: store.OrderStatusPlaced, Discount: 50, CouponCode: opts.CouponCode}
+			return saved, []store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 500}}, nil, nil
+		},
+		GetOrderByKeyFn: func(userID, key string) (int64, error) {
+			if saved.ID == 0 {
+				return 0, sql.ErrNoRows
+			}
+			return saved.ID, nil
+		},
+		GetOrderFn: func(orderID int64) (store.OrderRow, []store.OrderItemRow, error) {
+			return saved, []store.OrderItemRow{{ProductID: 1, Quantity: 1, Price: 500}}, nil
+		},
+	})
+	opts := store.CheckoutOptions{IdempotencyKey: "k1", CouponCode: "SPRING10"}
+	first, err := svc.Checkout(context.Background(), "u1", nil, opts)
+	if err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	again, err := svc.Checkout(context.Background(), "u1", nil, opts)
+	if err != nil {
+		t.Fatalf("replayed Checkout failed: %v", err)
+	}
+	if first.Discount != 50 || again.ID != first.ID || again.Total != first.Total ||
+		again.Discount != first.Discount || again.CouponCode != first.CouponCode {
+		t.Fatalf("replay doesn't match the original: first %+v, again %+v", first, again)
+	}
+	if od, err := svc.GetOrder(context.Background(), "u1", 3); err != nil || od.Discount != 50 || od.CouponCode != "SPRING10" {
+		t.Fatalf("expected GetOrder to report the discount, got %+v %v", od, err)
+	}
+}
+
+func TestCheckout_IdempotencyKeyRace(t *testing.T) {
+	// the concurrent twin committed between our lookup and our checkout
+	lookups := 0
+	svc := NewService(&fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(string, map[string]string, store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			return store.OrderRow{}, nil, nil, fmt.Errorf("%w: k1", store.ErrIdempotencyKeyInUse)
+		},
+		GetOrderByKeyFn: func(userID, key string) (int64, error) {
+			if lookups++; lookups == 1 {
+				return 0, sql.ErrNoRows
+			}
+			return 9, nil
+		},
+		GetOrderFn: func(orderID int64) (store.OrderRow, []store.OrderItemRow, error) {
+			return store.OrderRow{ID: orderID, UserID: "u1", Total: 500}, nil, nil
+		},
+	})
+	od, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{IdempotencyKey: "k1"})
+	if err != nil || od.ID != 9 {
+		t.Fatalf("expected the twin's order 9, got %+v %v", od, err)
+	}
+}
+
+func TestCheckoutAndPay_Charged(t *testing.T) {
+	var opts store.CheckoutOptions
+	var paid string
+	var cancelled bool
+	gw := &fakeGateway{}
+	svc := NewService(payStore(&opts, &paid, &cancelled))
+	svc.Payments = gw
+	var hooked []OrderDTO
+	svc.PostCheckoutHook = hookFunc(func(od OrderDTO) error { hooked = append(hooked, od); return nil })
+
+	od, err := svc.CheckoutAndPay(context.Background(), "u1", nil, store.CheckoutOptions{}, "tok_visa")
+	svc.WaitPostCheckoutHooks()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !opts.PendingPayment {
+		t.Fatal("expected the order to be created pending")
+	}
+	if !reflect.DeepEqual(gw.charged, []money.Cents{2000}) || paid != "ch_1" || cancelled {
+		t.Fatalf("expected one charge of 20 settling the order, got %v paid=%q cancelled=%v", gw.charged, paid, cancelled)
+	}
+	if od.Status != store.OrderStatusPaid || od.ChargeID != "ch_1" {
+		t.Fatalf("unexpected order %+v", od)
+	}
+	if len(hooked) != 1 || hooked[0].Status != store.OrderStatusPaid {
+		t.Fatalf("expected the hook to see the paid order, got %+v", hooked)
+	}
+}
+
+func TestCheckoutAndPay_DeclinedCancelsAndRestocks(t *testing.T) {
+	var opts store.CheckoutOptions
+	var paid string
+	var cancelled bool
+	svc := NewService(payStore(&opts, &paid, &cancelled))
+	svc.Payments = &fakeGateway{decline: true}
+	hooked := false
+	svc.PostCheckoutHook = hookFunc(func(OrderDTO) error { hooked = true; return nil })
+
+	_, err := svc.CheckoutAndPay(context.Background(), "u1", nil, store.CheckoutOptions{}, "tok_visa")
+	svc.WaitPostCheckoutHooks()
+	if !errors.Is(err, ErrPaymentDeclined) {
+		t.Fatalf("expected ErrPaymentDeclined, got %v", err)
+	}
+	if !cancelled || paid != "" || hooked {
+		t.Fatalf("expected the order cancelled and nothing else, got cancelled=%v paid=%q hooked=%v", cancelled, paid, hooked)
+	}
+}
+
+func TestCheckoutAndPay_GatewayTimeout(t *testing.T) {
+	var opts store.CheckoutOptions
+	var paid string
+	var cancelled bool
+	svc := NewService(payStore(&opts, &paid, &cancelled))
+	svc.Payments = &fakeGateway{delay: time.Second}
+	svc.PaymentTimeout = 10 * time.Millisecond
+
+	_, err := svc.CheckoutAndPay(context.Background(), "u1", nil, store.CheckoutOptions{}, "tok_visa")
+	if !errors.Is(err, ErrPaymentTimeout) {
+		t.Fatalf("expected ErrPaymentTimeout, got %v", err)
+	}
+	if !cancelled || paid != "" {
+		t.Fatalf("expected the order cancelled, got cancelled=%v paid=%q", cancelled, paid)
+	}
+}
+
+// gatewayFunc adapts a func to PaymentGateway
+type gatewayFunc func(ctx context.Context, amount money.Cents, token string) (string, error)
+
+func (f gatewayFunc) Charge(ctx context.Context, amount money.Cents, token string) (string, error) {
+	return f(ctx, amount, token)
+}
+
+// liveCtxStore fails the order settling calls when handed a done context,
+// as the real store's begin/Exec would
+type liveCtxStore struct{ *fakeStore }
+
+func (s liveCtxStore) MarkOrderPaid(ctx context.Context, orderID int64, chargeID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.fakeStore.MarkOrderPaid(ctx, orderID, chargeID)
+}
+
+func (s liveCtxStore) CancelPendingOrder(ctx context.Context, orderID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.fakeStore.CancelPendingOrder(ctx, orderID)
+}
+
+func TestCheckoutAndPay_ClientGoneDuringCharge(t *testing.T) {
+	for _, charged := range []bool{false, true} {
+		var opts store.CheckoutOptions
+		var paid string
+		var cancelled bool
+		svc := NewService(liveCtxStore{payStore(&opts, &paid, &cancelled)})
+		ctx, disconnect := context.WithCancel(context.Background())
+		svc.Payments = gatewayFunc(func(context.Context, money.Cents, string) (string, error) {
+			disconnect()
+			if charged {
+				return "ch_1", nil
+			}
+			return "", errors.New("connection reset")
+		})
+
+		_, err := svc.CheckoutAndPay(ctx, "u1", nil, store.CheckoutOptions{}, "tok_visa")
+		svc.WaitPostCheckoutHooks()
+		if charged {
+			if err != nil || paid != "ch_1" || cancelled {
+				t.Fatalf("expected the charge recorded, got paid=%q cancelled=%v err=%v", paid, cancelled, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrPaymentFailed) || !cancelled || paid != "" {
+			t.Fatalf("expected the order cancelled, got cancelled=%v paid=%q err=%v", cancelled, paid, err)
+		}
+	}
+}
+
+func TestCheckoutAndPay_NeedsGatewayAndToken(t *testing.T) {
+	svc := NewService(&fakeStore{})
+	if _, err := svc.CheckoutAndPay(context.Background(), "u1", nil, store.CheckoutOptions{}, "tok"); !errors.Is(err, ErrNoPaymentGateway) {
+		t.Fatalf("expected ErrNoPaymentGateway, got %v", err)
+	}
+	svc.Payments = &fakeGateway{}
+	if _, err := svc.CheckoutAndPay(context.Background(), "u1", nil, store.CheckoutOptions{}, ""); err == nil {
+		t.Fatal("expected payment_token to be required")
+	}
+}
+
+func TestPostCheckoutHook_CalledOnceWithCommittedOrder(t *testing.T) {
+	var mu sync.Mutex
+	var got []OrderDTO
+	fs := &fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			return store.OrderRow{ID: 55, UserID: userID, Total: 2000}, []store.OrderItemRow{{ProductID: 11, Quantity: 2, Price: 1000}}, nil, nil
+		},
+	}
+	svc := NewService(fs)
+	svc.PostCheckoutHook = hookFunc(func(od OrderDTO) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, od)
+		return nil
+	})
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{}); err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+	svc.WaitPostCheckoutHooks()
+	if len(got) != 1 || got[0].ID != 55 || len(got[0].Items) != 1 || got[0].Items[0].ProductID != 11 {
+		t.Fatalf("want one call with order 55, got %+v", got)
+	}
+
+	// a checkout that doesn't commit isn't reported
+	fs.CheckoutFn = func(string, map[string]string, store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+		return store.OrderRow{}, nil, nil, errors.New("db err")
+	}
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	svc.WaitPostCheckoutHooks()
+	if len(got) != 1 {
+		t.Fatalf("hook called for a failed checkout: %+v", got)
+	}
+}
+
+func TestOrderWebhook_SignedAndRetried(t *testing.T) {
+	secret := []byte("s3cret")
+	var mu sync.Mutex
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(WebhookSignatureHeader) != SignWebhook(secret, body) || r.Header.Get(WebhookEventHeader) != EventOrderCreated {
+			t.Errorf("bad headers %v", r.Header)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	fs := &fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			return store.OrderRow{ID: 55, UserID: userID, Total: 2000}, []store.OrderItemRow{{ProductID: 11, Quantity: 2, Price: 1000}}, nil, nil
+		},
+	}
+	svc := NewService(fs)
+	svc.OrderWebhook = NewOrderWebhook(srv.URL, secret, WebhookOptions{Attempts: 3, Backoff: time.Millisecond})
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{}); err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+	svc.OrderWebhook.Close()
+
+	// the 503 is retried with the same body
+	if len(bodies) != 2 || string(bodies[0]) != string(bodies[1]) {
+		t.Fatalf("want two identical deliveries, got %q", bodies)
+	}
+	var od OrderDTO
+	if err := json.Unmarshal(bodies[1], &od); err != nil {
+		t.Fatalf("payload isn't an OrderDTO: %v", err)
+	}
+	if od.ID != 55 || od.UserID != "u1" || len(od.Items) != 1 || od.Items[0].ProductID != 11 {
+		t.Fatalf("unexpected payload %+v", od)
+	}
+	if SignWebhook([]byte("other"), bodies[1]) == SignWebhook(secret, bodies[1]) {
+		t.Fatalf("signature doesn't depend on the secret")
+	}
+}
+
+func TestPostCheckoutHook_FailureRetriedFromOutbox(t *testing.T) {
+	var queued []byte
+	var published []int64
+	var failed []string
+	fs := &fakeStore{
+		GetCartFn: oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			return store.OrderRow{ID: 7, UserID: userID, Total: 500}, nil, nil, nil
+		},
+		EnqueueOutboxFn: func(eventType string, payload []byte) (int64, error) {
+			if eventType != EventCheckoutSync {
+				t.Fatalf("unexpected event type %q", eventType)
+			}
+			queued = payload
+			return 3, nil
+		},
+		ListOutboxFn: func(status string) ([]store.OutboxRow, error) {
+			if status != store.OutboxPending {
+				t.Fatalf("unexpected status %q", status)
+			}
+			return []store.OutboxRow{
+				{ID: 2, EventType: "order.created", Payload: []byte(`{"id":1}`)},
+				{ID: 3, EventType: EventCheckoutSync, Payload: queued},
+			}, nil
+		},
+		MarkPublishedFn: func(id int64) error { published = append(published, id); return nil },
+		MarkAttemptFn: func(id int64, lastErr string, maxAttempts int) error {
+			failed = append(failed, fmt.Sprintf("%d:%s:%d", id, lastErr, maxAttempts))
+			return nil
+		},
+	}
+	svc := NewService(fs)
+	svc.PostCheckoutRetries = 4
+	hookErr := errors.New("erp down")
+	svc.PostCheckoutHook = hookFunc(func(OrderDTO) error { return hookErr })
+
+	if _, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{}); err != nil {
+		t.Fatalf("a failing hook must not fail the checkout: %v", err)
+	}
+	svc.WaitPostCheckoutHooks()
+	if !strings.Contains(string(queued), `"id":7`) {
+		t.Fatalf("order not queued: %s", queued)
+	}
+
+	// still failing: the attempt is recorded against the retry budget
+	if n, err := svc.RetryPostCheckoutHooks(context.Background()); err != nil || n != 0 {
+		t.Fatalf("want 0 delivered, got %d, %v", n, err)
+	}
+	if len(failed) != 1 || failed[0] != "3:erp down:4" || len(published) != 0 {
+		t.Fatalf("unexpected bookkeeping: failed %v published %v", failed, published)
+	}
+
+	// recovered: only our event is delivered and marked published
+	var retried OrderDTO
+	svc.PostCheckoutHook = hookFunc(func(od OrderDTO) error { retried = od; return nil })
+	if n, err := svc.RetryPostCheckoutHooks(context.Background()); err != nil || n != 1 {
+		t.Fatalf("want 1 delivered, got %d, %v", n, err)
+	}
+	if retried.ID != 7 || len(published) != 1 || published[0] != 3 {
+		t.Fatalf("unexpected retry: order %+v published %v", retried, published)
+	}
+}
+
+func TestEstimateShippingWeightAndZones(t *testing.T) {
+	grams := func(g int64) sql.NullInt64 { return sql.NullInt64{Int64: g, Valid: true} }
+	fs := &fakeStore{
+		GetCartWeightsFn: func(userID string) ([]store.CartWeightRow, error) {
+			return []store.CartWeightRow{
+				{ProductID: 1, Quantity: 2, WeightGrams: grams(750)}, // 1500g
+				{ProductID: 2, Quantity: 1, WeightGrams: grams(500)}, // 500g
+				{ProductID: 3, Quantity: 4},                          // no weight (digital)
+			}, nil
+		},
+	}
+	svc := NewService(fs)
+	svc.ShippingRates = ShippingRates{
+		Zones: map[string]ShippingRate{
+			"domestic": {Base: 5, PerKg: 1},
+			"eu":       {Base: 10, PerKg: 3},
+		},
+		Flat: 2,
+	}
+
+	// 2kg total
+	if cost, err := svc.EstimateShipping(context.Background(), "u1", "domestic"); err != nil || cost != 7 {
+		t.Fatalf("expected domestic cost 7, got %v (%v)", cost, err)
+	}
+	if cost, err := svc.EstimateShipping(context.Background(), "u1", "eu"); err != nil || cost != 16 {
+		t.Fatalf("expected eu cost 16, got %v (%v)", cost, err)
+	}
+	if _, err := svc.EstimateShipping(context.Background(), "u1", "mars"); !errors.Is(err, ErrUnknownShippingZone) {
+		t.Fatalf("expected ErrUnknownShippingZone, got %v", err)
+	}
+
+	// nothing weighable -> flat default
+	fs.GetCartWeightsFn = func(userID string) ([]store.CartWeightRow, error) {
+		return []store.CartWeightRow{{ProductID: 3, Quantity: 4}}, nil
+	}
+	if cost, err := svc.EstimateShipping(context.Background(), "u1", "eu"); err != nil || cost != 2 {
+		t.Fatalf("expected flat cost 2, got %v (%v)", cost, err)
+	}
+}
+
+func TestListProductsByTagsNormalizesAndAttachesTags(t *testing.T) {
+	var gotTags []string
+	fs := &fakeStore{
+		ListByTagsFn: func(tags []string) ([]store.ProductRow, error) {
+			gotTags = tags
+			return []store.ProductRow{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}, nil
+		},
+		TagsForFn: func(ids []int64) (map[int64][]string, error) {
+			return map[int64][]string{1: {"new", "on-sale"}, 2: {"clearance", "new", "on-sale"}}, nil
+		},
+	}
+	svc := NewService(fs)
+
+	if _, err := svc.ListProductsByTags(context.Background(), []string{" "}); err == nil {
+		t.Fatalf("expected error for blank tag")
+	}
+	out, err := svc.ListProductsByTags(context.Background(), []string{"On-Sale", " new", "on-sale"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(gotTags, []string{"on-sale", "new"}) {
+		t.Fatalf("expected normalized, de-duplicated tags, got %v", gotTags)
+	}
+	if len(out) != 2 || !reflect.DeepEqual(out[1].Tags, []string{"clearance", "new", "on-sale"}) {
+		t.Fatalf("expected tags attached, got %+v", out)
+	}
+}
+
+func TestAddAndRemoveTagValidation(t *testing.T) {
+	var added string
+	fs := &fakeStore{
+		AddTagFn:    func(productID int64, tag string) error { added = tag; return nil },
+		RemoveTagFn: func(productID int64, tag string) error { return sql.ErrNoRows },
+	}
+	svc := NewService(fs)
+	if err := svc.AddTag(context.Background(), 0, "x"); err == nil {
+		t.Fatalf("expected error for invalid product id")
+	}
+	if err := svc.AddTag(context.Background(), 1, string(make([]byte, MaxTagLen+1))); err == nil {
+		t.Fatalf("expected error for overlong tag")
+	}
+	if err := svc.AddTag(context.Background(), 1, "  Clearance "); err != nil || added != "clearance" {
+		t.Fatalf("expected normalized tag forwarded, got %q (%v)", added, err)
+	}
+	if err := svc.RemoveTag(context.Background(), 1, "new"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected store error to propagate, got %v", err)
+	}
+}
+
+func TestGetOrderHistory(t *testing.T) {
+	var asked []int64
+	svc := NewService(&fakeStore{
+		ListOrdersFn: func(userID string) ([]store.OrderRow, error) {
+			if userID != "u1" {
+				return nil, nil
+			}
+			return []store.OrderRow{{ID: 9, UserID: "u1", Total: 800}, {ID: 4, UserID: "u1", Total: 2000}}, nil
+		},
+		ListOrderItemsFn: func(orderID int64) ([]store.OrderItemRow, error) {
+			asked = append(asked, orderID)
+			return []store.OrderItemRow{{ProductID: orderID * 10, Quantity: 1, Price: 200}}, nil
+		},
+	})
+	orders, err := svc.GetOrderHistory(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(orders) != 2 || orders[0].ID != 9 || orders[1].Items[0].ProductID != 40 {
+		t.Fatalf("expected orders 9 then 4 with their lines, got %+v", orders)
+	}
+	if !reflect.DeepEqual(asked, []int64{9, 4}) {
+		t.Fatalf("expected lines loaded per order, got %v", asked)
+	}
+	if orders, err := svc.GetOrderHistory(context.Background(), "u2"); err != nil || orders == nil || len(orders) != 0 {
+		t.Fatalf("expected an empty history, got %v %v", orders, err)
+	}
+	if _, err := svc.GetOrderHistory(context.Background(), ""); err == nil {
+		t.Fatal("expected user_id to be required")
+	}
+}
+
+func TestCancelOrder_ChecksOwner(t *testing.T) {
+	var cancelled int64
+	svc := NewService(&fakeStore{CancelOrderFn: func(orderID int64, userID string) error {
+		if userID != "u1" {
+			return fmt.Errorf("%w: order %d", store.ErrNotOrderOwner, orderID)
+		}
+		cancelled = orderID
+		return nil
+	}})
+	if err := svc.CancelOrder(context.Background(), 9, "u1"); err != nil || cancelled != 9 {
+		t.Fatalf("expected order 9 cancelled, got %d %v", cancelled, err)
+	}
+	if err := svc.CancelOrder(context.Background(), 9, "u2"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden for another user, got %v", err)
+	}
+	if err := svc.CancelOrder(context.Background(), 9, ""); err == nil {
+		t.Fatalf("expected an error without user_id")
+	}
+}
+
+func TestGetOrder_ChecksOwner(t *testing.T) {
+	svc := NewService(&fakeStore{
+		GetOrderFn: func(orderID int64) (store.OrderRow, []store.OrderItemRow, error) {
+			if orderID != 9 {
+				return store.OrderRow{}, nil, sql.ErrNoRows
+			}
+			return store.OrderRow{ID: 9, UserID: "u1", Total: 2400, Status: store.OrderStatusPlaced},
+				[]store.OrderItemRow{{ProductID: 1, Quantity: 2, Price: 1000}, {ProductID: 2, Quantity: 1, Price: 400}}, nil
+		},
+	})
+	od, err := svc.GetOrder(context.Background(), "u1", 9)
+	if err != nil || od.Total != 2400 || len(od.Items) != 2 || od.Items[1].Price != 400 {
+		t.Fatalf("unexpected order %+v %v", od, err)
+	}
+	if _, err := svc.GetOrder(context.Background(), "u2", 9); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden for another user, got %v", err)
+	}
+	if _, err := svc.GetOrder(context.Background(), "u1", 10); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestListAllOrders_ValidatesPaging(t *testing.T) {
+	fs := &fakeStore{
+		ListAllOrdersFn: func(store.OrderFilter, int, int) ([]store.OrderRow, error) {
+			return []store.OrderRow{{ID: 3, UserID: "u1", Total: 950, Status: store.OrderStatusPlaced}}, nil
+		},
+		CountOrdersFn: func(store.OrderFilter) (int64, error) { return 11, nil },
+	}
+	svc := NewService(fs)
+
+	for _, tc := range []struct{ limit, offset int }{{0, 0}, {MaxOrderPageSize + 1, 0}, {10, -1}} {
+		if _, _, err := svc.ListAllOrders(context.Background(), store.OrderFilter{}, tc.limit, tc.offset); err == nil {
+			t.Fatalf("expected error for limit=%d offset=%d", tc.limit, tc.offset)
+		}
+	}
+	now := time.Now()
+	if _, _, err := svc.ListAllOrders(context.Background(), store.OrderFilter{From: now, To: now}, 10, 0); err == nil {
+		t.Fatal("expected error for empty date range")
+	}
+
+	orders, total, err := svc.ListAllOrders(context.Background(), store.OrderFilter{}, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 11 || len(orders) != 1 || orders[0].ID != 3 || orders[0].Status != store.OrderStatusPlaced {
+		t.Fatalf("unexpected result %v total=%d", orders, total)
+	}
+}
+
+func TestUnpricedProducts(t *testing.T) {
+	products := func(sort string) ([]store.ProductRow, error) {
+		return []store.ProductRow{
+			{ID: 1, Name: "mug", Price: priced(4)},
+			{ID: 2, Name: "custom sofa"}, // call for price
+		}, nil
+	}
+	fs := &fakeStore{
+		ListProductsFn: products,
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 2, Price: priced(4), Published: true},
+				{ProductID: 2, Quantity: 1, Published: true},
+			}, nil
+		},
+	}
+	svc := NewService(fs)
+
+	ps, err := svc.ListProducts(context.Background(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ps[0].Price == nil || *ps[0].Price != 400 || ps[1].Price != nil {
+		t.Fatalf("expected only the second product unpriced, got %+v", ps)
+	}
+
+	// a line whose price was removed after the add is flagged, not fatal
+	items, total, _, err := svc.GetCart(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 800 || items[0].Unpriced || !items[1].Unpriced {
+		t.Fatalf("unexpected cart %+v total=%v", items, total)
+	}
+}
+
+func TestListProducts_RestockETAForOutOfStock(t *testing.T) {
+	eta := time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC)
+	var asked []int64
+	fs := &fakeStore{
+		ListProductsFn: func(sort string) ([]store.ProductRow, error) {
+			return []store.ProductRow{
+				{ID: 1, Name: "in stock", Price: priced(1), Stock: 4},
+				{ID: 2, Name: "sold out, PO inbound", Price: priced(1), Stock: 0},
+				{ID: 3, Name: "sold out, nothing inbound", Price: priced(1), Stock: 0},
+			}, nil
+		},
+		InboundETAsFn: func(ids []int64) (map[int64]time.Time, error) {
+			asked = ids
+			return map[int64]time.Time{2: eta}, nil
+		},
+	}
+	ps, err := NewService(fs).ListProducts(context.Background(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(asked, []int64{2, 3}) {
+		t.Fatalf("expected ETA lookup only for out-of-stock products, got %v", asked)
+	}
+	if ps[0].ExpectedRestock != nil || ps[2].ExpectedRestock != nil {
+		t.Fatalf("unexpected ETA: %+v", ps)
+	}
+	if ps[1].ExpectedRestock == nil || !ps[1].ExpectedRestock.Equal(eta) {
+		t.Fatalf("expected ETA %v on product 2, got %v", eta, ps[1].ExpectedRestock)
+	}
+}
+
+func TestCreatePurchaseOrder_Validation(t *testing.T) {
+	svc := NewService(&fakeStore{})
+	future := time.Now().Add(time.Hour)
+	if _, err := svc.CreatePurchaseOrder(context.Background(), 1, 0, future); err == nil {
+		t.Fatal("expected error for zero quantity")
+	}
+	if _, err := svc.CreatePurchaseOrder(context.Background(), 1, 5, time.Now().Add(-time.Hour)); err == nil {
+		t.Fatal("expected error for past expected_at")
+	}
+	if _, err := svc.CreatePurchaseOrder(context.Background(), 1, 5, future); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGetCart_FlagsUnpublishedLines(t *testing.T) {
+	fs := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 1, Name: "mug", Price: priced(4), Stock: 3, Tracked: true, Published: true},
+				{ProductID: 2, Quantity: 2, Name: "retired", Price: priced(1), Stock: 0, Tracked: true},
+			}, nil
+		},
+	}
+	items, total, _, err := NewService(fs).GetCart(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if items[0].Name != "mug" || items[0].Unavailable || !items[1].Unavailable {
+		t.Fatalf("unexpected lines %+v", items)
+	}
+	if total != 600 {
+		t.Fatalf("expected total 6, got %v", total)
+	}
+}
+
+func TestSalesVelocity_Window(t *testing.T) {
+	var got time.Duration
+	svc := NewService(&fakeStore{
+		VelocityFn: func(productID int64, window time.Duration) (float64, error) {
+			got = window
+			return 1, nil
+		},
+	})
+	if _, err := svc.SalesVelocity(context.Background(), 1, 0); err == nil {
+		t.Fatal("expected error for 0 days")
+	}
+	if _, err := svc.SalesVelocity(context.Background(), 1, MaxVelocityDays+1); err == nil {
+		t.Fatal("expected error for too many days")
+	}
+	if _, err := svc.SalesVelocity(context.Background(), 1, 14); err != nil || got != 14*24*time.Hour {
+		t.Fatalf("expected 14-day window, got %v %v", got, err)
+	}
+}
+
+func TestRestoreCancelledOrderToCart(t *testing.T) {
+	order := store.OrderRow{ID: 5, UserID: "u1", Status: store.OrderStatusCancelled}
+	lines := []store.OrderItemRow{{ProductID: 1, Quantity: 2, Price: 1000}, {ProductID: 2, Quantity: 1, Price: 400}}
+	var added []int64
+	fs := &fakeStore{
+		GetOrderFn: func(orderID int64) (store.OrderRow, []store.OrderItemRow, error) {
+			if orderID != 5 {
+				return store.OrderRow{}, nil, sql.ErrNoRows
+			}
+			return order, lines, nil
+		},
+		AddToCartFn: func(userID string, productID int64, qty int) error {
+			added = append(added, productID)
+			return nil
+		},
+	}
+	svc := NewService(fs)
+
+	// full restore
+	restored, unavailable, err := svc.RestoreCancelledOrderToCart(context.Background(), "u1", 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(restored) != 2 || restored[0].Quantity != 2 || len(unavailable) != 0 || len(added) != 2 {
+		t.Fatalf("unexpected restore: %+v %v (added %v)", restored, unavailable, added)
+	}
+
+	// partial: product 2 is out of stock, product 1 succeeds
+	fs.AddToCartFn = func(userID string, productID int64, qty int) error {
+		if productID == 2 {
+			return fmt.Errorf("%w: product 2", store.ErrInsufficientStock)
+		}
+		return nil
+	}
+	restored, unavailable, err = svc.RestoreCancelledOrderToCart(context.Background(), "u1", 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(restored) != 1 || restored[0].ProductID != 1 || len(unavailable) != 1 || unavailable[0] != 2 {
+		t.Fatalf("unexpected partial restore: %+v %v", restored, unavailable)
+	}
+
+	// unexpected store errors abort
+	fs.AddToCartFn = func(string, int64, int) error { return errors.New("db down") }
+	if _, _, err := svc.RestoreCancelledOrderToCart(context.Background(), "u1", 5); err == nil {
+		t.Fatalf("expected store error to propagate")
+	}
+}
+
+func TestRestoreCancelledOrderToCart_Rejected(t *testing.T) {
+	status := store.OrderStatusPlaced
+	fs := &fakeStore{
+		GetOrderFn: func(orderID int64) (store.OrderRow, []store.OrderItemRow, error) {
+			return store.OrderRow{ID: orderID, UserID: "u1", Status: status}, []store.OrderItemRow{{ProductID: 1, Quantity: 1}}, nil
+		},
+		AddToCartFn: func(string, int64, int) error {
+			t.Fatalf("nothing should be added")
+			return nil
+		},
+	}
+	svc := NewService(fs)
+
+	if _, _, err := svc.RestoreCancelledOrderToCart(context.Background(), "u1", 5); !errors.Is(err, ErrOrderNotCancelled) {
+		t.Fatalf("expected ErrOrderNotCancelled, got %v", err)
+	}
+	status = store.OrderStatusCancelled
+	if _, _, err := svc.RestoreCancelledOrderToCart(context.Background(), "someone-else", 5); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected another user's order to be not found, got %v", err)
+	}
+	if _, _, err := svc.RestoreCancelledOrderToCart(context.Background(), "", 5); err == nil {
+		t.Fatalf("expected error for empty user")
+	}
+}
+
+func TestListReviews_Validation(t *testing.T) {
+	var got store.ReviewQuery
+	fs := &fakeStore{
+		ListReviewsFn: func(productID int64, q store.ReviewQuery) ([]store.ReviewRow, error) {
+			got = q
+			return []store.ReviewRow{{ID: 1, ProductID: productID, Rating: 5}}, nil
+		},
+		CountReviewsFn: func(productID int64, minRating int) (int64, error) { return 12, nil },
+	}
+	svc := NewService(fs)
+
+	q := store.ReviewQuery{Sort: store.ReviewSortHighest, MinRating: 4, Limit: 10, Offset: 10}
+	reviews, total, err := svc.ListReviews(context.Background(), 3, q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reviews) != 1 || total != 12 || got != q {
+		t.Fatalf("unexpected result: %+v %d (query %+v)", reviews, total, got)
+	}
+	for _, bad := range []store.ReviewQuery{
+		{Limit: 0},
+		{Limit: MaxReviewPageSize + 1},
+		{Limit: 10, Offset: -1},
+		{Limit: 10, MinRating: 6},
+		{Limit: 10, Sort: "random"},
+	} {
+		if _, _, err := svc.ListReviews(context.Background(), 3, bad); err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestReviewSummary(t *testing.T) {
+	svc := NewService(&fakeStore{
+		ReviewDistFn: func(productID int64) (map[int]int64, error) {
+			return map[int]int64{5: 3, 4: 1, 1: 1}, nil
+		},
+	})
+	sum, err := svc.ReviewSummary(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[int]int64{1: 1, 2: 0, 3: 0, 4: 1, 5: 3}
+	if !reflect.DeepEqual(sum.Counts, want) || sum.Total != 5 || sum.Average != 4 {
+		t.Fatalf("unexpected summary: %+v", sum)
+	}
+
+	empty := NewService(&fakeStore{ReviewDistFn: func(int64) (map[int]int64, error) { return map[int]int64{}, nil }})
+	if sum, err := empty.ReviewSummary(context.Background(), 3); err != nil || sum.Total != 0 || sum.Average != 0 || len(sum.Counts) != 5 {
+		t.Fatalf("unexpected empty summary: %+v %v", sum, err)
+	}
+}
+
+func TestAddToCart_DedupWindow(t *testing.T) {
+	var mu sync.Mutex
+	reserved := 0
+	fs := &fakeStore{
+		AddToCartFn: func(userID string, productID int64, qty int) error {
+			time.Sleep(20 * time.Millisecond) // keep the first call in flight
+			mu.Lock()
+			reserved += qty
+			mu.Unlock()
+			return nil
+		},
+	}
+	svc := NewService(fs)
+	svc.AddToCartDedupWindow = 200 * time.Millisecond
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = svc.AddToCart(context.Background(), "u1", 7, 2)
+		}(i)
+	}
+	wg.Wait()
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if reserved != 2 {
+		t.Fatalf("expected one reservation of 2, got %d", reserved)
+	}
+
+	// a different quantity is a different request
+	if err := svc.AddToCart(context.Background(), "u1", 7, 3); err != nil || reserved != 5 {
+		t.Fatalf("expected a second reservation, got %d %v", reserved, err)
+	}
+
+	// once the window has passed the same add goes through again
+	time.Sleep(250 * time.Millisecond)
+	if err := svc.AddToCart(context.Background(), "u1", 7, 2); err != nil || reserved != 7 {
+		t.Fatalf("expected a new reservation after the window, got %d %v", reserved, err)
+	}
+}
+
+func TestAddToCart_DedupSharesError(t *testing.T) {
+	calls := 0
+	svc := NewService(&fakeStore{
+		AddToCartFn: func(string, int64, int) error {
+			calls++
+			return store.ErrInsufficientStock
+		},
+	})
+	svc.AddToCartDedupWindow = time.Second
+	for i := 0; i < 2; i++ {
+		if err := svc.AddToCart(context.Background(), "u1", 7, 2); !errors.Is(err, store.ErrInsufficientStock) {
+			t.Fatalf("call %d: expected ErrInsufficientStock, got %v", i, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the store to be hit once, got %d", calls)
+	}
+}
+
+func TestSearchProducts_ReportsStock(t *testing.T) {
+	var gotQuery string
+	svc := NewService(&fakeStore{
+		SearchFn: func(query string) ([]store.ProductRow, error) {
+			gotQuery = query
+			return []store.ProductRow{
+				{ID: 1, Name: "USB cable", Price: priced(5), Stock: 12},
+				{ID: 2, Name: "HDMI cable", Price: priced(9), Stock: 3},
+			}, nil
+		},
+	})
+
+	ps, err := svc.SearchProducts(context.Background(), "  cable ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotQuery != "cable" || len(ps) != 2 || ps[0].Stock != 12 || ps[1].Stock != 3 {
+		t.Fatalf("unexpected results for %q: %+v", gotQuery, ps)
+	}
+	if _, err := svc.SearchProducts(context.Background(), " "); err == nil {
+		t.Fatalf("expected error for empty query")
+	}
+	if _, err := svc.SearchProducts(context.Background(), strings.Repeat("x", MaxSearchQueryLen+1)); err == nil {
+		t.Fatalf("expected error for long query")
+	}
+}
+
+func TestUpdateOrderStatus_Validation(t *testing.T) {
+	var got string
+	svc := NewService(&fakeStore{OrderStatusFn: func(orderID int64, status string) error {
+		got = status
+		return nil
+	}})
+	for _, status := range []string{store.OrderStatusShipped, store.OrderStatusDelivered} {
+		if err := svc.UpdateOrderStatus(context.Background(), 7, status); err != nil || got != status {
+			t.Fatalf("%s: got %q %v", status, got, err)
+		}
+	}
+	got = ""
+	for _, status := range []string{store.OrderStatusPlaced, store.OrderStatusPending, store.OrderStatusPaid, store.OrderStatusCancelled} {
+		if err := svc.UpdateOrderStatus(context.Background(), 7, status); !errors.Is(err, store.ErrInvalidTransition) {
+			t.Fatalf("%s: expected ErrInvalidTransition, got %v", status, err)
+		}
+	}
+	if err := svc.UpdateOrderStatus(context.Background(), 7, "lost"); err == nil || errors.Is(err, store.ErrInvalidTransition) {
+		t.Fatalf("expected a plain error for an unknown status, got %v", err)
+	}
+	if got != "" {
+		t.Fatalf("a rejected status reached the store: %q", got)
+	}
+}
+
+func TestUpdateOrderStatusBatch_Validation(t *testing.T) {
+	var gotIDs []int64
+	var gotStrict bool
+	svc := NewService(&fakeStore{
+		StatusBatchFn: func(orderIDs []int64, status string, strict bool) ([]int64, error) {
+			gotIDs, gotStrict = orderIDs, strict
+			return nil, nil
+		},
+	})
+
+	updated, err := svc.UpdateOrderStatusBatch(context.Background(), []int64{3, 1, 3}, store.OrderStatusShipped, true)
+	if err != nil || updated == nil || len(updated) != 0 {
+		t.Fatalf("unexpected result %v %v", updated, err)
+	}
+	if !reflect.DeepEqual(gotIDs, []int64{3, 1}) || !gotStrict {
+		t.Fatalf("expected deduped ids and strict passed through, got %v %v", gotIDs, gotStrict)
+	}
+
+	if _, err := svc.UpdateOrderStatusBatch(context.Background(), []int64{1}, store.OrderStatusCancelled, false); !errors.Is(err, store.ErrInvalidTransition) {
+		t.Fatalf("expected bulk cancel to be rejected, got %v", err)
+	}
+	if _, err := svc.UpdateOrderStatusBatch(context.Background(), make([]int64, MaxOrderStatusBatch+1), store.OrderStatusShipped, false); !errors.Is(err, ErrTooManyIDs) {
+		t.Fatalf("expected ErrTooManyIDs, got %v", err)
+	}
+	for _, tc := range []struct {
+		ids    []int64
+		status string
+	}{{nil, store.OrderStatusShipped}, {[]int64{0}, store.OrderStatusShipped}, {[]int64{1}, "lost"}} {
+		if _, err := svc.UpdateOrderStatusBatch(context.Background(), tc.ids, tc.status, false); err == nil {
+			t.Fatalf("expected error for %v %q", tc.ids, tc.status)
+		}
+	}
+}
+
+func TestGetStock(t *testing.T) {
+	fs := &fakeStore{
+		GetStockFn: func(productID int64) (int, error) {
+			if productID == 404 {
+				return 0, sql.ErrNoRows
+			}
+			return 42, nil
+		},
+	}
+	svc := NewService(fs)
+	if got, err := svc.GetStock(context.Background(), 1); err != nil || got != 42 {
+		t.Fatalf("expected 42, got %d %v", got, err)
+	}
+	if _, err := svc.GetStock(context.Background(), 404); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if _, err := svc.GetStock(context.Background(), 0); err == nil {
+		t.Fatalf("expected an error for product id 0")
+	}
+}
+
+func TestReorderSuggestion(t *testing.T) {
+	stock := map[int64]int{1: 10, 2: 0, 3: 100, 4: store.UntrackedStock}
+	velocity := map[int64]float64{1: 2.5, 3: 1}
+	var gotWindow time.Duration
+	svc := NewService(&fakeStore{
+		GetStockFn: func(productID int64) (int, error) {
+			n, ok := stock[productID]
+			if !ok {
+				return 0, sql.ErrNoRows
+			}
+			return n, nil
+		},
+		VelocityFn: func(productID int64, window time.Duration) (float64, error) {
+			gotWindow = window
+			return velocity[productID], nil
+		},
+	})
+	svc.ReorderPolicy = ReorderPolicy{LeadDays: 7, SafetyStock: 5, VelocityDays: 30}
+
+	cases := []struct {
+		name string
+		id   int64
+		want int
+	}{
+		{"with sales", 1, 13},        // ceil(2.5*7)=18 + 5 - 10
+		{"no stock, no sales", 2, 5}, // tops up to safety stock
+		{"plenty of stock", 3, 0},    // 7 + 5 - 100 < 0
+	}
+	for _, tc := range cases {
+		got, err := svc.ReorderSuggestion(context.Background(), tc.id)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: want %d, got %d %v", tc.name, tc.want, got, err)
+		}
+	}
+	if gotWindow != 30*24*time.Hour {
+		t.Fatalf("expected a 30 day velocity window, got %v", gotWindow)
+	}
+	if _, err := svc.ReorderSuggestion(context.Background(), 4); !errors.Is(err, store.ErrUntrackedInventory) {
+		t.Fatalf("expected ErrUntrackedInventory, got %v", err)
+	}
+	if _, err := svc.ReorderSuggestion(context.Background(), 9); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestSetBundleComponents_Validation(t *testing.T) {
+	var called bool
+	svc := NewService(&fakeStore{
+		SetBundleFn: func(bundleID int64, components []store.BundleComponent) error {
+			called = true
+			return nil
+		},
+	})
+
+	bad := [][]store.BundleComponent{
+		{{ProductID: 2, Quantity: 0}},
+		{{ProductID: 9, Quantity: 1}},
+		{{ProductID: 2, Quantity: 1}, {ProductID: 2, Quantity: 3}},
+	}
+	for _, cs := range bad {
+		if err := svc.SetBundleComponents(context.Background(), 9, cs); !errors.Is(err, store.ErrInvalidBundle) {
+			t.Fatalf("%v: expected ErrInvalidBundle, got %v", cs, err)
+		}
+	}
+	if called {
+		t.Fatalf("store should not be called for an invalid bundle")
+	}
+	if err := svc.SetBundleComponents(context.Background(), 9, []store.BundleComponent{{ProductID: 2, Quantity: 1}, {ProductID: 3, Quantity: 2}}); err != nil || !called {
+		t.Fatalf("expected valid bundle to be stored, got %v", err)
+	}
+}
+
+type recordingNotifier struct {
+	alerts []Alert
+}
+
+func (n *recordingNotifier) Notify(a Alert) { n.alerts = append(n.alerts, a) }
+
+// flakyChannel fails the first failures sends, then records messages
+type flakyChannel struct {
+	mu       sync.Mutex
+	failures int
+	tries    int
+	sent     []Message
+}
+
+func (c *flakyChannel) Send(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tries++
+	if c.tries <= c.failures {
+		return errors.New("relay unavailable")
+	}
+	c.sent = append(c.sent, m)
+	return nil
+}
+
+func TestChannelNotifier_RendersAndRetries(t *testing.T) {
+	ch := &flakyChannel{failures: 2}
+	n, err := NewChannelNotifier(ch, ChannelOptions{Attempts: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewChannelNotifier: %v", err)
+	}
+	at := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	n.Notify(Alert{Kind: AlertStockDrop, ProductID: 7, Message: "stock fell from 50 to 5", At: at})
+	n.Close()
+
+	if ch.tries != 3 || len(ch.sent) != 1 {
+		t.Fatalf("expected delivery on the third try, got %d tries, %d sent", ch.tries, len(ch.sent))
+	}
+	want := Message{
+		Subject: "[stock_drop] product 7",
+		Body:    "Product 7: stock fell from 50 to 5\n\nRaised at 2026-03-01 09:30:00 UTC.",
+	}
+	if ch.sent[0] != want {
+		t.Fatalf("unexpected message %+v", ch.sent[0])
+	}
+}
+
+func TestChannelNotifier_GivesUp(t *testing.T) {
+	ch := &flakyChannel{failures: 10}
+	n, err := NewChannelNotifier(ch, ChannelOptions{Subject: "{{.Kind}}", Attempts: 2, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewChannelNotifier: %v", err)
+	}
+	n.Notify(Alert{Kind: AlertStockDrop, ProductID: 1})
+	n.Notify(Alert{Kind: AlertStockDrop, ProductID: 2})
+	n.Close()
+	// each alert gets its own attempts; neither is delivered
+	if ch.tries != 4 || len(ch.sent) != 0 {
+		t.Fatalf("expected 2 tries per alert and nothing sent, got %d tries, %d sent", ch.tries, len(ch.sent))
+	}
+	if _, err := NewChannelNotifier(ch, ChannelOptions{Body: "{{.Nope"}); err == nil {
+		t.Fatalf("expected a bad template to be rejected")
+	}
+}
+
+func TestSMTPChannel_Message(t *testing.T) {
+	var gotTo []string
+	var gotMsg string
+	ch := SMTPChannel{
+		Addr: "mail:25", From: "shop@example.com", To: []string{"ops@example.com", "oncall@example.com"},
+		sendMail: func(addr string, _ smtp.Auth, from string, to []string, msg []byte) error {
+			gotTo, gotMsg = to, string(msg)
+			return nil
+		},
+	}
+	if err := ch.Send(Message{Subject: "low stock", Body: "line one\nline two"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(gotTo) != 2 || !strings.Contains(gotMsg, "Subject: low stock\r\n") || !strings.HasSuffix(gotMsg, "line one\r\nline two") {
+		t.Fatalf("unexpected mail to %v:\n%s", gotTo, gotMsg)
+	}
+}
+
+func TestStockDropAlert_RapidDrain(t *testing.T) {
+	stock := 100
+	st := &fakeStore{
+		AddToCartFn: func(userID string, productID int64, qty int) error {
+			stock -= qty
+			return nil
+		},
+		GetStockFn: func(productID int64) (int, error) { return stock, nil },
+	}
+	n := &recordingNotifier{}
+	svc := NewService(st)
+	svc.Notifier = n
+	svc.StockDropAlert = StockDropPolicy{Window: time.Minute, MaxDropPercent: 50}
+
+	// 100 -> 10 in nine quick adds; the first level seen is 90 (after the
+	// first add), so the drop crosses 50% at 40 and alerts only once
+	for i := 0; i < 9; i++ {
+		if err := svc.AddToCart(context.Background(), "u1", 3, 10); err != nil {
+			t.Fatalf("AddToCart: %v", err)
+		}
+	}
+	if len(n.alerts) != 1 {
+		t.Fatalf("expected exactly one alert, got %d: %+v", len(n.alerts), n.alerts)
+	}
+	if a := n.alerts[0]; a.Kind != AlertStockDrop || a.ProductID != 3 || !strings.Contains(a.Message, "from 90 to 40") {
+		t.Fatalf("unexpected alert: %+v", a)
+	}
+}
+
+func TestStockMonitor_WindowRolls(t *testing.T) {
+	m := newStockMonitor()
+	n := &recordingNotifier{}
+	p := StockDropPolicy{Window: time.Minute, MaxDropUnits: 20}
+	t0 := time.Now()
+
+	// a slow decline never loses 20 within a minute
+	for i := 0; i < 10; i++ {
+		m.observe(p, n, 1, 100-5*i, t0.Add(time.Duration(i)*30*time.Second))
+	}
+	if len(n.alerts) != 0 {
+		t.Fatalf("expected no alert for a slow decline, got %+v", n.alerts)
+	}
+	// a sharp drop alerts, and again once the window has rolled past it
+	m.observe(p, n, 1, 30, t0.Add(5*time.Minute))
+	m.observe(p, n, 1, 5, t0.Add(5*time.Minute+10*time.Second))
+	m.observe(p, n, 1, 80, t0.Add(8*time.Minute))
+	m.observe(p, n, 1, 50, t0.Add(8*time.Minute+10*time.Second))
+	if len(n.alerts) != 2 {
+		t.Fatalf("expected two alerts, got %d: %+v", len(n.alerts), n.alerts)
+	}
+	// untracked products are ignored
+	m.observe(p, n, 2, store.UntrackedStock, t0)
+	if len(n.alerts) != 2 {
+		t.Fatalf("untracked product should not alert")
+	}
+}
+
+func TestLowStockAlert_OncePerCrossing(t *testing.T) {
+	stock := 8
+	st := &fakeStore{
+		AddToCartFn: func(userID string, productID int64, qty int) error {
+			stock -= qty
+			return nil
+		},
+		UpdateStockFn: func(productID int64, newStock int) error {
+			stock = newStock
+			return nil
+		},
+		GetStockFn: func(productID int64) (int, error) { return stock, nil },
+	}
+	n := &recordingNotifier{}
+	svc := NewService(st)
+	svc.Notifier = n
+	svc.LowStockAlert = true // threshold defaults to 5
+
+	// 8 -> 6 stays above; 6 -> 5 is exactly the threshold and alerts
+	for _, qty := range []int{2, 1} {
+		if err := svc.AddToCart(context.Background(), "u1", 3, qty); err != nil {
+			t.Fatalf("AddToCart: %v", err)
+		}
+	}
+	if len(n.alerts) != 1 || n.alerts[0].Kind != AlertLowStock || n.alerts[0].Message != "stock=5 threshold=5" {
+		t.Fatalf("expected one low_stock alert at 5, got %+v", n.alerts)
+	}
+	// still low: no repeat; a restock and a new fall alerts again
+	if err := svc.AddToCart(context.Background(), "u1", 3, 2); err != nil {
+		t.Fatalf("AddToCart: %v", err)
+	}
+	if err := svc.UpdateStock(context.Background(), 3, 20); err != nil {
+		t.Fatalf("UpdateStock: %v", err)
+	}
+	if err := svc.UpdateStock(context.Background(), 3, 1); err != nil {
+		t.Fatalf("UpdateStock: %v", err)
+	}
+	if len(n.alerts) != 2 || n.alerts[1].Message != "stock=1 threshold=5" {
+		t.Fatalf("expected a second alert after the restock, got %+v", n.alerts)
+	}
+}
+
+func TestListLowStockProducts_DefaultThreshold(t *testing.T) {
+	var got []int
+	svc := NewService(&fakeStore{
+		LowStockFn: func(threshold int) ([]store.ProductRow, error) {
+			got = append(got, threshold)
+			return []store.ProductRow{{ID: 4, Name: "mug", Stock: threshold}}, nil
+		},
+	})
+	svc.LowStockThreshold = 7
+	ps, err := svc.ListLowStockProducts(context.Background(), -1)
+	if err != nil || len(ps) != 1 || ps[0].Stock != 7 {
+		t.Fatalf("unexpected result %+v %v", ps, err)
+	}
+	if _, err := svc.ListLowStockProducts(context.Background(), 0); err != nil {
+		t.Fatalf("ListLowStockProducts: %v", err)
+	}
+	if !reflect.DeepEqual(got, []int{7, 0}) {
+		t.Fatalf("want thresholds [7 0], got %v", got)
+	}
+}
+
+func TestGetCartInCurrency(t *testing.T) {
+	fs := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 2, Name: "a", Price: priced(10.0), Published: true},
+				{ProductID: 2, Quantity: 1, Name: "b", Price: priced(3.33), Published: true},
+			}, nil
+		},
+	}
+	svc := NewService(fs)
+	svc.Currency = RateTable{Base: "USD", Rates: map[string]float64{"EUR": 0.9}}
+
+	cart, err := svc.GetCartInCurrency(context.Background(), "u1", "eur")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cart.Currency != "EUR" || cart.BaseCurrency != "USD" || cart.Total != 2333 || cart.ConvertedTotal != 2100 {
+		t.Fatalf("unexpected totals: %+v", cart)
+	}
+	if len(cart.Items) != 2 || cart.Items[0].Price != 1000 || cart.Items[0].ConvertedPrice != 900 || cart.Items[1].ConvertedPrice != 300 {
+		t.Fatalf("unexpected lines: %+v", cart.Items)
+	}
+
+	// no currency: priced in the base currency as-is
+	if cart, err := svc.GetCartInCurrency(context.Background(), "u1", ""); err != nil || cart.Currency != "USD" || cart.ConvertedTotal != 2333 {
+		t.Fatalf("expected base currency cart, got %+v %v", cart, err)
+	}
+	if _, err := svc.GetCartInCurrency(context.Background(), "u1", "XYZ"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Fatalf("expected ErrUnknownCurrency, got %v", err)
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates(" eur=0.92, GBP=0.79 ")
+	if err != nil || rates["EUR"] != 0.92 || rates["GBP"] != 0.79 {
+		t.Fatalf("unexpected rates: %v %v", rates, err)
+	}
+	for _, bad := range []string{"EUR", "EURO=1", "EUR=0", "EUR=x"} {
+		if _, err := ParseRates(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestQuoteCheckout_HeldQuoteConverts(t *testing.T) {
+	var hold store.QuoteHold
+	var gotOpts store.CheckoutOptions
+	fs := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{{ProductID: 1, Quantity: 2, Price: priced(10.0), Published: true}}, nil
+		},
+		PutQuoteHoldFn: func(h store.QuoteHold) error { hold = h; return nil },
+		GetQuoteHoldFn: func(userID string) (store.QuoteHold, error) { return hold, nil },
+		GetCartFn:      oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			gotOpts = opts
+			return store.OrderRow{ID: 1, UserID: userID, Total: 2000}, []store.OrderItemRow{{ProductID: 1, Quantity: 2, Price: opts.HeldPrices[1]}}, nil, nil
+		},
+	}
+	svc := NewService(fs)
+
+	q, err := svc.QuoteCheckout(context.Background(), "u1", true)
+	if err != nil {
+		t.Fatalf("QuoteCheckout: %v", err)
+	}
+	if q.Total != 2000 || !q.Fulfillable || q.HoldExpiresAt == nil || !q.HoldExpiresAt.Equal(hold.ExpiresAt) {
+		t.Fatalf("unexpected quote: %+v (hold %+v)", q, hold)
+	}
+	if len(hold.Lines) != 1 || hold.Lines[0] != (store.QuoteHoldLine{ProductID: 1, Quantity: 2, Price: 1000}) {
+		t.Fatalf("unexpected held lines: %+v", hold.Lines)
+	}
+
+	od, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{})
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if !od.QuoteHonored || gotOpts.HeldPrices[1] != 1000 {
+		t.Fatalf("expected the held prices to be used, got %+v / %+v", od, gotOpts)
+	}
+}
+
+func TestQuoteCheckout_ExpiredOrChangedHoldRevalidates(t *testing.T) {
+	qty := 2
+	hold := store.QuoteHold{UserID: "u1", Lines: []store.QuoteHoldLine{{ProductID: 1, Quantity: 2, Price: 1000}}}
+	var gotOpts store.CheckoutOptions
+	fs := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{{ProductID: 1, Quantity: qty, Price: priced(12.0), Published: true}}, nil
+		},
+		GetQuoteHoldFn: func(userID string) (store.QuoteHold, error) { return hold, nil },
+		GetCartFn:      oneLineCart,
+		CheckoutFn: func(userID string, meta map[string]string, opts store.CheckoutOptions) (store.OrderRow, []store.OrderItemRow, []int64, error) {
+			gotOpts = opts
+			return store.OrderRow{ID: 1, UserID: userID, Total: 2400}, nil, nil, nil
+		},
+	}
+	svc := NewService(fs)
+
+	// expired: checkout prices the cart afresh
+	hold.ExpiresAt = time.Now().Add(-time.Second)
+	od, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{})
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if od.QuoteHonored || gotOpts.HeldPrices != nil {
+		t.Fatalf("expired hold should not be honoured: %+v / %+v", od, gotOpts)
+	}
+
+	// still valid, but the cart changed since the quote
+	hold.ExpiresAt = time.Now().Add(time.Minute)
+	qty = 3
+	if od, err := svc.Checkout(context.Background(), "u1", nil, store.CheckoutOptions{}); err != nil || od.QuoteHonored || gotOpts.HeldPrices != nil {
+		t.Fatalf("changed cart should not use the hold: %+v %v / %+v", od, err, gotOpts)
+	}
+}
+
+func TestQuoteCheckout_UnavailableCantHold(t *testing.T) {
+	fs := &fakeStore{
+		GetCartContextFn: func(userID string) ([]store.CartLineContext, error) {
+			return []store.CartLineContext{
+				{ProductID: 1, Quantity: 1, Price: priced(5.0), Published: true},
+				{ProductID: 2, Quantity: 1, Price: priced(5.0), Published: false},
+			}, nil
+		},
+	}
+	svc := NewService(fs)
+
+	q, err := svc.QuoteCheckout(context.Background(), "u1", false)
+	if err != nil || q.Fulfillable || q.Total != 500 || len(q.Unavailable) != 1 || q.Unavailable[0] != 2 {
+		t.Fatalf("unexpected quote: %+v %v", q, err)
+	}
+	if _, err := svc.QuoteCheckout(context.Background(), "u1", true); !errors.Is(err, store.ErrItemUnavailable) {
+		t.Fatalf("expected ErrItemUnavailable, got %v", err)
+	}
+}
+
+func TestReleaseExpiredReservations_UsesCurrentTime(t *testing.T) {
+	var got time.Time
+	fs := &fakeStore{
+		ReleaseExpiredFn: func(now time.Time) (int, error) {
+			got = now
+			return 2, nil
+		},
+	}
+	svc := NewService(fs)
+
+	before := time.Now()
+	n, err := svc.ReleaseExpiredReservations(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 released, got %d, %v", n, err)
+	}
+	if got.Before(before) || got.After(time.Now()) {
+		t.Fatalf("released as of %v, not now", got)
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnknownShippingZone returned when no rate is configured for a destination.
+var ErrUnknownShippingZone = errors.New("unknown shipping zone")
+
+// ShippingRate prices a shipment to one zone: Base + PerKg * weight in kg
+type ShippingRate struct {
+	Base  float64
+	PerKg float64
+}
+
+// ShippingRates is the rate table used by EstimateShipping. Zones is keyed by
+// destination zone; Flat is charged when nothing in the cart has a weight.
+type ShippingRates struct {
+	Zones map[string]ShippingRate
+	Flat  float64
+}
+
+// DefaultShippingRates is the table NewService starts with
+var DefaultShippingRates = ShippingRates{
+	Zones: map[string]ShippingRate{
+		"domestic":      {Base: 4.99, PerKg: 1.00},
+		"international": {Base: 14.99, PerKg: 4.50},
+	},
+	Flat: 4.99,
+}
+
+// EstimateShipping sums the weight of the user's cart and prices it for the
+// destination zone. Products without a weight don't contribute.
+func (s *Service) EstimateShipping(ctx context.Context, userID string, destination string) (float64, error) {
+	if userID == "" {
+		return 0, errors.New("user_id required")
+	}
+	rate, ok := s.ShippingRates.Zones[destination]
+	if !ok {
+		return 0, ErrUnknownShippingZone
+	}
+	rows, err := s.store.GetCartWeights(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	var grams int64
+	for _, r := range rows {
+		if r.WeightGrams.Valid {
+			grams += r.WeightGrams.Int64 * int64(r.Quantity)
+		}
+	}
+	if grams == 0 {
+		return s.ShippingRates.Flat, nil
+	}
+	return rate.Base + rate.PerKg*float64(grams)/1000, nil
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"inventory-management/store"
+	"log"
+	"sync"
+	"time"
+)
+
+// Alert is something ops should look at.
+type Alert struct {
+	Kind      string
+	ProductID int64
+	Message   string
+	At        time.Time
+}
+
+// Alert kinds: a sudden fall in stock, and stock reaching the low-stock
+// threshold
+const (
+	AlertStockDrop = "stock_drop"
+	AlertLowStock  = "low_stock"
+)
+
+// DefaultLowStockThreshold is the low-stock threshold when none is configured
+const DefaultLowStockThreshold = 5
+
+// Notifier delivers alerts. Notify is called inline, so it should be quick.
+type Notifier interface {
+	Notify(a Alert)
+}
+
+// LogNotifier writes alerts to Logger (the default logger if nil).
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+func (n LogNotifier) Notify(a Alert) {
+	logger := n.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("ALERT %s: product=%d %s", a.Kind, a.ProductID, a.Message)
+}
+
+// StockDropPolicy says when a fall in a product's stock is sudden enough to
+// alert on: losing at least MaxDropUnits, or MaxDropPercent of the highest
+// level seen, within Window. A zero threshold is not checked; a zero Window
+// turns the monitor off.
+type StockDropPolicy struct {
+	Window         time.Duration
+	MaxDropUnits   int
+	MaxDropPercent float64
+}
+
+// stockMonitor keeps the stock levels each product had within the policy
+// window and raises one alert per window when they fall too fast.
+type stockMonitor struct {
+	mu      sync.Mutex
+	samples map[int64][]stockSample
+	alerted map[int64]time.Time
+	// low is whether each product was last seen at or below the
+	// low-stock threshold
+	low map[int64]bool
+}
+
+type stockSample struct {
+	at    time.Time
+	level int
+}
+
+func newStockMonitor() *stockMonitor {
+	return &stockMonitor{samples: make(map[int64][]stockSample), alerted: make(map[int64]time.Time), low: make(map[int64]bool)}
+}
+
+// observe records that productID now has level units in stock and notifies n
+// if that's a drop p considers alarming.
+func (m *stockMonitor) observe(p StockDropPolicy, n Notifier, productID int64, level int, now time.Time) {
+	if p.Window <= 0 || n == nil || level == store.UntrackedStock {
+		return
+	}
+	m.mu.Lock()
+	cutoff := now.Add(-p.Window)
+	kept := m.samples[productID][:0]
+	for _, s := range m.samples[productID] {
+		if s.at.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	kept = append(kept, stockSample{at: now, level: level})
+	m.samples[productID] = kept
+
+	peak := level
+	for _, s := range kept {
+		if s.level > peak {
+			peak = s.level
+		}
+	}
+	drop := peak - level
+	pct := 0.0
+	if peak > 0 {
+		pct = float64(drop) * 100 / float64(peak)
+	}
+	tripped := drop > 0 &&
+		((p.MaxDropUnits > 0 && drop >= p.MaxDropUnits) || (p.MaxDropPercent > 0 && pct >= p.MaxDropPercent))
+	if last, ok := m.alerted[productID]; ok && last.After(cutoff) {
+		tripped = false
+	}
+	if tripped {
+		m.alerted[productID] = now
+	}
+	m.mu.Unlock()
+
+	if tripped {
+		n.Notify(Alert{
+			Kind:      AlertStockDrop,
+			ProductID: productID,
+			Message:   fmt.Sprintf("stock fell from %d to %d (-%.0f%%) within %s", peak, level, pct, p.Window),
+			At:        now,
+		})
+	}
+}
+
+// observeLow notifies n when productID's stock reaches threshold or below,
+// once per crossing: it has to climb back above threshold to alert again.
+// A product first seen already low alerts once.
+func (m *stockMonitor) observeLow(threshold int, n Notifier, productID int64, level int, now time.Time) {
+	if n == nil || level == store.UntrackedStock {
+		return
+	}
+	low := level <= threshold
+	m.mu.Lock()
+	crossed := low && !m.low[productID]
+	m.low[productID] = low
+	m.mu.Unlock()
+
+	if crossed {
+		n.Notify(Alert{
+			Kind:      AlertLowStock,
+			ProductID: productID,
+			Message:   fmt.Sprintf("stock=%d threshold=%d", level, threshold),
+			At:        now,
+		})
+	}
+}
+
+// observeStock feeds the product's current stock to the stock-drop and
+// low-stock monitors after a movement. It's best effort: a failed read only
+// skips the checks.
+func (s *Service) observeStock(ctx context.Context, productID int64) {
+	if (s.StockDropAlert.Window <= 0 && !s.LowStockAlert) || s.Notifier == nil || s.stockMon == nil {
+		return
+	}
+	level, err := s.store.GetStock(ctx, productID)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	s.stockMon.observe(s.StockDropAlert, s.Notifier, productID, level, now)
+	if s.LowStockAlert {
+		s.stockMon.observeLow(s.LowStockThreshold, s.Notifier, productID, level, now)
+	}
+}
+
+// ListLowStockProducts returns the tracked products with threshold or fewer
+// units, emptiest first, each with its stock. A negative threshold means
+// LowStockThreshold.
+func (s *Service) ListLowStockProducts(ctx context.Context, threshold int) ([]ProductDTO, error) {
+	if threshold < 0 {
+		threshold = s.LowStockThreshold
+	}
+	rows, err := s.store.ListLowStockProducts(ctx, threshold)
+	if err != nil {
+		return nil, err
+	}
+	return s.productDTOs(ctx, rows)
+}
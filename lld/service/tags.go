@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxTagLen is the longest tag accepted, in bytes
+const MaxTagLen = 50
+
+// helper: tags are case-insensitive and stored trimmed + lowercased
+func normalizeTag(tag string) (string, error) {
+	t := strings.ToLower(strings.TrimSpace(tag))
+	if t == "" {
+		return "", errors.New("tag required")
+	}
+	if len(t) > MaxTagLen {
+		return "", fmt.Errorf("tag longer than %d bytes", MaxTagLen)
+	}
+	return t, nil
+}
+
+func (s *Service) AddTag(ctx context.Context, productID int64, tag string) error {
+	if productID <= 0 {
+		return errors.New("product_id must be > 0")
+	}
+	t, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	return s.store.AddTag(ctx, productID, t)
+}
+
+func (s *Service) RemoveTag(ctx context.Context, productID int64, tag string) error {
+	if productID <= 0 {
+		return errors.New("product_id must be > 0")
+	}
+	t, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	return s.store.RemoveTag(ctx, productID, t)
+}
+
+func (s *Service) ListTags(ctx context.Context, productID int64) ([]string, error) {
+	if productID <= 0 {
+		return nil, errors.New("product_id must be > 0")
+	}
+	return s.store.ListTags(ctx, productID)
+}
+
+// ListProductsByTags returns products carrying all of the given tags
+func (s *Service) ListProductsByTags(ctx context.Context, tags []string) ([]ProductDTO, error) {
+	seen := map[string]bool{}
+	norm := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		t, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[t] {
+			seen[t] = true
+			norm = append(norm, t)
+		}
+	}
+	if len(norm) == 0 {
+		return nil, errors.New("at least one tag required")
+	}
+	rows, err := s.store.ListProductsByTags(ctx, norm)
+	if err != nil {
+		return nil, err
+	}
+	return s.productDTOs(ctx, rows)
+}
+
+// helper: attach tags to products with one batched lookup
+func (s *Service) withTags(ctx context.Context, ps []ProductDTO) ([]ProductDTO, error) {
+	if len(ps) == 0 {
+		return ps, nil
+	}
+	ids := make([]int64, 0, len(ps))
+	for _, p := range ps {
+		ids = append(ids, p.ID)
+	}
+	tags, err := s.store.ListTagsForProducts(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ps {
+		ps[i].Tags = tags[ps[i].ID]
+	}
+	return ps, nil
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Default product text limits, in characters (runes) after normalization
+const (
+	DefaultMaxNameLen        = 255
+	DefaultMaxDescriptionLen = 5000
+)
+
+// ErrTextTooLong returned when a product name or description exceeds the
+// configured limit.
+var ErrTextTooLong = errors.New("text too long")
+
+// normalizeText returns s in Unicode NFC, so visually identical names are
+// stored identically, after checking it is at most max characters. Length is
+// counted in runes of the normalized form, not bytes.
+func normalizeText(field, s string, max int) (string, error) {
+	s = norm.NFC.String(s)
+	if n := utf8.RuneCountInString(s); n > max {
+		return "", fmt.Errorf("%w: %s is %d characters, at most %d allowed", ErrTextTooLong, field, n, max)
+	}
+	return s, nil
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Headers on every webhook request. The signature is "sha256=" and the hex
+// HMAC-SHA256 of the body under the shared secret.
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// EventOrderCreated is the webhook event sent after a checkout commits; its
+// body is the OrderDTO.
+const EventOrderCreated = "order.created"
+
+// OrderWebhook POSTs every new order as JSON to a URL from a single
+// background worker, so checkouts never wait on the receiver. A failed
+// delivery (network error or non-2xx) is retried up to Attempts times in all,
+// with Backoff doubling between tries; orders that arrive while the queue is
+// full are logged and dropped.
+type OrderWebhook struct {
+	url      string
+	secret   []byte
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+
+	queue chan OrderDTO
+	done  chan struct{}
+	once  sync.Once
+}
+
+// WebhookOptions tunes NewOrderWebhook; zero fields take the defaults.
+type WebhookOptions struct {
+	Attempts int           // 5
+	Backoff  time.Duration // 1s
+	Queue    int           // 100 pending orders
+	Client   *http.Client  // a client with a 10s timeout
+}
+
+// NewOrderWebhook starts an OrderWebhook posting to url, signed with secret.
+// Call Close to stop it once pending orders are delivered.
+func NewOrderWebhook(url string, secret []byte, opts WebhookOptions) *OrderWebhook {
+	if opts.Attempts <= 0 {
+		opts.Attempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = 100
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	w := &OrderWebhook{
+		url:      url,
+		secret:   secret,
+		client:   opts.Client,
+		attempts: opts.Attempts,
+		backoff:  opts.Backoff,
+		queue:    make(chan OrderDTO, opts.Queue),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Send queues od for delivery.
+func (w *OrderWebhook) Send(od OrderDTO) {
+	select {
+	case w.queue <- od:
+	default:
+		log.Printf("webhook: queue full, dropping order %d", od.ID)
+	}
+}
+
+// Close stops accepting orders and waits for the queued ones to be delivered
+// (or to run out of attempts).
+func (w *OrderWebhook) Close() {
+	w.once.Do(func() { close(w.queue) })
+	<-w.done
+}
+
+// SignWebhook returns the signature header value for body under secret.
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *OrderWebhook) run() {
+	defer close(w.done)
+	for od := range w.queue {
+		body, err := json.Marshal(od)
+		if err != nil {
+			log.Printf("webhook: encoding order %d: %v", od.ID, err)
+			continue
+		}
+		wait := w.backoff
+		for attempt := 1; ; attempt++ {
+			err = w.post(body)
+			if err == nil {
+				break
+			}
+			if attempt == w.attempts {
+				log.Printf("webhook: giving up on order %d after %d attempts: %v", od.ID, attempt, err)
+				break
+			}
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+func (w *OrderWebhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, EventOrderCreated)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(w.secret, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", w.url, resp.Status)
+	}
+	return nil
+}
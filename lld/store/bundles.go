@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// BundleComponent is one product (and how many of it) inside a bundle.
+type BundleComponent struct {
+	ProductID int64
+	Quantity  int
+}
+
+// ErrBundleInUse returned when changing the components of a bundle that is
+// sitting in carts (their reservations were made for the old components).
+var ErrBundleInUse = errors.New("bundle is in active carts")
+
+// ErrInvalidBundle returned for a component list that can't form a bundle.
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// SetBundleComponents turns a product into a bundle of components (or back
+// into a plain product when components is empty), replacing any earlier
+// components. A bundle's own stock is untracked. Fails with sql.ErrNoRows if
+// the bundle or a component doesn't exist.
+func (s *PostgresStore) SetBundleComponents(ctx context.Context, bundleID int64, components []BundleComponent) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var inCarts bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM cart_items WHERE product_id = p.id)
+		FROM products p WHERE p.id = $1 FOR UPDATE
+	`, bundleID).Scan(&inCarts); err != nil {
+		return err
+	}
+	if inCarts {
+		return fmt.Errorf("%w: product %d", ErrBundleInUse, bundleID)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM bundle_components WHERE bundle_id = $1`, bundleID); err != nil {
+		return err
+	}
+	for _, c := range components {
+		// components must be plain products: no nesting
+		var nested bool
+		if err := tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM bundle_components WHERE bundle_id = p.id)
+			FROM products p WHERE p.id = $1
+		`, c.ProductID).Scan(&nested); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%w: component %d", sql.ErrNoRows, c.ProductID)
+			}
+			return err
+		}
+		if nested {
+			return fmt.Errorf("%w: component %d is itself a bundle", ErrInvalidBundle, c.ProductID)
+		}
+		if _, err := tx.Exec(`INSERT INTO bundle_components (bundle_id, component_id, quantity) VALUES ($1, $2, $3)`,
+			bundleID, c.ProductID, c.Quantity); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE products SET track_inventory = $1 WHERE id = $2`, len(components) == 0, bundleID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
+
+// reserveBundle locks a bundle's components and takes qty bundles' worth of
+// stock from each tracked one, failing with ErrInsufficientStock (and
+// reserving nothing, once the caller rolls back) if any component is short.
+func reserveBundle(tx querier, bundleID int64, qty int) error {
+	rows, err := tx.Query(`
+		SELECT p.id, bc.quantity, p.stock
+		FROM bundle_components bc
+		JOIN products p ON p.id = bc.component_id
+		WHERE bc.bundle_id = $1 AND p.track_inventory
+		ORDER BY p.id
+		FOR UPDATE OF p
+	`, bundleID)
+	if err != nil {
+		return err
+	}
+	var need []BundleComponent
+	for rows.Next() {
+		var id int64
+		var per, stock int
+		if err := rows.Scan(&id, &per, &stock); err != nil {
+			rows.Close()
+			return err
+		}
+		if stock < per*qty {
+			rows.Close()
+			return fmt.Errorf("%w: component %d", ErrInsufficientStock, id)
+		}
+		need = append(need, BundleComponent{ProductID: id, Quantity: per * qty})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range need {
+		if _, err := tx.Exec(reserveStockSQL, c.Quantity, c.ProductID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
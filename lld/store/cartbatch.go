@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// AddToCartBatch adds every line to the user's cart in one transaction: if
+// any line can't be added (the error names it) none are. Product rows are
+// locked in id order so concurrent batches can't deadlock.
+func (s *PostgresStore) AddToCartBatch(ctx context.Context, userID string, lines []CartRow) error {
+	for _, l := range lines {
+		if l.Quantity <= 0 {
+			return fmt.Errorf("product %d: quantity must be > 0", l.ProductID)
+		}
+		if l.Quantity > MaxCartLineQuantity {
+			return fmt.Errorf("product %d: %w", l.ProductID, ErrQuantityOutOfRange)
+		}
+	}
+	sorted := append([]CartRow(nil), lines...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ProductID < sorted[j].ProductID })
+
+	unlock := s.lockForUser(userID)
+	defer unlock()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err := tx.Exec(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`, userID); err != nil {
+		return err
+	}
+	for _, l := range sorted {
+		if err := addCartLine(tx, userID, l.ProductID, l.Quantity, s.MaxReservedPerUser, s.reservedUntil()); err != nil {
+			return fmt.Errorf("product %d: %w", l.ProductID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
+
+// RemoveFromCartBatch removes every product from the user's cart in one
+// transaction, releasing their reservations; if any isn't in the cart
+// (sql.ErrNoRows, naming it) nothing is removed. Repeated ids count once.
+func (s *PostgresStore) RemoveFromCartBatch(ctx context.Context, userID string, productIDs []int64) error {
+	sorted := append([]int64(nil), productIDs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	unlock := s.lockForUser(userID)
+	defer unlock()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		if err := removeCartLine(tx, userID, id); err != nil {
+			return fmt.Errorf("product %d: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
+
+// ClearCart removes every line from the user's cart in one transaction,
+// giving back the stock each one reserved. An empty (or missing) cart is
+// not an error.
+func (s *PostgresStore) ClearCart(ctx context.Context, userID string) error {
+	unlock := s.lockForUser(userID)
+	defer unlock()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT product_id FROM cart_items WHERE cart_id=$1 ORDER BY product_id FOR UPDATE`, userID)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := removeCartLine(tx, userID, id); err != nil {
+			return fmt.Errorf("product %d: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
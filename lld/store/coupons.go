@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"inventory-management/money"
+	"time"
+)
+
+// ErrUnknownCoupon / ErrCouponExpired / ErrCouponUsedUp returned when
+// checking out with a coupon code that can't be applied; the order isn't
+// placed.
+var (
+	ErrUnknownCoupon = errors.New("unknown coupon code")
+	ErrCouponExpired = errors.New("coupon expired")
+	ErrCouponUsedUp  = errors.New("coupon has no uses left")
+)
+
+// CouponRow is a discount code. A nil ExpiresAt never expires; a nil MaxUses
+// can be used any number of times.
+type CouponRow struct {
+	Code       string
+	PercentOff int
+	ExpiresAt  *time.Time
+	MaxUses    *int
+	Uses       int
+}
+
+// Check reports why the coupon can't be applied at now, or nil if it can.
+func (c CouponRow) Check(now time.Time) error {
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return fmt.Errorf("%w: %s", ErrCouponExpired, c.Code)
+	}
+	if c.MaxUses != nil && c.Uses >= *c.MaxUses {
+		return fmt.Errorf("%w: %s", ErrCouponUsedUp, c.Code)
+	}
+	return nil
+}
+
+// Discount is what the coupon takes off total, rounded to the cent.
+func (c CouponRow) Discount(total money.Cents) money.Cents {
+	return (total.Mul(c.PercentOff) + 50) / 100
+}
+
+// GetCoupon returns a coupon, usable or not. sql.ErrNoRows if there's none
+// with that code.
+func (s *PostgresStore) GetCoupon(ctx context.Context, code string) (CouponRow, error) {
+	return getCoupon(s.db(ctx), code, false)
+}
+
+// IncrementCouponUse counts one use of a coupon, failing with
+// ErrCouponExpired / ErrCouponUsedUp (and counting nothing) if it can't be
+// used any more. sql.ErrNoRows for an unknown code.
+func (s *PostgresStore) IncrementCouponUse(ctx context.Context, code string) error {
+	return incrementCouponUse(s.db(ctx), code)
+}
+
+func getCoupon(q querier, code string, forUpdate bool) (CouponRow, error) {
+	query := `SELECT code, percent_off, expires_at, max_uses, uses FROM coupons WHERE code = $1`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	var c CouponRow
+	var expiresAt sql.NullTime
+	var maxUses sql.NullInt64
+	if err := q.QueryRow(query, code).Scan(&c.Code, &c.PercentOff, &expiresAt, &maxUses, &c.Uses); err != nil {
+		return c, err
+	}
+	if expiresAt.Valid {
+		c.ExpiresAt = &expiresAt.Time
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		c.MaxUses = &n
+	}
+	return c, nil
+}
+
+func incrementCouponUse(q querier, code string) error {
+	res, err := q.Exec(`
+		UPDATE coupons SET uses = uses + 1
+		WHERE code = $1 AND (expires_at IS NULL OR expires_at > now()) AND (max_uses IS NULL OR uses < max_uses)
+	`, code)
+	if err != nil {
+		return err
+	}
+	if ra, _ := res.RowsAffected(); ra == 0 {
+		// tell the caller why
+		c, err := getCoupon(q, code, false)
+		if err != nil {
+			return err
+		}
+		if err := c.Check(time.Now()); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrCouponUsedUp, code)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// ProductExportRow is a product with everything a catalog backup keeps.
+type ProductExportRow struct {
+	ID                 int64
+	Name               string
+	Description        sql.NullString
+	Price              sql.NullFloat64
+	Stock              int
+	TrackInventory     bool
+	Published          bool
+	AvailableFrom      sql.NullTime
+	AvailableUntil     sql.NullTime
+	WeightGrams        sql.NullInt64
+	MaxReservedPerUser sql.NullInt64
+	Tags               []string
+}
+
+// ExportProducts calls fn for every product, drafts included, in id order.
+// Rows are streamed from one query rather than loaded up front; an error
+// from fn stops the export and is returned.
+func (s *PostgresStore) ExportProducts(ctx context.Context, fn func(ProductExportRow) error) error {
+	rows, err := s.db(ctx).Query(`
+		SELECT p.id, p.name, p.description, p.price, p.stock, p.track_inventory, p.published,
+		       p.available_from, p.available_until, p.weight_grams, p.max_reserved_per_user,
+		       ARRAY(SELECT t.tag FROM product_tags t WHERE t.product_id = p.id ORDER BY t.tag)
+		FROM products p
+		ORDER BY p.id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p ProductExportRow
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.TrackInventory, &p.Published,
+			&p.AvailableFrom, &p.AvailableUntil, &p.WeightGrams, &p.MaxReservedPerUser, pq.Array(&p.Tags)); err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
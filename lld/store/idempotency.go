@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IdempotencyKeyTTL is how long a checkout's idempotency key keeps pointing
+// at its order; after that the key can place a new one.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// ErrIdempotencyKeyInUse returned by Checkout when another order was placed
+// under the same user and key within IdempotencyKeyTTL; nothing is ordered.
+var ErrIdempotencyKeyInUse = errors.New("idempotency key already used")
+
+// GetOrderByIdempotencyKey returns the id of the order the user placed with
+// key within IdempotencyKeyTTL, or sql.ErrNoRows if there's none.
+func (s *PostgresStore) GetOrderByIdempotencyKey(ctx context.Context, userID, key string) (int64, error) {
+	var orderID int64
+	err := s.db(ctx).QueryRow(`
+		SELECT order_id FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND created_at > now() - make_interval(secs => $3)
+	`, userID, key, IdempotencyKeyTTL.Seconds()).Scan(&orderID)
+	return orderID, err
+}
+
+// recordIdempotencyKey points the user's key at orderID inside the checkout
+// transaction. A key used within IdempotencyKeyTTL is ErrIdempotencyKeyInUse;
+// an older one is taken over. A concurrent checkout with the same key waits
+// on this row, so only one of them can commit.
+func recordIdempotencyKey(tx querier, userID, key string, orderID int64) error {
+	res, err := tx.Exec(`
+		INSERT INTO idempotency_keys (user_id, key, order_id) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, key) DO UPDATE SET order_id = EXCLUDED.order_id, created_at = now()
+		WHERE idempotency_keys.created_at <= now() - make_interval(secs => $4)
+	`, userID, key, orderID, IdempotencyKeyTTL.Seconds())
+	if err != nil {
+		return err
+	}
+	if ra, _ := res.RowsAffected(); ra == 0 {
+		return fmt.Errorf("%w: %s", ErrIdempotencyKeyInUse, key)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+
+	"github.com/lib/pq"
+)
+
+// What ImportProducts did with each row
+const (
+	ImportCreated   = "created"
+	ImportUpdated   = "updated"
+	ImportUnchanged = "unchanged"
+)
+
+// ImportProducts upserts rows, as written by ExportProducts, in one
+// transaction and returns what it did with each, in order. A row is matched
+// by id: an existing product is overwritten (tags included) unless nothing
+// differs, an unused id is created with that id, and ID 0 gets a fresh one.
+// Stock is restored as exported, whatever carts have reserved since; a change
+// on a tracked product is recorded as an adjustment.
+func (s *PostgresStore) ImportProducts(ctx context.Context, rows []ProductExportRow) ([]string, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	out := make([]string, 0, len(rows))
+	createdWithID := false
+	for _, r := range rows {
+		outcome, err := importProduct(tx, r)
+		if err != nil {
+			return nil, err
+		}
+		if outcome == ImportCreated && r.ID != 0 {
+			createdWithID = true
+		}
+		out = append(out, outcome)
+	}
+	// ids taken explicitly mustn't be handed out again by CreateProduct
+	if createdWithID {
+		if _, err := tx.Exec(`SELECT setval(pg_get_serial_sequence('products', 'id'), (SELECT MAX(id) FROM products))`); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	rolledBack = true
+	return out, nil
+}
+
+func importProduct(tx querier, r ProductExportRow) (string, error) {
+	if r.Tags == nil {
+		r.Tags = []string{}
+	}
+	if r.ID == 0 {
+		return ImportCreated, insertImported(tx, r)
+	}
+	cur := ProductExportRow{ID: r.ID}
+	err := tx.QueryRow(`
+		SELECT name, description, price, stock, track_inventory, published,
+		       available_from, available_until, weight_grams, max_reserved_per_user,
+		       ARRAY(SELECT t.tag FROM product_tags t WHERE t.product_id = products.id ORDER BY t.tag)
+		FROM products WHERE id = $1 FOR UPDATE
+	`, r.ID).Scan(&cur.Name, &cur.Description, &cur.Price, &cur.Stock, &cur.TrackInventory, &cur.Published,
+		&cur.AvailableFrom, &cur.AvailableUntil, &cur.WeightGrams, &cur.MaxReservedPerUser, pq.Array(&cur.Tags))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ImportCreated, insertImported(tx, r)
+	}
+	if err != nil {
+		return "", err
+	}
+	if cur.Tags == nil {
+		cur.Tags = []string{}
+	}
+	if sameImported(cur, r) {
+		return ImportUnchanged, nil
+	}
+	if _, err := tx.Exec(`
+		UPDATE products SET name=$2, description=$3, price=$4, stock=$5, track_inventory=$6, published=$7,
+		       available_from=$8, available_until=$9, weight_grams=$10, max_reserved_per_user=$11,
+		       version=version+1, updated_at=now()
+		WHERE id=$1
+	`, r.ID, r.Name, r.Description, r.Price, r.Stock, r.TrackInventory, r.Published,
+		r.AvailableFrom, r.AvailableUntil, r.WeightGrams, r.MaxReservedPerUser); err != nil {
+		return "", err
+	}
+	if r.TrackInventory && cur.TrackInventory && r.Stock != cur.Stock {
+		if _, err := tx.Exec(`INSERT INTO stock_movements (product_id, delta, reason) VALUES ($1, $2, $3)`,
+			r.ID, r.Stock-cur.Stock, MovementAdjustment); err != nil {
+			return "", err
+		}
+	}
+	if !reflect.DeepEqual(cur.Tags, r.Tags) {
+		if _, err := tx.Exec(`DELETE FROM product_tags WHERE product_id = $1`, r.ID); err != nil {
+			return "", err
+		}
+		if err := insertImportedTags(tx, r.ID, r.Tags); err != nil {
+			return "", err
+		}
+	}
+	return ImportUpdated, nil
+}
+
+// insertImported creates r, with its id unless that's 0
+func insertImported(tx querier, r ProductExportRow) error {
+	id := sql.NullInt64{Int64: r.ID, Valid: r.ID != 0}
+	if err := tx.QueryRow(`
+		INSERT INTO products (id, name, description, price, stock, track_inventory, published,
+		                      available_from, available_until, weight_grams, max_reserved_per_user)
+		VALUES (COALESCE($1, nextval(pg_get_serial_sequence('products', 'id'))), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`, id, r.Name, r.Description, r.Price, r.Stock, r.TrackInventory, r.Published,
+		r.AvailableFrom, r.AvailableUntil, r.WeightGrams, r.MaxReservedPerUser).Scan(&r.ID); err != nil {
+		return err
+	}
+	return insertImportedTags(tx, r.ID, r.Tags)
+}
+
+func insertImportedTags(tx querier, productID int64, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO product_tags (product_id, tag) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING`, productID, pq.Array(tags))
+	return err
+}
+
+// sameImported reports whether importing r over cur would change nothing. An
+// export doesn't tell a NULL description from an empty one, so neither does
+// this.
+func sameImported(cur, r ProductExportRow) bool {
+	sameTime := func(a, b sql.NullTime) bool {
+		return a.Valid == b.Valid && (!a.Valid || a.Time.Equal(b.Time))
+	}
+	return cur.Name == r.Name && cur.Description.String == r.Description.String && cur.Price == r.Price &&
+		cur.Stock == r.Stock && cur.TrackInventory == r.TrackInventory && cur.Published == r.Published &&
+		sameTime(cur.AvailableFrom, r.AvailableFrom) && sameTime(cur.AvailableUntil, r.AvailableUntil) &&
+		cur.WeightGrams == r.WeightGrams && cur.MaxReservedPerUser == r.MaxReservedPerUser &&
+		reflect.DeepEqual(cur.Tags, r.Tags)
+}
@@ -1,22 +1,163 @@
 package store
 
+import (
+	"context"
+	"inventory-management/money"
+	"time"
+)
+
+// GET /healthz - Readiness: 200 if the database answers, 503 if not
+// GET /livez - Liveness: always 200
+// POST /auth/login - Testing stub: a bearer token for any user_id (AUTH_LOGIN_STUB=true)
 // POST /products – Create a new product in the backend.
-// GET /products/list -  For listing all products
+// POST /products/bulk - Create many products at once (one invalid entry fails the batch)
+// GET /products/list -  For listing all products (?sort= e.g. newest; ?limit=&offset= pages; ?category= filters)
+// GET /products/search?q= - Match name/description, with stock
+// POST /products/prices - Current prices for a list of product ids
+// POST /products/stock - Set a tracked product's stock, e.g. after receiving a shipment
+// POST /products/stock/adjust - Add to (or take from) a tracked product's stock
+// POST /products/stock/bulk - Set many tracked products' stock at once (one unknown id fails the batch)
+// GET /products/low-stock?threshold=5 - Tracked products at or below the threshold (default LOW_STOCK_THRESHOLD)
+// GET /products/{id} - One published product, with its stock
+// PUT /products/{id} - Replace a product's name, description and price, given the version last read
+// DELETE /products/{id}?strict=true - Soft-delete a product and drop it from every cart (strict: 404 if missing, 409 if carted)
+// POST /products/{id}/clone - Copy a product as an unpublished draft with zero stock
+// POST /products/{id}/publish, /products/{id}/unpublish - Show/hide a product in public listings
+// GET /products/{id}/stock - A product's current stock (-1 if untracked)
+// GET /products/{id}/velocity?days=30 - Average units sold per day over the window
+// GET /products/{id}/reorder-suggestion - Units to order to cover lead time plus safety stock
+// GET /products/{id}/reviews?limit=&offset=&sort=newest|highest|lowest&min_rating= - Page through reviews
+// GET /products/{id}/reviews/summary - Review count per star, total and average
+// PUT /products/{id}/track-inventory - Enable/disable inventory tracking
+// PUT /products/{id}/reservation-limit - Cap the units of a product one user can hold in their cart
+// PUT /products/{id}/availability - Set the preorder/expiry window (list filter: ?available_now=true)
+// GET/POST /products/{id}/tags, DELETE /products/{id}/tags/{tag} - Product tags (list filter: ?tag=)
+// GET /cart?user_id=&currency=EUR - Cart with prices and total converted from the base currency
 // GET /cart/list - For listing cart products
+// GET /cart/detailed - Cart lines with full product details
+// GET /cart/fulfillable - Read-only check that every cart line can still be checked out
 // POST /cart/add - To add  product in cart
 // POST /cart/remove - To remove product from cart
-// POST /checkout/order - For a checkout
+// POST /cart/update - Set a cart line's quantity, reserving or releasing only the difference (0 removes it)
+// POST /cart/clear - Empty the cart, giving back its reserved stock
+// POST /cart/add-batch, /cart/remove-batch?mode=best_effort - Several lines at once, all or nothing unless best_effort
+// POST /checkout/order - For a checkout, optionally with a coupon_code
+// POST /checkout/pay - Checkout and charge payment_token; a failed charge cancels the order and restocks
+// POST /checkout/quote - Price the cart without ordering; hold=true keeps the prices for a while
+// POST /checkout/shipping-estimate - Weight-based shipping cost for the cart
+// GET /orders/list?user_id= - A user's orders with their lines, newest first
+// GET /orders/{id}?user_id= - One of the user's orders with its lines (403 for another user's)
+// POST /orders/{id}/return - Return (part of) an order line
+// PATCH /orders/{id}/status - Move an order to shipped/delivered (admin only)
+// POST /orders/{id}/cancel - Cancel a placed order within the cancel window, restocking its lines
+// POST /orders/{id}/restore-to-cart - Re-add a cancelled order's lines to the cart
+// GET /orders/{id}/cart-snapshot - The cart as it stood at checkout (admin only)
+// GET /admin - Dashboard page for products, stock and orders (browsers sign in with the admin token as Basic password)
+// POST /admin/purchase-orders - Record an inbound purchase order (restock ETA)
+// PUT /admin/bundles/{id}/components - Make a product a bundle of components (empty list: plain product)
+// GET /admin/products?include_deleted=true - List all products, unpublished (and optionally deleted) included
+// POST /admin/products/{id}/restore - Undelete a product, as a draft
+// GET /admin/orders?status=&user_id=&from=&to=&limit=&offset= - List all orders, newest first
+// GET /admin/products/{id}/orders?from=&to=&limit=&offset= - Orders containing a product, with its quantity
+// POST /admin/products/publish-batch - Publish many drafts at once (unknown ids fail the batch)
+// POST /admin/orders/status-batch - Move many orders to shipped/delivered (strict: all or nothing)
+// GET /admin/stock/movements?product_id=&reason=&from=&to=&limit=&offset= - Stock ledger, newest first
+// GET /admin/products/export?format=jsonl - Stream the whole catalog as a JSON array (or JSON lines) for backup
+// POST /admin/products/import-catalog - Upsert an exported catalog by id, reporting created/updated/skipped
+// GET /admin/outbox?status= - List outbox events (default: failed)
+// POST /admin/outbox/{id}/replay - Re-queue an outbox event
+// GET /admin/metrics - expvar counters (latency_over_budget per route)
+// GET /metrics - Prometheus metrics: checkouts, cart adds, stock refusals, latency per route
 
 type Store interface {
-	CreateProduct(name, desc string, price float64) (int64, error)
-	ListProducts() ([]ProductRow, error)
+	CreateProduct(ctx context.Context, name, desc string, price money.Cents, category, currency string) (int64, error)
+	CreateProductsBatch(ctx context.Context, products []ProductRow) ([]int64, error)
+	GetProduct(ctx context.Context, id int64) (ProductRow, error)
+	UpdateProduct(ctx context.Context, id int64, name, desc string, price money.Cents, category, currency string, version int) error
+	ListProducts(ctx context.Context, sort string) ([]ProductRow, error)
+	ListProductsByCategory(ctx context.Context, category string) ([]ProductRow, error)
+	ListAllProducts(ctx context.Context, includeDeleted bool) ([]ProductRow, error)
+	DeleteProduct(ctx context.Context, id int64, strict bool) (int, error)
+	SearchProducts(ctx context.Context, query string) ([]ProductRow, error)
+	CloneProduct(ctx context.Context, id int64) (int64, error)
+	SetPublished(ctx context.Context, id int64, published bool) error
+	RestoreProduct(ctx context.Context, id int64) error
+	PublishProducts(ctx context.Context, ids []int64) ([]int64, error)
+	ListProductsPage(ctx context.Context, limit, offset int, sort string) ([]ProductRow, error)
+	ListAvailableProducts(ctx context.Context) ([]ProductRow, error)
+	GetPrices(ctx context.Context, ids []int64) (map[int64]money.Cents, error)
+	CountProducts(ctx context.Context) (int64, error)
+	EstimateProductCount(ctx context.Context) (int64, error)
+
+	AddTag(ctx context.Context, productID int64, tag string) error
+	RemoveTag(ctx context.Context, productID int64, tag string) error
+	ListTags(ctx context.Context, productID int64) ([]string, error)
+	ListTagsForProducts(ctx context.Context, productIDs []int64) (map[int64][]string, error)
+	ListProductsByTags(ctx context.Context, tags []string) ([]ProductRow, error)
+
+	AddToCart(ctx context.Context, userID string, productID int64, qty int) error
+	RemoveFromCart(ctx context.Context, userID string, productID int64) error
+	UpdateCartQuantity(ctx context.Context, userID string, productID int64, newQty int) error
+	AddToCartBatch(ctx context.Context, userID string, lines []CartRow) error
+	RemoveFromCartBatch(ctx context.Context, userID string, productIDs []int64) error
+	ClearCart(ctx context.Context, userID string) error
+	ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error)
+	GetCart(ctx context.Context, userID string) ([]CartRow, error)
+	GetCartStock(ctx context.Context, userID string) ([]CartStockRow, error)
+	GetCartContext(ctx context.Context, userID string) ([]CartLineContext, error)
+	GetCartDetailed(ctx context.Context, userID string) ([]CartDetailRow, error)
+	GetCartWeights(ctx context.Context, userID string) ([]CartWeightRow, error)
+
+	Checkout(ctx context.Context, userID string, meta map[string]string, opts CheckoutOptions) (OrderRow, []OrderItemRow, []int64, error)
+	GetOrder(ctx context.Context, orderID int64) (OrderRow, []OrderItemRow, error)
+	GetOrderByIdempotencyKey(ctx context.Context, userID, key string) (int64, error)
+	ListOrders(ctx context.Context, userID string) ([]OrderRow, error)
+	ListOrderItems(ctx context.Context, orderID int64) ([]OrderItemRow, error)
+	MarkOrderPaid(ctx context.Context, orderID int64, chargeID string) error
+	CancelPendingOrder(ctx context.Context, orderID int64) error
+	CancelOrder(ctx context.Context, orderID int64, userID string) error
+	GetCoupon(ctx context.Context, code string) (CouponRow, error)
+	IncrementCouponUse(ctx context.Context, code string) error
+	GetCartSnapshot(ctx context.Context, orderID int64) (string, []CartSnapshotLine, error)
+	PutQuoteHold(ctx context.Context, h QuoteHold) error
+	GetQuoteHold(ctx context.Context, userID string) (QuoteHold, error)
+	ListAllOrders(ctx context.Context, filter OrderFilter, limit, offset int) ([]OrderRow, error)
+	CountOrders(ctx context.Context, filter OrderFilter) (int64, error)
+	OrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time, limit, offset int) ([]ProductOrderRow, error)
+	CountOrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time) (int64, error)
+	UpdateOrderStatus(ctx context.Context, orderID int64, status string) error
+	UpdateOrderStatusBatch(ctx context.Context, orderIDs []int64, status string, strict bool) ([]int64, error)
+	GetStock(ctx context.Context, productID int64) (int, error)
+	ListLowStockProducts(ctx context.Context, threshold int) ([]ProductRow, error)
+	SalesVelocity(ctx context.Context, productID int64, window time.Duration) (float64, error)
+	ListReviews(ctx context.Context, productID int64, q ReviewQuery) ([]ReviewRow, error)
+	CountReviews(ctx context.Context, productID int64, minRating int) (int64, error)
+	ReviewDistribution(ctx context.Context, productID int64) (map[int]int64, error)
+	UpdateOrderMetadata(ctx context.Context, orderID int64, meta map[string]string) error
+	ReturnOrderItem(ctx context.Context, orderID int64, userID string, productID int64, qty int, restock bool) error
+	UpdateStock(ctx context.Context, productID int64, newStock int) error
+	AdjustStock(ctx context.Context, productID int64, delta int) error
+	UpdateStockBatch(ctx context.Context, updates []StockUpdate) error
+	ListAllStockMovements(ctx context.Context, filter MovementFilter, limit, offset int) ([]StockMovementRow, error)
+	CountStockMovements(ctx context.Context, filter MovementFilter) (int64, error)
+	SetTrackInventory(ctx context.Context, productID int64, track bool) error
+	SetReservationLimit(ctx context.Context, productID int64, limit *int) error
+	ExportProducts(ctx context.Context, fn func(ProductExportRow) error) error
+	ImportProducts(ctx context.Context, rows []ProductExportRow) ([]string, error)
+	SetAvailability(ctx context.Context, productID int64, from, until *time.Time) error
+	SetBundleComponents(ctx context.Context, bundleID int64, components []BundleComponent) error
 
-	AddToCart(userID string, productID int64, qty int) error
-	RemoveFromCart(userID string, productID int64) error
-	GetCart(userID string) ([]CartRow, error)
+	CreatePurchaseOrder(ctx context.Context, productID int64, qty int, expectedAt time.Time) (int64, error)
+	GetInboundETA(ctx context.Context, productID int64) (*time.Time, error)
+	ListInboundETAs(ctx context.Context, productIDs []int64) (map[int64]time.Time, error)
 
-	Checkout(userID string) (OrderRow, []OrderItemRow, error)
-	UpdateStock(productID int64, newStock int) error
+	GetOutboxEvent(ctx context.Context, id int64) (OutboxRow, error)
+	ListOutboxEvents(ctx context.Context, status string) ([]OutboxRow, error)
+	MarkOutboxUnpublished(ctx context.Context, id int64) error
+	EnqueueOutboxEvent(ctx context.Context, eventType string, payload []byte) (int64, error)
+	MarkOutboxPublished(ctx context.Context, id int64) error
+	MarkOutboxAttemptFailed(ctx context.Context, id int64, lastErr string, maxAttempts int) error
 
+	Ping(ctx context.Context) error
 	Close() error
 }
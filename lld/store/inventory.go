@@ -1,19 +1,232 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // ErrInsufficientStock returned when requested qty exceeds available stock.
 var ErrInsufficientStock = errors.New("insufficient stock")
 
+// ErrUntrackedInventory returned when setting stock on a product that has
+// inventory tracking disabled.
+var ErrUntrackedInventory = errors.New("inventory not tracked for product")
+
+// ErrNotAvailableYet / ErrNoLongerAvailable returned when adding a product
+// outside its available_from / available_until window.
+var (
+	ErrNotAvailableYet   = errors.New("product not available yet")
+	ErrNoLongerAvailable = errors.New("product no longer available")
+)
+
+// ErrNotPublished returned when adding a product that hasn't been published.
+var ErrNotPublished = errors.New("product not published")
+
+// ErrNoPrice returned when adding or checking out a product whose price is
+// NULL ("call for price").
+var ErrNoPrice = errors.New("product has no price")
+
+// ErrItemUnavailable returned when checking out a cart line whose product
+// was unpublished or left its availability window after it was added.
+var ErrItemUnavailable = errors.New("cart item no longer available")
+
+// ErrMixedCurrencies returned when checking out a cart whose lines are priced
+// in more than one currency; an order has a single currency.
+var ErrMixedCurrencies = errors.New("cart mixes currencies")
+
+// ErrCartEmpty returned when checking out (or quoting) a cart with no lines.
+var ErrCartEmpty = errors.New("cart is empty")
+
+// ErrQuantityOutOfRange returned when a cart line would exceed MaxCartLineQuantity.
+var ErrQuantityOutOfRange = errors.New("quantity out of range")
+
+// MaxCartLineQuantity is the most units of one product a cart line can hold.
+// Mirrored by the cart_items_quantity_max CHECK constraint in migrations.sql.
+const MaxCartLineQuantity = 99
+
+// helper: true if err is the DB rejecting a line over MaxCartLineQuantity
+func isQuantityCapViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23514" && pqErr.Constraint == "cart_items_quantity_max"
+}
+
+// ListLowStockProducts returns the tracked products, drafts included, with
+// threshold or fewer units in stock, emptiest first. Deleted products and
+// untracked ones (bundles among them) are left out.
+func (s *PostgresStore) ListLowStockProducts(ctx context.Context, threshold int) ([]ProductRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT id, name, description, price, stock, category, currency FROM products
+		WHERE track_inventory AND NOT is_deleted AND stock <= $1
+		ORDER BY stock, id
+	`, threshold)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// UntrackedStock is what GetStock reports for products without inventory tracking.
+const UntrackedStock = -1
+
 // UpdateStock sets the absolute stock for a product (admin operation).
-func (s *PostgresStore) UpdateStock(productID int64, newStock int) error {
+// Whatever a cart reserved or returned between the caller reading the stock
+// and this call is overwritten; use AdjustStock for restocks and corrections.
+func (s *PostgresStore) UpdateStock(ctx context.Context, productID int64, newStock int) error {
 	if newStock < 0 {
 		return errors.New("stock cannot be negative")
 	}
-	res, err := s.DB.Exec(`UPDATE products SET stock=$1 WHERE id=$2`, newStock, productID)
+	res, err := s.db(ctx).Exec(`
+		WITH old AS (SELECT stock FROM products WHERE id=$2 FOR UPDATE),
+		     moved AS (UPDATE products SET stock=$1 WHERE id=$2 AND track_inventory RETURNING id)
+		INSERT INTO stock_movements (product_id, delta, reason)
+		SELECT moved.id, $1 - old.stock, 'adjustment' FROM moved, old
+	`, newStock, productID)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		// either missing or untracked; tell the caller which
+		var tracked bool
+		if err := s.db(ctx).QueryRow(`SELECT track_inventory FROM products WHERE id=$1`, productID).Scan(&tracked); err != nil {
+			return err
+		}
+		return ErrUntrackedInventory
+	}
+	return nil
+}
+
+// AdjustStock adds delta (negative to take stock away) to a tracked
+// product's stock, recorded as an adjustment movement. Being relative it
+// can't clobber concurrent reservations. ErrInsufficientStock if stock would
+// go negative, ErrUntrackedInventory / sql.ErrNoRows as for UpdateStock.
+func (s *PostgresStore) AdjustStock(ctx context.Context, productID int64, delta int) error {
+	if delta == 0 {
+		return errors.New("stock delta cannot be zero")
+	}
+	res, err := s.db(ctx).Exec(`
+		WITH moved AS (
+			UPDATE products SET stock = stock + $1
+			WHERE id = $2 AND track_inventory AND stock + $1 >= 0
+			RETURNING id
+		)
+		INSERT INTO stock_movements (product_id, delta, reason)
+		SELECT id, $1, $3 FROM moved
+	`, delta, productID, MovementAdjustment)
+	if err != nil {
+		return err
+	}
+	if ra, _ := res.RowsAffected(); ra == 0 {
+		var tracked bool
+		var stock int
+		if err := s.db(ctx).QueryRow(`SELECT track_inventory, stock FROM products WHERE id=$1`, productID).Scan(&tracked, &stock); err != nil {
+			return err
+		}
+		if !tracked {
+			return ErrUntrackedInventory
+		}
+		return fmt.Errorf("%w: product %d has %d, can't take %d", ErrInsufficientStock, productID, stock, -delta)
+	}
+	return nil
+}
+
+// StockUpdate is one line of UpdateStockBatch: set ProductID's stock to NewStock.
+type StockUpdate struct {
+	ProductID int64
+	NewStock  int
+}
+
+// UpdateStockBatch sets the absolute stock of several products in one
+// transaction, each recorded as an adjustment movement like UpdateStock. If
+// any product is missing (sql.ErrNoRows) or untracked (ErrUntrackedInventory)
+// nothing changes, and the error lists every such id. Product rows are locked
+// in id order so concurrent batches can't deadlock.
+func (s *PostgresStore) UpdateStockBatch(ctx context.Context, updates []StockUpdate) error {
+	for _, u := range updates {
+		if u.NewStock < 0 {
+			return fmt.Errorf("product %d: stock cannot be negative", u.ProductID)
+		}
+	}
+	sorted := append([]StockUpdate(nil), updates...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ProductID < sorted[j].ProductID })
+	ids := make([]int64, 0, len(sorted))
+	for _, u := range sorted {
+		ids = append(ids, u.ProductID)
+	}
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT id, track_inventory FROM products WHERE id = ANY($1) ORDER BY id FOR UPDATE`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	tracked := make(map[int64]bool, len(ids))
+	for rows.Next() {
+		var id int64
+		var t bool
+		if err := rows.Scan(&id, &t); err != nil {
+			rows.Close()
+			return err
+		}
+		tracked[id] = t
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var missing, untracked []int64
+	for _, id := range ids {
+		t, ok := tracked[id]
+		switch {
+		case !ok:
+			missing = append(missing, id)
+		case !t:
+			untracked = append(untracked, id)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: products %v", sql.ErrNoRows, missing)
+	}
+	if len(untracked) > 0 {
+		return fmt.Errorf("%w: products %v", ErrUntrackedInventory, untracked)
+	}
+
+	for _, u := range sorted {
+		if _, err := tx.Exec(`
+			WITH old AS (SELECT stock FROM products WHERE id=$2),
+			     moved AS (UPDATE products SET stock=$1 WHERE id=$2 RETURNING id)
+			INSERT INTO stock_movements (product_id, delta, reason)
+			SELECT moved.id, $1 - old.stock, $3 FROM moved, old
+		`, u.NewStock, u.ProductID, MovementAdjustment); err != nil {
+			return fmt.Errorf("product %d: %w", u.ProductID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
+
+// SetTrackInventory turns inventory tracking on or off for a product.
+func (s *PostgresStore) SetTrackInventory(ctx context.Context, productID int64, track bool) error {
+	res, err := s.db(ctx).Exec(`UPDATE products SET track_inventory=$1 WHERE id=$2`, track, productID)
 	if err != nil {
 		return err
 	}
@@ -24,11 +237,54 @@ func (s *PostgresStore) UpdateStock(productID int64, newStock int) error {
 	return nil
 }
 
-// GetStock returns current stock for a product.
-func (s *PostgresStore) GetStock(productID int64) (int, error) {
+// SetReservationLimit sets how many units of a product one user can hold in
+// their cart; nil falls back to the store's MaxReservedPerUser.
+func (s *PostgresStore) SetReservationLimit(ctx context.Context, productID int64, limit *int) error {
+	res, err := s.db(ctx).Exec(`UPDATE products SET max_reserved_per_user=$1 WHERE id=$2`, limit, productID)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetStock returns current stock for a product, or UntrackedStock if the
+// product has inventory tracking disabled. A bundle's stock is how many whole
+// bundles its scarcest tracked component can still make.
+func (s *PostgresStore) GetStock(ctx context.Context, productID int64) (int, error) {
 	var stock int
-	if err := s.DB.QueryRow(`SELECT stock FROM products WHERE id=$1`, productID).Scan(&stock); err != nil {
+	var tracked bool
+	var bundleStock sql.NullInt64
+	if err := s.db(ctx).QueryRow(`
+		SELECT p.stock, p.track_inventory,
+		       (SELECT MIN(c.stock / bc.quantity)
+		        FROM bundle_components bc JOIN products c ON c.id = bc.component_id
+		        WHERE bc.bundle_id = p.id AND c.track_inventory)
+		FROM products p WHERE p.id=$1
+	`, productID).Scan(&stock, &tracked, &bundleStock); err != nil {
 		return 0, err
 	}
+	if bundleStock.Valid {
+		return int(bundleStock.Int64), nil
+	}
+	if !tracked {
+		return UntrackedStock, nil
+	}
 	return stock, nil
 }
+
+// SetAvailability sets a product's availability window; nil means unbounded.
+func (s *PostgresStore) SetAvailability(ctx context.Context, productID int64, from, until *time.Time) error {
+	res, err := s.db(ctx).Exec(`UPDATE products SET available_from=$1, available_until=$2 WHERE id=$3`, from, until, productID)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
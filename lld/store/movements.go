@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Reasons recorded on stock movements
+const (
+	MovementReserve    = "reserve"    // taken by a cart line
+	MovementRelease    = "release"    // given back by a removed or dropped cart line
+	MovementReturn     = "return"     // restocked by an order return
+	MovementAdjustment = "adjustment" // set by UpdateStock or AdjustStock
+	MovementCancel     = "cancel"     // given back by a cancelled order
+	MovementExpire     = "expire"     // given back by a cart line whose reservation ran out
+)
+
+// StockMovementRow is one change to a product's stock in the ledger.
+type StockMovementRow struct {
+	ID        int64
+	ProductID int64
+	Delta     int
+	Reason    string
+	CreatedAt time.Time
+}
+
+// MovementFilter narrows ListAllStockMovements; zero fields don't filter.
+type MovementFilter struct {
+	ProductID int64
+	Reason    string
+	From      time.Time // created_at >= From
+	To        time.Time // created_at < To
+}
+
+// where renders the filter as a WHERE clause and its positional args.
+func (f MovementFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.ProductID != 0 {
+		add("product_id = $%d", f.ProductID)
+	}
+	if f.Reason != "" {
+		add("reason = $%d", f.Reason)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at < $%d", f.To)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// reserveStockSQL takes $1 units of product $2 and records the movement.
+const reserveStockSQL = `
+	WITH moved AS (UPDATE products SET stock = stock - $1 WHERE id = $2 RETURNING id)
+	INSERT INTO stock_movements (product_id, delta, reason)
+	SELECT id, -$1, 'reserve' FROM moved`
+
+// releaseReservationSQL gives back $1 reserved units of product $2: to the
+// product itself if tracked and, for a bundle, to each tracked component.
+// Each change is recorded as a movement with reason $3.
+const releaseReservationSQL = `
+	WITH moved AS (
+		UPDATE products p SET stock = p.stock + $1 * r.units
+		FROM (SELECT $2::bigint AS id, 1 AS units
+		      UNION ALL
+		      SELECT component_id, quantity FROM bundle_components WHERE bundle_id = $2) r
+		WHERE p.id = r.id AND p.track_inventory
+		RETURNING p.id, $1 * r.units AS delta)
+	INSERT INTO stock_movements (product_id, delta, reason)
+	SELECT id, delta, $3 FROM moved`
+
+// ListAllStockMovements returns one page of the stock ledger across all
+// products matching filter, newest first.
+func (s *PostgresStore) ListAllStockMovements(ctx context.Context, filter MovementFilter, limit, offset int) ([]StockMovementRow, error) {
+	where, args := filter.where()
+	args = append(args, limit, offset)
+	q := `SELECT id, product_id, delta, reason, created_at FROM stock_movements` + where +
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+	rows, err := s.db(ctx).Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []StockMovementRow
+	for rows.Next() {
+		var m StockMovementRow
+		if err := rows.Scan(&m.ID, &m.ProductID, &m.Delta, &m.Reason, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// CountStockMovements returns how many ledger entries match filter.
+func (s *PostgresStore) CountStockMovements(ctx context.Context, filter MovementFilter) (int64, error) {
+	where, args := filter.where()
+	var n int64
+	err := s.db(ctx).QueryRow(`SELECT COUNT(*) FROM stock_movements`+where, args...).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,572 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"inventory-management/money"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Order statuses
+const (
+	OrderStatusPlaced    = "placed"  // a new order starts here
+	OrderStatusPending   = "pending" // ...or here, when it's paid for at checkout
+	OrderStatusPaid      = "paid"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCancelled = "cancelled"
+)
+
+// orderTransitions lists the statuses each status may move to through
+// UpdateOrderStatusBatch. Cancelling isn't a plain status change (stock has
+// to be given back), so it isn't reachable here.
+var orderTransitions = map[string][]string{
+	OrderStatusPlaced:  {OrderStatusShipped},
+	OrderStatusPaid:    {OrderStatusShipped},
+	OrderStatusShipped: {OrderStatusDelivered},
+}
+
+// ErrInvalidTransition returned when an order can't move from its current
+// status to the requested one.
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// CanTransition reports whether an order in status from may move to to.
+func CanTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderFilter narrows ListAllOrders / CountOrders; zero-valued fields are ignored.
+type OrderFilter struct {
+	Status string
+	UserID string
+	From   time.Time // created_at >= From
+	To     time.Time // created_at < To
+}
+
+// where renders the filter as a WHERE clause and its positional args.
+func (f OrderFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Status != "" {
+		add("status = $%d", f.Status)
+	}
+	if f.UserID != "" {
+		add("user_id = $%d", f.UserID)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at < $%d", f.To)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ErrReturnExceedsOrdered returned when a return would take more units back
+// than the order line contained (counting earlier returns).
+var ErrReturnExceedsOrdered = errors.New("return exceeds ordered quantity")
+
+// UpdateOrderMetadata replaces the metadata stored on an order.
+func (s *PostgresStore) UpdateOrderMetadata(ctx context.Context, orderID int64, meta map[string]string) error {
+	metaJSON, err := marshalMetadata(meta)
+	if err != nil {
+		return err
+	}
+	res, err := s.db(ctx).Exec(`UPDATE orders SET metadata=$1 WHERE id=$2`, metaJSON, orderID)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ReturnOrderItem records the return of qty units of one of the user's order
+// lines, adds the refunded amount to orders.refunded_total and, if restock is
+// set, puts the units back into products.stock. Only shipped and delivered
+// orders take returns: a cancelled one has already been restocked, and one
+// that hasn't shipped should be cancelled instead (ErrInvalidTransition).
+// Returns sql.ErrNoRows if the order has no such line and ErrNotOrderOwner if
+// it's another user's.
+func (s *PostgresStore) ReturnOrderItem(ctx context.Context, orderID int64, userID string, productID int64, qty int, restock bool) error {
+	if qty <= 0 {
+		return errors.New("quantity must be > 0")
+	}
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// lock the order so a return can't race a cancel
+	var owner, status string
+	if err := tx.QueryRow(`SELECT user_id, status FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&owner, &status); err != nil {
+		return err
+	}
+	if owner != userID {
+		return fmt.Errorf("%w: order %d", ErrNotOrderOwner, orderID)
+	}
+	if status != OrderStatusShipped && status != OrderStatusDelivered {
+		return fmt.Errorf("%w: order %d is %s, can't take returns", ErrInvalidTransition, orderID, status)
+	}
+
+	// lock the order line so concurrent returns are serialized
+	var ordered int
+	var price money.Cents
+	if err := tx.QueryRow(`SELECT quantity, price FROM order_items WHERE order_id=$1 AND product_id=$2 FOR UPDATE`, orderID, productID).Scan(&ordered, &price); err != nil {
+		return err
+	}
+
+	var returned int
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(quantity), 0) FROM order_returns WHERE order_id=$1 AND product_id=$2`, orderID, productID).Scan(&returned); err != nil {
+		return err
+	}
+	if returned+qty > ordered {
+		return ErrReturnExceedsOrdered
+	}
+
+	amount := price.Mul(qty)
+	if _, err := tx.Exec(`INSERT INTO order_returns (order_id, product_id, quantity, amount, restocked) VALUES ($1,$2,$3,$4,$5)`, orderID, productID, qty, amount, restock); err != nil {
+		return err
+	}
+	if restock {
+		if _, err := tx.Exec(releaseReservationSQL, qty, productID, MovementReturn); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE orders SET refunded_total = refunded_total + $1 WHERE id = $2`, amount, orderID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
+
+// ErrNotOrderOwner returned when a user acts on another user's order.
+var ErrNotOrderOwner = errors.New("order belongs to another user")
+
+// ErrCancelWindowClosed returned when an order is older than CancelWindow.
+var ErrCancelWindowClosed = errors.New("order can no longer be cancelled")
+
+// CancelOrder cancels one of the user's placed orders and gives back, in one
+// transaction, the stock its lines took (less units already returned to
+// stock) and its coupon use. sql.ErrNoRows for an unknown order,
+// ErrNotOrderOwner for another user's, ErrInvalidTransition unless it's
+// placed (already cancelled, pending payment, paid or shipped), and
+// ErrCancelWindowClosed once it's older than CancelWindow (0 = no limit).
+func (s *PostgresStore) CancelOrder(ctx context.Context, orderID int64, userID string) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var owner, status string
+	var recent bool
+	if err := tx.QueryRow(`
+		SELECT user_id, status, created_at > now() - make_interval(secs => $2)
+		FROM orders WHERE id = $1 FOR UPDATE
+	`, orderID, s.CancelWindow.Seconds()).Scan(&owner, &status, &recent); err != nil {
+		return err
+	}
+	if owner != userID {
+		return fmt.Errorf("%w: order %d", ErrNotOrderOwner, orderID)
+	}
+	if status != OrderStatusPlaced {
+		return fmt.Errorf("%w: order %d is %s, can't become %s", ErrInvalidTransition, orderID, status, OrderStatusCancelled)
+	}
+	if s.CancelWindow > 0 && !recent {
+		return fmt.Errorf("%w: order %d is older than %v", ErrCancelWindowClosed, orderID, s.CancelWindow)
+	}
+	if err := cancelOrderTx(tx, orderID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
+
+// cancelOrderTx marks a locked order cancelled inside tx and gives back its
+// coupon use and the units of each line not already returned to stock.
+func cancelOrderTx(tx querier, orderID int64) error {
+	if _, err := tx.Exec(`UPDATE orders SET status = $1 WHERE id = $2`, OrderStatusCancelled, orderID); err != nil {
+		return err
+	}
+	// the coupon use, if any, goes back too
+	if _, err := tx.Exec(`UPDATE coupons SET uses = uses - 1 WHERE code = (SELECT coupon_code FROM orders WHERE id = $1) AND uses > 0`, orderID); err != nil {
+		return err
+	}
+
+	// by product id, like every other stock update, to avoid deadlocks
+	rows, err := tx.Query(`
+		SELECT oi.product_id, oi.quantity - COALESCE((
+			SELECT SUM(r.quantity) FROM order_returns r
+			WHERE r.order_id = oi.order_id AND r.product_id = oi.product_id AND r.restocked), 0)
+		FROM order_items oi WHERE oi.order_id = $1 ORDER BY oi.product_id
+	`, orderID)
+	if err != nil {
+		return err
+	}
+	var items []OrderItemRow
+	for rows.Next() {
+		var it OrderItemRow
+		if err := rows.Scan(&it.ProductID, &it.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, it := range items {
+		if it.Quantity <= 0 {
+			continue
+		}
+		if _, err := tx.Exec(releaseReservationSQL, it.Quantity, it.ProductID, MovementCancel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateOrderStatus moves one order to status if its current status allows
+// it (see CanTransition). sql.ErrNoRows for an unknown order,
+// ErrInvalidTransition otherwise.
+func (s *PostgresStore) UpdateOrderStatus(ctx context.Context, orderID int64, status string) error {
+	var from []string
+	for st := range orderTransitions {
+		if CanTransition(st, status) {
+			from = append(from, st)
+		}
+	}
+	res, err := s.db(ctx).Exec(`UPDATE orders SET status = $1 WHERE id = $2 AND status = ANY($3)`,
+		status, orderID, pq.Array(from))
+	if err != nil {
+		return err
+	}
+	if ra, _ := res.RowsAffected(); ra == 0 {
+		var current string
+		if err := s.db(ctx).QueryRow(`SELECT status FROM orders WHERE id = $1`, orderID).Scan(&current); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: order %d is %s, can't become %s", ErrInvalidTransition, orderID, current, status)
+	}
+	return nil
+}
+
+// UpdateOrderStatusBatch moves the given orders to status in one transaction
+// and returns the ids it updated, ascending. An order that doesn't exist or
+// can't make the transition fails the whole batch when strict is set and is
+// skipped otherwise.
+func (s *PostgresStore) UpdateOrderStatusBatch(ctx context.Context, orderIDs []int64, status string, strict bool) ([]int64, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT id, status FROM orders WHERE id = ANY($1) ORDER BY id FOR UPDATE`, pq.Array(orderIDs))
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[int64]string, len(orderIDs))
+	for rows.Next() {
+		var id int64
+		var st string
+		if err := rows.Scan(&id, &st); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		current[id] = st
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var updated []int64
+	for _, id := range orderIDs {
+		from, ok := current[id]
+		switch {
+		case ok && CanTransition(from, status):
+			updated = append(updated, id)
+		case !strict:
+		case !ok:
+			return nil, fmt.Errorf("%w: order %d", sql.ErrNoRows, id)
+		default:
+			return nil, fmt.Errorf("%w: order %d is %s, can't become %s", ErrInvalidTransition, id, from, status)
+		}
+	}
+	sort.Slice(updated, func(i, j int) bool { return updated[i] < updated[j] })
+	if len(updated) > 0 {
+		if _, err := tx.Exec(`UPDATE orders SET status = $1 WHERE id = ANY($2)`, status, pq.Array(updated)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	rolledBack = true
+	return updated, nil
+}
+
+// ErrNoCartSnapshot returned for orders placed before cart snapshots were kept
+var ErrNoCartSnapshot = errors.New("order has no cart snapshot")
+
+// CartSnapshotLine is one cart line as it stood when the cart was checked
+// out, including lines Checkout dropped. Price is nil for unpriced products.
+type CartSnapshotLine struct {
+	ProductID int64        `json:"product_id"`
+	Quantity  int          `json:"quantity"`
+	Price     *money.Cents `json:"price"`
+	Removed   bool         `json:"removed,omitempty"`
+}
+
+// GetCartSnapshot returns the owner of an order and the cart it was placed
+// from. Fails with sql.ErrNoRows for an unknown order.
+func (s *PostgresStore) GetCartSnapshot(ctx context.Context, orderID int64) (string, []CartSnapshotLine, error) {
+	var userID string
+	var raw []byte
+	if err := s.db(ctx).QueryRow(`SELECT user_id, cart_snapshot FROM orders WHERE id = $1`, orderID).Scan(&userID, &raw); err != nil {
+		return "", nil, err
+	}
+	if raw == nil {
+		return userID, nil, fmt.Errorf("%w: order %d", ErrNoCartSnapshot, orderID)
+	}
+	var lines []CartSnapshotLine
+	if err := json.Unmarshal(raw, &lines); err != nil {
+		return userID, nil, err
+	}
+	return userID, lines, nil
+}
+
+// helper: encode metadata for the JSONB column; nil is stored as {}
+func marshalMetadata(meta map[string]string) (string, error) {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ListAllOrders returns orders across all users matching filter, newest first.
+func (s *PostgresStore) ListAllOrders(ctx context.Context, filter OrderFilter, limit, offset int) ([]OrderRow, error) {
+	where, args := filter.where()
+	args = append(args, limit, offset)
+	q := `SELECT id, user_id, total, currency, status, metadata, created_at, discount, COALESCE(coupon_code, '') FROM orders` + where +
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+	rows, err := s.db(ctx).Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanOrders(rows)
+}
+
+// ListOrders returns a user's orders, newest first, without their lines.
+func (s *PostgresStore) ListOrders(ctx context.Context, userID string) ([]OrderRow, error) {
+	rows, err := s.db(ctx).Query(`SELECT id, user_id, total, currency, status, metadata, created_at, discount, COALESCE(coupon_code, '') FROM orders
+		WHERE user_id = $1 ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanOrders(rows)
+}
+
+// scanOrders reads and closes rows of id, user_id, total, currency, status,
+// metadata, created_at, discount, coupon_code.
+func scanOrders(rows *sql.Rows) ([]OrderRow, error) {
+	defer rows.Close()
+	var out []OrderRow
+	for rows.Next() {
+		var o OrderRow
+		var metaJSON []byte
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Total, &o.Currency, &o.Status, &metaJSON, &o.CreatedAt, &o.Discount, &o.CouponCode); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metaJSON, &o.Metadata); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// GetOrder returns an order and its lines. sql.ErrNoRows if it doesn't exist.
+func (s *PostgresStore) GetOrder(ctx context.Context, orderID int64) (OrderRow, []OrderItemRow, error) {
+	var o OrderRow
+	var metaJSON []byte
+	if err := s.db(ctx).QueryRow(`SELECT id, user_id, total, currency, status, metadata, created_at, discount, COALESCE(coupon_code, '') FROM orders WHERE id = $1`, orderID).
+		Scan(&o.ID, &o.UserID, &o.Total, &o.Currency, &o.Status, &metaJSON, &o.CreatedAt, &o.Discount, &o.CouponCode); err != nil {
+		return o, nil, err
+	}
+	if err := json.Unmarshal(metaJSON, &o.Metadata); err != nil {
+		return o, nil, err
+	}
+	items, err := s.ListOrderItems(ctx, orderID)
+	return o, items, err
+}
+
+// ListOrderItems returns an order's lines by product id, each with its
+// product's name (soft-deleted products still have one); none for an unknown
+// order.
+func (s *PostgresStore) ListOrderItems(ctx context.Context, orderID int64) ([]OrderItemRow, error) {
+	return listOrderItems(s.db(ctx), orderID)
+}
+
+func listOrderItems(q querier, orderID int64) ([]OrderItemRow, error) {
+	rows, err := q.Query(`
+		SELECT oi.product_id, oi.quantity, oi.price, COALESCE(p.name, '')
+		FROM order_items oi LEFT JOIN products p ON p.id = oi.product_id
+		WHERE oi.order_id = $1 ORDER BY oi.product_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []OrderItemRow
+	for rows.Next() {
+		var it OrderItemRow
+		if err := rows.Scan(&it.ProductID, &it.Quantity, &it.Price, &it.Name); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// CountOrders returns how many orders match filter.
+func (s *PostgresStore) CountOrders(ctx context.Context, filter OrderFilter) (int64, error) {
+	where, args := filter.where()
+	var n int64
+	err := s.db(ctx).QueryRow(`SELECT COUNT(*) FROM orders`+where, args...).Scan(&n)
+	return n, err
+}
+
+// ProductOrderRow is an order that contains a given product, with that
+// product's line.
+type ProductOrderRow struct {
+	OrderRow
+	Quantity int
+	Price    money.Cents
+}
+
+// productOrdersWhere renders the conditions shared by OrdersContainingProduct
+// and CountOrdersContainingProduct; zero times don't filter.
+func productOrdersWhere(productID int64, from, to time.Time) (string, []interface{}) {
+	where := " WHERE oi.product_id = $1"
+	args := []interface{}{productID}
+	if !from.IsZero() {
+		args = append(args, from)
+		where += fmt.Sprintf(" AND o.created_at >= $%d", len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		where += fmt.Sprintf(" AND o.created_at < $%d", len(args))
+	}
+	return where, args
+}
+
+// OrdersContainingProduct returns the orders with a line for productID placed
+// in [from, to), newest first, with that line's quantity and price.
+func (s *PostgresStore) OrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time, limit, offset int) ([]ProductOrderRow, error) {
+	where, args := productOrdersWhere(productID, from, to)
+	args = append(args, limit, offset)
+	q := `SELECT o.id, o.user_id, o.total, o.currency, o.status, o.metadata, o.created_at, oi.quantity, oi.price
+		FROM orders o JOIN order_items oi ON oi.order_id = o.id` + where +
+		fmt.Sprintf(` ORDER BY o.created_at DESC, o.id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+	rows, err := s.db(ctx).Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ProductOrderRow
+	for rows.Next() {
+		var o ProductOrderRow
+		var metaJSON []byte
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Total, &o.Currency, &o.Status, &metaJSON, &o.CreatedAt, &o.Quantity, &o.Price); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metaJSON, &o.Metadata); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// CountOrdersContainingProduct counts what OrdersContainingProduct pages over.
+func (s *PostgresStore) CountOrdersContainingProduct(ctx context.Context, productID int64, from, to time.Time) (int64, error) {
+	where, args := productOrdersWhere(productID, from, to)
+	var n int64
+	err := s.db(ctx).QueryRow(`SELECT COUNT(*) FROM orders o JOIN order_items oi ON oi.order_id = o.id`+where, args...).Scan(&n)
+	return n, err
+}
+
+// SalesVelocity returns the average units of a product sold per day over the
+// last window, counting every order that wasn't cancelled. 0 if none sold.
+func (s *PostgresStore) SalesVelocity(ctx context.Context, productID int64, window time.Duration) (float64, error) {
+	days := window.Hours() / 24
+	if days <= 0 {
+		return 0, errors.New("window must be positive")
+	}
+	var units int64
+	if err := s.db(ctx).QueryRow(`
+		SELECT COALESCE(SUM(oi.quantity), 0)
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id
+		WHERE oi.product_id = $1 AND o.status <> $2
+		  AND o.created_at >= now() - make_interval(secs => $3)
+	`, productID, OrderStatusCancelled, window.Seconds()).Scan(&units); err != nil {
+		return 0, err
+	}
+	return float64(units) / days, nil
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Outbox event statuses
+const (
+	OutboxPending   = "pending"
+	OutboxPublished = "published"
+	OutboxFailed    = "failed"
+)
+
+// OutboxRow is an event waiting for (or done with) delivery by the publisher
+type OutboxRow struct {
+	ID          int64
+	EventType   string
+	Payload     []byte
+	Status      string
+	Attempts    int
+	LastError   sql.NullString
+	CreatedAt   time.Time
+	PublishedAt sql.NullTime
+}
+
+const outboxColumns = `id, event_type, payload, status, attempts, last_error, created_at, published_at`
+
+// GetOutboxEvent returns one outbox event by id
+func (s *PostgresStore) GetOutboxEvent(ctx context.Context, id int64) (OutboxRow, error) {
+	var e OutboxRow
+	err := s.db(ctx).QueryRow(`SELECT `+outboxColumns+` FROM outbox_events WHERE id=$1`, id).
+		Scan(&e.ID, &e.EventType, &e.Payload, &e.Status, &e.Attempts, &e.LastError, &e.CreatedAt, &e.PublishedAt)
+	return e, err
+}
+
+// ListOutboxEvents returns events with the given status, oldest first
+func (s *PostgresStore) ListOutboxEvents(ctx context.Context, status string) ([]OutboxRow, error) {
+	rows, err := s.db(ctx).Query(`SELECT `+outboxColumns+` FROM outbox_events WHERE status=$1 ORDER BY id`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []OutboxRow{}
+	for rows.Next() {
+		var e OutboxRow
+		if err := rows.Scan(&e.ID, &e.EventType, &e.Payload, &e.Status, &e.Attempts, &e.LastError, &e.CreatedAt, &e.PublishedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// MarkOutboxUnpublished resets an event to pending with a fresh attempt
+// budget so the publisher picks it up again.
+func (s *PostgresStore) MarkOutboxUnpublished(ctx context.Context, id int64) error {
+	res, err := s.db(ctx).Exec(`UPDATE outbox_events SET status=$1, attempts=0, last_error=NULL, published_at=NULL WHERE id=$2`, OutboxPending, id)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// EnqueueOutboxEvent adds a pending event and returns its id
+func (s *PostgresStore) EnqueueOutboxEvent(ctx context.Context, eventType string, payload []byte) (int64, error) {
+	var id int64
+	err := s.db(ctx).QueryRow(`INSERT INTO outbox_events (event_type, payload) VALUES ($1, $2) RETURNING id`, eventType, string(payload)).Scan(&id)
+	return id, err
+}
+
+// MarkOutboxPublished records a successful delivery attempt.
+func (s *PostgresStore) MarkOutboxPublished(ctx context.Context, id int64) error {
+	res, err := s.db(ctx).Exec(`UPDATE outbox_events SET status=$1, attempts=attempts+1, last_error=NULL, published_at=now() WHERE id=$2`, OutboxPublished, id)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// MarkOutboxAttemptFailed records a failed delivery attempt. The event stays
+// pending until it has had maxAttempts, then it's failed (and can be replayed
+// by an admin).
+func (s *PostgresStore) MarkOutboxAttemptFailed(ctx context.Context, id int64, lastErr string, maxAttempts int) error {
+	res, err := s.db(ctx).Exec(`
+		UPDATE outbox_events
+		SET attempts = attempts + 1, last_error = $1,
+		    status = CASE WHEN attempts + 1 >= $2 THEN $3 ELSE status END
+		WHERE id = $4
+	`, lastErr, maxAttempts, OutboxFailed, id)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// MarkOrderPaid settles a pending order as paid, storing the payment
+// gateway's charge id. sql.ErrNoRows for an unknown order,
+// ErrInvalidTransition if it isn't pending.
+func (s *PostgresStore) MarkOrderPaid(ctx context.Context, orderID int64, chargeID string) error {
+	res, err := s.db(ctx).Exec(`UPDATE orders SET status = $1, charge_id = $2 WHERE id = $3 AND status = $4`,
+		OrderStatusPaid, chargeID, orderID, OrderStatusPending)
+	if err != nil {
+		return err
+	}
+	if ra, _ := res.RowsAffected(); ra == 0 {
+		var status string
+		if err := s.db(ctx).QueryRow(`SELECT status FROM orders WHERE id = $1`, orderID).Scan(&status); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: order %d is %s, can't become %s", ErrInvalidTransition, orderID, status, OrderStatusPaid)
+	}
+	return nil
+}
+
+// CancelPendingOrder cancels a pending order whose payment failed and gives
+// back the stock its lines took and its coupon use, in one transaction. sql.ErrNoRows for an
+// unknown order, ErrInvalidTransition if it isn't pending.
+func (s *PostgresStore) CancelPendingOrder(ctx context.Context, orderID int64) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var status string
+	if err := tx.QueryRow(`SELECT status FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&status); err != nil {
+		return err
+	}
+	if status != OrderStatusPending {
+		return fmt.Errorf("%w: order %d is %s, can't become %s", ErrInvalidTransition, orderID, status, OrderStatusCancelled)
+	}
+	if err := cancelOrderTx(tx, orderID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolledBack = true
+	return nil
+}
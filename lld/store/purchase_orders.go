@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CreatePurchaseOrder records qty units of a product expected to arrive at
+// expectedAt. sql.ErrNoRows if the product doesn't exist.
+func (s *PostgresStore) CreatePurchaseOrder(ctx context.Context, productID int64, qty int, expectedAt time.Time) (int64, error) {
+	var id int64
+	err := s.db(ctx).QueryRow(
+		`INSERT INTO purchase_orders (product_id, quantity, expected_at) VALUES ($1, $2, $3) RETURNING id`,
+		productID, qty, expectedAt,
+	).Scan(&id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+		return 0, sql.ErrNoRows
+	}
+	return id, err
+}
+
+// GetInboundETA returns when the next purchase order for a product is due,
+// or nil if none is expected.
+func (s *PostgresStore) GetInboundETA(ctx context.Context, productID int64) (*time.Time, error) {
+	var eta sql.NullTime
+	if err := s.db(ctx).QueryRow(
+		`SELECT MIN(expected_at) FROM purchase_orders WHERE product_id=$1 AND expected_at > now()`,
+		productID,
+	).Scan(&eta); err != nil {
+		return nil, err
+	}
+	if !eta.Valid {
+		return nil, nil
+	}
+	return &eta.Time, nil
+}
+
+// ListInboundETAs is GetInboundETA for many products at once; products with
+// nothing inbound are omitted.
+func (s *PostgresStore) ListInboundETAs(ctx context.Context, productIDs []int64) (map[int64]time.Time, error) {
+	out := map[int64]time.Time{}
+	if len(productIDs) == 0 {
+		return out, nil
+	}
+	rows, err := s.db(ctx).Query(`
+		SELECT product_id, MIN(expected_at) FROM purchase_orders
+		WHERE product_id = ANY($1) AND expected_at > now()
+		GROUP BY product_id
+	`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var eta time.Time
+		if err := rows.Scan(&id, &eta); err != nil {
+			return nil, err
+		}
+		out[id] = eta
+	}
+	return out, rows.Err()
+}
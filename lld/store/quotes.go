@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"inventory-management/money"
+	"time"
+)
+
+// QuoteHoldLine is a cart line as quoted: its quantity and the price the
+// quote promised.
+type QuoteHoldLine struct {
+	ProductID int64       `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	Price     money.Cents `json:"price"`
+}
+
+// QuoteHold is a user's quoted cart, honoured by Checkout until ExpiresAt.
+// A user has at most one; quoting again replaces it.
+type QuoteHold struct {
+	UserID    string
+	Lines     []QuoteHoldLine
+	ExpiresAt time.Time
+}
+
+// PutQuoteHold stores (or replaces) the user's quote hold.
+func (s *PostgresStore) PutQuoteHold(ctx context.Context, h QuoteHold) error {
+	lines, err := json.Marshal(h.Lines)
+	if err != nil {
+		return err
+	}
+	_, err = s.db(ctx).Exec(`
+		INSERT INTO quote_holds (user_id, lines, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET lines = EXCLUDED.lines, expires_at = EXCLUDED.expires_at
+	`, h.UserID, string(lines), h.ExpiresAt)
+	return err
+}
+
+// GetQuoteHold returns the user's quote hold, expired or not, or
+// sql.ErrNoRows if there is none.
+func (s *PostgresStore) GetQuoteHold(ctx context.Context, userID string) (QuoteHold, error) {
+	h := QuoteHold{UserID: userID}
+	var raw []byte
+	if err := s.db(ctx).QueryRow(`SELECT lines, expires_at FROM quote_holds WHERE user_id = $1`, userID).Scan(&raw, &h.ExpiresAt); err != nil {
+		return h, err
+	}
+	if err := json.Unmarshal(raw, &h.Lines); err != nil {
+		return h, err
+	}
+	return h, nil
+}
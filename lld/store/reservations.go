@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// reservedUntil is when a cart line added or grown now stops holding its
+// stock; null (never) if reservations don't expire.
+func (s *PostgresStore) reservedUntil() sql.NullTime {
+	if s.ReservationTTL <= 0 {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: time.Now().Add(s.ReservationTTL), Valid: true}
+}
+
+// ReleaseExpiredReservations drops every cart line whose reservation ran out
+// at or before now and gives its stock back (recorded as expire movements),
+// in one transaction. It returns how many lines it dropped.
+func (s *PostgresStore) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`
+		DELETE FROM cart_items WHERE reserved_until <= $1
+		RETURNING product_id, quantity
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+	var expired []CartRow
+	for rows.Next() {
+		var c CartRow
+		if err := rows.Scan(&c.ProductID, &c.Quantity); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// by product id, like every other stock update, to avoid deadlocks
+	sort.SliceStable(expired, func(i, j int) bool { return expired[i].ProductID < expired[j].ProductID })
+	for _, c := range expired {
+		if _, err := tx.Exec(releaseReservationSQL, c.Quantity, c.ProductID, MovementExpire); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	rolledBack = true
+	return len(expired), nil
+}
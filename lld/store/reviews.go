@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type ReviewRow struct {
+	ID        int64
+	ProductID int64
+	UserID    string
+	Rating    int
+	Body      string
+	CreatedAt time.Time
+}
+
+// Review sort orders accepted by ListReviews
+const (
+	ReviewSortNewest  = "newest"
+	ReviewSortHighest = "highest"
+	ReviewSortLowest  = "lowest"
+)
+
+// reviewOrderBy maps a review sort to its ORDER BY; ties fall back to newest.
+var reviewOrderBy = map[string]string{
+	ReviewSortNewest:  "created_at DESC, id DESC",
+	ReviewSortHighest: "rating DESC, created_at DESC, id DESC",
+	ReviewSortLowest:  "rating ASC, created_at DESC, id DESC",
+}
+
+// ReviewQuery selects one page of a product's reviews. An empty Sort means
+// newest first; MinRating 0 matches every review.
+type ReviewQuery struct {
+	Sort      string
+	MinRating int
+	Limit     int
+	Offset    int
+}
+
+// ListReviews returns one page of a product's reviews with at least
+// q.MinRating stars, in q.Sort order.
+func (s *PostgresStore) ListReviews(ctx context.Context, productID int64, q ReviewQuery) ([]ReviewRow, error) {
+	sort := q.Sort
+	if sort == "" {
+		sort = ReviewSortNewest
+	}
+	orderBy, ok := reviewOrderBy[sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown review sort %q", q.Sort)
+	}
+	rows, err := s.db(ctx).Query(`
+		SELECT id, product_id, user_id, rating, body, created_at
+		FROM reviews
+		WHERE product_id = $1 AND rating >= $2
+		ORDER BY `+orderBy+`
+		LIMIT $3 OFFSET $4
+	`, productID, q.MinRating, q.Limit, q.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ReviewRow
+	for rows.Next() {
+		var rv ReviewRow
+		if err := rows.Scan(&rv.ID, &rv.ProductID, &rv.UserID, &rv.Rating, &rv.Body, &rv.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rv)
+	}
+	return out, rows.Err()
+}
+
+// CountReviews returns how many of a product's reviews have at least
+// minRating stars.
+func (s *PostgresStore) CountReviews(ctx context.Context, productID int64, minRating int) (int64, error) {
+	var n int64
+	err := s.db(ctx).QueryRow(`SELECT COUNT(*) FROM reviews WHERE product_id = $1 AND rating >= $2`, productID, minRating).Scan(&n)
+	return n, err
+}
+
+// ReviewDistribution returns the number of reviews per star rating for a
+// product. Ratings nobody gave are absent.
+func (s *PostgresStore) ReviewDistribution(ctx context.Context, productID int64) (map[int]int64, error) {
+	rows, err := s.db(ctx).Query(`SELECT rating, COUNT(*) FROM reviews WHERE product_id = $1 GROUP BY rating`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]int64)
+	for rows.Next() {
+		var rating int
+		var n int64
+		if err := rows.Scan(&rating, &n); err != nil {
+			return nil, err
+		}
+		out[rating] = n
+	}
+	return out, rows.Err()
+}
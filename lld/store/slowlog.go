@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// querier is what the store runs statements through: s.db(ctx), a *storeTx,
+// each bound to the context of the call.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// conn is what *sql.DB and *sql.Tx have in common that timedQuerier runs
+// statements through.
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// timedQuerier runs statements through q under ctx and logs any that take
+// longer than threshold (zero disables it). Only the SQL text is logged,
+// never the args.
+type timedQuerier struct {
+	ctx       context.Context
+	q         conn
+	threshold time.Duration
+	logger    *log.Logger
+}
+
+func (t timedQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer t.observe(query, len(args), time.Now())
+	return t.q.ExecContext(t.ctx, query, args...)
+}
+
+func (t timedQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer t.observe(query, len(args), time.Now())
+	return t.q.QueryContext(t.ctx, query, args...)
+}
+
+func (t timedQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer t.observe(query, len(args), time.Now())
+	return t.q.QueryRowContext(t.ctx, query, args...)
+}
+
+func (t timedQuerier) observe(query string, nargs int, start time.Time) {
+	if t.threshold <= 0 {
+		return
+	}
+	if took := time.Since(start); took > t.threshold {
+		t.logger.Printf("WARN slow query: duration=%s threshold=%s args=%d sql=%s",
+			took, t.threshold, nargs, strings.Join(strings.Fields(query), " "))
+	}
+}
+
+// storeTx is a *sql.Tx whose Exec / Query / QueryRow go through the store's
+// slow-query logging.
+type storeTx struct {
+	*sql.Tx
+	timed timedQuerier
+}
+
+func (t *storeTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.timed.Exec(query, args...)
+}
+
+func (t *storeTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.timed.Query(query, args...)
+}
+
+func (t *storeTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.timed.QueryRow(query, args...)
+}
+
+func (s *PostgresStore) timed(ctx context.Context, q conn) timedQuerier {
+	logger := s.SlowQueryLogger
+	if logger == nil {
+		logger = log.Default()
+	}
+	return timedQuerier{ctx: ctx, q: q, threshold: s.SlowQueryThreshold, logger: logger}
+}
+
+// db is s.DB with slow-query logging, running statements under ctx
+func (s *PostgresStore) db(ctx context.Context) timedQuerier { return s.timed(ctx, s.DB) }
+
+// begin starts a transaction under ctx with slow-query logging; it's rolled
+// back if ctx is done before Commit
+func (s *PostgresStore) begin(ctx context.Context) (*storeTx, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &storeTx{Tx: tx, timed: s.timed(ctx, tx)}, nil
+}
@@ -1,12 +1,19 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"inventory-management/money"
+	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // ProductRow, CartRow, OrderRow etc are simple structs representing DB rows
@@ -14,8 +21,14 @@ type ProductRow struct {
 	ID          int64
 	Name        string
 	Description sql.NullString
-	Price       float64
+	Price       money.NullCents // NULL = "call for price"
 	Stock       int
+	Category    sql.NullString // NULL = uncategorised
+	Currency    string         // ISO 4217 code Price is in
+	Version     int            // bumped by every UpdateProduct; only read by GetProduct
+	CreatedAt   time.Time      // only read by GetProduct, ListProducts and ListProductsPage
+	UpdatedAt   time.Time      // as CreatedAt; moves with Version, not with Stock
+	Deleted     bool           // only read by ListAllProducts
 }
 
 type CartRow struct {
@@ -23,35 +36,138 @@ type CartRow struct {
 	Quantity  int
 }
 
+// CartStockRow is a cart line joined with the product's live stock.
+// Tracked is false for products without inventory tracking.
+type CartStockRow struct {
+	ProductID int64
+	Quantity  int
+	Stock     int
+	Tracked   bool
+}
+
+// CartLineContext is a cart line with everything the service needs to price
+// and validate it. Deleted is set when the product has been deleted (the
+// other product fields are then zero). Unavailable is set outside the
+// product's availability window, ReservationExpired once the line's
+// reserved_until has passed but the sweeper hasn't released it yet.
+type CartLineContext struct {
+	ProductID          int64
+	Quantity           int
+	Name               string
+	Price              money.NullCents
+	Stock              int
+	Currency           string
+	Tracked            bool
+	Published          bool
+	Deleted            bool
+	Unavailable        bool
+	ReservationExpired bool
+}
+
+// CartWeightRow is a cart line with its product's shipping weight;
+// WeightGrams is NULL for products without a weight.
+type CartWeightRow struct {
+	ProductID   int64
+	Quantity    int
+	WeightGrams sql.NullInt64
+}
+
+// CartDetailRow is a cart line with its product; Product is nil when the
+// product row no longer exists.
+type CartDetailRow struct {
+	ProductID int64
+	Quantity  int
+	Product   *ProductRow
+}
+
 type OrderRow struct {
 	ID        int64
 	UserID    string
-	Total     float64
+	Total     money.Cents
+	Currency  string // ISO 4217 code of Total and the line prices
+	Status    string
+	Metadata  map[string]string
 	CreatedAt time.Time
+	// Discount is what CouponCode took off Total; zero and empty without a
+	// coupon
+	Discount   money.Cents
+	CouponCode string
 }
 
 type OrderItemRow struct {
 	ProductID int64
 	Quantity  int
-	Price     float64
+	Price     money.Cents
+	Name      string // the product's name, deleted or not; set by ListOrderItems
 }
 
-// PostgresStore is a Store backed by Postgres and has in-process locks
+// PostgresStore is a Store backed by Postgres and has in-process locks.
+//
+// Stock is reserved when it goes into a cart: AddToCart (and growing a line
+// with UpdateCartQuantity) takes the units off products.stock, and removing,
+// shrinking, clearing or expiring a line gives them back. Checkout turns the
+// reserved lines into an order without touching products.stock again, other
+// than to give back lines it drops; cancelling an order (or a restocking
+// return) puts them back.
 type PostgresStore struct {
 	DB *sql.DB
 
+	// SlowQueryThreshold, when > 0, logs (to SlowQueryLogger, or the
+	// default logger if nil) every statement that takes longer than it.
+	SlowQueryThreshold time.Duration
+	SlowQueryLogger    *log.Logger
+
+	// MaxReservedPerUser caps how many units of one product a user can hold
+	// in their cart, for products without a reservation limit of their own
+	// (0 = only MaxCartLineQuantity).
+	MaxReservedPerUser int
+
+	// ReservationTTL is how long a cart line holds its stock after it was
+	// last added to; ReleaseExpiredReservations gives back what has run out
+	// (0 = reservations never expire).
+	ReservationTTL time.Duration
+
+	// CancelWindow is how long after it was placed a user may cancel an
+	// order with CancelOrder (0 = any time until it ships).
+	CancelWindow time.Duration
+
 	// per-user mutexes to avoid concurrent goroutines in this process
-	// racing on the same cart. Keys are user_id -> *sync.Mutex
-	locks sync.Map // map[string]*sync.Mutex
+	// racing on the same cart. An entry only lives while some goroutine
+	// holds or waits on it, so the map doesn't grow with every user seen.
+	locksMu sync.Mutex
+	locks   map[string]*userLock
 
 	// (optional) you could add productLocks sync.Map if you want per-product in-process locking
 }
 
-func NewPostgresStore(dsn string) (*PostgresStore, error) {
+// PoolConfig sizes the database connection pool. Every replica opens up to
+// MaxOpenConns, so replicas × MaxOpenConns has to stay under the server's
+// max_connections. The per-user locks are taken before a transaction begins,
+// so requests queued behind one user's lock don't hold a connection, and
+// each user ties up at most one; across replicas those locks don't
+// coordinate at all and the row locks in the transactions do the work.
+type PoolConfig struct {
+	MaxOpenConns    int           // 0 = unlimited
+	MaxIdleConns    int           // 0 = keep none idle
+	ConnMaxLifetime time.Duration // 0 = reuse forever
+}
+
+// DefaultPoolConfig is the pool used unless configured otherwise.
+var DefaultPoolConfig = PoolConfig{MaxOpenConns: 25, MaxIdleConns: 5, ConnMaxLifetime: 5 * time.Minute}
+
+// Apply sets c's limits on db.
+func (c PoolConfig) Apply(db *sql.DB) {
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+}
+
+func NewPostgresStore(dsn string, pool PoolConfig) (*PostgresStore, error) {
 	DB, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
+	pool.Apply(DB)
 	if err := DB.Ping(); err != nil {
 		return nil, err
 	}
@@ -60,35 +176,365 @@ func NewPostgresStore(dsn string) (*PostgresStore, error) {
 
 func (s *PostgresStore) Close() error { return s.DB.Close() }
 
+// Ping checks that the database is reachable.
+func (s *PostgresStore) Ping(ctx context.Context) error { return s.DB.PingContext(ctx) }
+
+// userLock is a per-user mutex and the number of goroutines holding or
+// waiting on it.
+type userLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
 // helper: acquire per-user lock (process-local). Returns unlock func.
 func (s *PostgresStore) lockForUser(userID string) func() {
-	// fast path Load
-	if v, ok := s.locks.Load(userID); ok {
-		m := v.(*sync.Mutex)
-		m.Lock()
-		return func() { m.Unlock() }
+	s.locksMu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*userLock)
 	}
+	l, ok := s.locks[userID]
+	if !ok {
+		l = &userLock{}
+		s.locks[userID] = l
+	}
+	l.refs++
+	s.locksMu.Unlock()
 
-	// Otherwise create and store a new mutex (race-safe via LoadOrStore)
-	m := &sync.Mutex{}
-	actual, _ := s.locks.LoadOrStore(userID, m)
-	mtx := actual.(*sync.Mutex)
-	mtx.Lock()
-	return func() { mtx.Unlock() }
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, userID)
+		}
+		s.locksMu.Unlock()
+	}
 }
 
-// CreateProduct inserts a product and returns its id
-func (s *PostgresStore) CreateProduct(name, desc string, price float64) (int64, error) {
+// CreateProduct inserts a product priced in currency and returns its id
+func (s *PostgresStore) CreateProduct(ctx context.Context, name, desc string, price money.Cents, category, currency string) (int64, error) {
 	var id int64
-	err := s.DB.QueryRow(
-		`INSERT INTO products (name, description, price) VALUES ($1, $2, $3) RETURNING id`,
-		name, desc, price,
+	err := s.db(ctx).QueryRow(
+		`INSERT INTO products (name, description, price, category, currency) VALUES ($1, $2, $3, NULLIF($4, ''), $5) RETURNING id`,
+		name, desc, price, category, currency,
 	).Scan(&id)
 	return id, err
 }
 
-func (s *PostgresStore) ListProducts() ([]ProductRow, error) {
-	rows, err := s.DB.Query(`SELECT id, name, description, price, stock FROM products ORDER BY id`)
+// CreateProductsBatch inserts products (name, description, price, category
+// and currency; empty description and category for none) with one multi-row
+// INSERT in a transaction and returns their new ids, in order. Either all of
+// them are created or none.
+func (s *PostgresStore) CreateProductsBatch(ctx context.Context, products []ProductRow) ([]int64, error) {
+	if len(products) == 0 {
+		return []int64{}, nil
+	}
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var q strings.Builder
+	q.WriteString(`INSERT INTO products (name, description, price, category, currency) VALUES `)
+	args := make([]interface{}, 0, 5*len(products))
+	for i, p := range products {
+		if i > 0 {
+			q.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&q, "($%d, $%d, $%d, NULLIF($%d, ''), $%d)", n+1, n+2, n+3, n+4, n+5)
+		args = append(args, p.Name, p.Description.String, p.Price, p.Category.String, p.Currency)
+	}
+	q.WriteString(` RETURNING id`)
+	rows, err := tx.Query(q.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(products))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	rolledBack = true
+	return ids, nil
+}
+
+// GetProduct returns a published product; sql.ErrNoRows if it doesn't exist
+// or is a draft
+func (s *PostgresStore) GetProduct(ctx context.Context, id int64) (ProductRow, error) {
+	var p ProductRow
+	err := s.db(ctx).QueryRow(`SELECT id, name, description, price, stock, category, currency, version, created_at, updated_at FROM products WHERE id = $1 AND published AND NOT is_deleted`, id).
+		Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Category, &p.Currency, &p.Version, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+// ErrVersionConflict returned by UpdateProduct when the product was changed
+// since the caller read the version it passed.
+var ErrVersionConflict = errors.New("product was changed by someone else")
+
+// UpdateProduct replaces a product's name, description, price, category
+// (empty for none) and currency, bumps its version and stamps updated_at,
+// provided it is still
+// at version; ErrVersionConflict if it isn't, sql.ErrNoRows if it doesn't
+// exist. Carts keep only quantities, so lines already in carts are priced at
+// the new price from then on.
+func (s *PostgresStore) UpdateProduct(ctx context.Context, id int64, name, desc string, price money.Cents, category, currency string, version int) error {
+	res, err := s.db(ctx).Exec(`UPDATE products SET name=$1, description=$2, price=$3, category=NULLIF($4, ''), currency=$5, version=version+1, updated_at=now() WHERE id=$6 AND version=$7`,
+		name, desc, price, category, currency, id, version)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra > 0 {
+		return nil
+	}
+	var current int
+	if err := s.db(ctx).QueryRow(`SELECT version FROM products WHERE id = $1`, id).Scan(&current); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: product %d is at version %d, not %d", ErrVersionConflict, id, current, version)
+}
+
+// CloneProduct copies a product and its tags into a new draft (unpublished,
+// zero stock, name suffixed " (copy)"). sql.ErrNoRows if id doesn't exist.
+func (s *PostgresStore) CloneProduct(ctx context.Context, id int64) (int64, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var newID int64
+	if err := tx.QueryRow(`
+		INSERT INTO products (name, description, price, stock, published, track_inventory, weight_grams, category, currency)
+		SELECT name || ' (copy)', description, price, 0, false, track_inventory, weight_grams, category, currency
+		FROM products WHERE id = $1
+		RETURNING id
+	`, id).Scan(&newID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO product_tags (product_id, tag) SELECT $1, tag FROM product_tags WHERE product_id = $2`, newID, id); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	rolledBack = true
+	return newID, nil
+}
+
+// ListProducts returns published products in sort order (by id when
+// empty); drafts are left out
+func (s *PostgresStore) ListProducts(ctx context.Context, sort string) ([]ProductRow, error) {
+	orderBy, err := productOrder(sort)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db(ctx).Query(`SELECT id, name, description, price, stock, category, currency, created_at, updated_at FROM products WHERE published AND NOT is_deleted ORDER BY ` + orderBy)
+	if err != nil {
+		return nil, err
+	}
+	return scanStampedProducts(rows)
+}
+
+// ListProductsByCategory returns the published products in category, by id
+func (s *PostgresStore) ListProductsByCategory(ctx context.Context, category string) ([]ProductRow, error) {
+	rows, err := s.db(ctx).Query(`SELECT id, name, description, price, stock, category, currency FROM products WHERE published AND category = $1 ORDER BY id`, category)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// ErrProductInCarts returned by a strict DeleteProduct of a product that is
+// still in someone's cart.
+var ErrProductInCarts = errors.New("product is in open carts")
+
+// DeleteProduct soft-deletes a product and removes every cart line holding
+// it, in one transaction, and returns how many carts lost a line. Their
+// reserved units go back to its stock (and a bundle's components'), so a
+// restored product isn't short what carts were holding. The row stays (is_deleted, and
+// unpublished so no storefront query sees it) for the orders and returns that
+// point at it; RestoreProduct brings it back. Deleting a product that doesn't
+// exist or is already deleted is a no-op (0, nil). With strict, either is
+// sql.ErrNoRows and a product still in a cart fails with ErrProductInCarts
+// instead of being cleaned out.
+func (s *PostgresStore) DeleteProduct(ctx context.Context, id int64, strict bool) (int, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if strict {
+		var inCarts bool
+		if err := tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM cart_items WHERE product_id = p.id)
+			FROM products p WHERE p.id = $1 AND NOT p.is_deleted FOR UPDATE
+		`, id).Scan(&inCarts); err != nil {
+			return 0, err
+		}
+		if inCarts {
+			return 0, fmt.Errorf("%w: product %d", ErrProductInCarts, id)
+		}
+	}
+
+	// a cart holds at most one line per product, so lines == carts
+	rows, err := tx.Query(`DELETE FROM cart_items WHERE product_id = $1 RETURNING quantity`, id)
+	if err != nil {
+		return 0, err
+	}
+	carts, units := 0, 0
+	for rows.Next() {
+		var qty int
+		if err := rows.Scan(&qty); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		carts++
+		units += qty
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if units > 0 {
+		if _, err := tx.Exec(releaseReservationSQL, units, id, MovementRelease); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE products SET is_deleted = true, published = false WHERE id = $1`, id); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	rolledBack = true
+	return carts, nil
+}
+
+// RestoreProduct undeletes a soft-deleted product. It comes back as a draft,
+// to be published again once checked; restoring a product that isn't
+// deleted changes nothing. sql.ErrNoRows if it doesn't exist.
+func (s *PostgresStore) RestoreProduct(ctx context.Context, id int64) error {
+	res, err := s.db(ctx).Exec(`UPDATE products SET is_deleted = false WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetPublished publishes or unpublishes a product; sql.ErrNoRows if missing or deleted
+func (s *PostgresStore) SetPublished(ctx context.Context, id int64, published bool) error {
+	res, err := s.db(ctx).Exec(`UPDATE products SET published=$1 WHERE id=$2 AND NOT is_deleted`, published, id)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PublishProducts publishes the given drafts in one transaction and returns
+// the ids it flipped, ascending; products already published are skipped. An
+// id that doesn't exist fails the whole batch with sql.ErrNoRows.
+func (s *PostgresStore) PublishProducts(ctx context.Context, ids []int64) ([]int64, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT id, published FROM products WHERE id = ANY($1) AND NOT is_deleted ORDER BY id FOR UPDATE`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	published := make(map[int64]bool, len(ids))
+	for rows.Next() {
+		var id int64
+		var p bool
+		if err := rows.Scan(&id, &p); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		published[id] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var drafts []int64
+	for _, id := range ids {
+		p, ok := published[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: product %d", sql.ErrNoRows, id)
+		}
+		if !p {
+			drafts = append(drafts, id)
+		}
+	}
+	sort.Slice(drafts, func(i, j int) bool { return drafts[i] < drafts[j] })
+	if len(drafts) > 0 {
+		if _, err := tx.Exec(`UPDATE products SET published = true WHERE id = ANY($1)`, pq.Array(drafts)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	rolledBack = true
+	return drafts, nil
+}
+
+// ListAllProducts returns every product, drafts included; deleted ones too
+// with includeDeleted, marked Deleted
+func (s *PostgresStore) ListAllProducts(ctx context.Context, includeDeleted bool) ([]ProductRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT id, name, description, price, stock, category, currency, is_deleted FROM products
+		WHERE $1 OR NOT is_deleted
+		ORDER BY id
+	`, includeDeleted)
 	if err != nil {
 		return nil, err
 	}
@@ -96,24 +542,195 @@ func (s *PostgresStore) ListProducts() ([]ProductRow, error) {
 	out := []ProductRow{}
 	for rows.Next() {
 		var p ProductRow
-		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Category, &p.Currency, &p.Deleted); err != nil {
 			return nil, err
 		}
 		out = append(out, p)
 	}
-	return out, nil
+	return out, rows.Err()
+}
+
+// MaxSearchResults caps how many products SearchProducts returns
+const MaxSearchResults = 50
+
+// SearchProducts returns up to MaxSearchResults published products whose
+// name or description contains query (case-insensitive). Name matches come
+// before description-only ones, each by name.
+func (s *PostgresStore) SearchProducts(ctx context.Context, query string) ([]ProductRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT id, name, description, price, stock, category, currency FROM products
+		WHERE published AND NOT is_deleted AND (name ILIKE '%' || $1 || '%' OR description ILIKE '%' || $1 || '%')
+		ORDER BY name ILIKE '%' || $1 || '%' DESC, name, id
+		LIMIT $2
+	`, likeEscaper.Replace(query), MaxSearchResults)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// likeEscaper makes user input match literally inside a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ListAvailableProducts returns products whose availability window includes now
+func (s *PostgresStore) ListAvailableProducts(ctx context.Context) ([]ProductRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT id, name, description, price, stock, category, currency FROM products
+		WHERE published
+		  AND (available_from IS NULL OR available_from <= now())
+		  AND (available_until IS NULL OR available_until > now())
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}
+
+// Product sort orders accepted by ListProductsPage
+const (
+	ProductSortID        = "id"
+	ProductSortPriceAsc  = "price_asc"
+	ProductSortPriceDesc = "price_desc"
+	ProductSortName      = "name"
+	ProductSortNewest    = "newest"
+)
+
+// productOrderBy maps a product sort to its ORDER BY. Every order ends on id
+// so products with equal prices, names or creation times keep their place
+// between pages; unpriced products sort last.
+var productOrderBy = map[string]string{
+	ProductSortID:        "id",
+	ProductSortPriceAsc:  "price ASC NULLS LAST, id",
+	ProductSortPriceDesc: "price DESC NULLS LAST, id",
+	ProductSortName:      "name, id",
+	ProductSortNewest:    "created_at DESC, id DESC",
+}
+
+// productOrder returns the ORDER BY for sort, by id when empty
+func productOrder(sort string) (string, error) {
+	if sort == "" {
+		sort = ProductSortID
+	}
+	orderBy, ok := productOrderBy[sort]
+	if !ok {
+		return "", fmt.Errorf("unknown product sort %q", sort)
+	}
+	return orderBy, nil
+}
+
+// IsProductSort reports whether sort is a known product sort order
+func IsProductSort(sort string) bool {
+	_, ok := productOrderBy[sort]
+	return ok
 }
 
-func (s *PostgresStore) AddToCart(userID string, productID int64, qty int) error {
+// ListProductsPage returns one page of published products in sort order
+// (by id when empty)
+func (s *PostgresStore) ListProductsPage(ctx context.Context, limit, offset int, sort string) ([]ProductRow, error) {
+	orderBy, err := productOrder(sort)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db(ctx).Query(`SELECT id, name, description, price, stock, category, currency, created_at, updated_at FROM products WHERE published ORDER BY `+orderBy+` LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanStampedProducts(rows)
+}
+
+// GetPrices returns current prices keyed by product id; unknown, unpriced
+// and hidden (draft or deleted) ids are omitted
+func (s *PostgresStore) GetPrices(ctx context.Context, ids []int64) (map[int64]money.Cents, error) {
+	out := map[int64]money.Cents{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	rows, err := s.db(ctx).Query(`SELECT id, price FROM products WHERE id = ANY($1) AND published AND NOT is_deleted`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var price money.NullCents
+		if err := rows.Scan(&id, &price); err != nil {
+			return nil, err
+		}
+		if price.Valid {
+			out[id] = price.Cents
+		}
+	}
+	return out, rows.Err()
+}
+
+// CountProducts returns the exact number of published products (full scan)
+func (s *PostgresStore) CountProducts(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.db(ctx).QueryRow(`SELECT COUNT(*) FROM products WHERE published`).Scan(&n)
+	return n, err
+}
+
+// EstimateProductCount estimates the number of published products, to match
+// CountProducts: the planner's row estimate for the table scaled by the
+// fraction of rows ANALYZE saw with published = true (drafts and deleted
+// products are unpublished). Cheap but only as fresh as the last
+// ANALYZE/autovacuum; a negative value means the table has never been analyzed.
+func (s *PostgresStore) EstimateProductCount(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.db(ctx).QueryRow(`
+		SELECT CASE WHEN c.reltuples < 0 THEN -1
+		       ELSE (c.reltuples * COALESCE((
+		           SELECT f.freq
+		           FROM pg_stats st, unnest(st.most_common_vals::text::text[], st.most_common_freqs) AS f(val, freq)
+		           WHERE st.tablename = 'products' AND st.attname = 'published' AND f.val = 't'
+		       ), 0))::BIGINT END
+		FROM pg_class c WHERE c.oid = 'products'::regclass`).Scan(&n)
+	return n, err
+}
+
+// helper: scan product rows and close them
+func scanProducts(rows *sql.Rows) ([]ProductRow, error) {
+	defer rows.Close()
+	out := []ProductRow{}
+	for rows.Next() {
+		var p ProductRow
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Category, &p.Currency); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// scanStampedProducts is scanProducts for queries that also select
+// created_at, updated_at
+func scanStampedProducts(rows *sql.Rows) ([]ProductRow, error) {
+	defer rows.Close()
+	out := []ProductRow{}
+	for rows.Next() {
+		var p ProductRow
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Category, &p.Currency, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) AddToCart(ctx context.Context, userID string, productID int64, qty int) error {
 	if qty <= 0 {
 		return errors.New("quantity must be > 0")
 	}
+	if qty > MaxCartLineQuantity {
+		return ErrQuantityOutOfRange
+	}
 
 	// process-local lock to avoid concurrent goroutines in same process
 	unlock := s.lockForUser(userID)
 	defer unlock()
 
-	tx, err := s.DB.Begin()
+	tx, err := s.begin(ctx)
 	if err != nil {
 		return err
 	}
@@ -132,34 +749,128 @@ func (s *PostgresStore) AddToCart(userID string, productID int64, qty int) error
 		return err
 	}
 
-	// Lock the product row and read stock
-	var stock int
-	if err := tx.QueryRow(`SELECT stock FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&stock); err != nil {
+	if err := addCartLine(tx, userID, productID, qty, s.MaxReservedPerUser, s.reservedUntil()); err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
 		return err
 	}
 
-	if stock < qty {
+	if err := tx.Commit(); err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
+		return err
+	}
+	rolledBack = true
+	return nil
+}
+
+// addCartLine adds qty of productID to the user's (existing) cart inside tx:
+// it locks the product, checks it can be sold and reserves the stock until
+// reservedUntil. maxPerUser is the reservation limit for products without one
+// of their own.
+func addCartLine(tx querier, userID string, productID int64, qty, maxPerUser int, reservedUntil sql.NullTime) error {
+	// Lock the product row and read stock + availability window (DB clock)
+	var stock int
+	var tracked, notYet, expired, unpriced, unpublished, bundle bool
+	var perUser sql.NullInt64
+	if err := tx.QueryRow(`
+		SELECT stock, track_inventory,
+		       COALESCE(available_from > now(), false),
+		       COALESCE(available_until <= now(), false),
+		       price IS NULL,
+		       NOT published,
+		       EXISTS (SELECT 1 FROM bundle_components WHERE bundle_id = products.id),
+		       max_reserved_per_user
+		FROM products WHERE id = $1 AND NOT is_deleted FOR UPDATE
+	`, productID).Scan(&stock, &tracked, &notYet, &expired, &unpriced, &unpublished, &bundle, &perUser); err != nil {
+		return err
+	}
+
+	if unpublished {
+		return ErrNotPublished
+	}
+
+	if unpriced {
+		return ErrNoPrice
+	}
+
+	if notYet {
+		return ErrNotAvailableYet
+	}
+	if expired {
+		return ErrNoLongerAvailable
+	}
+
+	// the product row lock serializes adds of this product, so what the user
+	// already holds can't change under us
+	if perUser.Valid {
+		maxPerUser = int(perUser.Int64)
+	}
+	if maxPerUser > 0 {
+		var held int
+		if err := tx.QueryRow(`
+			SELECT COALESCE((SELECT quantity FROM cart_items WHERE cart_id = $1 AND product_id = $2), 0)
+		`, userID, productID).Scan(&held); err != nil {
+			return err
+		}
+		if held+qty > maxPerUser {
+			return fmt.Errorf("%w: at most %d per customer, %d already in cart", ErrQuantityOutOfRange, maxPerUser, held)
+		}
+	}
+
+	// untracked products (digital goods) are never stock-checked or reserved
+	if tracked && stock < qty {
 		return ErrInsufficientStock
 	}
 
-	// Upsert cart item (add quantity)
+	// a bundle reserves its components, all or nothing
+	if bundle {
+		if err := reserveBundle(tx, productID, qty); err != nil {
+			return err
+		}
+	}
+
+	// Upsert cart item (add quantity); adding to a line renews its reservation
 	if _, err := tx.Exec(`
-		INSERT INTO cart_items (cart_id, product_id, quantity)
-		VALUES ($1, $2, $3)
+		INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)
+		VALUES ($1, $2, $3, $4)
 		ON CONFLICT (cart_id, product_id)
-		DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity
-	`, userID, productID, qty); err != nil {
-		_ = tx.Rollback()
-		rolledBack = true
+		DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity, reserved_until = EXCLUDED.reserved_until
+	`, userID, productID, qty, reservedUntil); err != nil {
+		if isQuantityCapViolation(err) {
+			return ErrQuantityOutOfRange
+		}
 		return err
 	}
 
 	// decrement product stock (reserved)
-	if _, err := tx.Exec(`UPDATE products SET stock = stock - $1 WHERE id = $2`, qty, productID); err != nil {
+	if tracked {
+		if _, err := tx.Exec(reserveStockSQL, qty, productID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveFromCart drops a line from the user's cart and gives its reserved
+// stock back; sql.ErrNoRows if the cart doesn't have it.
+func (s *PostgresStore) RemoveFromCart(ctx context.Context, userID string, productID int64) error {
+	// process-local lock
+	unlock := s.lockForUser(userID)
+	defer unlock()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err := removeCartLine(tx, userID, productID); err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
 		return err
@@ -174,12 +885,22 @@ func (s *PostgresStore) AddToCart(userID string, productID int64, qty int) error
 	return nil
 }
 
-func (s *PostgresStore) RemoveFromCart(userID string, productID int64) error {
-	// process-local lock
+// UpdateCartQuantity sets a cart line to newQty and moves only the
+// difference between the cart and stock, in one transaction: growing the
+// line reserves more (checked like AddToCart), shrinking it gives the
+// surplus back, and 0 removes it. sql.ErrNoRows if the line isn't in the cart.
+func (s *PostgresStore) UpdateCartQuantity(ctx context.Context, userID string, productID int64, newQty int) error {
+	if newQty < 0 {
+		return errors.New("quantity must be >= 0")
+	}
+	if newQty > MaxCartLineQuantity {
+		return ErrQuantityOutOfRange
+	}
+
 	unlock := s.lockForUser(userID)
 	defer unlock()
 
-	tx, err := s.DB.Begin()
+	tx, err := s.begin(ctx)
 	if err != nil {
 		return err
 	}
@@ -190,46 +911,60 @@ func (s *PostgresStore) RemoveFromCart(userID string, productID int64) error {
 		}
 	}()
 
-	// read current quantity in cart
+	// product row first, in the same order as AddToCart, so the two can't
+	// deadlock; it also keeps the line from changing under us
+	var locked int64
+	if err := tx.QueryRow(`SELECT id FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&locked); err != nil {
+		return err
+	}
 	var qty int
-	err = tx.QueryRow(`SELECT quantity FROM cart_items WHERE cart_id=$1 AND product_id=$2`, userID, productID).Scan(&qty)
-	if err == sql.ErrNoRows {
-		_ = tx.Rollback()
-		rolledBack = true
-		return sql.ErrNoRows
+	if err := tx.QueryRow(`SELECT quantity FROM cart_items WHERE cart_id=$1 AND product_id=$2`, userID, productID).Scan(&qty); err != nil {
+		return err
+	}
+
+	switch delta := newQty - qty; {
+	case newQty == 0:
+		err = removeCartLine(tx, userID, productID)
+	case delta > 0:
+		err = addCartLine(tx, userID, productID, delta, s.MaxReservedPerUser, s.reservedUntil())
+	case delta < 0:
+		if _, err = tx.Exec(`UPDATE cart_items SET quantity=$1 WHERE cart_id=$2 AND product_id=$3`, newQty, userID, productID); err == nil {
+			_, err = tx.Exec(releaseReservationSQL, -delta, productID, MovementRelease)
+		}
 	}
 	if err != nil {
-		_ = tx.Rollback()
-		rolledBack = true
 		return err
 	}
 
-	// delete item from cart
-	if _, err := tx.Exec(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2`, userID, productID); err != nil {
-		_ = tx.Rollback()
-		rolledBack = true
+	if err := tx.Commit(); err != nil {
 		return err
 	}
+	rolledBack = true
+	return nil
+}
 
-	// restore reserved stock
-	if _, err := tx.Exec(`UPDATE products SET stock = stock + $1 WHERE id = $2`, qty, productID); err != nil {
-		_ = tx.Rollback()
-		rolledBack = true
+// removeCartLine drops productID from the user's cart inside tx and gives
+// its reserved stock back; sql.ErrNoRows if the cart doesn't have it.
+func removeCartLine(tx querier, userID string, productID int64) error {
+	// delete the line and read what it held in one statement: of two
+	// concurrent removes only one gets the row back, so the stock is
+	// released once
+	var qty int
+	err := tx.QueryRow(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2 RETURNING quantity`, userID, productID).Scan(&qty)
+	if err != nil {
 		return err
 	}
 
-	if err := tx.Commit(); err != nil {
-		_ = tx.Rollback()
-		rolledBack = true
+	// restore reserved stock (nothing was reserved for untracked products,
+	// a bundle's reservation sits on its components)
+	if _, err := tx.Exec(releaseReservationSQL, qty, productID, MovementRelease); err != nil {
 		return err
 	}
-	rolledBack = true
 	return nil
 }
 
-
-func (s *PostgresStore) GetCart(userID string) ([]CartRow, error) {
-	rows, err := s.DB.Query(`SELECT product_id, quantity FROM cart_items WHERE cart_id=$1`, userID)
+func (s *PostgresStore) GetCart(ctx context.Context, userID string) ([]CartRow, error) {
+	rows, err := s.db(ctx).Query(`SELECT product_id, quantity FROM cart_items WHERE cart_id=$1`, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -245,19 +980,163 @@ func (s *PostgresStore) GetCart(userID string) ([]CartRow, error) {
 	return out, nil
 }
 
-// Checkout when stock was already reserved on AddToCart.
-// Creates order + order_items and clears the cart. Does NOT modify products.stock.
-func (s *PostgresStore) Checkout(userID string) (OrderRow, []OrderItemRow, error) {
+// GetCartContext returns each cart line with the product's current name,
+// price, stock, published/deleted status and availability, and whether the
+// line's reservation has expired, in a single read-only query.
+func (s *PostgresStore) GetCartContext(ctx context.Context, userID string) ([]CartLineContext, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT ci.product_id, ci.quantity, p.id IS NULL,
+		       COALESCE(p.name, ''), p.price, COALESCE(p.currency, ''), COALESCE(p.stock, 0),
+		       COALESCE(p.track_inventory, false), COALESCE(p.published, false),
+		       NOT (COALESCE(p.available_from <= now(), true) AND COALESCE(p.available_until > now(), true)),
+		       COALESCE(ci.reserved_until <= now(), false)
+		FROM cart_items ci
+		LEFT JOIN products p ON p.id = ci.product_id AND NOT p.is_deleted
+		WHERE ci.cart_id = $1
+		ORDER BY ci.product_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []CartLineContext{}
+	for rows.Next() {
+		var c CartLineContext
+		if err := rows.Scan(&c.ProductID, &c.Quantity, &c.Deleted, &c.Name, &c.Price, &c.Currency, &c.Stock, &c.Tracked, &c.Published,
+			&c.Unavailable, &c.ReservationExpired); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// GetCartStock returns each cart line with the current product stock.
+// Read-only: takes no row locks and no process-local lock.
+func (s *PostgresStore) GetCartStock(ctx context.Context, userID string) ([]CartStockRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT ci.product_id, ci.quantity, p.stock, p.track_inventory
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1
+		ORDER BY ci.product_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []CartStockRow{}
+	for rows.Next() {
+		var c CartStockRow
+		if err := rows.Scan(&c.ProductID, &c.Quantity, &c.Stock, &c.Tracked); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// GetCartWeights returns each cart line with its product weight
+func (s *PostgresStore) GetCartWeights(ctx context.Context, userID string) ([]CartWeightRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT ci.product_id, ci.quantity, p.weight_grams
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []CartWeightRow{}
+	for rows.Next() {
+		var c CartWeightRow
+		if err := rows.Scan(&c.ProductID, &c.Quantity, &c.WeightGrams); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// GetCartDetailed returns cart lines joined with full product rows in one query.
+func (s *PostgresStore) GetCartDetailed(ctx context.Context, userID string) ([]CartDetailRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT ci.product_id, ci.quantity, p.id, p.name, p.description, p.price, p.stock
+		FROM cart_items ci
+		LEFT JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1
+		ORDER BY ci.product_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []CartDetailRow{}
+	for rows.Next() {
+		var (
+			c     CartDetailRow
+			id    sql.NullInt64
+			name  sql.NullString
+			desc  sql.NullString
+			price money.NullCents
+			stock sql.NullInt64
+		)
+		if err := rows.Scan(&c.ProductID, &c.Quantity, &id, &name, &desc, &price, &stock); err != nil {
+			return nil, err
+		}
+		if id.Valid {
+			c.Product = &ProductRow{ID: id.Int64, Name: name.String, Description: desc, Price: price, Stock: int(stock.Int64)}
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// CheckoutOptions tunes how Checkout treats lines it can't fulfil.
+type CheckoutOptions struct {
+	// RemoveUnavailable drops unpriced / unavailable lines (releasing their
+	// reservation) instead of failing the whole checkout.
+	RemoveUnavailable bool
+	// HeldPrices, from a still-valid quote hold, price the lines they name
+	// instead of the current product price; the hold is consumed.
+	HeldPrices map[int64]money.Cents
+	// PendingPayment creates the order as pending rather than placed, to be
+	// settled with MarkOrderPaid or CancelPendingOrder.
+	PendingPayment bool
+	// CouponCode, if set, takes the coupon's percentage off the total and
+	// counts a use of it; an unknown, expired or used-up code fails the
+	// checkout.
+	CouponCode string
+	// IdempotencyKey, if set, is recorded against the new order for
+	// GetOrderByIdempotencyKey; one already used by the user within
+	// IdempotencyKeyTTL fails the checkout with ErrIdempotencyKeyInUse.
+	IdempotencyKey string
+}
+
+// Checkout places the cart, whose stock was already reserved by AddToCart
+// (see PostgresStore). Creates order + order_items and clears the cart. Does NOT modify products.stock,
+// except to release the reservation of lines dropped via opts.RemoveUnavailable;
+// their product ids are returned as removed. The order takes its lines'
+// currency; lines in different currencies fail with ErrMixedCurrencies.
+// meta is stored on the order as-is; callers validate it.
+func (s *PostgresStore) Checkout(ctx context.Context, userID string, meta map[string]string, opts CheckoutOptions) (OrderRow, []OrderItemRow, []int64, error) {
 	var order OrderRow
 	var items []OrderItemRow
+	var removed []int64
+
+	metaJSON, err := marshalMetadata(meta)
+	if err != nil {
+		return order, items, removed, err
+	}
 
 	// process-local lock (optional extra safety)
 	unlock := s.lockForUser(userID)
 	defer unlock()
 
-	tx, err := s.DB.Begin()
+	tx, err := s.begin(ctx)
 	if err != nil {
-		return order, items, err
+		return order, items, removed, err
 	}
 	// ensure rollback on any early return
 	rolledBack := false
@@ -269,7 +1148,8 @@ func (s *PostgresStore) Checkout(userID string) (OrderRow, []OrderItemRow, error
 
 	// Read cart items and lock product rows defensively (ORDER BY to avoid deadlocks)
 	rows, err := tx.Query(`
-		SELECT ci.product_id, ci.quantity, p.price
+		SELECT ci.product_id, ci.quantity, p.price, p.currency,
+		       p.published AND COALESCE(p.available_from <= now(), true) AND COALESCE(p.available_until > now(), true)
 		FROM cart_items ci
 		JOIN products p ON p.id = ci.product_id
 		WHERE ci.cart_id = $1
@@ -279,42 +1159,129 @@ func (s *PostgresStore) Checkout(userID string) (OrderRow, []OrderItemRow, error
 	if err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
-		return order, items, err
+		return order, items, removed, err
 	}
 	defer rows.Close()
 
-	var total float64
+	type release struct {
+		productID int64
+		qty       int
+	}
+	var releases []release
+	var snapshot []CartSnapshotLine
+	var total money.Cents
+	var currency string
 	for rows.Next() {
 		var it OrderItemRow
-		if err := rows.Scan(&it.ProductID, &it.Quantity, &it.Price); err != nil {
+		var price money.NullCents
+		var lineCurrency string
+		var available bool
+		if err := rows.Scan(&it.ProductID, &it.Quantity, &price, &lineCurrency, &available); err != nil {
+			_ = tx.Rollback()
+			rolledBack = true
+			return order, items, removed, err
+		}
+		if held, ok := opts.HeldPrices[it.ProductID]; ok {
+			price = money.NullCents{Cents: held, Valid: true}
+		}
+		line := CartSnapshotLine{ProductID: it.ProductID, Quantity: it.Quantity, Removed: !price.Valid || !available}
+		if price.Valid {
+			line.Price = &price.Cents
+		}
+		snapshot = append(snapshot, line)
+		if !price.Valid || !available {
+			if !opts.RemoveUnavailable {
+				_ = tx.Rollback()
+				rolledBack = true
+				if !price.Valid {
+					return order, items, removed, fmt.Errorf("%w: product %d", ErrNoPrice, it.ProductID)
+				}
+				return order, items, removed, fmt.Errorf("%w: product %d", ErrItemUnavailable, it.ProductID)
+			}
+			// every dropped line gives its reservation back: releaseReservationSQL
+			// skips untracked products and covers a bundle's components (the
+			// bundle row itself is untracked)
+			removed = append(removed, it.ProductID)
+			releases = append(releases, release{it.ProductID, it.Quantity})
+			continue
+		}
+		if currency == "" {
+			currency = lineCurrency
+		} else if lineCurrency != currency {
 			_ = tx.Rollback()
 			rolledBack = true
-			return order, items, err
+			return order, items, removed, fmt.Errorf("%w: %s and %s", ErrMixedCurrencies, currency, lineCurrency)
 		}
+		it.Price = price.Cents
 		items = append(items, it)
-		total += float64(it.Quantity) * it.Price
+		total += it.Price.Mul(it.Quantity)
 	}
 	if len(items) == 0 {
 		_ = tx.Rollback()
 		rolledBack = true
-		return order, items, errors.New("cart empty")
+		if len(removed) > 0 {
+			return order, items, removed, fmt.Errorf("%w: every cart line was removed", ErrItemUnavailable)
+		}
+		return order, items, removed, ErrCartEmpty
+	}
+
+	var discount money.Cents
+	if opts.CouponCode != "" {
+		c, err := getCoupon(tx, opts.CouponCode, true)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fmt.Errorf("%w: %s", ErrUnknownCoupon, opts.CouponCode)
+		}
+		if err == nil {
+			err = c.Check(time.Now())
+		}
+		if err == nil {
+			err = incrementCouponUse(tx, c.Code)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			rolledBack = true
+			return order, items, removed, err
+		}
+		discount = c.Discount(total)
+		total -= discount
+	}
+
+	// Give back the reservations of dropped lines; the cart clear below
+	// deletes the lines themselves.
+	for _, rel := range releases {
+		if _, err := tx.Exec(releaseReservationSQL, rel.qty, rel.productID, MovementRelease); err != nil {
+			_ = tx.Rollback()
+			rolledBack = true
+			return order, items, removed, err
+		}
+	}
+
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return order, items, removed, err
 	}
 
 	// Create order and get id
+	status := OrderStatusPlaced
+	if opts.PendingPayment {
+		status = OrderStatusPending
+	}
 	var orderID int64
 	var createdAt time.Time
-	if err := tx.QueryRow(`INSERT INTO orders (user_id, total) VALUES ($1,$2) RETURNING id, created_at`, userID, total).Scan(&orderID, &createdAt); err != nil {
+	coupon := sql.NullString{String: opts.CouponCode, Valid: opts.CouponCode != ""}
+	if err := tx.QueryRow(`INSERT INTO orders (user_id, total, metadata, cart_snapshot, status, discount, coupon_code, currency) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id, created_at`,
+		userID, total, metaJSON, string(snapshotJSON), status, discount, coupon, currency).Scan(&orderID, &createdAt); err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
-		return order, items, err
+		return order, items, removed, err
 	}
 
 	// Insert order_items
-	stmt, err := tx.Prepare(`INSERT INTO order_items (order_id, product_id, quantity, price) VALUES ($1,$2,$3,$4)`)
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO order_items (order_id, product_id, quantity, price) VALUES ($1,$2,$3,$4)`)
 	if err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
-		return order, items, err
+		return order, items, removed, err
 	}
 	defer stmt.Close()
 
@@ -322,7 +1289,15 @@ func (s *PostgresStore) Checkout(userID string) (OrderRow, []OrderItemRow, error
 		if _, err := stmt.Exec(orderID, it.ProductID, it.Quantity, it.Price); err != nil {
 			_ = tx.Rollback()
 			rolledBack = true
-			return order, items, err
+			return order, items, removed, err
+		}
+	}
+
+	if opts.IdempotencyKey != "" {
+		if err := recordIdempotencyKey(tx, userID, opts.IdempotencyKey, orderID); err != nil {
+			_ = tx.Rollback()
+			rolledBack = true
+			return order, items, removed, err
 		}
 	}
 
@@ -330,21 +1305,27 @@ func (s *PostgresStore) Checkout(userID string) (OrderRow, []OrderItemRow, error
 	if _, err := tx.Exec(`DELETE FROM cart_items WHERE cart_id = $1`, userID); err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
-		return order, items, err
+		return order, items, removed, err
 	}
 	if _, err := tx.Exec(`DELETE FROM carts WHERE user_id = $1`, userID); err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
-		return order, items, err
+		return order, items, removed, err
+	}
+	if opts.HeldPrices != nil {
+		if _, err := tx.Exec(`DELETE FROM quote_holds WHERE user_id = $1`, userID); err != nil {
+			return order, items, removed, err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		_ = tx.Rollback()
 		rolledBack = true
-		return order, items, err
+		return order, items, removed, err
 	}
 	rolledBack = true
 
-	order = OrderRow{ID: orderID, UserID: userID, Total: total, CreatedAt: createdAt}
-	return order, items, nil
+	order = OrderRow{ID: orderID, UserID: userID, Total: total, Currency: currency, Status: status, Metadata: meta, CreatedAt: createdAt,
+		Discount: discount, CouponCode: opts.CouponCode}
+	return order, items, removed, nil
 }
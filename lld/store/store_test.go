@@ -1,13 +1,23 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"inventory-management/money"
+	"log"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 )
 
 func TestAddToCart_SuccessAndInvalidQty(t *testing.T) {
@@ -20,25 +30,34 @@ func TestAddToCart_SuccessAndInvalidQty(t *testing.T) {
 	s := &PostgresStore{DB: db}
 
 	// invalid qty -> should error early, no DB calls
-	if err := s.AddToCart("u1", 1, 0); err == nil {
+	if err := s.AddToCart(context.Background(), "u1", 1, 0); err == nil {
 		t.Fatalf("expected error for qty <= 0")
 	}
 
-	// success path: expect insert cart (ON CONFLICT DO NOTHING) then upsert cart_items
+	// success path: ensure cart, lock product stock, upsert cart_items, reserve stock
+	mock.ExpectBegin()
 	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
 		WithArgs("u1").
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(10)).
+		WillReturnRows(lockRows(lockRow{stock: 5}))
 
 	// upsert cart_items
 	mock.ExpectExec(regexp.QuoteMeta(`
-		INSERT INTO cart_items (cart_id, product_id, quantity) VALUES ($1,$2,$3)
+		INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)
+		VALUES ($1, $2, $3, $4)
 		ON CONFLICT (cart_id, product_id)
-		DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity
+		DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity, reserved_until = EXCLUDED.reserved_until
 	`)).
-		WithArgs("u1", int64(10), 3).
+		WithArgs("u1", int64(10), 3, nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(3, int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 
-	if err := s.AddToCart("u1", 10, 3); err != nil {
+	if err := s.AddToCart(context.Background(), "u1", 10, 3); err != nil {
 		t.Fatalf("AddToCart failed: %v", err)
 	}
 
@@ -47,26 +66,493 @@ func TestAddToCart_SuccessAndInvalidQty(t *testing.T) {
 	}
 }
 
+// expectCappedAdd queues an AddToCart of a capped product up to the check of
+// what the user already holds
+func expectCappedAdd(mock sqlmock.Sqlmock, productID int64, row lockRow, held int) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(productID).
+		WillReturnRows(lockRows(row))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE((SELECT quantity FROM cart_items WHERE cart_id = $1 AND product_id = $2), 0)`)).
+		WithArgs("u1", productID).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(held))
+}
+
+func TestAddToCart_ReservationCapAcrossAdds(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db, MaxReservedPerUser: 3}
+
+	// 2 then 1 fill the cap exactly; one more is refused and rolled back
+	for _, add := range []struct{ held, qty int }{{0, 2}, {2, 1}} {
+		expectCappedAdd(mock, 10, lockRow{stock: 50}, add.held)
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+			WithArgs("u1", int64(10), add.qty, nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+			WithArgs(add.qty, int64(10)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	expectCappedAdd(mock, 10, lockRow{stock: 47}, 3)
+	mock.ExpectRollback()
+
+	if err := s.AddToCart(context.Background(), "u1", 10, 2); err != nil {
+		t.Fatalf("first add: %v", err)
+	}
+	if err := s.AddToCart(context.Background(), "u1", 10, 1); err != nil {
+		t.Fatalf("second add: %v", err)
+	}
+	if err := s.AddToCart(context.Background(), "u1", 10, 1); !errors.Is(err, ErrQuantityOutOfRange) {
+		t.Fatalf("expected ErrQuantityOutOfRange, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddToCart_PerProductReservationCap(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db, MaxReservedPerUser: 3}
+
+	// the product's own limit wins over the store-wide one, either way
+	expectCappedAdd(mock, 10, lockRow{stock: 50, perUser: 1}, 1)
+	mock.ExpectRollback()
+	expectCappedAdd(mock, 11, lockRow{stock: 50, perUser: 10}, 3)
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+		WithArgs("u1", int64(11), 5, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(5, int64(11)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := s.AddToCart(context.Background(), "u1", 10, 1); !errors.Is(err, ErrQuantityOutOfRange) {
+		t.Fatalf("expected ErrQuantityOutOfRange, got %v", err)
+	}
+	if err := s.AddToCart(context.Background(), "u1", 11, 5); err != nil {
+		t.Fatalf("add under the product's own limit: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddToCart_UntrackedUnlimited(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// stock column is 0 but tracking is off: no stock check, no decrement
+	// (the per-line quantity cap still applies)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(7)).
+		WillReturnRows(lockRows(lockRow{untracked: true}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+		WithArgs("u1", int64(7), MaxCartLineQuantity, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := s.AddToCart(context.Background(), "u1", 7, MaxCartLineQuantity); err != nil {
+		t.Fatalf("expected untracked add to succeed, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// lockRow describes the product row AddToCart reads when it locks the
+// product; the zero value is a tracked, published, priced product in its
+// availability window with no stock and no reservation limit.
+type lockRow struct {
+	stock                                               int
+	untracked, notYet, expired, unpriced, draft, bundle bool
+	perUser                                             int
+}
+
+func lockRows(r lockRow) *sqlmock.Rows {
+	var perUser interface{}
+	if r.perUser > 0 {
+		perUser = int64(r.perUser)
+	}
+	return sqlmock.NewRows([]string{"stock", "track_inventory", "not_yet", "expired", "unpriced", "unpublished", "bundle", "max_reserved_per_user"}).
+		AddRow(r.stock, !r.untracked, r.notYet, r.expired, r.unpriced, r.draft, r.bundle, perUser)
+}
+
+// checkoutCols are the columns Checkout reads per cart line
+var checkoutCols = []string{"product_id", "quantity", "price", "currency", "available"}
+
+// expectAddUpTo queues an AddToCart transaction up to (and including) the cart_items upsert
+func expectAddUpTo(mock sqlmock.Sqlmock, userID string, productID int64, qty, stock int) *sqlmock.ExpectedExec {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(productID).
+		WillReturnRows(lockRows(lockRow{stock: stock}))
+	return mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+		WithArgs(userID, productID, qty, nil)
+}
+
+func TestAddToCartBatch_AtomicRollsBack(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// lines are locked in product id order; the second is short on stock, so
+	// the first one's reservation is rolled back with it
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(2)).
+		WillReturnRows(lockRows(lockRow{stock: 5}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+		WithArgs("u1", int64(2), 1, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(1, int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(9)).
+		WillReturnRows(lockRows(lockRow{stock: 1}))
+	mock.ExpectRollback()
+
+	err := s.AddToCartBatch(context.Background(), "u1", []CartRow{{ProductID: 9, Quantity: 3}, {ProductID: 2, Quantity: 1}})
+	if !errors.Is(err, ErrInsufficientStock) || !strings.Contains(err.Error(), "product 9") {
+		t.Fatalf("expected ErrInsufficientStock naming product 9, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestRemoveFromCartBatch_AtomicMissingLine(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2 RETURNING quantity`)).
+		WithArgs("u1", int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(2, int64(1), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2 RETURNING quantity`)).
+		WithArgs("u1", int64(4)).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	// the repeated id is removed once
+	err := s.RemoveFromCartBatch(context.Background(), "u1", []int64{4, 1, 1})
+	if !errors.Is(err, sql.ErrNoRows) || !strings.Contains(err.Error(), "product 4") {
+		t.Fatalf("expected sql.ErrNoRows naming product 4, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestExportProducts_Streams(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	cols := []string{"id", "name", "description", "price", "stock", "track_inventory", "published",
+		"available_from", "available_until", "weight_grams", "max_reserved_per_user", "tags"}
+	mock.ExpectQuery(regexp.QuoteMeta(`ARRAY(SELECT t.tag FROM product_tags t WHERE t.product_id = p.id ORDER BY t.tag)`)).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(int64(1), "cable", "usb-c", 9.5, 40, true, true, nil, nil, int64(250), int64(2), []byte("{clearance,usb}")).
+			AddRow(int64(2), "draft", nil, nil, 0, true, false, nil, nil, nil, nil, []byte("{}")))
+
+	var got []ProductExportRow
+	if err := s.ExportProducts(context.Background(), func(p ProductExportRow) error { got = append(got, p); return nil }); err != nil {
+		t.Fatalf("ExportProducts failed: %v", err)
+	}
+	if len(got) != 2 || !reflect.DeepEqual(got[0].Tags, []string{"clearance", "usb"}) || got[0].WeightGrams.Int64 != 250 ||
+		got[1].Published || got[1].Price.Valid || len(got[1].Tags) != 0 {
+		t.Fatalf("unexpected rows: %+v", got)
+	}
+
+	// an error from fn stops the export
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM products p`)).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(int64(1), "cable", nil, nil, 0, true, true, nil, nil, nil, nil, []byte("{}")).
+			AddRow(int64(2), "draft", nil, nil, 0, true, false, nil, nil, nil, nil, []byte("{}")))
+	calls := 0
+	stop := errors.New("client went away")
+	if err := s.ExportProducts(context.Background(), func(ProductExportRow) error { calls++; return stop }); !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("want the export stopped after 1 row, got %d calls, %v", calls, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// expectQtyUpdate queues the start of an UpdateCartQuantity: the product
+// lock and the read of the current line
+func expectQtyUpdate(mock sqlmock.Sqlmock, productID int64, held int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id FROM products WHERE id = $1 FOR UPDATE`)).
+		WithArgs(productID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(productID))
+	q := mock.ExpectQuery(regexp.QuoteMeta(`SELECT quantity FROM cart_items WHERE cart_id=$1 AND product_id=$2`)).
+		WithArgs("u1", productID)
+	if held > 0 {
+		q.WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(held))
+	} else {
+		q.WillReturnError(sql.ErrNoRows)
+	}
+}
+
+func TestUpdateCartQuantity_MovesOnlyTheDelta(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// 2 -> 5 reserves 3 more
+	expectQtyUpdate(mock, 10, 2)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(10)).
+		WillReturnRows(lockRows(lockRow{stock: 3}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+		WithArgs("u1", int64(10), 3, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(3, int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// 5 -> 9 needs 4 but only 0 are left
+	expectQtyUpdate(mock, 10, 5)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(10)).
+		WillReturnRows(lockRows(lockRow{stock: 0}))
+	mock.ExpectRollback()
+	// 5 -> 1 gives 4 back
+	expectQtyUpdate(mock, 10, 5)
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE cart_items SET quantity=$1 WHERE cart_id=$2 AND product_id=$3`)).
+		WithArgs(1, "u1", int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(4, int64(10), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// 1 -> 0 removes the line
+	expectQtyUpdate(mock, 10, 1)
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2 RETURNING quantity`)).
+		WithArgs("u1", int64(10)).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(1, int64(10), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// not in the cart
+	expectQtyUpdate(mock, 11, 0)
+	mock.ExpectRollback()
+
+	if err := s.UpdateCartQuantity(context.Background(), "u1", 10, 5); err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	if err := s.UpdateCartQuantity(context.Background(), "u1", 10, 9); !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("expected ErrInsufficientStock, got %v", err)
+	}
+	if err := s.UpdateCartQuantity(context.Background(), "u1", 10, 1); err != nil {
+		t.Fatalf("shrink: %v", err)
+	}
+	if err := s.UpdateCartQuantity(context.Background(), "u1", 10, 0); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := s.UpdateCartQuantity(context.Background(), "u1", 11, 2); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := s.UpdateCartQuantity(context.Background(), "u1", 10, MaxCartLineQuantity+1); !errors.Is(err, ErrQuantityOutOfRange) {
+		t.Fatalf("expected ErrQuantityOutOfRange, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportProducts_CreatesUpdatesAndSkips(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	curCols := []string{"name", "description", "price", "stock", "track_inventory", "published",
+		"available_from", "available_until", "weight_grams", "max_reserved_per_user", "tags"}
+	lock := regexp.QuoteMeta(`FROM products WHERE id = $1 FOR UPDATE`)
+	insert := regexp.QuoteMeta(`VALUES (COALESCE($1, nextval(pg_get_serial_sequence('products', 'id')))`)
+
+	mock.ExpectBegin()
+	// 1 exists: new price and stock, one tag dropped
+	mock.ExpectQuery(lock).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(curCols).AddRow("cable", "usb-c", 9.5, 40, true, true, nil, nil, nil, nil, []byte("{sale,usb}")))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET name=$2, description=$3, price=$4, stock=$5`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO stock_movements (product_id, delta, reason) VALUES ($1, $2, $3)`)).
+		WithArgs(int64(1), -10, MovementAdjustment).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM product_tags WHERE product_id = $1`)).
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO product_tags (product_id, tag) SELECT $1, unnest($2::text[])`)).
+		WithArgs(int64(1), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// 2 exists exactly as imported (a NULL description exports as "")
+	mock.ExpectQuery(lock).WithArgs(int64(2)).
+		WillReturnRows(sqlmock.NewRows(curCols).AddRow("draft", nil, nil, 0, true, false, nil, nil, nil, nil, []byte("{}")))
+	// 50 is unused: created with that id
+	mock.ExpectQuery(lock).WithArgs(int64(50)).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(insert).
+		WithArgs(sql.NullInt64{Int64: 50, Valid: true}, "lamp", sqlmock.AnyArg(), sqlmock.AnyArg(), 3, true, true, nil, nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(50)))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO product_tags`)).
+		WithArgs(int64(50), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// no id: a fresh one
+	mock.ExpectQuery(insert).
+		WithArgs(sql.NullInt64{}, "mat", sqlmock.AnyArg(), sqlmock.AnyArg(), 0, true, false, nil, nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(51)))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT setval(pg_get_serial_sequence('products', 'id'), (SELECT MAX(id) FROM products))`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	got, err := s.ImportProducts(context.Background(), []ProductExportRow{
+		{ID: 1, Name: "cable", Description: sql.NullString{String: "usb-c", Valid: true}, Price: sql.NullFloat64{Float64: 8, Valid: true},
+			Stock: 30, TrackInventory: true, Published: true, Tags: []string{"usb"}},
+		{ID: 2, Name: "draft", Description: sql.NullString{Valid: true}, TrackInventory: true},
+		{ID: 50, Name: "lamp", Stock: 3, TrackInventory: true, Published: true, Tags: []string{"home"}},
+		{Name: "mat", TrackInventory: true},
+	})
+	if err != nil {
+		t.Fatalf("ImportProducts failed: %v", err)
+	}
+	if want := []string{ImportUpdated, ImportUnchanged, ImportCreated, ImportCreated}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestClearCart_ReleasesEveryLine(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	held := map[int64]int{3: 2, 7: 5, 9: 1}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT product_id FROM cart_items WHERE cart_id=$1 ORDER BY product_id FOR UPDATE`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"product_id"}).AddRow(int64(3)).AddRow(int64(7)).AddRow(int64(9)))
+	released := 0
+	for _, id := range []int64{3, 7, 9} {
+		mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2 RETURNING quantity`)).
+			WithArgs("u1", id).
+			WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(held[id]))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+			WithArgs(held[id], id, MovementRelease).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		released += held[id]
+	}
+	mock.ExpectCommit()
+
+	if err := s.ClearCart(context.Background(), "u1"); err != nil {
+		t.Fatalf("ClearCart failed: %v", err)
+	}
+	if released != 8 {
+		t.Fatalf("want 8 units released, got %d", released)
+	}
+
+	// an empty cart clears without error
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT product_id FROM cart_items`)).
+		WithArgs("u2").
+		WillReturnRows(sqlmock.NewRows([]string{"product_id"}))
+	mock.ExpectCommit()
+	if err := s.ClearCart(context.Background(), "u2"); err != nil {
+		t.Fatalf("ClearCart of an empty cart: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddToCart_QuantityCapRace(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// Two adds of 60 for the same line, as if from two replicas: each passes the
+	// app-level cap on its own, the first commits, and the second's upsert trips
+	// the CHECK constraint because 60+60 > MaxCartLineQuantity.
+	expectAddUpTo(mock, "u1", 3, 60, 500).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(60, int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectAddUpTo(mock, "u1", 3, 60, 440).WillReturnError(&pq.Error{
+		Code:       "23514",
+		Constraint: "cart_items_quantity_max",
+		Message:    `new row for relation "cart_items" violates check constraint "cart_items_quantity_max"`,
+	})
+	mock.ExpectRollback()
+
+	if err := s.AddToCart(context.Background(), "u1", 3, 60); err != nil {
+		t.Fatalf("first add failed: %v", err)
+	}
+	if err := s.AddToCart(context.Background(), "u1", 3, 60); !errors.Is(err, ErrQuantityOutOfRange) {
+		t.Fatalf("expected ErrQuantityOutOfRange for second add, got %v", err)
+	}
+
+	// a single add over the cap never reaches the DB
+	if err := s.AddToCart(context.Background(), "u1", 3, MaxCartLineQuantity+1); !errors.Is(err, ErrQuantityOutOfRange) {
+		t.Fatalf("expected ErrQuantityOutOfRange, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestRemoveFromCart_NoRowsAndSuccess(t *testing.T) {
 	db, mock, _ := sqlmock.New()
 	defer db.Close()
 	s := &PostgresStore{DB: db}
 
-	// no rows affected -> sql.ErrNoRows expected
-	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2`)).
+	// item not in cart -> sql.ErrNoRows expected
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2 RETURNING quantity`)).
 		WithArgs("u1", int64(5)).
-		WillReturnResult(sqlmock.NewResult(0, 0))
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}))
+	mock.ExpectRollback()
 
-	if err := s.RemoveFromCart("u1", 5); !errors.Is(err, sql.ErrNoRows) {
+	if err := s.RemoveFromCart(context.Background(), "u1", 5); !errors.Is(err, sql.ErrNoRows) {
 		t.Fatalf("expected sql.ErrNoRows, got %v", err)
 	}
 
-	// success -> rows affected >0
-	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2`)).
+	// success -> delete line and restore reserved stock
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2 RETURNING quantity`)).
 		WithArgs("u1", int64(5)).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(2, int64(5), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 
-	if err := s.RemoveFromCart("u1", 5); err != nil {
+	if err := s.RemoveFromCart(context.Background(), "u1", 5); err != nil {
 		t.Fatalf("expected success, got %v", err)
 	}
 
@@ -87,7 +573,7 @@ func TestGetCart_Success(t *testing.T) {
 		WithArgs("u1").
 		WillReturnRows(rows)
 
-	got, err := s.GetCart("u1")
+	got, err := s.GetCart(context.Background(), "u1")
 	if err != nil {
 		t.Fatalf("GetCart failed: %v", err)
 	}
@@ -99,83 +585,283 @@ func TestGetCart_Success(t *testing.T) {
 	}
 }
 
-func TestCheckout_InsufficientStock(t *testing.T) {
+func TestProductCountsExactAndEstimate(t *testing.T) {
 	db, mock, _ := sqlmock.New()
 	defer db.Close()
 	s := &PostgresStore{DB: db}
 
-	// Begin transaction
-	mock.ExpectBegin()
-	// Query returns a row with stock < qty -> should return ErrInsufficientStock
-	rows := sqlmock.NewRows([]string{"product_id", "quantity", "price", "stock"}).
-		AddRow(int64(100), 5, 10.0, 3) // stock 3 < qty 5
-	mock.ExpectQuery(regexp.QuoteMeta(`
-		SELECT ci.product_id, ci.quantity, p.price, p.stock
-		FROM cart_items ci
-		JOIN products p ON p.id = ci.product_id
-		WHERE ci.cart_id = $1
-		FOR UPDATE
-	`)).WithArgs("userx").WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM products WHERE published`)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(1000)))
+	// the estimate is scaled to published rows, like the exact count
+	mock.ExpectQuery(`(?s)SELECT CASE WHEN c\.reltuples < 0 THEN -1\s+ELSE \(c\.reltuples \* COALESCE\(.*st\.attname = 'published' AND f\.val = 't'.*FROM pg_class c WHERE c\.oid = 'products'::regclass`).
+		WillReturnRows(sqlmock.NewRows([]string{"reltuples"}).AddRow(int64(985)))
 
-	// Because code returns ErrInsufficientStock before making changes, transaction should be rolled back.
-	// The implementation defers rollback if err != nil — sqlmock will accept a rollback call if it happens.
-	mock.ExpectRollback()
+	exact, err := s.CountProducts(context.Background())
+	if err != nil || exact != 1000 {
+		t.Fatalf("expected exact 1000, got %d (%v)", exact, err)
+	}
+	approx, err := s.EstimateProductCount(context.Background())
+	if err != nil || approx != 985 {
+		t.Fatalf("expected estimate 985, got %d (%v)", approx, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
 
-	_, _, err := s.Checkout("userx")
-	if err == nil || !errors.Is(err, ErrInsufficientStock) {
-		t.Fatalf("expected ErrInsufficientStock, got %v", err)
+func TestListProductsPage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency", "created_at", "updated_at"}).
+		AddRow(int64(3), "c", nil, 1.0, 0, nil, "USD", now, now).
+		AddRow(int64(4), "d", "desc", 2.0, 7, nil, "USD", now, now)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, name, description, price, stock, category, currency, created_at, updated_at FROM products WHERE published ORDER BY id LIMIT $1 OFFSET $2`)).
+		WithArgs(2, 2).
+		WillReturnRows(rows)
+
+	got, err := s.ListProductsPage(context.Background(), 2, 2, "")
+	if err != nil {
+		t.Fatalf("ListProductsPage failed: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != 3 || got[1].Stock != 7 || !got[1].Description.Valid {
+		t.Fatalf("unexpected rows: %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListProductsPage_StableByPrice(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// seven products, most sharing a price, one unpriced; the table is kept
+	// in the order price ASC NULLS LAST, id that the query must ask for
+	type product struct {
+		id    int64
+		price interface{}
+	}
+	catalog := []product{{2, 5.0}, {4, 5.0}, {7, 5.0}, {1, 9.5}, {3, 9.5}, {6, 12.0}, {5, nil}}
+	const pageSize = 2
+	for offset := 0; offset < len(catalog); offset += pageSize {
+		rows := sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency", "created_at", "updated_at"})
+		for _, p := range catalog[offset:min(offset+pageSize, len(catalog))] {
+			rows.AddRow(p.id, "p", nil, p.price, 1, nil, "USD", time.Now(), time.Now())
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(`FROM products WHERE published ORDER BY price ASC NULLS LAST, id LIMIT $1 OFFSET $2`)).
+			WithArgs(pageSize, offset).
+			WillReturnRows(rows)
 	}
 
+	seen := map[int64]bool{}
+	for offset := 0; offset < len(catalog); offset += pageSize {
+		page, err := s.ListProductsPage(context.Background(), pageSize, offset, ProductSortPriceAsc)
+		if err != nil {
+			t.Fatalf("page at %d: %v", offset, err)
+		}
+		for _, p := range page {
+			if seen[p.ID] {
+				t.Fatalf("product %d repeated at offset %d", p.ID, offset)
+			}
+			seen[p.ID] = true
+		}
+	}
+	if len(seen) != len(catalog) {
+		t.Fatalf("expected every product once, saw %v", seen)
+	}
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Fatalf("unmet expectations: %v", err)
 	}
+
+	if _, err := s.ListProductsPage(context.Background(), 2, 0, "cheapest"); err == nil {
+		t.Fatalf("expected error for unknown sort")
+	}
 }
 
-func TestCheckout_Success(t *testing.T) {
+func TestListProducts_Sorted(t *testing.T) {
+	cols := []string{"id", "name", "description", "price", "stock", "category", "currency", "created_at", "updated_at"}
+	day := func(d int) time.Time { return time.Date(2030, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	for _, tc := range []struct {
+		sort    string
+		orderBy string
+		rows    [][]driver.Value // in the order the query must ask for
+		want    []int64
+	}{
+		{ProductSortNewest, "ORDER BY created_at DESC, id DESC",
+			[][]driver.Value{{int64(3), 9.0, day(5)}, {int64(2), 1.0, day(4)}, {int64(1), 5.0, day(4)}}, []int64{3, 2, 1}},
+		{ProductSortPriceAsc, "ORDER BY price ASC NULLS LAST, id",
+			[][]driver.Value{{int64(2), 1.0, day(4)}, {int64(1), 5.0, day(4)}, {int64(3), 9.0, day(5)}}, []int64{2, 1, 3}},
+		{ProductSortPriceDesc, "ORDER BY price DESC NULLS LAST, id",
+			[][]driver.Value{{int64(3), 9.0, day(5)}, {int64(1), 5.0, day(4)}, {int64(2), 1.0, day(4)}}, []int64{3, 1, 2}},
+	} {
+		t.Run(tc.sort, func(t *testing.T) {
+			db, mock, _ := sqlmock.New()
+			defer db.Close()
+			s := &PostgresStore{DB: db}
+			rows := sqlmock.NewRows(cols)
+			for _, r := range tc.rows {
+				rows.AddRow(r[0], "p", nil, r[1], 1, nil, "USD", r[2], r[2])
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(`FROM products WHERE published AND NOT is_deleted ` + tc.orderBy)).WillReturnRows(rows)
+
+			ps, err := s.ListProducts(context.Background(), tc.sort)
+			if err != nil {
+				t.Fatalf("ListProducts: %v", err)
+			}
+			var got []int64
+			for _, p := range ps {
+				got = append(got, p.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) || ps[0].CreatedAt.IsZero() {
+				t.Fatalf("unexpected order %v (want %v) or missing timestamps: %+v", got, tc.want, ps)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+
+	s := &PostgresStore{}
+	if _, err := s.ListProducts(context.Background(), "oldest"); err == nil {
+		t.Fatalf("expected error for unknown sort")
+	}
+}
+
+func TestGetCartStock(t *testing.T) {
 	db, mock, _ := sqlmock.New()
 	defer db.Close()
 	s := &PostgresStore{DB: db}
 
-	// Begin
-	mock.ExpectBegin()
-	// Query cart items -> two products
-	rows := sqlmock.NewRows([]string{"product_id", "quantity", "price", "stock"}).
-		AddRow(int64(1), 2, 10.0, 5).
-		AddRow(int64(2), 1, 20.0, 3)
+	rows := sqlmock.NewRows([]string{"product_id", "quantity", "stock", "track_inventory"}).
+		AddRow(int64(1), 2, 5, true).
+		AddRow(int64(2), 4, 1, false)
 	mock.ExpectQuery(regexp.QuoteMeta(`
-		SELECT ci.product_id, ci.quantity, p.price, p.stock
+		SELECT ci.product_id, ci.quantity, p.stock, p.track_inventory
 		FROM cart_items ci
 		JOIN products p ON p.id = ci.product_id
 		WHERE ci.cart_id = $1
-		FOR UPDATE
-	`)).WithArgs("userA").WillReturnRows(rows)
-
-	// Validate and insert order -> expect insert returning id,created_at
-	createdAt := time.Now()
-	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO orders (user_id, total) VALUES ($1,$2) RETURNING id, created_at`)).
-		WithArgs("userA", 40.0).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(77), createdAt))
+		ORDER BY ci.product_id
+	`)).WithArgs("u1").WillReturnRows(rows)
 
-	// Prepare insert order_items
-	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO order_items (order_id, product_id, quantity, price) VALUES ($1,$2,$3,$4)`))
-	// Exec insert for first item
+	got, err := s.GetCartStock(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("GetCartStock failed: %v", err)
+	}
+	if len(got) != 2 || got[1].ProductID != 2 || got[1].Quantity != 4 || got[1].Stock != 1 || got[1].Tracked || !got[0].Tracked {
+		t.Fatalf("unexpected cart stock rows: %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetCartDetailed_JoinAndMissingProduct(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	rows := sqlmock.NewRows([]string{"product_id", "quantity", "id", "name", "description", "price", "stock"}).
+		AddRow(int64(1), 2, int64(1), "speaker", "loud", 25.0, 4).
+		AddRow(int64(2), 1, nil, nil, nil, nil, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(`
+		SELECT ci.product_id, ci.quantity, p.id, p.name, p.description, p.price, p.stock
+		FROM cart_items ci
+		LEFT JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1
+		ORDER BY ci.product_id
+	`)).WithArgs("u1").WillReturnRows(rows)
+
+	got, err := s.GetCartDetailed(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("GetCartDetailed failed: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(got))
+	}
+	if got[0].Product == nil || got[0].Product.Name != "speaker" || got[0].Product.Stock != 4 {
+		t.Fatalf("unexpected enriched row: %+v", got[0])
+	}
+	if got[1].Product != nil {
+		t.Fatalf("expected nil product for missing row, got %+v", got[1].Product)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_EmptyCart(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`
+		SELECT ci.product_id, ci.quantity, p.price, p.currency,
+		       p.published AND COALESCE(p.available_from <= now(), true) AND COALESCE(p.available_until > now(), true)
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1
+		ORDER BY p.id
+		FOR UPDATE
+	`)).WithArgs("userx").WillReturnRows(sqlmock.NewRows(checkoutCols))
+	// nothing to order -> transaction rolled back
+	mock.ExpectRollback()
+
+	if _, _, _, err := s.Checkout(context.Background(), "userx", nil, CheckoutOptions{}); !errors.Is(err, ErrCartEmpty) {
+		t.Fatalf("expected ErrCartEmpty, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_Success(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// Begin
+	mock.ExpectBegin()
+	// Query cart items -> two products
+	rows := sqlmock.NewRows(checkoutCols).
+		AddRow(int64(1), 2, 10.0, "USD", true).
+		AddRow(int64(2), 1, 20.0, "USD", true)
+	mock.ExpectQuery(regexp.QuoteMeta(`
+		SELECT ci.product_id, ci.quantity, p.price, p.currency,
+		       p.published AND COALESCE(p.available_from <= now(), true) AND COALESCE(p.available_until > now(), true)
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1
+		ORDER BY p.id
+		FOR UPDATE
+	`)).WithArgs("userA").WillReturnRows(rows)
+
+	// Insert order -> expect insert returning id,created_at
+	createdAt := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO orders (user_id, total, metadata, cart_snapshot, status, discount, coupon_code, currency) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id, created_at`)).
+		WithArgs("userA", "40.00", `{"campaign":"spring"}`,
+			`[{"product_id":1,"quantity":2,"price":10},{"product_id":2,"quantity":1,"price":20}]`, OrderStatusPlaced, "0.00", nil, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(77), createdAt))
+
+	// Prepare insert order_items
+	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO order_items (order_id, product_id, quantity, price) VALUES ($1,$2,$3,$4)`))
+	// Exec insert for first item
 	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items (order_id, product_id, quantity, price) VALUES ($1,$2,$3,$4)`)).
-		WithArgs(int64(77), int64(1), 2, 10.0).
+		WithArgs(int64(77), int64(1), 2, "10.00").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	// Exec insert for second item
 	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items (order_id, product_id, quantity, price) VALUES ($1,$2,$3,$4)`)).
-		WithArgs(int64(77), int64(2), 1, 20.0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-
-	// Prepare update stock and expect two updates
-	mock.ExpectPrepare(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`))
-	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
-		WithArgs(2, int64(1)).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
-		WithArgs(1, int64(2)).
+		WithArgs(int64(77), int64(2), 1, "20.00").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	// Stock was reserved at AddToCart, so no product updates here: sqlmock
+	// fails the test on any statement not expected.
 	// Delete cart_items and cart
 	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id = $1`)).
 		WithArgs("userA").
@@ -187,15 +873,2623 @@ func TestCheckout_Success(t *testing.T) {
 	// Commit
 	mock.ExpectCommit()
 
-	order, items, err := s.Checkout("userA")
+	order, items, removed, err := s.Checkout(context.Background(), "userA", map[string]string{"campaign": "spring"}, CheckoutOptions{})
 	if err != nil {
 		t.Fatalf("Checkout failed: %v", err)
 	}
-	if order.ID != 77 || order.UserID != "userA" || len(items) != 2 {
+	if order.ID != 77 || order.UserID != "userA" || len(items) != 2 || order.Metadata["campaign"] != "spring" || order.Currency != "USD" {
 		t.Fatalf("unexpected order result: %+v %+v", order, items)
 	}
+	if len(removed) != 0 {
+		t.Fatalf("expected nothing removed, got %v", removed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUpdateOrderMetadata(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET metadata=$1 WHERE id=$2`)).
+		WithArgs(`{"referrer":"ads"}`, int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.UpdateOrderMetadata(context.Background(), 9, map[string]string{"referrer": "ads"}); err != nil {
+		t.Fatalf("UpdateOrderMetadata failed: %v", err)
+	}
+
+	// unknown order; nil metadata is stored as an empty object
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET metadata=$1 WHERE id=$2`)).
+		WithArgs(`{}`, int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := s.UpdateOrderMetadata(context.Background(), 10, nil); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// expectReturnLookup queues the order, order-line and prior-returns lookups
+// of ReturnOrderItem for a delivered order owned by u1
+func expectReturnLookup(mock sqlmock.Sqlmock, orderID, productID int64, ordered int, price float64, returned int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, status FROM orders WHERE id = $1 FOR UPDATE`)).
+		WithArgs(orderID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status"}).AddRow("u1", OrderStatusDelivered))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT quantity, price FROM order_items WHERE order_id=$1 AND product_id=$2 FOR UPDATE`)).
+		WithArgs(orderID, productID).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity", "price"}).AddRow(ordered, price))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(SUM(quantity), 0) FROM order_returns WHERE order_id=$1 AND product_id=$2`)).
+		WithArgs(orderID, productID).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(returned))
+}
+
+func TestReturnOrderItem_PartialWithRestock(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// ordered 3, 1 already returned, return 2 more -> allowed
+	expectReturnLookup(mock, 5, 1, 3, 10.0, 1)
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_returns (order_id, product_id, quantity, amount, restocked) VALUES ($1,$2,$3,$4,$5)`)).
+		WithArgs(int64(5), int64(1), 2, "20.00", true).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(2, int64(1), MovementReturn).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET refunded_total = refunded_total + $1 WHERE id = $2`)).
+		WithArgs("20.00", int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := s.ReturnOrderItem(context.Background(), 5, "u1", 1, 2, true); err != nil {
+		t.Fatalf("ReturnOrderItem failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestReturnOrderItem_WithoutRestock(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// damaged goods: refund but don't touch stock
+	expectReturnLookup(mock, 5, 1, 3, 10.0, 0)
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_returns (order_id, product_id, quantity, amount, restocked) VALUES ($1,$2,$3,$4,$5)`)).
+		WithArgs(int64(5), int64(1), 1, "10.00", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET refunded_total = refunded_total + $1 WHERE id = $2`)).
+		WithArgs("10.00", int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := s.ReturnOrderItem(context.Background(), 5, "u1", 1, 1, false); err != nil {
+		t.Fatalf("ReturnOrderItem failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestReturnOrderItem_OverQuantityRejected(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// ordered 3, 2 already returned, asking for 2 more -> rejected, nothing written
+	expectReturnLookup(mock, 5, 1, 3, 10.0, 2)
+	mock.ExpectRollback()
+
+	if err := s.ReturnOrderItem(context.Background(), 5, "u1", 1, 2, true); !errors.Is(err, ErrReturnExceedsOrdered) {
+		t.Fatalf("expected ErrReturnExceedsOrdered, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestReturnOrderItem_AnotherUsersOrder(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, status FROM orders WHERE id = $1 FOR UPDATE`)).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status"}).AddRow("u1", OrderStatusDelivered))
+	mock.ExpectRollback()
+
+	if err := s.ReturnOrderItem(context.Background(), 5, "u2", 1, 1, true); !errors.Is(err, ErrNotOrderOwner) {
+		t.Fatalf("expected ErrNotOrderOwner, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestReturnOrderItem_AfterCancelRejected(t *testing.T) {
+	// cancelling already put back every unreturned unit, so a return now would
+	// restock them twice and refund them again; unshipped orders are cancelled,
+	// not returned
+	for _, status := range []string{OrderStatusCancelled, OrderStatusPlaced, OrderStatusPending, OrderStatusPaid} {
+		db, mock, _ := sqlmock.New()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, status FROM orders WHERE id = $1 FOR UPDATE`)).
+			WithArgs(int64(5)).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "status"}).AddRow("u1", status))
+		mock.ExpectRollback()
+
+		if err := s.ReturnOrderItem(context.Background(), 5, "u1", 1, 1, true); !errors.Is(err, ErrInvalidTransition) {
+			t.Fatalf("%s order: expected ErrInvalidTransition, got %v", status, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%s order: unmet expectations: %v", status, err)
+		}
+		db.Close()
+	}
+}
+
+func TestGetStock_UntrackedSentinel(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT p.stock, p.track_inventory,`)).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"stock", "track_inventory", "bundle_stock"}).AddRow(4, true, nil))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT p.stock, p.track_inventory,`)).
+		WithArgs(int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"stock", "track_inventory", "bundle_stock"}).AddRow(0, false, nil))
+
+	if n, err := s.GetStock(context.Background(), 1); err != nil || n != 4 {
+		t.Fatalf("expected stock 4, got %d (%v)", n, err)
+	}
+	if n, err := s.GetStock(context.Background(), 2); err != nil || n != UntrackedStock {
+		t.Fatalf("expected UntrackedStock, got %d (%v)", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUpdateStock_UntrackedAndMissing(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// untracked product -> rejected
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock=$1 WHERE id=$2 AND track_inventory`)).
+		WithArgs(10, int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT track_inventory FROM products WHERE id=$1`)).
+		WithArgs(int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"track_inventory"}).AddRow(false))
+	if err := s.UpdateStock(context.Background(), 2, 10); !errors.Is(err, ErrUntrackedInventory) {
+		t.Fatalf("expected ErrUntrackedInventory, got %v", err)
+	}
+
+	// missing product -> sql.ErrNoRows
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock=$1 WHERE id=$2 AND track_inventory`)).
+		WithArgs(10, int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT track_inventory FROM products WHERE id=$1`)).
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"track_inventory"}))
+	if err := s.UpdateStock(context.Background(), 3, 10); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUpdateStockBatch(t *testing.T) {
+	lockQ := regexp.QuoteMeta(`SELECT id, track_inventory FROM products WHERE id = ANY($1) ORDER BY id FOR UPDATE`)
+	setQ := regexp.QuoteMeta(`moved AS (UPDATE products SET stock=$1 WHERE id=$2 RETURNING id)`)
+
+	t.Run("every product is set, in id order", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{2, 5})).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "track_inventory"}).AddRow(int64(2), true).AddRow(int64(5), true))
+		mock.ExpectExec(setQ).WithArgs(40, int64(2), MovementAdjustment).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(setQ).WithArgs(100, int64(5), MovementAdjustment).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		err := s.UpdateStockBatch(context.Background(), []StockUpdate{{ProductID: 5, NewStock: 100}, {ProductID: 2, NewStock: 40}})
+		if err != nil {
+			t.Fatalf("UpdateStockBatch: %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("unknown id rolls the batch back", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{2, 7, 99})).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "track_inventory"}).AddRow(int64(2), true))
+		mock.ExpectRollback()
+
+		err := s.UpdateStockBatch(context.Background(), []StockUpdate{{ProductID: 2, NewStock: 40}, {ProductID: 99, NewStock: 1}, {ProductID: 7, NewStock: 3}})
+		if !errors.Is(err, sql.ErrNoRows) || !strings.Contains(err.Error(), "products [7 99]") {
+			t.Fatalf("expected sql.ErrNoRows naming products 7 and 99, got %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("untracked product fails the batch", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{2, 3})).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "track_inventory"}).AddRow(int64(2), true).AddRow(int64(3), false))
+		mock.ExpectRollback()
+
+		err := s.UpdateStockBatch(context.Background(), []StockUpdate{{ProductID: 2, NewStock: 40}, {ProductID: 3, NewStock: 1}})
+		if !errors.Is(err, ErrUntrackedInventory) || !strings.Contains(err.Error(), "products [3]") {
+			t.Fatalf("expected ErrUntrackedInventory naming product 3, got %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+}
+
+func TestListLowStockProducts(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// stock equal to the threshold is low
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE track_inventory AND NOT is_deleted AND stock <= $1
+		ORDER BY stock, id`)).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency"}).
+			AddRow(int64(7), "cable", nil, 3.0, 0, nil, "USD").
+			AddRow(int64(4), "mug", nil, 4.5, 5, nil, "USD"))
+
+	ps, err := s.ListLowStockProducts(context.Background(), 5)
+	if err != nil || len(ps) != 2 || ps[0].ID != 7 || ps[1].Stock != 5 {
+		t.Fatalf("unexpected result %+v %v", ps, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAdjustStock(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	adjust := regexp.QuoteMeta(`UPDATE products SET stock = stock + $1`)
+	lookup := regexp.QuoteMeta(`SELECT track_inventory, stock FROM products WHERE id=$1`)
+
+	mock.ExpectExec(adjust).WithArgs(12, int64(1), MovementAdjustment).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.AdjustStock(context.Background(), 1, 12); err != nil {
+		t.Fatalf("AdjustStock: %v", err)
+	}
+
+	// guard fails on a tracked product -> not enough stock
+	mock.ExpectExec(adjust).WithArgs(-5, int64(1), MovementAdjustment).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lookup).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"track_inventory", "stock"}).AddRow(true, 3))
+	if err := s.AdjustStock(context.Background(), 1, -5); !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("expected ErrInsufficientStock, got %v", err)
+	}
+
+	mock.ExpectExec(adjust).WithArgs(2, int64(2), MovementAdjustment).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lookup).WithArgs(int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"track_inventory", "stock"}).AddRow(false, 0))
+	if err := s.AdjustStock(context.Background(), 2, 2); !errors.Is(err, ErrUntrackedInventory) {
+		t.Fatalf("expected ErrUntrackedInventory, got %v", err)
+	}
+
+	mock.ExpectExec(adjust).WithArgs(2, int64(3), MovementAdjustment).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lookup).WithArgs(int64(3)).WillReturnRows(sqlmock.NewRows([]string{"track_inventory", "stock"}))
+	if err := s.AdjustStock(context.Background(), 3, 2); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	if err := s.AdjustStock(context.Background(), 1, 0); err == nil {
+		t.Fatalf("expected error for zero delta")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListOutboxEvents_Failed(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "event_type", "payload", "status", "attempts", "last_error", "created_at", "published_at"}).
+		AddRow(int64(1), "order.created", []byte(`{"id":10}`), "failed", 5, "connection refused", now, nil).
+		AddRow(int64(4), "order.created", []byte(`{"id":11}`), "failed", 5, nil, now, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM outbox_events WHERE status=$1 ORDER BY id`)).
+		WithArgs("failed").
+		WillReturnRows(rows)
+
+	got, err := s.ListOutboxEvents(context.Background(), OutboxFailed)
+	if err != nil {
+		t.Fatalf("ListOutboxEvents failed: %v", err)
+	}
+	if len(got) != 2 || got[0].LastError.String != "connection refused" || got[1].LastError.Valid {
+		t.Fatalf("unexpected events: %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMarkOutboxUnpublished(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox_events SET status=$1, attempts=0, last_error=NULL, published_at=NULL WHERE id=$2`)).
+		WithArgs("pending", int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox_events SET status=$1`)).
+		WithArgs("pending", int64(99)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
 
+	if err := s.MarkOutboxUnpublished(context.Background(), 1); err != nil {
+		t.Fatalf("MarkOutboxUnpublished failed: %v", err)
+	}
+	if err := s.MarkOutboxUnpublished(context.Background(), 99); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Fatalf("unmet expectations: %v", err)
 	}
 }
+
+func TestOutboxEnqueueAndAttempts(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO outbox_events (event_type, payload) VALUES ($1, $2) RETURNING id`)).
+		WithArgs("checkout.sync", `{"id":7}`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(3)))
+	mock.ExpectExec(regexp.QuoteMeta(`status = CASE WHEN attempts + 1 >= $2 THEN $3 ELSE status END`)).
+		WithArgs("erp down", 5, "failed", int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox_events SET status=$1, attempts=attempts+1, last_error=NULL, published_at=now() WHERE id=$2`)).
+		WithArgs("published", int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox_events SET status=$1`)).
+		WithArgs("published", int64(99)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	id, err := s.EnqueueOutboxEvent(context.Background(), "checkout.sync", []byte(`{"id":7}`))
+	if err != nil || id != 3 {
+		t.Fatalf("EnqueueOutboxEvent: got %d, %v", id, err)
+	}
+	if err := s.MarkOutboxAttemptFailed(context.Background(), 3, "erp down", 5); err != nil {
+		t.Fatalf("MarkOutboxAttemptFailed failed: %v", err)
+	}
+	if err := s.MarkOutboxPublished(context.Background(), 3); err != nil {
+		t.Fatalf("MarkOutboxPublished failed: %v", err)
+	}
+	if err := s.MarkOutboxPublished(context.Background(), 99); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetCartWeights(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	rows := sqlmock.NewRows([]string{"product_id", "quantity", "weight_grams"}).
+		AddRow(int64(1), 2, int64(750)).
+		AddRow(int64(2), 1, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.weight_grams`)).
+		WithArgs("u1").
+		WillReturnRows(rows)
+
+	got, err := s.GetCartWeights(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("GetCartWeights failed: %v", err)
+	}
+	if len(got) != 2 || got[0].WeightGrams.Int64 != 750 || got[1].WeightGrams.Valid {
+		t.Fatalf("unexpected rows: %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+const productsByTagsSQL = `
+		SELECT p.id, p.name, p.description, p.price, p.stock, p.category, p.currency
+		FROM products p
+		JOIN product_tags t ON t.product_id = p.id
+		WHERE t.tag = ANY($1) AND p.published
+		GROUP BY p.id
+		HAVING COUNT(DISTINCT t.tag) = $2
+		ORDER BY p.id
+	`
+
+func TestListProductsByTags_SingleTag(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	rows := sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency"}).
+		AddRow(int64(1), "speaker", nil, 25.0, 4, nil, "USD").
+		AddRow(int64(3), "cable", nil, 5.0, 40, nil, "USD")
+	mock.ExpectQuery(regexp.QuoteMeta(productsByTagsSQL)).
+		WithArgs(`{"on-sale"}`, 1).
+		WillReturnRows(rows)
+
+	got, err := s.ListProductsByTags(context.Background(), []string{"on-sale"})
+	if err != nil {
+		t.Fatalf("ListProductsByTags failed: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 3 {
+		t.Fatalf("unexpected rows: %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListProductsByTags_MultiTagAnd(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// AND semantics: HAVING requires every requested tag to match
+	rows := sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency"}).
+		AddRow(int64(3), "cable", nil, 5.0, 40, nil, "USD")
+	mock.ExpectQuery(regexp.QuoteMeta(productsByTagsSQL)).
+		WithArgs(`{"on-sale","new"}`, 2).
+		WillReturnRows(rows)
+
+	got, err := s.ListProductsByTags(context.Background(), []string{"on-sale", "new"})
+	if err != nil {
+		t.Fatalf("ListProductsByTags failed: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != 3 {
+		t.Fatalf("unexpected rows: %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListTagsForProducts(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	rows := sqlmock.NewRows([]string{"product_id", "tag"}).
+		AddRow(int64(1), "new").
+		AddRow(int64(1), "on-sale").
+		AddRow(int64(2), "clearance")
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT product_id, tag FROM product_tags WHERE product_id = ANY($1) ORDER BY product_id, tag`)).
+		WithArgs(`{1,2}`).
+		WillReturnRows(rows)
+
+	got, err := s.ListTagsForProducts(context.Background(), []int64{1, 2})
+	if err != nil {
+		t.Fatalf("ListTagsForProducts failed: %v", err)
+	}
+	if len(got[1]) != 2 || got[2][0] != "clearance" {
+		t.Fatalf("unexpected tags: %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetPrices_OmitsUnknown(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// 2 doesn't exist and 5 is a draft; the filter keeps both out
+	rows := sqlmock.NewRows([]string{"id", "price"}).
+		AddRow(int64(1), 9.99).
+		AddRow(int64(3), 4.5)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, price FROM products WHERE id = ANY($1) AND published AND NOT is_deleted`)).
+		WithArgs(`{1,2,3,5}`).
+		WillReturnRows(rows)
+
+	got, err := s.GetPrices(context.Background(), []int64{1, 2, 3, 5})
+	if err != nil {
+		t.Fatalf("GetPrices failed: %v", err)
+	}
+	if len(got) != 2 || got[1] != 999 || got[3] != 450 {
+		t.Fatalf("unexpected prices: %v", got)
+	}
+	if _, ok := got[2]; ok {
+		t.Fatalf("unknown id 2 should be omitted")
+	}
+	if _, ok := got[5]; ok {
+		t.Fatalf("draft 5 should be omitted")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddToCart_AvailabilityWindow(t *testing.T) {
+	cases := []struct {
+		name            string
+		notYet, expired bool
+		want            error
+	}{
+		{"before window", true, false, ErrNotAvailableYet},
+		{"after window", false, true, ErrNoLongerAvailable},
+		{"in window", false, false, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, _ := sqlmock.New()
+			defer db.Close()
+			s := &PostgresStore{DB: db}
+
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+				WithArgs("u1").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+				WithArgs(int64(1)).
+				WillReturnRows(lockRows(lockRow{stock: 5, notYet: tc.notYet, expired: tc.expired}))
+			if tc.want != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+					WithArgs("u1", int64(1), 1, nil).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+					WithArgs(1, int64(1)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+
+			err := s.AddToCart(context.Background(), "u1", 1, 1)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestListAllOrders_CombinedFilters(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	created := from.Add(time.Hour)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, user_id, total, currency, status, metadata, created_at, discount, COALESCE(coupon_code, '') FROM orders WHERE status = $1 AND user_id = $2 AND created_at >= $3 AND created_at < $4 ORDER BY created_at DESC, id DESC LIMIT $5 OFFSET $6`)).
+		WithArgs("placed", "u1", from, to, 10, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "total", "currency", "status", "metadata", "created_at", "discount", "coupon_code"}).
+			AddRow(9, "u1", 12.5, "USD", "placed", []byte(`{"campaign":"spring"}`), created, 0.0, "").
+			AddRow(8, "u1", 3.0, "USD", "placed", []byte(`{}`), created, 0.0, ""))
+
+	rows, err := s.ListAllOrders(context.Background(), OrderFilter{Status: "placed", UserID: "u1", From: from, To: to}, 10, 20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rows) != 2 || rows[0].ID != 9 || rows[0].Metadata["campaign"] != "spring" || !rows[0].CreatedAt.Equal(created) {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestOrdersContainingProduct(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	cols := []string{"id", "user_id", "total", "currency", "status", "metadata", "created_at", "quantity", "price"}
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	created := from.Add(time.Hour)
+	// date window
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM orders o JOIN order_items oi ON oi.order_id = o.id WHERE oi.product_id = $1 AND o.created_at >= $2 AND o.created_at < $3 ORDER BY o.created_at DESC, o.id DESC LIMIT $4 OFFSET $5`)).
+		WithArgs(int64(7), from, to, 10, 0).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(9, "u1", 30.0, "EUR", "placed", []byte(`{}`), created, 3, 5.0).
+			AddRow(4, "u2", 5.0, "USD", "shipped", []byte(`{"gift":"yes"}`), created, 1, 5.0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM orders o JOIN order_items oi ON oi.order_id = o.id WHERE oi.product_id = $1 AND o.created_at >= $2 AND o.created_at < $3`)).
+		WithArgs(int64(7), from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	// open-ended: only the lower bound
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE oi.product_id = $1 AND o.created_at >= $2 ORDER BY o.created_at DESC, o.id DESC LIMIT $3 OFFSET $4`)).
+		WithArgs(int64(7), from, 10, 10).
+		WillReturnRows(sqlmock.NewRows(cols))
+
+	rows, err := s.OrdersContainingProduct(context.Background(), 7, from, to, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rows) != 2 || rows[0].ID != 9 || rows[0].Quantity != 3 || rows[0].Currency != "EUR" || rows[1].Metadata["gift"] != "yes" {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	if n, err := s.CountOrdersContainingProduct(context.Background(), 7, from, to); err != nil || n != 2 {
+		t.Fatalf("expected count 2, got %d %v", n, err)
+	}
+	if rows, err := s.OrdersContainingProduct(context.Background(), 7, from, time.Time{}, 10, 10); err != nil || len(rows) != 0 {
+		t.Fatalf("expected no rows, got %v %v", rows, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListAllOrders_NoFilterAndCount(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM orders ORDER BY created_at DESC, id DESC LIMIT $1 OFFSET $2`)).
+		WithArgs(5, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "total", "currency", "status", "metadata", "created_at", "discount", "coupon_code"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM orders WHERE user_id = $1`)).
+		WithArgs("u2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	if rows, err := s.ListAllOrders(context.Background(), OrderFilter{}, 5, 0); err != nil || len(rows) != 0 {
+		t.Fatalf("expected no rows, got %v %v", rows, err)
+	}
+	if n, err := s.CountOrders(context.Background(), OrderFilter{UserID: "u2"}); err != nil || n != 3 {
+		t.Fatalf("expected 3, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListAllOrders_StatusOnly(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	created := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM orders WHERE status = $1 ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`)).
+		WithArgs("shipped", 50, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "total", "currency", "status", "metadata", "created_at", "discount", "coupon_code"}).
+			AddRow(12, "u3", 7.0, "USD", "shipped", []byte(`{}`), created, 0.0, "").
+			AddRow(4, "u1", 9.5, "USD", "shipped", []byte(`{}`), created.Add(-time.Hour), 0.0, ""))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM orders WHERE status = $1`)).
+		WithArgs("shipped").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	filter := OrderFilter{Status: "shipped"}
+	rows, err := s.ListAllOrders(context.Background(), filter, 50, 0)
+	if err != nil || len(rows) != 2 || rows[0].UserID != "u3" || rows[1].UserID != "u1" {
+		t.Fatalf("unexpected rows: %+v %v", rows, err)
+	}
+	if n, err := s.CountOrders(context.Background(), filter); err != nil || n != 2 {
+		t.Fatalf("expected 2, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddToCart_UnpricedRejected(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(4)).
+		WillReturnRows(lockRows(lockRow{stock: 10, unpriced: true}))
+	mock.ExpectRollback()
+
+	if err := s.AddToCart(context.Background(), "u1", 4, 1); !errors.Is(err, ErrNoPrice) {
+		t.Fatalf("expected ErrNoPrice, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_UnpricedRejected(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).
+			AddRow(1, 1, 5.0, "USD", true).
+			AddRow(4, 1, nil, "USD", true))
+	mock.ExpectRollback()
+
+	if _, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{}); !errors.Is(err, ErrNoPrice) {
+		t.Fatalf("expected ErrNoPrice, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_UnavailableRejectedByDefault(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).
+			AddRow(1, 1, 5.0, "USD", true).
+			AddRow(2, 3, 8.0, "USD", false))
+	mock.ExpectRollback()
+
+	if _, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{}); !errors.Is(err, ErrItemUnavailable) {
+		t.Fatalf("expected ErrItemUnavailable, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_MixedCurrenciesRejected(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).
+			AddRow(1, 1, 5.0, "USD", true).
+			AddRow(2, 2, 8.0, "EUR", true))
+	mock.ExpectRollback()
+
+	_, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{})
+	if !errors.Is(err, ErrMixedCurrencies) {
+		t.Fatalf("expected ErrMixedCurrencies, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "USD and EUR") {
+		t.Fatalf("expected both currencies in %q", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_RemoveUnavailable(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	// 1 is fine, 2 (tracked) was unpublished, 3 (untracked) lost its price
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).
+			AddRow(int64(1), 2, 5.0, "USD", true).
+			AddRow(int64(2), 3, 8.0, "USD", false).
+			AddRow(int64(3), 1, nil, "USD", true))
+	// both dropped lines are released; the statement itself skips the
+	// untracked product
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(3, int64(2), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(1, int64(3), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	// the snapshot keeps the dropped lines, as they were
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO orders (user_id, total, metadata, cart_snapshot, status, discount, coupon_code, currency)`)).
+		WithArgs("u1", "10.00", `{}`,
+			`[{"product_id":1,"quantity":2,"price":5},{"product_id":2,"quantity":3,"price":8,"removed":true},{"product_id":3,"quantity":1,"price":null,"removed":true}]`, OrderStatusPlaced, "0.00", nil, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(9), time.Now()))
+	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO order_items`))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items`)).
+		WithArgs(int64(9), int64(1), 2, "5.00").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM carts WHERE user_id = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	order, items, removed, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{RemoveUnavailable: true})
+	if err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	if order.ID != 9 || order.Total != 1000 || len(items) != 1 || items[0].ProductID != 1 {
+		t.Fatalf("unexpected order result: %+v %+v", order, items)
+	}
+	if len(removed) != 2 || removed[0] != 2 || removed[1] != 3 {
+		t.Fatalf("expected products 2 and 3 removed, got %v", removed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_RemoveUnavailableReleasesBundleComponents(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	// 9 is a bundle (untracked itself) that was unpublished
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).
+			AddRow(int64(1), 1, 5.0, "USD", true).
+			AddRow(int64(9), 2, 20.0, "USD", false))
+	// the bundle's line goes back through its components
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT component_id, quantity FROM bundle_components WHERE bundle_id = $2`)).
+		WithArgs(2, int64(9), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO orders (user_id, total, metadata, cart_snapshot, status, discount, coupon_code, currency)`)).
+		WithArgs("u1", "5.00", `{}`,
+			`[{"product_id":1,"quantity":1,"price":5},{"product_id":9,"quantity":2,"price":20,"removed":true}]`, OrderStatusPlaced, "0.00", nil, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(3), time.Now()))
+	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO order_items`))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items`)).
+		WithArgs(int64(3), int64(1), 1, "5.00").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM carts WHERE user_id = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, _, removed, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{RemoveUnavailable: true})
+	if err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != 9 {
+		t.Fatalf("expected bundle 9 removed, got %v", removed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_RemoveUnavailable_NothingLeft(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).AddRow(int64(2), 1, 8.0, "USD", false))
+	mock.ExpectRollback()
+
+	if _, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{RemoveUnavailable: true}); !errors.Is(err, ErrItemUnavailable) {
+		t.Fatalf("expected ErrItemUnavailable, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetPrices_OmitsUnpriced(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, price FROM products WHERE id = ANY($1) AND published AND NOT is_deleted`)).
+		WithArgs("{1,4}").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "price"}).AddRow(1, 5.0).AddRow(4, nil))
+
+	prices, err := s.GetPrices(context.Background(), []int64{1, 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := prices[4]; ok || prices[1] != 500 {
+		t.Fatalf("expected only product 1 priced, got %v", prices)
+	}
+}
+
+func TestGetInboundETA(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	eta := time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT MIN(expected_at) FROM purchase_orders WHERE product_id=$1 AND expected_at > now()`)).
+		WithArgs(int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(eta))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT MIN(expected_at) FROM purchase_orders`)).
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(nil))
+
+	got, err := s.GetInboundETA(context.Background(), 2)
+	if err != nil || got == nil || !got.Equal(eta) {
+		t.Fatalf("expected ETA %v, got %v %v", eta, got, err)
+	}
+	if got, err := s.GetInboundETA(context.Background(), 3); err != nil || got != nil {
+		t.Fatalf("expected no ETA, got %v %v", got, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreatePurchaseOrder_UnknownProduct(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	at := time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO purchase_orders (product_id, quantity, expected_at)`)).
+		WithArgs(int64(99), 10, at).
+		WillReturnError(&pq.Error{Code: "23503"})
+
+	if _, err := s.CreatePurchaseOrder(context.Background(), 99, 10, at); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestCloneProduct_DraftWithZeroStock(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	// name/description/price/tracking/weight copied; stock 0 and unpublished
+	mock.ExpectQuery(regexp.QuoteMeta(`
+		INSERT INTO products (name, description, price, stock, published, track_inventory, weight_grams, category, currency)
+		SELECT name || ' (copy)', description, price, 0, false, track_inventory, weight_grams, category, currency
+		FROM products WHERE id = $1
+		RETURNING id`)).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO product_tags (product_id, tag) SELECT $1, tag FROM product_tags WHERE product_id = $2`)).
+		WithArgs(int64(12), int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	id, err := s.CloneProduct(context.Background(), 5)
+	if err != nil || id != 12 {
+		t.Fatalf("expected clone id 12, got %d %v", id, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCloneProduct_NotFound(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name || ' (copy)'`)).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	if _, err := s.CloneProduct(context.Background(), 9); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListProducts_HidesDrafts(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	cols := []string{"id", "name", "description", "price", "stock", "category", "currency"}
+	allCols := append(cols, "is_deleted")
+	allQ := regexp.QuoteMeta(`SELECT id, name, description, price, stock, category, currency, is_deleted FROM products
+		WHERE $1 OR NOT is_deleted`)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM products WHERE published AND NOT is_deleted ORDER BY id`)).
+		WillReturnRows(sqlmock.NewRows(append(cols, "created_at", "updated_at")).AddRow(1, "live", nil, 5.0, 3, nil, "USD", time.Now(), time.Now()))
+	mock.ExpectQuery(allQ).WithArgs(false).
+		WillReturnRows(sqlmock.NewRows(allCols).AddRow(1, "live", nil, 5.0, 3, nil, "USD", false).AddRow(2, "live (copy)", nil, 5.0, 0, nil, "USD", false))
+	mock.ExpectQuery(allQ).WithArgs(true).
+		WillReturnRows(sqlmock.NewRows(allCols).AddRow(1, "live", nil, 5.0, 3, nil, "USD", false).AddRow(3, "gone", nil, 5.0, 0, nil, "USD", true))
+
+	if ps, err := s.ListProducts(context.Background(), ""); err != nil || len(ps) != 1 {
+		t.Fatalf("expected 1 published product, got %v %v", ps, err)
+	}
+	if ps, err := s.ListAllProducts(context.Background(), false); err != nil || len(ps) != 2 {
+		t.Fatalf("expected drafts in ListAllProducts, got %v %v", ps, err)
+	}
+	if ps, err := s.ListAllProducts(context.Background(), true); err != nil || len(ps) != 2 || ps[0].Deleted || !ps[1].Deleted {
+		t.Fatalf("expected the deleted product marked, got %+v %v", ps, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestSoftDeletedProduct_HiddenButStillOrdered(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+	cols := []string{"id", "name", "description", "price", "stock", "category", "currency"}
+
+	// every storefront read skips deleted rows
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM products WHERE id = $1 AND published AND NOT is_deleted`)).
+		WithArgs(int64(4)).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM products WHERE published AND NOT is_deleted ORDER BY id`)).
+		WillReturnRows(sqlmock.NewRows(cols))
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE published AND NOT is_deleted AND (name ILIKE`)).
+		WithArgs("mug", MaxSearchResults).WillReturnRows(sqlmock.NewRows(cols))
+	// and so does adding it to a cart
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM products WHERE id = $1 AND NOT is_deleted FOR UPDATE`)).
+		WithArgs(int64(4)).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	// but an order placed before the delete still names it
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM order_items oi LEFT JOIN products p ON p.id = oi.product_id`)).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity", "price", "name"}).AddRow(int64(4), 1, 7.5, "mug"))
+
+	if _, err := s.GetProduct(context.Background(), 4); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows for a deleted product, got %v", err)
+	}
+	if ps, err := s.ListProducts(context.Background(), ""); err != nil || len(ps) != 0 {
+		t.Fatalf("expected no products, got %v %v", ps, err)
+	}
+	if ps, err := s.SearchProducts(context.Background(), "mug"); err != nil || len(ps) != 0 {
+		t.Fatalf("expected no matches, got %v %v", ps, err)
+	}
+	if err := s.AddToCart(context.Background(), "u1", 4, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows adding a deleted product, got %v", err)
+	}
+	items, err := s.ListOrderItems(context.Background(), 9)
+	if err != nil || len(items) != 1 || items[0].Name != "mug" {
+		t.Fatalf("expected the order line to keep its name, got %+v %v", items, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestRestoreProduct(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+	q := regexp.QuoteMeta(`UPDATE products SET is_deleted = false WHERE id = $1`)
+	mock.ExpectExec(q).WithArgs(int64(4)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).WithArgs(int64(99)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := s.RestoreProduct(context.Background(), 4); err != nil {
+		t.Fatalf("RestoreProduct failed: %v", err)
+	}
+	if err := s.RestoreProduct(context.Background(), 99); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddToCart_UnpublishedRejected(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(6)).
+		WillReturnRows(lockRows(lockRow{stock: 10, draft: true}))
+	mock.ExpectRollback()
+
+	if err := s.AddToCart(context.Background(), "u1", 6, 1); !errors.Is(err, ErrNotPublished) {
+		t.Fatalf("expected ErrNotPublished, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestSetPublished(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET published=$1 WHERE id=$2`)).
+		WithArgs(true, int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET published=$1 WHERE id=$2`)).
+		WithArgs(false, int64(404)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := s.SetPublished(context.Background(), 3, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SetPublished(context.Background(), 404, false); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestGetCartContext_CombinedQuery(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`LEFT JOIN products p ON p.id = ci.product_id AND NOT p.is_deleted`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity", "deleted", "name", "price", "currency", "stock", "track_inventory", "published", "unavailable", "reservation_expired"}).
+			AddRow(1, 2, false, "mug", 4.5, "USD", 10, true, true, false, false).
+			AddRow(2, 1, false, "sofa", nil, "USD", 0, false, false, true, true).
+			AddRow(3, 1, true, "", nil, "USD", 0, false, false, false, false))
+
+	lines, err := s.GetCartContext(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []CartLineContext{
+		{ProductID: 1, Quantity: 2, Name: "mug", Price: money.NullCents{Cents: 450, Valid: true}, Stock: 10, Currency: "USD", Tracked: true, Published: true},
+		{ProductID: 2, Quantity: 1, Name: "sofa", Currency: "USD", Unavailable: true, ReservationExpired: true},
+		{ProductID: 3, Quantity: 1, Currency: "USD", Deleted: true},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got %d", len(want), len(lines))
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Fatalf("line %d: want %+v, got %+v", i, want[i], lines[i])
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestSalesVelocity(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	q := regexp.QuoteMeta(`SELECT COALESCE(SUM(oi.quantity), 0)`)
+	mock.ExpectQuery(q).
+		WithArgs(int64(3), OrderStatusCancelled, float64(7*24*3600)).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(21))
+	mock.ExpectQuery(q).
+		WithArgs(int64(4), OrderStatusCancelled, float64(30*24*3600)).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+
+	if v, err := s.SalesVelocity(context.Background(), 3, 7*24*time.Hour); err != nil || v != 3 {
+		t.Fatalf("expected 3 units/day, got %v %v", v, err)
+	}
+	// no sales in the window
+	if v, err := s.SalesVelocity(context.Background(), 4, 30*24*time.Hour); err != nil || v != 0 {
+		t.Fatalf("expected 0 units/day, got %v %v", v, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	created := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, user_id, total, currency, status, metadata, created_at, discount, COALESCE(coupon_code, '') FROM orders WHERE id = $1`)).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "total", "currency", "status", "metadata", "created_at", "discount", "coupon_code"}).
+			AddRow(int64(5), "u1", 24.0, "USD", OrderStatusCancelled, []byte(`{"campaign":"spring"}`), created, 6.0, "SPRING10"))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM order_items oi LEFT JOIN products p ON p.id = oi.product_id`)).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity", "price", "name"}).
+			AddRow(int64(1), 2, 10.0, "speaker").
+			AddRow(int64(2), 1, 4.0, "cable"))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM orders WHERE id = $1`)).
+		WithArgs(int64(6)).
+		WillReturnError(sql.ErrNoRows)
+
+	o, items, err := s.GetOrder(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("GetOrder failed: %v", err)
+	}
+	if o.UserID != "u1" || o.Status != OrderStatusCancelled || o.Metadata["campaign"] != "spring" || o.Discount != 600 || o.CouponCode != "SPRING10" ||
+		len(items) != 2 || items[1].ProductID != 2 {
+		t.Fatalf("unexpected order: %+v %+v", o, items)
+	}
+	if _, _, err := s.GetOrder(context.Background(), 6); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListOrdersAndItems(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	cols := []string{"id", "user_id", "total", "currency", "status", "metadata", "created_at", "discount", "coupon_code"}
+	newer, older := time.Now(), time.Now().Add(-time.Hour)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM orders
+		WHERE user_id = $1 ORDER BY created_at DESC, id DESC`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(int64(9), "u1", 8.0, "USD", OrderStatusPlaced, []byte(`{}`), newer, 0.0, "").
+			AddRow(int64(4), "u1", 20.0, "USD", OrderStatusShipped, []byte(`{"gift":"yes"}`), older, 0.0, ""))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM orders
+		WHERE user_id = $1 ORDER BY created_at DESC, id DESC`)).
+		WithArgs("u2").
+		WillReturnRows(sqlmock.NewRows(cols))
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE oi.order_id = $1 ORDER BY oi.product_id`)).
+		WithArgs(int64(4)).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity", "price", "name"}).
+			AddRow(int64(1), 2, 10.0, "speaker"))
+
+	orders, err := s.ListOrders(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("ListOrders failed: %v", err)
+	}
+	if len(orders) != 2 || orders[0].ID != 9 || orders[1].ID != 4 || orders[1].Metadata["gift"] != "yes" {
+		t.Fatalf("expected orders 9 then 4, got %+v", orders)
+	}
+	if orders, err := s.ListOrders(context.Background(), "u2"); err != nil || len(orders) != 0 {
+		t.Fatalf("expected no orders, got %+v %v", orders, err)
+	}
+	items, err := s.ListOrderItems(context.Background(), 4)
+	if err != nil || len(items) != 1 || items[0] != (OrderItemRow{ProductID: 1, Quantity: 2, Price: 1000, Name: "speaker"}) {
+		t.Fatalf("unexpected items %+v %v", items, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_Coupon(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	couponCols := []string{"code", "percent_off", "expires_at", "max_uses", "uses"}
+	cartQ := regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)
+	couponQ := regexp.QuoteMeta(`SELECT code, percent_off, expires_at, max_uses, uses FROM coupons WHERE code = $1 FOR UPDATE`)
+
+	// 10% off 33.30 -> 3.33 off, one use counted, code kept on the order
+	mock.ExpectBegin()
+	mock.ExpectQuery(cartQ).WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).AddRow(int64(1), 3, 11.1, "USD", true))
+	mock.ExpectQuery(couponQ).WithArgs("SPRING10").
+		WillReturnRows(sqlmock.NewRows(couponCols).AddRow("SPRING10", 10, time.Now().Add(time.Hour), 5, 4))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE coupons SET uses = uses + 1`)).WithArgs("SPRING10").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO orders (user_id, total, metadata, cart_snapshot, status, discount, coupon_code, currency)`)).
+		WithArgs("u1", "29.97", `{}`, `[{"product_id":1,"quantity":3,"price":11.1}]`, OrderStatusPlaced, "3.33", "SPRING10", "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(5), time.Now()))
+	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO order_items`))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items`)).WithArgs(int64(5), int64(1), 3, "11.10").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id = $1`)).WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM carts WHERE user_id = $1`)).WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	order, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{CouponCode: "SPRING10"})
+	if err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	if order.Discount != 333 || order.CouponCode != "SPRING10" {
+		t.Fatalf("unexpected discount %v / %q", order.Discount, order.CouponCode)
+	}
+
+	// an expired coupon fails the checkout before anything is written
+	mock.ExpectBegin()
+	mock.ExpectQuery(cartQ).WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).AddRow(int64(1), 1, 5.0, "USD", true))
+	mock.ExpectQuery(couponQ).WithArgs("OLD").
+		WillReturnRows(sqlmock.NewRows(couponCols).AddRow("OLD", 50, time.Now().Add(-time.Hour), nil, 0))
+	mock.ExpectRollback()
+	if _, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{CouponCode: "OLD"}); !errors.Is(err, ErrCouponExpired) {
+		t.Fatalf("expected ErrCouponExpired, got %v", err)
+	}
+
+	// so does an unknown one
+	mock.ExpectBegin()
+	mock.ExpectQuery(cartQ).WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).AddRow(int64(1), 1, 5.0, "USD", true))
+	mock.ExpectQuery(couponQ).WithArgs("NOPE").WillReturnRows(sqlmock.NewRows(couponCols))
+	mock.ExpectRollback()
+	if _, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{CouponCode: "NOPE"}); !errors.Is(err, ErrUnknownCoupon) {
+		t.Fatalf("expected ErrUnknownCoupon, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_IdempotencyKey(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	cartQ := regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)
+	orderQ := regexp.QuoteMeta(`INSERT INTO orders (user_id, total, metadata, cart_snapshot, status, discount, coupon_code, currency)`)
+	keyQ := regexp.QuoteMeta(`INSERT INTO idempotency_keys (user_id, key, order_id)`)
+	expectOrder := func(orderID int64) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(cartQ).WithArgs("u1").
+			WillReturnRows(sqlmock.NewRows(checkoutCols).AddRow(int64(1), 1, 5.0, "USD", true))
+		mock.ExpectQuery(orderQ).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(orderID, time.Now()))
+		mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO order_items`))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items`)).WithArgs(orderID, int64(1), 1, "5.00").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	// the key is recorded against the new order in the same transaction
+	expectOrder(5)
+	mock.ExpectExec(keyQ).WithArgs("u1", "k1", int64(5), IdempotencyKeyTTL.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id = $1`)).WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM carts WHERE user_id = $1`)).WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if _, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{IdempotencyKey: "k1"}); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+
+	// a live key left untouched by the upsert rolls the second order back
+	expectOrder(6)
+	mock.ExpectExec(keyQ).WithArgs("u1", "k1", int64(6), IdempotencyKeyTTL.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if _, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{IdempotencyKey: "k1"}); !errors.Is(err, ErrIdempotencyKeyInUse) {
+		t.Fatalf("expected ErrIdempotencyKeyInUse, got %v", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT order_id FROM idempotency_keys`)).
+		WithArgs("u1", "k1", IdempotencyKeyTTL.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"order_id"}).AddRow(int64(5)))
+	if id, err := s.GetOrderByIdempotencyKey(context.Background(), "u1", "k1"); err != nil || id != 5 {
+		t.Fatalf("expected order 5, got %d %v", id, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestIncrementCouponUse_UsedUp(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE coupons SET uses = uses + 1`)).WithArgs("ONCE").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT code, percent_off, expires_at, max_uses, uses FROM coupons WHERE code = $1`)).
+		WithArgs("ONCE").
+		WillReturnRows(sqlmock.NewRows([]string{"code", "percent_off", "expires_at", "max_uses", "uses"}).AddRow("ONCE", 20, nil, 1, 1))
+	if err := s.IncrementCouponUse(context.Background(), "ONCE"); !errors.Is(err, ErrCouponUsedUp) {
+		t.Fatalf("expected ErrCouponUsedUp, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// cancelItemsQ is the read of the units a cancelled order gives back
+var cancelItemsQ = regexp.QuoteMeta(`SELECT oi.product_id, oi.quantity - COALESCE((`)
+
+func TestCancelOrder_Restocks(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db, CancelWindow: time.Hour}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, status, created_at > now() - make_interval(secs => $2)`)).
+		WithArgs(int64(7), time.Hour.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "recent"}).AddRow("u1", OrderStatusPlaced, true))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET status = $1 WHERE id = $2`)).
+		WithArgs(OrderStatusCancelled, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE coupons SET uses = uses - 1`)).
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	// 3 of product 1 ordered; product 2's 4 units were already returned to
+	// stock, product 5 had 1 of its 2 returned
+	mock.ExpectQuery(cancelItemsQ).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity"}).
+			AddRow(int64(1), 3).
+			AddRow(int64(2), 0).
+			AddRow(int64(5), 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(3, int64(1), MovementCancel).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(1, int64(5), MovementCancel).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := s.CancelOrder(context.Background(), 7, "u1"); err != nil {
+		t.Fatalf("CancelOrder failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCancelOrder_Guards(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db, CancelWindow: time.Hour}
+
+	orderQ := regexp.QuoteMeta(`SELECT user_id, status, created_at > now() - make_interval(secs => $2)`)
+	cols := []string{"user_id", "status", "recent"}
+	for _, tc := range []struct {
+		name   string
+		owner  string
+		status string
+		recent bool
+		want   error
+	}{
+		{"already cancelled", "u1", OrderStatusCancelled, true, ErrInvalidTransition},
+		{"shipped", "u1", OrderStatusShipped, true, ErrInvalidTransition},
+		{"another user's", "u2", OrderStatusPlaced, true, ErrNotOrderOwner},
+		{"too old", "u1", OrderStatusPlaced, false, ErrCancelWindowClosed},
+	} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(orderQ).WithArgs(int64(7), time.Hour.Seconds()).
+			WillReturnRows(sqlmock.NewRows(cols).AddRow(tc.owner, tc.status, tc.recent))
+		mock.ExpectRollback()
+		if err := s.CancelOrder(context.Background(), 7, "u1"); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(orderQ).WithArgs(int64(8), time.Hour.Seconds()).WillReturnRows(sqlmock.NewRows(cols))
+	mock.ExpectRollback()
+	if err := s.CancelOrder(context.Background(), 8, "u1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows for an unknown order, got %v", err)
+	}
+
+	// without a window any placed order can be cancelled
+	s.CancelWindow = 0
+	mock.ExpectBegin()
+	mock.ExpectQuery(orderQ).WithArgs(int64(7), 0.0).
+		WillReturnRows(sqlmock.NewRows(cols).AddRow("u1", OrderStatusPlaced, false))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET status = $1 WHERE id = $2`)).
+		WithArgs(OrderStatusCancelled, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE coupons SET uses = uses - 1`)).
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(cancelItemsQ).WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity"}))
+	mock.ExpectCommit()
+	if err := s.CancelOrder(context.Background(), 7, "u1"); err != nil {
+		t.Fatalf("CancelOrder without a window failed: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCancelPendingOrder_Restocks(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT status FROM orders WHERE id = $1 FOR UPDATE`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(OrderStatusPending))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET status = $1 WHERE id = $2`)).
+		WithArgs(OrderStatusCancelled, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE coupons SET uses = uses - 1`)).
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(cancelItemsQ).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity"}).
+			AddRow(int64(1), 2).
+			AddRow(int64(3), 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(2, int64(1), MovementCancel).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(1, int64(3), MovementCancel).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// an order that was already settled is left alone
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT status FROM orders WHERE id = $1 FOR UPDATE`)).
+		WithArgs(int64(8)).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(OrderStatusPaid))
+	mock.ExpectRollback()
+
+	if err := s.CancelPendingOrder(context.Background(), 7); err != nil {
+		t.Fatalf("CancelPendingOrder failed: %v", err)
+	}
+	if err := s.CancelPendingOrder(context.Background(), 8); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("expected ErrInvalidTransition, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMarkOrderPaid(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET status = $1, charge_id = $2 WHERE id = $3 AND status = $4`)).
+		WithArgs(OrderStatusPaid, "ch_1", int64(7), OrderStatusPending).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE orders SET status = $1, charge_id = $2`)).
+		WithArgs(OrderStatusPaid, "ch_2", int64(8), OrderStatusPending).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT status FROM orders WHERE id = $1`)).
+		WithArgs(int64(8)).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(OrderStatusCancelled))
+
+	if err := s.MarkOrderPaid(context.Background(), 7, "ch_1"); err != nil {
+		t.Fatalf("MarkOrderPaid failed: %v", err)
+	}
+	if err := s.MarkOrderPaid(context.Background(), 8, "ch_2"); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("expected ErrInvalidTransition for a cancelled order, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListReviews_SortAndFilter(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	cols := []string{"id", "product_id", "user_id", "rating", "body", "created_at"}
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`ORDER BY created_at DESC, id DESC`)).
+		WithArgs(int64(3), 0, 10, 0).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(int64(2), int64(3), "u2", 2, "meh", now).
+			AddRow(int64(1), int64(3), "u1", 5, "great", now.Add(-time.Hour)))
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE product_id = $1 AND rating >= $2
+		ORDER BY rating DESC, created_at DESC, id DESC`)).
+		WithArgs(int64(3), 4, 5, 5).
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(int64(1), int64(3), "u1", 5, "great", now))
+	mock.ExpectQuery(regexp.QuoteMeta(`ORDER BY rating ASC, created_at DESC, id DESC`)).
+		WithArgs(int64(3), 0, 10, 0).
+		WillReturnRows(sqlmock.NewRows(cols))
+
+	got, err := s.ListReviews(context.Background(), 3, ReviewQuery{Limit: 10})
+	if err != nil || len(got) != 2 || got[0].ID != 2 || got[1].Body != "great" {
+		t.Fatalf("newest: unexpected result %+v %v", got, err)
+	}
+	got, err = s.ListReviews(context.Background(), 3, ReviewQuery{Sort: ReviewSortHighest, MinRating: 4, Limit: 5, Offset: 5})
+	if err != nil || len(got) != 1 || got[0].Rating != 5 {
+		t.Fatalf("highest: unexpected result %+v %v", got, err)
+	}
+	if _, err := s.ListReviews(context.Background(), 3, ReviewQuery{Sort: ReviewSortLowest, Limit: 10}); err != nil {
+		t.Fatalf("lowest: %v", err)
+	}
+	if _, err := s.ListReviews(context.Background(), 3, ReviewQuery{Sort: "random", Limit: 10}); err == nil {
+		t.Fatalf("expected error for unknown sort")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestReviewDistribution(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT rating, COUNT(*) FROM reviews WHERE product_id = $1 GROUP BY rating`)).
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"rating", "count"}).AddRow(5, 3).AddRow(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM reviews WHERE product_id = $1 AND rating >= $2`)).
+		WithArgs(int64(3), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	dist, err := s.ReviewDistribution(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("ReviewDistribution failed: %v", err)
+	}
+	if len(dist) != 2 || dist[5] != 3 || dist[1] != 1 {
+		t.Fatalf("unexpected distribution: %v", dist)
+	}
+	if n, err := s.CountReviews(context.Background(), 3, 2); err != nil || n != 3 {
+		t.Fatalf("unexpected count: %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestSearchProducts_ReturnsStock(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE published AND NOT is_deleted AND (name ILIKE '%' || $1 || '%' OR description ILIKE '%' || $1 || '%')`)).
+		WithArgs("cable", MaxSearchResults).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency"}).
+			AddRow(int64(1), "USB cable", "", 5.0, 12, nil, "USD").
+			AddRow(int64(2), "HDMI cable", "2m", 9.0, 0, nil, "USD"))
+	// LIKE wildcards in the query match literally
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM products`)).
+		WithArgs(`50\%\_off`, MaxSearchResults).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency"}))
+
+	ps, err := s.SearchProducts(context.Background(), "cable")
+	if err != nil {
+		t.Fatalf("SearchProducts failed: %v", err)
+	}
+	if len(ps) != 2 || ps[0].Stock != 12 || ps[1].Stock != 0 || ps[1].Name != "HDMI cable" {
+		t.Fatalf("unexpected results: %+v", ps)
+	}
+	if _, err := s.SearchProducts(context.Background(), "50%_off"); err != nil {
+		t.Fatalf("SearchProducts failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestSearchProducts_RankedAndCapped(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`ORDER BY name ILIKE '%' || $1 || '%' DESC, name, id`)).
+		WithArgs("nothing like it", MaxSearchResults).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency"}))
+
+	ps, err := s.SearchProducts(context.Background(), "nothing like it")
+	if err != nil {
+		t.Fatalf("SearchProducts failed: %v", err)
+	}
+	if len(ps) != 0 {
+		t.Fatalf("expected no results, got %+v", ps)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetProduct(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	created := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	q := regexp.QuoteMeta(`SELECT id, name, description, price, stock, category, currency, version, created_at, updated_at FROM products WHERE id = $1 AND published`)
+	mock.ExpectQuery(q).WithArgs(int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency", "version", "created_at", "updated_at"}).
+			AddRow(int64(2), "b", nil, 3.0, 4, nil, "USD", 5, created, created.Add(time.Hour)))
+	mock.ExpectQuery(q).WithArgs(int64(9)).WillReturnError(sql.ErrNoRows)
+
+	p, err := s.GetProduct(context.Background(), 2)
+	if err != nil || p.ID != 2 || p.Stock != 4 || !p.Price.Valid || p.Version != 5 || !p.CreatedAt.Equal(created) || !p.UpdatedAt.Equal(created.Add(time.Hour)) {
+		t.Fatalf("unexpected product %+v %v", p, err)
+	}
+	if _, err := s.GetProduct(context.Background(), 9); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetProduct_CancelledContext(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, name, description, price, stock, category, currency, version, created_at, updated_at FROM products WHERE id = $1 AND published`)).
+		WithArgs(int64(2)).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "price", "stock", "category", "currency", "version", "created_at", "updated_at"}).
+			AddRow(int64(2), "b", nil, 3.0, 4, nil, "USD", 1, time.Now(), time.Now()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.GetProduct(ctx, 2); err == nil {
+		t.Fatalf("expected the query to be cancelled with its context")
+	}
+}
+
+func TestListProductsByCategory(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	q := regexp.QuoteMeta(`SELECT id, name, description, price, stock, category, currency FROM products WHERE published AND category = $1 ORDER BY id`)
+	cols := []string{"id", "name", "description", "price", "stock", "category", "currency"}
+	mock.ExpectQuery(q).WithArgs("electronics").
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(int64(3), "cable", nil, 5.0, 40, "electronics", "USD"))
+	mock.ExpectQuery(q).WithArgs("garden").WillReturnRows(sqlmock.NewRows(cols))
+
+	ps, err := s.ListProductsByCategory(context.Background(), "electronics")
+	if err != nil || len(ps) != 1 || ps[0].ID != 3 || ps[0].Category.String != "electronics" {
+		t.Fatalf("unexpected products %+v %v", ps, err)
+	}
+	// an unknown category lists nothing, as an empty slice
+	if ps, err := s.ListProductsByCategory(context.Background(), "garden"); err != nil || ps == nil || len(ps) != 0 {
+		t.Fatalf("expected an empty list, got %#v %v", ps, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUpdateProduct(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	q := regexp.QuoteMeta(`UPDATE products SET name=$1, description=$2, price=$3, category=NULLIF($4, ''), currency=$5, version=version+1, updated_at=now() WHERE id=$6 AND version=$7`)
+	versionQ := regexp.QuoteMeta(`SELECT version FROM products WHERE id = $1`)
+	mock.ExpectExec(q).WithArgs("Widget", "blue", "4.50", "tools", "EUR", int64(3), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).WithArgs("Widget", "blue", "4.50", "", "USD", int64(9), 1).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(versionQ).WithArgs(int64(9)).WillReturnError(sql.ErrNoRows)
+
+	if err := s.UpdateProduct(context.Background(), 3, "Widget", "blue", 450, "tools", "EUR", 2); err != nil {
+		t.Fatalf("UpdateProduct: %v", err)
+	}
+	if err := s.UpdateProduct(context.Background(), 9, "Widget", "blue", 450, "", "USD", 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUpdateProduct_StaleVersion(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// someone else's update got in first and took the product to version 3
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE id=$6 AND version=$7`)).
+		WithArgs("Widget", "", "4.50", "", "USD", int64(3), 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT version FROM products WHERE id = $1`)).WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(3))
+
+	err := s.UpdateProduct(context.Background(), 3, "Widget", "", 450, "", "USD", 2)
+	if !errors.Is(err, ErrVersionConflict) || !strings.Contains(err.Error(), "at version 3, not 2") {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCreateProductsBatch(t *testing.T) {
+	insertQ := regexp.QuoteMeta(`INSERT INTO products (name, description, price, category, currency) VALUES ($1, $2, $3, NULLIF($4, ''), $5), ($6, $7, $8, NULLIF($9, ''), $10) RETURNING id`)
+	products := []ProductRow{
+		{Name: "mug", Description: sql.NullString{String: "blue", Valid: true}, Price: money.NullCents{Cents: 450, Valid: true}, Currency: "USD"},
+		{Name: "tee", Price: money.NullCents{Cents: 1200, Valid: true}, Category: sql.NullString{String: "apparel", Valid: true}, Currency: "EUR"},
+	}
+
+	t.Run("one insert for the whole batch", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(insertQ).
+			WithArgs("mug", "blue", sqlmock.AnyArg(), "", "USD", "tee", "", sqlmock.AnyArg(), "apparel", "EUR").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(10)).AddRow(int64(11)))
+		mock.ExpectCommit()
+
+		ids, err := s.CreateProductsBatch(context.Background(), products)
+		if err != nil || !reflect.DeepEqual(ids, []int64{10, 11}) {
+			t.Fatalf("unexpected result %v %v", ids, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("a failed insert rolls back", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(insertQ).WillReturnError(errors.New("value too long for type character varying(255)"))
+		mock.ExpectRollback()
+
+		if _, err := s.CreateProductsBatch(context.Background(), products); err == nil {
+			t.Fatalf("expected the insert error")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+}
+
+func TestPublishProducts(t *testing.T) {
+	lockQ := regexp.QuoteMeta(`SELECT id, published FROM products WHERE id = ANY($1) AND NOT is_deleted ORDER BY id FOR UPDATE`)
+	updateQ := regexp.QuoteMeta(`UPDATE products SET published = true WHERE id = ANY($1)`)
+
+	t.Run("drafts go live, published ones are skipped", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{6, 4, 5})).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "published"}).
+				AddRow(int64(4), false).AddRow(int64(5), true).AddRow(int64(6), false))
+		mock.ExpectExec(updateQ).WithArgs(pq.Array([]int64{4, 6})).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		got, err := s.PublishProducts(context.Background(), []int64{6, 4, 5})
+		if err != nil || !reflect.DeepEqual(got, []int64{4, 6}) {
+			t.Fatalf("unexpected result %v %v", got, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("unknown id fails the batch", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{4, 99})).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "published"}).AddRow(int64(4), false))
+		mock.ExpectRollback()
+
+		_, err := s.PublishProducts(context.Background(), []int64{4, 99})
+		if !errors.Is(err, sql.ErrNoRows) || !strings.Contains(err.Error(), "product 99") {
+			t.Fatalf("expected sql.ErrNoRows naming product 99, got %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+}
+
+func TestUpdateOrderStatusBatch(t *testing.T) {
+	lockQ := regexp.QuoteMeta(`SELECT id, status FROM orders WHERE id = ANY($1) ORDER BY id FOR UPDATE`)
+	updateQ := regexp.QuoteMeta(`UPDATE orders SET status = $1 WHERE id = ANY($2)`)
+	statuses := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "status"}).
+			AddRow(int64(1), OrderStatusPlaced).
+			AddRow(int64(2), OrderStatusPlaced).
+			AddRow(int64(3), OrderStatusDelivered)
+	}
+
+	t.Run("all valid", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{2, 1})).WillReturnRows(statuses())
+		mock.ExpectExec(updateQ).WithArgs(OrderStatusShipped, pq.Array([]int64{1, 2})).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		updated, err := s.UpdateOrderStatusBatch(context.Background(), []int64{2, 1}, OrderStatusShipped, true)
+		if err != nil || len(updated) != 2 || updated[0] != 1 || updated[1] != 2 {
+			t.Fatalf("unexpected result %v %v", updated, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("strict fails on one invalid", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{1, 2, 3})).WillReturnRows(statuses())
+		mock.ExpectRollback()
+
+		if _, err := s.UpdateOrderStatusBatch(context.Background(), []int64{1, 2, 3}, OrderStatusShipped, true); !errors.Is(err, ErrInvalidTransition) {
+			t.Fatalf("expected ErrInvalidTransition, got %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("strict fails on a missing order", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{1, 9})).WillReturnRows(statuses())
+		mock.ExpectRollback()
+
+		if _, err := s.UpdateOrderStatusBatch(context.Background(), []int64{1, 9}, OrderStatusShipped, true); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows, got %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("lenient skips invalid", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		s := &PostgresStore{DB: db}
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockQ).WithArgs(pq.Array([]int64{1, 2, 3, 9})).WillReturnRows(statuses())
+		mock.ExpectExec(updateQ).WithArgs(OrderStatusShipped, pq.Array([]int64{1, 2})).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		updated, err := s.UpdateOrderStatusBatch(context.Background(), []int64{1, 2, 3, 9}, OrderStatusShipped, false)
+		if err != nil || len(updated) != 2 || updated[0] != 1 || updated[1] != 2 {
+			t.Fatalf("unexpected result %v %v", updated, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+}
+
+func TestCanTransition(t *testing.T) {
+	// every pair of statuses; only these moves are allowed
+	valid := map[[2]string]bool{
+		{OrderStatusPlaced, OrderStatusShipped}:    true,
+		{OrderStatusPaid, OrderStatusShipped}:      true,
+		{OrderStatusShipped, OrderStatusDelivered}: true,
+	}
+	all := []string{OrderStatusPlaced, OrderStatusPending, OrderStatusPaid, OrderStatusShipped, OrderStatusDelivered, OrderStatusCancelled}
+	for _, from := range all {
+		for _, to := range all {
+			if got := CanTransition(from, to); got != valid[[2]string{from, to}] {
+				t.Errorf("CanTransition(%s, %s) = %v", from, to, got)
+			}
+		}
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+	updateQ := regexp.QuoteMeta(`UPDATE orders SET status = $1 WHERE id = $2 AND status = ANY($3)`)
+	statusQ := regexp.QuoteMeta(`SELECT status FROM orders WHERE id = $1`)
+
+	mock.ExpectExec(updateQ).WithArgs(OrderStatusDelivered, int64(7), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.UpdateOrderStatus(context.Background(), 7, OrderStatusDelivered); err != nil {
+		t.Fatalf("UpdateOrderStatus failed: %v", err)
+	}
+
+	// a delivered order can't go back
+	mock.ExpectExec(updateQ).WithArgs(OrderStatusShipped, int64(7), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(statusQ).WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(OrderStatusDelivered))
+	if err := s.UpdateOrderStatus(context.Background(), 7, OrderStatusShipped); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("expected ErrInvalidTransition, got %v", err)
+	}
+
+	mock.ExpectExec(updateQ).WithArgs(OrderStatusShipped, int64(8), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(statusQ).WithArgs(int64(8)).WillReturnRows(sqlmock.NewRows([]string{"status"}))
+	if err := s.UpdateOrderStatus(context.Background(), 8, OrderStatusShipped); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDeleteProduct_CleansCarts(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// product 4 sits in two carts
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE product_id = $1 RETURNING quantity`)).
+		WithArgs(int64(4)).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(1).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(2, int64(4), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET is_deleted = true, published = false WHERE id = $1`)).
+		WithArgs(int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// deleting it again is a no-op
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE product_id = $1 RETURNING quantity`)).
+		WithArgs(int64(4)).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET is_deleted = true, published = false WHERE id = $1`)).
+		WithArgs(int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	if n, err := s.DeleteProduct(context.Background(), 4, false); err != nil || n != 2 {
+		t.Fatalf("expected 2 carts cleaned, got %d %v", n, err)
+	}
+	if n, err := s.DeleteProduct(context.Background(), 4, false); err != nil || n != 0 {
+		t.Fatalf("expected idempotent delete, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDeleteProduct_Strict(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+	expectCheck := func(id int64) *sqlmock.ExpectedQuery {
+		mock.ExpectBegin()
+		return mock.ExpectQuery(regexp.QuoteMeta(`SELECT EXISTS (SELECT 1 FROM cart_items WHERE product_id = p.id)`)).
+			WithArgs(id)
+	}
+
+	// missing
+	expectCheck(9).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	// still carted: nothing is touched
+	expectCheck(4).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+	// free to go
+	expectCheck(5).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE product_id = $1 RETURNING quantity`)).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET is_deleted = true, published = false WHERE id = $1`)).
+		WithArgs(int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if _, err := s.DeleteProduct(context.Background(), 9, true); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if _, err := s.DeleteProduct(context.Background(), 4, true); !errors.Is(err, ErrProductInCarts) {
+		t.Fatalf("expected ErrProductInCarts, got %v", err)
+	}
+	if n, err := s.DeleteProduct(context.Background(), 5, true); err != nil || n != 0 {
+		t.Fatalf("expected delete to succeed, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDeleteProduct_Ordered(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// order_items still point at product 1; the row stays, so that's fine
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE product_id = $1 RETURNING quantity`)).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+		WithArgs(1, int64(1), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET is_deleted = true, published = false WHERE id = $1`)).
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if n, err := s.DeleteProduct(context.Background(), 1, false); err != nil || n != 1 {
+		t.Fatalf("expected an ordered product to be soft-deleted, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDeleteProduct_RestoreKeepsStock(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// product 4 has 10 on the shelf and 2+3 reserved by two carts, so its
+	// stock column reads 5; deleting it must put the 5 back (recorded as a
+	// release) so that restoring it brings back all 10
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE product_id = $1 RETURNING quantity`)).
+		WithArgs(int64(4)).
+		WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(2).AddRow(3))
+	mock.ExpectExec(regexp.QuoteMeta(releaseReservationSQL)).
+		WithArgs(5, int64(4), MovementRelease).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET is_deleted = true, published = false WHERE id = $1`)).
+		WithArgs(int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET is_deleted = false WHERE id = $1`)).
+		WithArgs(int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if n, err := s.DeleteProduct(context.Background(), 4, false); err != nil || n != 2 {
+		t.Fatalf("expected 2 carts cleaned, got %d %v", n, err)
+	}
+	if err := s.RestoreProduct(context.Background(), 4); err != nil {
+		t.Fatalf("RestoreProduct failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// bundleCols are the columns reserveBundle reads per tracked component
+var bundleCols = []string{"id", "quantity", "stock"}
+
+func TestAddToCart_BundleReservesComponents(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// bundle 9 = 2x product 1 + 1x product 2; 2 bundles take 4 and 2
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(9)).
+		WillReturnRows(lockRows(lockRow{untracked: true, bundle: true}))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM bundle_components bc`)).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(bundleCols).AddRow(1, 2, 4).AddRow(2, 1, 10))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(4, int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(2, int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO cart_items (cart_id, product_id, quantity, reserved_until)`)).
+		WithArgs("u1", int64(9), 2, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := s.AddToCart(context.Background(), "u1", 9, 2); err != nil {
+		t.Fatalf("expected bundle add to succeed, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddToCart_BundleShortComponent(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// product 2 has 1 left but 2 bundles need 2: nothing is reserved
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(9)).
+		WillReturnRows(lockRows(lockRow{untracked: true, bundle: true}))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM bundle_components bc`)).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(bundleCols).AddRow(1, 2, 4).AddRow(2, 1, 1))
+	mock.ExpectRollback()
+
+	err := s.AddToCart(context.Background(), "u1", 9, 2)
+	if !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("expected ErrInsufficientStock, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "component 2") {
+		t.Fatalf("expected the short component to be named, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetStock_BundleLimitedByComponent(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// the bundle row itself is untracked; its components can make 3
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT p.stock, p.track_inventory,`)).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"stock", "track_inventory", "bundle_stock"}).AddRow(0, false, 3))
+
+	if n, err := s.GetStock(context.Background(), 9); err != nil || n != 3 {
+		t.Fatalf("expected bundle stock 3, got %d (%v)", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	var buf bytes.Buffer
+	s := &PostgresStore{DB: db, SlowQueryThreshold: 20 * time.Millisecond, SlowQueryLogger: log.New(&buf, "", 0)}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO products (name, description, price, category, currency)`)).
+		WithArgs("fast", "", "1.00", "", "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO products (name, description, price, category, currency)`)).
+		WithArgs("secret name", "", "1.00", "", "USD").
+		WillDelayFor(50 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+
+	if _, err := s.CreateProduct(context.Background(), "fast", "", 100, "", "USD"); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no log for a fast query, got %q", buf.String())
+	}
+	if _, err := s.CreateProduct(context.Background(), "secret name", "", 100, "", "USD"); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "WARN slow query") || !strings.Contains(out, "INSERT INTO products (name, description, price, category, currency) VALUES ($1, $2, $3, NULLIF($4, ''), $5)") {
+		t.Fatalf("expected slow query log with the SQL, got %q", out)
+	}
+	if strings.Contains(out, "secret name") {
+		t.Fatalf("slow query log leaked an arg: %q", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGetCartSnapshot(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, cart_snapshot FROM orders WHERE id = $1`)).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "cart_snapshot"}).
+			AddRow("u1", []byte(`[{"product_id":1,"quantity":2,"price":5},{"product_id":3,"quantity":1,"price":null,"removed":true}]`)))
+	// placed before snapshots were kept
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, cart_snapshot FROM orders WHERE id = $1`)).
+		WithArgs(int64(4)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "cart_snapshot"}).AddRow("u1", nil))
+
+	user, lines, err := s.GetCartSnapshot(context.Background(), 9)
+	if err != nil || user != "u1" || len(lines) != 2 {
+		t.Fatalf("unexpected snapshot: %q %+v %v", user, lines, err)
+	}
+	if lines[0].Price == nil || *lines[0].Price != 500 || lines[1].Price != nil || !lines[1].Removed {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+	if _, _, err := s.GetCartSnapshot(context.Background(), 4); !errors.Is(err, ErrNoCartSnapshot) {
+		t.Fatalf("expected ErrNoCartSnapshot, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListAllStockMovements_CombinedFilters(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	created := from.Add(time.Hour)
+	filter := MovementFilter{ProductID: 3, Reason: MovementReserve, From: from, To: to}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, product_id, delta, reason, created_at FROM stock_movements WHERE product_id = $1 AND reason = $2 AND created_at >= $3 AND created_at < $4 ORDER BY created_at DESC, id DESC LIMIT $5 OFFSET $6`)).
+		WithArgs(int64(3), "reserve", from, to, 2, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "delta", "reason", "created_at"}).
+			AddRow(12, 3, -2, "reserve", created).
+			AddRow(11, 3, -1, "reserve", created))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM stock_movements WHERE product_id = $1 AND reason = $2 AND created_at >= $3 AND created_at < $4`)).
+		WithArgs(int64(3), "reserve", from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+
+	rows, err := s.ListAllStockMovements(context.Background(), filter, 2, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rows) != 2 || rows[0].ID != 12 || rows[0].Delta != -2 || !rows[0].CreatedAt.Equal(created) {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	if n, err := s.CountStockMovements(context.Background(), filter); err != nil || n != 7 {
+		t.Fatalf("expected 7, got %d %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListAllStockMovements_NoFilter(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM stock_movements ORDER BY created_at DESC, id DESC LIMIT $1 OFFSET $2`)).
+		WithArgs(50, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "delta", "reason", "created_at"}))
+
+	if rows, err := s.ListAllStockMovements(context.Background(), MovementFilter{}, 50, 100); err != nil || len(rows) != 0 {
+		t.Fatalf("expected an empty page, got %v %v", rows, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckout_HeldPricesConsumeHold(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	// price went from 10 to 12 (and 2 lost its price) since the quote
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ci.product_id, ci.quantity, p.price`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(checkoutCols).
+			AddRow(int64(1), 2, 12.0, "USD", true).
+			AddRow(int64(2), 1, nil, "USD", true))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO orders (user_id, total, metadata, cart_snapshot, status, discount, coupon_code, currency)`)).
+		WithArgs("u1", "23.00", `{}`,
+			`[{"product_id":1,"quantity":2,"price":10},{"product_id":2,"quantity":1,"price":3}]`, OrderStatusPlaced, "0.00", nil, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(4), time.Now()))
+	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO order_items`))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items`)).
+		WithArgs(int64(4), int64(1), 2, "10.00").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_items`)).
+		WithArgs(int64(4), int64(2), 1, "3.00").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM cart_items WHERE cart_id = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM carts WHERE user_id = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM quote_holds WHERE user_id = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	order, _, _, err := s.Checkout(context.Background(), "u1", nil, CheckoutOptions{HeldPrices: map[int64]money.Cents{1: 1000, 2: 300}})
+	if err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	if order.Total != 2300 {
+		t.Fatalf("expected the held total 23, got %v", order.Total)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestQuoteHold_RoundTrip(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+
+	expires := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	lines := `[{"product_id":1,"quantity":2,"price":10}]`
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO quote_holds (user_id, lines, expires_at) VALUES ($1, $2, $3)`)).
+		WithArgs("u1", lines, expires).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT lines, expires_at FROM quote_holds WHERE user_id = $1`)).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"lines", "expires_at"}).AddRow([]byte(lines), expires))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT lines, expires_at FROM quote_holds WHERE user_id = $1`)).
+		WithArgs("u2").
+		WillReturnError(sql.ErrNoRows)
+
+	if err := s.PutQuoteHold(context.Background(), QuoteHold{UserID: "u1", Lines: []QuoteHoldLine{{ProductID: 1, Quantity: 2, Price: 1000}}, ExpiresAt: expires}); err != nil {
+		t.Fatalf("PutQuoteHold: %v", err)
+	}
+	h, err := s.GetQuoteHold(context.Background(), "u1")
+	if err != nil || len(h.Lines) != 1 || h.Lines[0].Price != 1000 || !h.ExpiresAt.Equal(expires) {
+		t.Fatalf("unexpected hold: %+v %v", h, err)
+	}
+	if _, err := s.GetQuoteHold(context.Background(), "u2"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// timeBetween matches a time argument in [lo, hi]
+type timeBetween struct{ lo, hi time.Time }
+
+func (b timeBetween) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && !t.Before(b.lo) && !t.After(b.hi)
+}
+
+func TestAddToCart_StampsReservation(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	ttl := 30 * time.Minute
+	s := &PostgresStore{DB: db, ReservationTTL: ttl}
+
+	before := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO carts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT stock, track_inventory,`)).
+		WithArgs(int64(10)).
+		WillReturnRows(lockRows(lockRow{stock: 5}))
+	// the line holds its stock for ttl from now, renewed on every add
+	mock.ExpectExec(regexp.QuoteMeta(`reserved_until = EXCLUDED.reserved_until`)).
+		WithArgs("u1", int64(10), 2, timeBetween{before.Add(ttl), before.Add(ttl + time.Minute)}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE products SET stock = stock - $1 WHERE id = $2`)).
+		WithArgs(2, int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := s.AddToCart(context.Background(), "u1", 10, 2); err != nil {
+		t.Fatalf("AddToCart failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestReleaseExpiredReservations(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE reserved_until <= $1`)).
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity"}).
+			AddRow(int64(7), 1).
+			AddRow(int64(3), 2).
+			AddRow(int64(7), 4))
+	// stock goes back by product id
+	for _, rel := range []struct {
+		qty int
+		id  int64
+	}{{2, 3}, {1, 7}, {4, 7}} {
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE products p SET stock = p.stock + $1 * r.units`)).
+			WithArgs(rel.qty, rel.id, MovementExpire).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	n, err := s.ReleaseExpiredReservations(context.Background(), now)
+	if err != nil {
+		t.Fatalf("ReleaseExpiredReservations failed: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 lines released, got %d", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestReleaseExpiredReservations_NothingExpired(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &PostgresStore{DB: db}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM cart_items WHERE reserved_until <= $1`)).
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity"}))
+	mock.ExpectCommit()
+
+	if n, err := s.ReleaseExpiredReservations(context.Background(), now); err != nil || n != 0 {
+		t.Fatalf("expected nothing released, got %d, %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestPoolConfig_Apply(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+
+	DefaultPoolConfig.Apply(db)
+	if got := db.Stats().MaxOpenConnections; got != 25 {
+		t.Fatalf("expected 25 open connections, got %d", got)
+	}
+	PoolConfig{MaxOpenConns: 3}.Apply(db)
+	if got := db.Stats().MaxOpenConnections; got != 3 {
+		t.Fatalf("expected 3 open connections, got %d", got)
+	}
+}
+
+func TestLockForUser_MapDoesNotGrow(t *testing.T) {
+	s := &PostgresStore{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			unlock := s.lockForUser(fmt.Sprintf("user-%d", i%100))
+			unlock()
+		}(i)
+	}
+	wg.Wait()
+	if n := len(s.locks); n != 0 {
+		t.Fatalf("expected no locks left behind, got %d", n)
+	}
+
+	// one user's lock still excludes while it's held
+	unlock := s.lockForUser("u1")
+	acquired := make(chan struct{})
+	go func() {
+		s.lockForUser("u1")()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("second lock for u1 acquired while the first was held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+	if n := len(s.locks); n != 0 {
+		t.Fatalf("expected no locks left behind, got %d", n)
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// AddTag attaches a tag to a product; adding an existing tag is a no-op.
+func (s *PostgresStore) AddTag(ctx context.Context, productID int64, tag string) error {
+	_, err := s.db(ctx).Exec(`INSERT INTO product_tags (product_id, tag) VALUES ($1, $2) ON CONFLICT DO NOTHING`, productID, tag)
+	return err
+}
+
+// RemoveTag detaches a tag; sql.ErrNoRows if the product didn't have it.
+func (s *PostgresStore) RemoveTag(ctx context.Context, productID int64, tag string) error {
+	res, err := s.db(ctx).Exec(`DELETE FROM product_tags WHERE product_id=$1 AND tag=$2`, productID, tag)
+	if err != nil {
+		return err
+	}
+	ra, _ := res.RowsAffected()
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListTags returns a product's tags in name order
+func (s *PostgresStore) ListTags(ctx context.Context, productID int64) ([]string, error) {
+	rows, err := s.db(ctx).Query(`SELECT tag FROM product_tags WHERE product_id=$1 ORDER BY tag`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// ListTagsForProducts returns tags for many products at once, keyed by product id
+func (s *PostgresStore) ListTagsForProducts(ctx context.Context, productIDs []int64) (map[int64][]string, error) {
+	out := map[int64][]string{}
+	if len(productIDs) == 0 {
+		return out, nil
+	}
+	rows, err := s.db(ctx).Query(`SELECT product_id, tag FROM product_tags WHERE product_id = ANY($1) ORDER BY product_id, tag`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var t string
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], t)
+	}
+	return out, rows.Err()
+}
+
+// ListProductsByTags returns products carrying every one of tags (AND semantics)
+func (s *PostgresStore) ListProductsByTags(ctx context.Context, tags []string) ([]ProductRow, error) {
+	rows, err := s.db(ctx).Query(`
+		SELECT p.id, p.name, p.description, p.price, p.stock, p.category, p.currency
+		FROM products p
+		JOIN product_tags t ON t.product_id = p.id
+		WHERE t.tag = ANY($1) AND p.published
+		GROUP BY p.id
+		HAVING COUNT(DISTINCT t.tag) = $2
+		ORDER BY p.id
+	`, pq.Array(tags), len(tags))
+	if err != nil {
+		return nil, err
+	}
+	return scanProducts(rows)
+}